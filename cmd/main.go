@@ -4,10 +4,13 @@ import (
 	"log"
 
 	"github.com/xdimtech/go-xiaozhi/handler"
-	_ "github.com/xdimtech/go-xiaozhi/pkg/config"
+	"github.com/xdimtech/go-xiaozhi/pkg/config"
 )
 
 func main() {
+	if err := config.Load(""); err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
 	server := handler.NewWebSocketServer()
 	if err := server.Start(":8000"); err != nil {
 		log.Fatal("Error starting server:", err)
@@ -0,0 +1,227 @@
+// Command replay re-runs a recorded session through the gateway against a
+// realtime provider and compares the result with the recording:
+//
+//	go run ./cmd/replay -dir data/records/<device>/<session> [-speed 2] [-url ws://...]
+//
+// The uplink audio and control events of the device are fed to the handler
+// at their recorded times divided by speed. Configuration is read from
+// conf/biz.yaml as for the server, -url and -model override the provider.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	handler "github.com/xdimtech/go-xiaozhi/handler/openai"
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
+	"github.com/xdimtech/go-xiaozhi/pkg/config"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/record"
+	"github.com/xdimtech/go-xiaozhi/pkg/replay"
+)
+
+// 等待服务端 hello 的上限
+const helloTimeout = 15 * time.Second
+
+func main() {
+	dir := flag.String("dir", "", "recorded session directory")
+	speed := flag.Float64("speed", 1, "replay speed, 2 feeds the recording twice as fast")
+	url := flag.String("url", "", "realtime api url, overrides openai.base_url")
+	model := flag.String("model", "", "model, overrides openai.model")
+	settle := flag.Duration("settle", 5*time.Second, "wait for output after the last input")
+	strict := flag.Bool("strict", false, "exit with status 1 when transcripts or event order differ")
+	flag.Parse()
+	if *dir == "" || *speed <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := config.Load(""); err != nil {
+		log.Fatal(err)
+	}
+	if *url != "" {
+		config.OpenAIConfig().BaseURL = *url
+	}
+	if *model != "" {
+		config.OpenAIConfig().Model = *model
+	}
+
+	rec, err := load(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	replayed, err := run(context.Background(), rec, *speed, *settle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !replay.WriteReport(os.Stdout, rec.output, replayed) && *strict {
+		os.Exit(1)
+	}
+}
+
+// recording is a recorded session split into the input of the device and
+// the output of the gateway.
+type recording struct {
+	meta   record.Meta
+	input  []record.Entry
+	uplink [][]byte
+	output []replay.Event
+}
+
+func load(dir string) (*recording, error) {
+	meta, err := record.ReadMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := record.ReadTimeline(dir)
+	if err != nil {
+		return nil, err
+	}
+	rec := &recording{meta: meta}
+	if f, err := os.Open(filepath.Join(dir, record.UplinkFile)); err == nil {
+		rec.uplink, err = record.ReadOggPackets(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range entries {
+		if e.Stream != record.StreamXiaozhi {
+			continue
+		}
+		offset := time.Duration(e.Offset) * time.Millisecond
+		switch {
+		case e.Dir == record.DirIn:
+			rec.input = append(rec.input, e)
+		case e.Type == record.TypeAudio:
+			rec.output = append(rec.output, replay.Event{Offset: offset, Kind: replay.KindAudio})
+		default:
+			ev, err := xiaozhi.UnmarshalServerEvent(e.Event)
+			if err != nil {
+				continue
+			}
+			rec.output = append(rec.output, replay.ServerEvent(offset, ev))
+		}
+	}
+	return rec, nil
+}
+
+// helloDelay is the recorded time from the hello of the device to the reply.
+func (rec *recording) helloDelay(hello record.Entry) time.Duration {
+	sent := time.Duration(hello.Offset) * time.Millisecond
+	for _, e := range rec.output {
+		if e.Kind == string(xiaozhi.ServerEventTypeHello) && e.Offset >= sent {
+			return e.Offset - sent
+		}
+	}
+	return 0
+}
+
+// collector keeps what the handler sends to the device.
+type collector struct {
+	start time.Time
+	hello chan struct{}
+
+	mu     sync.Mutex
+	events []replay.Event
+	last   time.Time
+}
+
+func (c *collector) run(queue <-chan any) {
+	helloOnce := sync.Once{}
+	for msg := range queue {
+		e := replay.Event{Offset: time.Since(c.start), Kind: replay.KindAudio}
+		if ev, ok := msg.(xiaozhi.ServerEvent); ok {
+			e = replay.ServerEvent(e.Offset, ev)
+			if ev.GetType() == xiaozhi.ServerEventTypeHello {
+				helloOnce.Do(func() { close(c.hello) })
+			}
+		}
+		c.mu.Lock()
+		c.events = append(c.events, e)
+		c.last = time.Now()
+		c.mu.Unlock()
+	}
+}
+
+func (c *collector) quietFor() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.last)
+}
+
+func run(ctx context.Context, rec *recording, speed float64, settle time.Duration) ([]replay.Event, error) {
+	header := http.Header{}
+	header.Set("Device-Id", rec.meta.DeviceId)
+	header.Set("Client-Id", rec.meta.ClientId)
+	entry := registry.NewSession("replay-"+rec.meta.SessionID, rec.meta.DeviceId, rec.meta.ClientId, "openai")
+	h, err := handler.NewXiaozhiHandler(ctx, nil, header, entry, nil, nil, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Info().Persona != rec.meta.Persona {
+		log.Printf("persona changed: recorded %q, now %q", rec.meta.Persona, entry.Info().Persona)
+	}
+
+	c := &collector{start: time.Now(), hello: make(chan struct{}), last: time.Now()}
+	done := make(chan struct{})
+	go func() {
+		c.run(h.Recv(ctx))
+		close(done)
+	}()
+
+	// 服务端 hello 比录制时慢的部分顺延到后续输入
+	var shift time.Duration
+	frames, events := 0, 0
+	for _, e := range rec.input {
+		due := c.start.Add(shift + time.Duration(float64(e.Offset)*float64(time.Millisecond)/speed))
+		time.Sleep(time.Until(due))
+
+		var ev xiaozhi.ClientEvent
+		if e.Type == record.TypeAudio {
+			if frames >= len(rec.uplink) {
+				continue
+			}
+			ev = &xiaozhi.ClientEventAppendBuffer{
+				ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeAppendBuffer},
+				Bytes:           rec.uplink[frames],
+			}
+			frames++
+		} else if ev, err = xiaozhi.UnmarshalClientEvent(e.Event); err != nil {
+			log.Printf("skip %s event: %v", e.Type, err)
+			continue
+		}
+		if err, _ := h.DispatchClientEvent(ctx, ev); err != nil {
+			log.Printf("dispatch %s event: %v", e.Type, err)
+		}
+		if e.Type != record.TypeAudio {
+			events++
+		}
+
+		if ev.ClientEventType() == xiaozhi.ClientEventTypeHello {
+			sent := time.Now()
+			select {
+			case <-c.hello:
+			case <-time.After(helloTimeout):
+				_ = h.Close(ctx)
+				return nil, errors.New("no hello from the server")
+			}
+			shift += max(0, time.Since(sent)-time.Duration(float64(rec.helloDelay(e))/speed))
+		}
+	}
+
+	for c.quietFor() < settle {
+		time.Sleep(settle - c.quietFor())
+	}
+	_ = h.Close(ctx)
+	<-done
+	fmt.Printf("replayed %d events and %d audio frames of %s\n\n", events, frames, rec.meta.SessionID)
+	return c.events, nil
+}
@@ -0,0 +1,96 @@
+// Command xiaozhi-load measures how many devices one gateway serves. It
+// starts the gateway in process against a mock realtime server, then runs
+// simulated devices in stages of increasing concurrency:
+//
+//	XDIM_STEP_API_KEY=mock go run ./cmd/xiaozhi-load -stages 10,50,100 -ramp 10s -hold 30s
+//
+// Every device speaks, waits for the whole reply, pauses and speaks again.
+// Each stage reports throughput per busy core, time to first audio
+// percentiles, write queue overflows and errors. The time to first audio is
+// measured from the end of the speech, so it includes the -silence the mock
+// VAD waits for. The cpu time includes the devices and the mock server; with
+// -url the devices run against another gateway, whose mock server must end
+// utterances the same way, and only latency and errors are meaningful.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/handler"
+	handleropenai "github.com/xdimtech/go-xiaozhi/handler/openai"
+	"github.com/xdimtech/go-xiaozhi/pkg/config"
+	"github.com/xdimtech/go-xiaozhi/pkg/loadtest"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai/mock"
+)
+
+func main() {
+	url := flag.String("url", "", "gateway url, empty to start one in process")
+	stages := flag.String("stages", "10,50,100", "concurrent devices of each stage")
+	ramp := flag.Duration("ramp", 10*time.Second, "time for the devices added by a stage to connect")
+	hold := flag.Duration("hold", 30*time.Second, "time each stage runs at full concurrency")
+	speech := flag.Duration("speech", 1500*time.Millisecond, "user speech per turn")
+	silence := flag.Duration("silence", 300*time.Millisecond, "silence after the speech until the mock VAD ends it")
+	reply := flag.Duration("reply", 2*time.Second, "reply audio per turn")
+	think := flag.Duration("think", time.Second, "pause between turns")
+	turnTimeout := flag.Duration("turn-timeout", 30*time.Second, "give up on a turn after")
+	flag.Parse()
+
+	opts := loadtest.Options{
+		URL:         *url,
+		Ramp:        *ramp,
+		Hold:        *hold,
+		Speech:      mock.Tone(loadtest.SampleRate, *speech),
+		Silence:     *silence,
+		Think:       *think,
+		TurnTimeout: *turnTimeout,
+	}
+	for _, s := range strings.Split(*stages, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			log.Fatalf("invalid stage %q", s)
+		}
+		opts.Stages = append(opts.Stages, n)
+	}
+
+	if opts.URL == "" {
+		if err := config.Load(""); err != nil {
+			log.Fatal(err)
+		}
+		server := mock.NewServer(mock.WithoutHistory(), mock.WithVAD(loadtest.VADBytes(opts)),
+			mock.WithDefaultTurn(mock.Turn{
+				Transcript: "今天天气怎么样",
+				Reply:      "今天晴，气温二十度左右，适合出门走走。",
+				Audio:      mock.Tone(24000, *reply),
+			}))
+		defer server.Close()
+		config.OpenAIConfig().BaseURL = server.URL()
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/xiaozhi/v1/", handler.NewWebSocketServer().RealTime)
+		go func() { _ = http.Serve(ln, mux) }()
+		opts.URL = "ws://" + ln.Addr().String() + "/xiaozhi/v1/"
+		opts.Overflows = handleropenai.QueueOverflows
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	log.Printf("running %v devices against %s", opts.Stages, opts.URL)
+	report, err := loadtest.Run(ctx, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	loadtest.WriteReport(os.Stdout, report)
+}
@@ -0,0 +1,169 @@
+// Command xiaozhi-sim connects to the gateway as a xiaozhi device, speaks a
+// wav file or sends text, saves the reply audio and prints the timeline:
+//
+//	go run ./cmd/xiaozhi-sim -wav hello.wav [-mode manual] [-out reply.wav]
+//	go run ./cmd/xiaozhi-sim -text 你好 -abort-after 1s
+//
+// In auto and realtime mode the device keeps streaming silence after the wav
+// until the gateway starts replying, as a device waiting for server VAD does.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/pkg/audio"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/sim"
+)
+
+type headers []string
+
+func (h *headers) String() string { return strings.Join(*h, ", ") }
+
+func (h *headers) Set(v string) error {
+	if !strings.Contains(v, ":") {
+		return errors.New("header must be Key: Value")
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+func main() {
+	url := flag.String("url", "ws://127.0.0.1:8000/xiaozhi/v1/", "gateway url")
+	deviceId := flag.String("device-id", "sim:00:00:00:00:01", "Device-Id header")
+	clientId := flag.String("client-id", "xiaozhi-sim", "Client-Id header")
+	token := flag.String("token", "", "bearer token for the Authorization header")
+	version := flag.Int("protocol", 1, "binary protocol version, 1, 2 or 3")
+	sampleRate := flag.Int("sample-rate", 16000, "uplink sample rate")
+	channels := flag.Int("channels", 1, "uplink channels")
+	frameDuration := flag.Int("frame-duration", 60, "uplink frame duration in ms")
+	wavPath := flag.String("wav", "", "pcm16 wav file to speak")
+	text := flag.String("text", "", "text to send instead of audio")
+	mode := flag.String("mode", string(xiaozhi.ClientModeAuto), "listen mode: auto, manual or realtime")
+	abortAfter := flag.Duration("abort-after", 0, "abort the reply this long after its first audio")
+	out := flag.String("out", "", "write the reply audio to this wav file")
+	timeout := flag.Duration("timeout", 60*time.Second, "give up waiting for the reply")
+	var extra headers
+	flag.Var(&extra, "header", "extra handshake header as Key: Value, repeatable")
+	flag.Parse()
+	if (*wavPath == "") == (*text == "") {
+		log.Print("one of -wav and -text is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := []sim.Option{
+		sim.WithDeviceId(*deviceId, *clientId),
+		sim.WithProtocolVersion(*version),
+		sim.WithAudioParams(xiaozhi.AudioParams{
+			Format:        "opus",
+			SampleRate:    *sampleRate,
+			Channels:      *channels,
+			FrameDuration: *frameDuration,
+		}),
+	}
+	if *token != "" {
+		opts = append(opts, sim.WithHeader("Authorization", "Bearer "+*token))
+	}
+	for _, h := range extra {
+		key, value, _ := strings.Cut(h, ":")
+		opts = append(opts, sim.WithHeader(strings.TrimSpace(key), strings.TrimSpace(value)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	d, err := sim.Dial(ctx, *url, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	runErr := run(ctx, d, *wavPath, *text, xiaozhi.ClientMode(*mode), *abortAfter)
+	_ = d.Close()
+
+	events := d.Events()
+	sim.WriteTimeline(os.Stdout, events)
+	fmt.Println()
+	sim.WriteTurns(os.Stdout, sim.Turns(events))
+	if *out != "" {
+		if err := writeWav(d, *out); err != nil {
+			log.Print(err)
+		}
+	}
+	if runErr != nil {
+		log.Fatal(runErr)
+	}
+}
+
+func run(ctx context.Context, d *sim.Device, wavPath, text string, mode xiaozhi.ClientMode, abortAfter time.Duration) error {
+	if _, err := d.Hello(ctx); err != nil {
+		return fmt.Errorf("hello: %w", err)
+	}
+	if text != "" {
+		if err := d.Text(text); err != nil {
+			return err
+		}
+	} else if err := speak(ctx, d, wavPath, mode); err != nil {
+		return err
+	}
+
+	if abortAfter > 0 {
+		if _, err := d.Wait(ctx, sim.Kind(sim.KindAudio)); err != nil {
+			return err
+		}
+		time.Sleep(abortAfter)
+		if err := d.Abort(""); err != nil {
+			return err
+		}
+	}
+	if _, err := d.Wait(ctx, sim.Kind(sim.KindTTSStop)); err != nil {
+		return fmt.Errorf("waiting for tts stop: %w", err)
+	}
+	return nil
+}
+
+func speak(ctx context.Context, d *sim.Device, wavPath string, mode xiaozhi.ClientMode) error {
+	f, err := os.Open(wavPath)
+	if err != nil {
+		return err
+	}
+	wav, err := audio.DecodeWav(f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := d.Listen(xiaozhi.ClientStateListenStart, mode); err != nil {
+		return err
+	}
+	if mode != xiaozhi.ClientModeManual {
+		return d.Speak(ctx, wav.Mono(), wav.SampleRate)
+	}
+	if err := d.SendPCM(ctx, wav.Mono(), wav.SampleRate); err != nil {
+		return err
+	}
+	d.Mark(sim.KindSpeechEnd, "")
+	return d.Listen(xiaozhi.ClientStateListenStop, mode)
+}
+
+func writeWav(d *sim.Device, path string) error {
+	wav, err := d.Downlink()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := audio.EncodeWav(f, wav); err != nil {
+		_ = f.Close()
+		return err
+	}
+	log.Printf("wrote %.1fs of reply audio to %s", float64(len(wav.PCM))/float64(2*wav.SampleRate*wav.Channels), path)
+	return f.Close()
+}
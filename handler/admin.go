@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
+	"github.com/xdimtech/go-xiaozhi/pkg/audio"
+	"github.com/xdimtech/go-xiaozhi/pkg/parental"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+)
+
+const (
+	// 主动播报音频的大小上限
+	maxSpeechSize = 16 << 20
+	maxEventSize  = 64 << 10
+)
+
+// AdminServer serves the admin API for the sessions of connected devices,
+// and for their usage policies when parental controls are enabled.
+type AdminServer struct {
+	registry *registry.Registry
+	parental *parental.Controls
+	token    string
+}
+
+func NewAdminServer(reg *registry.Registry, controls *parental.Controls, token string) *AdminServer {
+	return &AdminServer{registry: reg, parental: controls, token: token}
+}
+
+func (s *AdminServer) Register(mux *http.ServeMux) {
+	mux.Handle("GET /admin/sessions", s.auth(s.listSessions))
+	mux.Handle("GET /admin/sessions/{id}", s.auth(s.getSession))
+	mux.Handle("DELETE /admin/sessions/{id}", s.auth(s.closeSession))
+	mux.Handle("POST /admin/sessions/{id}/update", s.auth(s.updateSession))
+	mux.Handle("POST /admin/sessions/{id}/events", s.auth(s.sendEvent))
+	mux.Handle("POST /admin/devices/{device_id}/speak", s.auth(s.speak))
+	if s.parental != nil {
+		mux.Handle("GET /admin/devices/{device_id}/policy", s.auth(s.getPolicy))
+		mux.Handle("PUT /admin/devices/{device_id}/policy", s.auth(s.setPolicy))
+		mux.Handle("DELETE /admin/devices/{device_id}/policy", s.auth(s.deletePolicy))
+	}
+}
+
+func (s *AdminServer) auth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (s *AdminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"sessions": lo.Map(s.registry.List(), func(sess *registry.Session, _ int) registry.Info {
+			return sess.Info()
+		}),
+	})
+}
+
+func (s *AdminServer) getSession(w http.ResponseWriter, r *http.Request) {
+	sess, err := s.registry.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sess.Info())
+}
+
+func (s *AdminServer) closeSession(w http.ResponseWriter, r *http.Request) {
+	sess, err := s.registry.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err := sess.Close(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateSession changes the voice or instructions of a live session, e.g.
+// {"voice": "voice-xxx", "instructions": "..."}. Instructions are refused for
+// a device whose policy limits its personas, they would replace the persona.
+func (s *AdminServer) updateSession(w http.ResponseWriter, r *http.Request) {
+	sess, err := s.registry.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	var update registry.Update
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if update.Voice == nil && update.Instructions == nil {
+		writeError(w, http.StatusBadRequest, errors.New("voice or instructions is required"))
+		return
+	}
+	if update.Instructions != nil && s.parental != nil {
+		if p := s.parental.Status(sess.DeviceId).Policy; p != nil && len(p.Personas) > 0 {
+			writeError(w, http.StatusForbidden, errors.New("the device policy limits its personas"))
+			return
+		}
+	}
+	if err := sess.Update(update); err != nil {
+		status := lo.Ternary(errors.Is(err, registry.ErrNotSupported), http.StatusNotImplemented, http.StatusInternalServerError)
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sess.Info())
+}
+
+// sendEvent sends an iot, system, alert or goodbye event to the device, e.g.
+// {"type": "alert", "status": "提醒", "message": "该睡觉了"}. The session id
+// is filled in.
+func (s *AdminServer) sendEvent(w http.ResponseWriter, r *http.Request) {
+	sess, err := s.registry.Get(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEventSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	event, err := xiaozhi.UnmarshalServerEvent(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch event.GetType() {
+	case xiaozhi.ServerEventTypeIot, xiaozhi.ServerEventTypeSystem,
+		xiaozhi.ServerEventTypeAlert, xiaozhi.ServerEventTypeGoodbye:
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("event type %s is not allowed", event.GetType()))
+		return
+	}
+	if err := sess.SendEvent(event); err != nil {
+		status := lo.Ternary(errors.Is(err, registry.ErrNotSupported), http.StatusNotImplemented, http.StatusConflict)
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, sess.Info())
+}
+
+// speak pushes speech to the latest session of a device. A json body such as
+// {"text": "...", "instructions": "..."} is said by the model; an audio/wav
+// body is played as is, with the text query parameter as its subtitle.
+func (s *AdminServer) speak(w http.ResponseWriter, r *http.Request) {
+	sess, err := s.registry.ByDevice(r.PathValue("device_id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, maxSpeechSize)
+	var speech registry.Speech
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); strings.HasSuffix(mediaType, "wav") {
+		wav, err := audio.DecodeWav(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		speech = registry.Speech{
+			Text:       r.URL.Query().Get("text"),
+			PCM:        wav.Mono(),
+			SampleRate: wav.SampleRate,
+		}
+	} else if err := json.NewDecoder(body).Decode(&speech); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := sess.Speak(speech); err != nil {
+		status := lo.Ternary(errors.Is(err, registry.ErrNotSupported), http.StatusNotImplemented, http.StatusConflict)
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, sess.Info())
+}
+
+// getPolicy returns the usage policy of a device, null if it has none, with
+// its usage today and whether it may be used now.
+func (s *AdminServer) getPolicy(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.parental.Status(r.PathValue("device_id")))
+}
+
+// setPolicy replaces the usage policy of a device, e.g. {"timezone":
+// "Asia/Shanghai", "hours": ["07:00-20:30"], "daily_minutes": 30}. A
+// connected device is held to its hours and daily minutes right away, its
+// personas take effect when it reconnects.
+func (s *AdminServer) setPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy parental.Policy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	deviceId := r.PathValue("device_id")
+	if err := s.parental.Set(deviceId, policy); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.parental.Status(deviceId))
+}
+
+func (s *AdminServer) deletePolicy(w http.ResponseWriter, r *http.Request) {
+	if err := s.parental.Delete(r.PathValue("device_id")); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -11,5 +11,6 @@ type WsHandler interface {
 	UnmarshalClientBinEvent(msg []byte) (any, error)
 	DispatchClientEvent(ctx context.Context, event any) (error, bool)
 	MarshalServerEvent(event any) ([]byte, error)
+	MarshalServerBinEvent(event any) ([]byte, error)
 	BuildErrorEvent(ctx context.Context, err error) interface{}
 }
@@ -2,32 +2,152 @@ package handler
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
 	"sync/atomic"
+	"time"
 
 	"github.com/xdimtech/go-xiaozhi/handler/base"
 	"github.com/xdimtech/go-xiaozhi/handler/openai"
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
 	"github.com/xdimtech/go-xiaozhi/handler/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/audio"
 	"github.com/xdimtech/go-xiaozhi/pkg/config"
+	"github.com/xdimtech/go-xiaozhi/pkg/logger"
+	"github.com/xdimtech/go-xiaozhi/pkg/moderation"
+	"github.com/xdimtech/go-xiaozhi/pkg/parental"
+	"github.com/xdimtech/go-xiaozhi/pkg/record"
+	"github.com/xdimtech/go-xiaozhi/pkg/reminder"
+	"github.com/xdimtech/go-xiaozhi/pkg/tracing"
+	"github.com/xdimtech/go-xiaozhi/pkg/webhook"
 
 	"github.com/gorilla/websocket"
+	"github.com/samber/lo"
 	"github.com/xdimtech/go-xiaozhi/pkg/utils"
 )
 
 type WebSocketServer struct {
 	requestCounter atomic.Int64
+	registry       *registry.Registry
+	reminders      *reminder.Scheduler
+	recorder       *record.Recorder
+	hooks          *webhook.Sink
+	classifier     moderation.Classifier
+	moderator      *moderation.Moderator
+	parental       *parental.Controls
 }
 
 func NewWebSocketServer() *WebSocketServer {
-	return &WebSocketServer{}
+	return &WebSocketServer{
+		registry: registry.New(),
+	}
+}
+
+// Registry returns the sessions of the connected devices.
+func (s *WebSocketServer) Registry() *registry.Registry {
+	return s.registry
+}
+
+// SetClassifier plugs in a classifier for the content safety filter, used
+// instead of moderation.classifier.url. Call it before Start.
+func (s *WebSocketServer) SetClassifier(c moderation.Classifier) {
+	s.classifier = c
 }
 
 func (s *WebSocketServer) Start(addr string) error {
+	if err := logger.Init(os.Stderr, config.Log().Level, config.Log().Format); err != nil {
+		return err
+	}
+	c := config.Trace()
+	shutdown, err := tracing.Init(context.Background(), tracing.Options{
+		Exporter:    c.Exporter,
+		Endpoint:    c.Endpoint,
+		Insecure:    c.Insecure,
+		File:        c.File,
+		SampleRatio: c.SampleRatio,
+	})
+	if err != nil {
+		return err
+	}
+	// ListenAndServe 返回后导出尚未发送的 span
+	defer func() { _ = shutdown(context.Background()) }()
+	if path := config.Reminder().Path; path != "" {
+		reminders, err := reminder.New(path, s.fireReminder)
+		if err != nil {
+			return err
+		}
+		s.reminders = reminders
+		go reminders.Run(context.Background())
+	}
+	if c := config.Record(); c.Dir != "" {
+		s.recorder = record.New(record.Options{
+			Dir:             c.Dir,
+			MaxSessionBytes: int64(c.MaxSessionMB) << 20,
+			MaxTotalBytes:   int64(c.MaxTotalMB) << 20,
+			Retention:       time.Duration(c.RetentionDays) * 24 * time.Hour,
+		})
+		go s.recorder.Run(context.Background())
+	}
+	if c := config.Webhook(); len(c.Endpoints) > 0 {
+		hooks, err := webhook.New(webhook.Options{
+			Endpoints: lo.Map(c.Endpoints, func(e config.WebhookEndpoint, _ int) webhook.Endpoint {
+				return webhook.Endpoint{Name: e.Name, URL: e.URL, Secret: e.Secret, Events: e.Events}
+			}),
+			Dir:         c.QueueDir,
+			MaxAttempts: c.MaxAttempts,
+			Timeout:     time.Duration(c.TimeoutSeconds) * time.Second,
+			MaxQueued:   c.MaxQueued,
+		})
+		if err != nil {
+			return err
+		}
+		s.hooks = hooks
+		go hooks.Run(context.Background())
+	}
+	if c := config.Moderation(); c.Enabled() || s.classifier != nil {
+		classifier := s.classifier
+		if classifier == nil && c.Classifier.URL != "" {
+			classifier = &moderation.HTTPClassifier{URL: c.Classifier.URL}
+		}
+		opts := moderation.Options{
+			Keywords:          c.Keywords,
+			Patterns:          c.Patterns,
+			Classifier:        classifier,
+			ClassifierTimeout: time.Duration(c.Classifier.TimeoutMs) * time.Millisecond,
+			SafeReply:         c.SafeReply,
+			AuditFile:         c.AuditFile,
+		}
+		if c.SafeReplyAudio != "" {
+			wav, err := loadWav(c.SafeReplyAudio)
+			if err != nil {
+				return fmt.Errorf("load safe reply audio: %w", err)
+			}
+			opts.SafeReplyAudio, opts.SafeReplySampleRate = wav.Mono(), wav.SampleRate
+		}
+		moderator, err := moderation.New(opts)
+		if err != nil {
+			return err
+		}
+		defer moderator.Close()
+		s.moderator = moderator
+	}
+	if path := config.Parental().Path; path != "" {
+		controls, err := parental.New(path)
+		if err != nil {
+			return err
+		}
+		s.parental = controls
+	}
 	http.HandleFunc("/xiaozhi/v1/", s.RealTime)
-	log.Printf("Server started at local: ws://127.0.0.1%s\n", addr)
+	if token := config.Admin().Token; token != "" {
+		NewAdminServer(s.registry, s.parental, token).Register(http.DefaultServeMux)
+		slog.Info("admin api enabled", "url", "http://127.0.0.1"+addr+"/admin/sessions")
+	}
 	ip, _ := utils.GetLocalIP()
-	log.Printf("Server started at public: ws://%s%s\n", ip, addr)
+	slog.Info("server started", "local", "ws://127.0.0.1"+addr, "public", "ws://"+ip+addr,
+		"provider", config.Provider().Name)
 	return http.ListenAndServe(addr, nil)
 }
 
@@ -56,7 +176,8 @@ func (s *WebSocketServer) RealTime(w http.ResponseWriter, r *http.Request) {
 	var err error
 	conn, err := s.wsConnect(w, r)
 	if err != nil {
-		panic(err)
+		slog.Warn("websocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+		return
 	}
 
 	defer func() {
@@ -64,19 +185,95 @@ func (s *WebSocketServer) RealTime(w http.ResponseWriter, r *http.Request) {
 		conn = nil
 	}()
 
+	sess := registry.NewSession(utils.UniqueID(),
+		r.Header.Get("Device-Id"), r.Header.Get("Client-Id"), config.Provider().Name)
+	s.registry.Add(sess)
+	defer func() {
+		sess.SetState(registry.StateClosed)
+		s.registry.Remove(sess.ID)
+	}()
+
+	// 连接时间计入设备当天的使用时长
+	limits := s.parental.Start(sess.DeviceId)
+	defer limits.Stop()
+
+	log := sess.Logger()
 	ctx := r.Context()
-	connWrapper, err := s.NewConnWrapper(ctx, conn, r)
+	connWrapper, err := s.NewConnWrapper(ctx, conn, r, sess, limits)
 	if err != nil {
-		panic(err)
+		log.Error("start session failed", "err", err)
+		return
+	}
+	log.Info("device connected", "client_id", sess.ClientId, "remote", r.RemoteAddr,
+		"protocol_version", r.Header.Get("Protocol-Version"))
+	s.hooks.Send(webhook.Event{Type: webhook.TypeSessionStart, SessionID: sess.ID,
+		DeviceId: sess.DeviceId, Data: sess.Info()})
+
+	// 设备离线时错过的提醒，连接后排队播报
+	if s.reminders != nil {
+		s.reminders.Deliver(sess.DeviceId)
 	}
 
 	_ = connWrapper.ReadLoop(ctx)
+	duration := time.Since(sess.StartTime)
+	log.Info("device disconnected", "duration", duration.Round(time.Millisecond),
+		"bytes_in", sess.BytesIn.Load(), "bytes_out", sess.BytesOut.Load(),
+		"input_tokens", sess.InputTokens.Load(), "output_tokens", sess.OutputTokens.Load())
+	s.hooks.Send(webhook.Event{Type: webhook.TypeSessionEnd, SessionID: sess.ID, DeviceId: sess.DeviceId,
+		Data: sessionEnd{Info: sess.Info(), DurationMs: duration.Milliseconds()}})
+}
+
+// sessionEnd is the data of a session end webhook event.
+type sessionEnd struct {
+	registry.Info
+	DurationMs int64 `json:"duration_ms"`
 }
 
-func (s *WebSocketServer) NewConnWrapper(
-	ctx context.Context, conn *websocket.Conn, r *http.Request) (base.WsConnWrapper, error) {
+// fireReminder speaks a due reminder on the device and waits for it to be
+// played, failing if the device is offline or disconnects first.
+func (s *WebSocketServer) fireReminder(r reminder.Reminder) error {
+	sess, err := s.registry.ByDevice(r.DeviceId)
+	if err != nil {
+		return err
+	}
+	played := make(chan error, 1)
+	speech := openai.ReminderSpeech(r)
+	speech.Played = func(err error) { played <- err }
+	if err := sess.Speak(speech); err != nil {
+		return err
+	}
+	return <-played
+}
+
+func (s *WebSocketServer) NewConnWrapper(ctx context.Context, conn *websocket.Conn,
+	r *http.Request, sess *registry.Session, limits *parental.Tracker) (base.WsConnWrapper, error) {
 	if config.Provider().Name == "openai" {
-		return openai.NewConnWrapper(ctx, conn)
+		return openai.NewConnWrapper(ctx, conn, openai.WithOriginReq(r), openai.WithSession(sess),
+			openai.WithReminders(s.reminders), openai.WithRecorder(s.recorder), openai.WithWebhooks(s.hooks),
+			openai.WithModerator(s.moderator), openai.WithLimits(limits))
+	}
+	// 透传上游时无法播报提醒，超出限制直接拒绝或断开
+	if v := limits.Check(); !v.Allowed {
+		return nil, fmt.Errorf("usage not allowed: %s", v.Reason)
+	}
+	wrapper, err := xiaozhi.NewConnWrapper(ctx, conn, xiaozhi.WithOriginReq(r), xiaozhi.WithSession(sess))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if v, ok := limits.Wait(ctx); ok {
+			sess.Logger().Info("usage limit reached", "reason", v.Reason)
+			_ = sess.Close()
+		}
+	}()
+	return wrapper, nil
+}
+
+func loadWav(path string) (*audio.Wav, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
-	return xiaozhi.NewConnWrapper(ctx, conn, xiaozhi.WithOriginReq(r))
+	defer f.Close()
+	return audio.DecodeWav(f)
 }
@@ -5,43 +5,149 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
 	"github.com/xdimtech/go-xiaozhi/pkg/audio"
 	"github.com/xdimtech/go-xiaozhi/pkg/config"
+	"github.com/xdimtech/go-xiaozhi/pkg/emotion"
+	"github.com/xdimtech/go-xiaozhi/pkg/logger"
+	"github.com/xdimtech/go-xiaozhi/pkg/moderation"
+	"github.com/xdimtech/go-xiaozhi/pkg/parental"
+	"github.com/xdimtech/go-xiaozhi/pkg/record"
+	"github.com/xdimtech/go-xiaozhi/pkg/reminder"
+	"github.com/xdimtech/go-xiaozhi/pkg/tracing"
+	"github.com/xdimtech/go-xiaozhi/pkg/webhook"
 
 	"github.com/gorilla/websocket"
 	"github.com/samber/lo"
 	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
 	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
 	"github.com/xdimtech/go-xiaozhi/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// errSessionNotReady is returned for requests that need the hello exchange
+// to have completed.
+var errSessionNotReady = errors.New("session is not ready")
+
 type XiaozhiHandler struct {
 	ctx               context.Context
 	cliConn           *websocket.Conn
 	apiConn           *websocket.Conn
+	apiMu             sync.Mutex   // 工具调用结果等会从其他协程写入 apiConn
+	downMu            sync.Mutex   // 主动播报的音频与模型输出互斥下发
+	pushGen           atomic.Int64 // 用户开口时递增，丢弃主动播报音频尚未下发的帧
 	sess              *ApiSession
+	entry             *registry.Session // 注册表中的会话，用于管理接口和统计
 	closed            atomic.Bool
 	writeQueue        chan any
+	queueMu           sync.RWMutex // 写入队列时持读锁，Close 持写锁关闭队列
+	closing           chan struct{}
 	audioConverter    *audio.Converter
 	firstDeltaTs      int64
 	totalOpusDuration int
+	helloSent         atomic.Bool
+	subtitles         *subtitler
+	userTranscripts   map[string]string // item id -> 流式转写的部分文本
+	pushMu            sync.Mutex        // 保护 pushQueue 的入队与 pushStopped
+	pushQueue         chan registry.Speech
+	pushStopped       bool
+	responding        atomic.Bool  // response.created 到 response.done 之间
+	userSpeaking      atomic.Bool  // 服务端 VAD 检测到用户正在说话
+	limited           atomic.Bool  // 超出家长控制的限制，不再接受用户输入
+	textPending       atomic.Bool  // 回复中收到文本输入，等该回复结束后再回复
+	pendingCreate     atomic.Value // 网关发出、尚未 response.created 的 response.create 的 event id
+	// 设备在 hello 中声明 features.mcp 时才会创建
+	mcp *mcpClient
+	// 未配置提醒存储时为 nil
+	reminders *reminderTools
+	// 未开启录音时为 nil，其方法均可在 nil 上调用
+	rec *record.Session
+	// 未配置 webhook 时为 nil，其方法均可在 nil 上调用
+	hooks *webhook.Sink
+	guard *guard
+	calls *toolCalls
+	// 带会话属性的日志，音频事件按 audioLog 采样记录
+	log       *slog.Logger
+	audioLog  *logger.Sampler
+	overflows *logger.Sampler
+	// 会话 span，每轮对话为其子 span
+	span  trace.Span
+	turns *turnTracer
 }
 
-func NewXiaozhiHandler(ctx context.Context, conn *websocket.Conn) (*XiaozhiHandler, error) {
-	sess := NewApiSession(ctx, config.OpenAIConfig().Model)
+func NewXiaozhiHandler(ctx context.Context, conn *websocket.Conn, header http.Header,
+	entry *registry.Session, reminders *reminder.Scheduler, recorder *record.Recorder,
+	hooks *webhook.Sink, mod *moderation.Moderator, limits *parental.Tracker) (*XiaozhiHandler, error) {
+	ctx, span := tracing.Tracer().Start(ctx, tracing.SpanSession, trace.WithAttributes(
+		attribute.String("session.id", entry.ID),
+		attribute.String("device.id", header.Get("Device-Id")),
+		attribute.String("client.id", header.Get("Client-Id")),
+	))
+	sess := NewApiSession(ctx, config.OpenAIConfig().Model, header.Get("Device-Id"), header.Get("Client-Id"))
+	// 家长控制不允许配置的人设时换用允许的，会话中策略变化后要等重连才生效
+	if name := limits.Persona(sess.Persona.Name); name != sess.Persona.Name {
+		sess.Persona = config.Persona(name)
+		sess.defaultVoice = sess.Persona.Voice
+	}
+	entry.SetPersona(sess.Persona.Name)
+	span.SetAttributes(attribute.String("persona", sess.Persona.Name))
+	sess.ProtocolVersion = xiaozhi.ParseProtocolVersion(header.Get("Protocol-Version"))
 	handler := &XiaozhiHandler{
-		ctx:        ctx,
-		sess:       sess,
-		cliConn:    conn,
-		writeQueue: make(chan any, WriteQueueSize),
+		ctx:             ctx,
+		sess:            sess,
+		cliConn:         conn,
+		entry:           entry,
+		writeQueue:      make(chan any, WriteQueueSize),
+		closing:         make(chan struct{}),
+		userTranscripts: make(map[string]string),
+		pushQueue:       make(chan registry.Speech, pushQueueSize),
+		hooks:           hooks,
+		log:             entry.Logger(),
+		audioLog:        logger.NewSampler(config.Log().AudioSample),
+		overflows:       logger.NewSampler(overflowLogEvery),
+		span:            span,
+		turns:           newTurnTracer(ctx),
+		calls:           newToolCalls(),
 	}
+	if reminders != nil && sess.DeviceId != "" {
+		handler.reminders = newReminderTools(reminders, sess.DeviceId)
+	}
+	if recorder != nil && config.Xiaozhi().Device(sess.DeviceId).Record {
+		rec, err := recorder.Open(record.Meta{
+			SessionID: entry.ID,
+			DeviceId:  sess.DeviceId,
+			ClientId:  sess.ClientId,
+			Provider:  entry.Provider,
+			Persona:   sess.Persona.Name,
+			StartTime: entry.StartTime,
+		})
+		if err != nil {
+			handler.log.Error("open session recording failed", "err", err)
+		}
+		handler.rec = rec
+	}
+	handler.guard = newGuard(handler, mod)
+	handler.subtitles = newSubtitler(handler,
+		emotion.NewParser(sess.Persona.EmotionTags, config.Emotion().Default))
 	if err := handler.InitProxy(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "connect to realtime api failed")
+		span.End()
 		return nil, err
 	}
+	go handler.subtitles.Run(sess.ctx)
+	go handler.pushLoop(sess.ctx)
+	go handler.watchLimits(sess.ctx, limits)
 	return handler, nil
 }
 
@@ -57,22 +163,8 @@ func (r *XiaozhiHandler) setFrameTs() {
 	r.firstDeltaTs = time.Now().UnixMilli()
 }
 
-func (r *XiaozhiHandler) getWait() int64 {
-	now := time.Now().UnixMilli()
-	if r.firstDeltaTs == 0 {
-		return 0
-	}
-	if r.totalOpusDuration == 0 {
-		return 0
-	}
-	if wait := int64(r.totalOpusDuration) - (now - r.firstDeltaTs); wait > 0 {
-		return wait
-	}
-	return 0
-}
-
 func (r *XiaozhiHandler) addOpusDuration() {
-	r.totalOpusDuration += r.sess.CliConfig.FrameDuration
+	r.totalOpusDuration += r.sess.DownConfig.FrameDuration
 }
 
 func (r *XiaozhiHandler) GetSessionId() string {
@@ -82,12 +174,26 @@ func (r *XiaozhiHandler) GetSessionId() string {
 	return ""
 }
 
+// Close is idempotent, the admin api may close a session that is closing.
 func (r *XiaozhiHandler) Close(ctx context.Context) error {
+	if !r.closed.CompareAndSwap(false, true) {
+		return nil
+	}
 	if r.sess != nil {
 		r.sess.Close()
 	}
+	if r.mcp != nil {
+		r.mcp.Close()
+	}
+	r.closeRealtimeAPI()
+	// 字幕、播报等协程可能仍在写入，等其退出后再关闭队列
+	close(r.closing)
+	r.queueMu.Lock()
 	close(r.writeQueue)
-	r.closed.Store(true)
+	r.queueMu.Unlock()
+	_ = r.rec.Close()
+	r.turns.End("closed")
+	r.span.End()
 	return nil
 }
 
@@ -103,18 +209,30 @@ func (r *XiaozhiHandler) MarshalServerEvent(ev any) ([]byte, error) {
 	return json.Marshal(event)
 }
 
+func (r *XiaozhiHandler) MarshalServerBinEvent(ev any) ([]byte, error) {
+	frame, ok := ev.(*xiaozhi.ServerAudioFrame)
+	if !ok {
+		return nil, errors.New("invalid ServerAudioFrame")
+	}
+	return xiaozhi.MarshalBinaryFrame(r.sess.ProtocolVersion, &xiaozhi.BinaryFrame{
+		Type:      xiaozhi.BinaryTypeOpus,
+		Timestamp: frame.Timestamp,
+		Payload:   frame.Payload,
+	})
+}
+
 func (r *XiaozhiHandler) UnmarshalClientTextEvent(data []byte) (any, error) {
 	return xiaozhi.UnmarshalClientEvent(data)
 }
 
 func (r *XiaozhiHandler) UnmarshalClientBinEvent(data []byte) (any, error) {
-	return xiaozhi.UnmarshalClientBinEvent(data)
+	return xiaozhi.UnmarshalClientBinEvent(r.sess.ProtocolVersion, data)
 }
 
 func (r *XiaozhiHandler) DispatchClientEvent(ctx context.Context, ev any) (error, bool) {
 	defer func() {
 		if err := recover(); err != nil {
-			fmt.Errorf("dispatch client event panic, err:%v", err)
+			r.log.Error("dispatch client event panic", "err", err, "stack", string(debug.Stack()))
 		}
 	}()
 
@@ -122,6 +240,8 @@ func (r *XiaozhiHandler) DispatchClientEvent(ctx context.Context, ev any) (error
 	if !ok {
 		return errors.New("invalid RealtimeClientEvent"), false
 	}
+	r.recordClientEvent(event)
+	r.logEvent(ctx, event)
 
 	var rtEvent openai.ClientEvent = nil
 	var err error = nil
@@ -134,8 +254,12 @@ func (r *XiaozhiHandler) DispatchClientEvent(ctx context.Context, ev any) (error
 		rtEvent, err = r.handleInputAudioBufferAppend(ctx, ev)
 	case *xiaozhi.ClientEventIot:
 		rtEvent, err = r.handleIotEvent(ctx, ev)
+	case *xiaozhi.ClientEventMcp:
+		rtEvent, err = r.handleMcpEvent(ctx, ev)
+	case *xiaozhi.ClientEventText:
+		rtEvent, err = r.handleTextEvent(ctx, ev)
 	default:
-		fmt.Errorf("unknown event type: %T", ev)
+		r.log.Warn("unknown client event", "type", fmt.Sprintf("%T", ev))
 		return nil, false
 	}
 
@@ -143,7 +267,7 @@ func (r *XiaozhiHandler) DispatchClientEvent(ctx context.Context, ev any) (error
 		return err, false
 	}
 	if err := r.SendToRealtimeAPI(rtEvent); err != nil {
-		fmt.Errorf("send to realtime api failed, err: %v", err)
+		r.log.Error("send to realtime api failed", "event", rtEvent.ClientEventType(), "err", err)
 		return err, false
 	}
 
@@ -162,8 +286,6 @@ func (r *XiaozhiHandler) handleHelloEvent(ctx context.Context,
 	}
 
 	frameSize := event.GetAudioParams().FrameDuration * event.GetAudioParams().SampleRate / 1000
-	r.audioConverter = audio.NewConverter(event.GetAudioParams().SampleRate,
-		event.GetAudioParams().Channels, event.GetAudioParams().FrameDuration, frameSize, r.WriteRespEvent)
 	r.sess.CliConfig = &ClientConfig{
 		Format:        event.GetAudioParams().Format,
 		SampleRate:    event.GetAudioParams().SampleRate,
@@ -171,8 +293,16 @@ func (r *XiaozhiHandler) handleHelloEvent(ctx context.Context,
 		FrameDuration: event.GetAudioParams().FrameDuration,
 		FrameSize:     frameSize,
 	}
+	r.sess.DownConfig = negotiateDownConfig(r.sess.CliConfig, r.sess.DeviceId)
+	r.audioConverter = audio.NewConverter(r.sess.CliConfig.AudioParams(),
+		r.sess.DownConfig.AudioParams(), r.WriteRespEvent,
+		audio.WithEncoderProfile(encoderProfile(r.sess.DeviceId, r.sess.Persona)),
+		audio.WithUpstream(r.sess.Upstream))
+	if event.Features["mcp"] {
+		r.mcp = newMcpClient(r.sendMcpRequest, r.log, r.gatewayToolNames())
+	}
 
-	systemPrompt := config.OpenAIConfig().SystemPrompt
+	systemPrompt := r.sess.Persona.SystemPrompt
 	maxToken := openai.IntOrInf(4096)
 	eventID := utils.UniqueID()
 	pbEvent := &openai.SessionUpdateEvent{
@@ -186,11 +316,12 @@ func (r *XiaozhiHandler) handleHelloEvent(ctx context.Context,
 				openai.ModalityText,
 				openai.ModalityAudio,
 			},
-			Voice:             lo.ToPtr(openai.Voice(r.sess.defaultVoice)),
-			InputAudioFormat:  lo.ToPtr(openai.AudioFormatPcm16),
-			OutputAudioFormat: lo.ToPtr(openai.AudioFormatPcm16),
-			ToolChoice:        openai.ToolChoiceRequired,
-			MaxOutputTokens:   lo.ToPtr(maxToken),
+			Voice:                   lo.ToPtr(openai.Voice(r.sess.defaultVoice)),
+			InputAudioFormat:        lo.ToPtr(openai.AudioFormat(r.sess.Upstream.InputFormat)),
+			OutputAudioFormat:       lo.ToPtr(openai.AudioFormat(r.sess.Upstream.OutputFormat)),
+			ToolChoice:              sessionToolChoice,
+			MaxOutputTokens:         lo.ToPtr(maxToken),
+			InputAudioTranscription: inputTranscription(r.sess.Persona.Transcription),
 			TurnDetection: &openai.TurnDetection{
 				Type: openai.ClientTurnDetectionTypeServerVad,
 			},
@@ -207,12 +338,15 @@ func (r *XiaozhiHandler) handleListenEvent(ctx context.Context,
 	event *xiaozhi.ClientEventListen) (openai.ClientEvent, error) {
 	if event.State == xiaozhi.ClientStateListenStart {
 		// 新的一轮对话开始
+		r.entry.SetState(registry.StateListening)
 	} else if event.State == xiaozhi.ClientStateListenStop {
 		// 对话结束
+		r.entry.SetState(registry.StateIdle)
 	} else if event.State == xiaozhi.ClientStateListenDetect {
 
 	} else if event.State == xiaozhi.ClientStateIdle {
 		// 空闲状态
+		r.entry.SetState(registry.StateIdle)
 	}
 
 	return nil, nil
@@ -222,11 +356,12 @@ func (r *XiaozhiHandler) handleInputAudioBufferAppend(ctx context.Context,
 	event *xiaozhi.ClientEventAppendBuffer) (*openai.InputAudioBufferAppendEvent, error) {
 
 	audioData := event.Bytes
-	if len(audioData) == 0 {
+	// 超出限制后不再开始新的一轮对话
+	if len(audioData) == 0 || r.limited.Load() {
 		return nil, nil
 	}
 
-	b64Data, err := r.audioConverter.OpusToPcmBase64(audioData)
+	b64Data, err := r.audioConverter.OpusToPcmBase64(audioData, event.Timestamp)
 	if err != nil {
 		return nil, err
 	}
@@ -245,6 +380,117 @@ func (r *XiaozhiHandler) handleIotEvent(
 	return nil, nil
 }
 
+// handleTextEvent adds typed text as a user message and asks for a spoken reply.
+func (r *XiaozhiHandler) handleTextEvent(
+	ctx context.Context, ev *xiaozhi.ClientEventText) (openai.ClientEvent, error) {
+	// hello 之前没有下行参数，也不能开始回复
+	if !r.helloSent.Load() {
+		return nil, errSessionNotReady
+	}
+	text := strings.TrimSpace(ev.Text)
+	if text == "" || r.limited.Load() {
+		return nil, nil
+	}
+	r.emit(webhook.TypeUserTranscript, webhook.Transcript{Source: "text", Text: text})
+	// 被拦截的文本不发给模型，只播报安全回复
+	if r.guard.Input("", text, true) {
+		return nil, nil
+	}
+	err := r.SendToRealtimeAPI(&openai.ConversationItemCreateEvent{
+		ClientEventBase: openai.ClientEventBase{
+			EventID: utils.UniqueID(),
+			Type:    openai.ClientEventTypeConversationItemCreate,
+		},
+		Item: openai.MessageItem{
+			Type: openai.MessageItemTypeMessage,
+			Role: openai.MessageRoleUser,
+			Content: []openai.MessageContentPart{{
+				Type: openai.MessageContentTypeInputText,
+				Text: lo.ToPtr(text),
+			}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.turns.Begin("text")
+	// 在 response.created 之前置位，避免主动播报等在回复开始前插入
+	if r.responding.CompareAndSwap(false, true) {
+		return nil, r.replyToText(ctx)
+	}
+	// 打断进行中的回复，其 response.done 后再回复这条文本
+	r.textPending.Store(true)
+	r.subtitles.Drop()
+	return nil, r.SendToRealtimeAPI(&openai.ResponseCancelEvent{
+		ClientEventBase: openai.ClientEventBase{
+			EventID: utils.UniqueID(),
+			Type:    openai.ClientEventTypeResponseCancel,
+		},
+	})
+}
+
+// replyToText asks for a spoken reply to the typed text, responding is set
+// by the caller.
+func (r *XiaozhiHandler) replyToText(ctx context.Context) error {
+	// 语音输入时 tts start 在 input_audio_buffer.committed 时下发，文本输入没有该事件
+	_ = r.WriteRespEvent(ctx, r.ttsStartEvent())
+	err := r.createResponse(openai.ResponseCreateParams{
+		Modalities: []openai.Modality{
+			openai.ModalityText,
+			openai.ModalityAudio,
+		},
+	})
+	if err != nil {
+		r.responding.Store(false)
+		_ = r.WriteRespEvent(ctx, r.ttsEvent(xiaozhi.ServerTTSStateStop, ""))
+	}
+	return err
+}
+
+// replyToPendingText replies to text typed while the previous response was
+// in progress, once it is done.
+func (r *XiaozhiHandler) replyToPendingText(ctx context.Context) {
+	if !r.textPending.Load() || !r.responding.CompareAndSwap(false, true) {
+		return
+	}
+	r.textPending.Store(false)
+	if err := r.replyToText(ctx); err != nil {
+		r.log.Error("reply to text failed", "err", err)
+	}
+}
+
+func (r *XiaozhiHandler) handleMcpEvent(
+	ctx context.Context, ev *xiaozhi.ClientEventMcp) (openai.ClientEvent, error) {
+	if r.mcp == nil {
+		return nil, errors.New("mcp not enabled in hello")
+	}
+	r.mcp.Dispatch(&ev.Payload)
+	return nil, nil
+}
+
+func (r *XiaozhiHandler) sendMcpRequest(req *xiaozhi.McpRequest) error {
+	return r.WriteRespEvent(r.ctx, &xiaozhi.ServerEventMcp{
+		ServerEventBase: xiaozhi.ServerEventBase{
+			Type:      xiaozhi.ServerEventTypeMcp,
+			SessionId: r.GetSessionId(),
+		},
+		Payload: req,
+	})
+}
+
+// initTools discovers the device tools, if any, and registers them with the
+// model along with the gateway tools.
+func (r *XiaozhiHandler) initTools() {
+	if r.mcp != nil {
+		if err := r.mcp.Init(r.sess.ctx); err != nil {
+			r.log.Warn("init mcp failed", "err", err)
+		}
+	}
+	if err := r.updateTools(); err != nil {
+		r.log.Error("update session tools failed", "err", err)
+	}
+}
+
 func (w *XiaozhiHandler) BuildErrorEvent(ctx context.Context, err error) interface{} {
 	return &xiaozhi.ServerEventError{
 		ServerEventBase: xiaozhi.ServerEventBase{
@@ -258,25 +504,111 @@ func (w *XiaozhiHandler) WriteRespEvent(ctx context.Context, event any) error {
 	if w.closed.Load() {
 		return errors.New("write queue closed")
 	}
-	if len(w.writeQueue) > WriteQueueSize {
-		fmt.Errorf("write queue is full, len: %d", len(w.writeQueue))
-	}
 	if ev, ok := xiaozhi.IsServerEvent(event); ok {
-		if !strings.HasSuffix(string(ev.GetType()), ".delta") {
+		w.log.Debug("event to device", "type", ev.GetType(), "event", ev)
+		w.recordServerEvent(ev)
+		return w.enqueue(event)
+	}
+
+	payload, ok := event.([]byte)
+	if !ok {
+		return errors.New("invalid audio frame")
+	}
+	frame := &xiaozhi.ServerAudioFrame{
+		Timestamp: uint32(w.totalOpusDuration),
+		Payload:   payload,
+	}
+	w.recordServerEvent(frame)
+	w.logAudio("audio to device", "bytes", len(payload), "timestamp", frame.Timestamp)
+	w.addOpusDuration()
+	w.audioConverter.AdaptToBacklog(len(w.writeQueue) * w.sess.DownConfig.FrameDuration)
+	return w.enqueue(frame)
+}
+
+// enqueue sends to the write queue unless the handler is closing. Close
+// unblocks pending sends before closing the queue.
+func (w *XiaozhiHandler) enqueue(event any) error {
+	w.queueMu.RLock()
+	defer w.queueMu.RUnlock()
+	if w.closed.Load() {
+		return errors.New("write queue closed")
+	}
+	select {
+	case w.writeQueue <- event:
+		return nil
+	default:
+		// 设备写得比回复慢，阻塞等待
+		queueOverflows.Add(1)
+		if n, ok := w.overflows.Sample("write_queue"); ok {
+			w.log.Warn("write queue is full", "len", len(w.writeQueue), "count", n)
 		}
-		w.writeQueue <- event
+	}
+	select {
+	case w.writeQueue <- event:
 		return nil
+	case <-w.closing:
+		return errors.New("write queue closed")
 	}
+}
 
-	w.addOpusDuration()
-	w.writeQueue <- event
-	return nil
+// QueueOverflows is the number of writes to devices that found the write
+// queue full and had to wait, over all sessions.
+func QueueOverflows() int64 {
+	return queueOverflows.Load()
+}
+
+// UpdateSession changes the voice or instructions of the live realtime
+// session. Providers may refuse a voice change once audio was produced.
+func (w *XiaozhiHandler) UpdateSession(update registry.Update) error {
+	if !w.helloSent.Load() {
+		return errSessionNotReady
+	}
+	session := openai.ClientSession{
+		TurnDetection: &openai.TurnDetection{
+			Type: openai.ClientTurnDetectionTypeServerVad,
+		},
+		Instructions: update.Instructions,
+	}
+	if update.Voice != nil {
+		session.Voice = lo.ToPtr(openai.Voice(*update.Voice))
+	}
+	return w.SendToRealtimeAPI(&openai.SessionUpdateEvent{
+		ClientEventBase: openai.ClientEventBase{
+			EventID: utils.UniqueID(),
+			Type:    openai.ClientEventTypeSessionUpdate,
+		},
+		Session: session,
+	})
+}
+
+// SendServerEvent pushes a server event such as iot, goodbye, system or alert
+// to the device, filling in its type and the session id.
+func (w *XiaozhiHandler) SendServerEvent(ctx context.Context, event xiaozhi.ServerEvent) error {
+	xiaozhi.SetServerEventType(event)
+	event.SetSessionId(w.GetSessionId())
+	return w.WriteRespEvent(ctx, event)
 }
 
 func (w *XiaozhiHandler) Done() <-chan struct{} {
 	return w.ctx.Done()
 }
 
-func (w *XiaozhiHandler) logEvent(ctx context.Context, eventName string) {
-	return
+// logEvent logs an event from the device at debug level, audio sampled.
+func (w *XiaozhiHandler) logEvent(ctx context.Context, event xiaozhi.ClientEvent) {
+	if ev, ok := event.(*xiaozhi.ClientEventAppendBuffer); ok {
+		w.logAudio("audio from device", "bytes", len(ev.Bytes), "timestamp", ev.Timestamp)
+		return
+	}
+	w.log.Debug("event from device", "type", event.ClientEventType(), "event", event)
+}
+
+// logAudio logs one of every config.Log().AudioSample audio events of a kind
+// at debug level, with the count of events so far.
+func (w *XiaozhiHandler) logAudio(msg string, args ...any) {
+	if !w.log.Enabled(w.ctx, slog.LevelDebug) {
+		return
+	}
+	if n, ok := w.audioLog.Sample(msg); ok {
+		w.log.Debug(msg, append(args, "count", n)...)
+	}
 }
@@ -3,27 +3,50 @@ package openai
 import (
 	"context"
 	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xdimtech/go-xiaozhi/handler/base"
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
+	"github.com/xdimtech/go-xiaozhi/pkg/moderation"
+	"github.com/xdimtech/go-xiaozhi/pkg/parental"
+	"github.com/xdimtech/go-xiaozhi/pkg/record"
+	"github.com/xdimtech/go-xiaozhi/pkg/reminder"
+	"github.com/xdimtech/go-xiaozhi/pkg/webhook"
 
 	"github.com/gorilla/websocket"
 	xiaozhiapi "github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/utils"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
 	WriteQueueSize = 1024
 	PingTick       = 1 * time.Second
+	goodbyeTimeout = time.Second
+	// 写队列满时每多少次记录一条日志
+	overflowLogEvery = 100
 )
 
+var queueOverflows atomic.Int64
+
 type ConnWrapper struct {
 	ctx         context.Context
 	conn        *websocket.Conn
+	writeMu     sync.Mutex // 写循环、错误与 goodbye 并发写设备连接
 	handler     base.WsHandler
 	done        chan struct{}
 	idleTimeout time.Duration
 	idleTimer   *time.Timer
+	originReq   *http.Request
+	session     *registry.Session
+	reminders   *reminder.Scheduler
+	recorder    *record.Recorder
+	hooks       *webhook.Sink
+	moderator   *moderation.Moderator
+	limits      *parental.Tracker
 }
 
 type WsConnOption func(*ConnWrapper)
@@ -35,23 +58,58 @@ func WithIdleTimeout(idleTimeout time.Duration) WsConnOption {
 	}
 }
 
-func WithProxyHandler(handler base.WsHandler) WsConnOption {
+func WithOriginReq(originReq *http.Request) WsConnOption {
 	return func(w *ConnWrapper) {
-		w.handler = handler
+		w.originReq = originReq
 	}
 }
 
-func NewConnWrapper(ctx context.Context, conn *websocket.Conn, ops ...WsConnOption) (*ConnWrapper, error) {
+func WithSession(session *registry.Session) WsConnOption {
+	return func(w *ConnWrapper) {
+		w.session = session
+	}
+}
 
-	hdl, err := NewXiaozhiHandler(ctx, conn)
-	if err != nil {
-		return nil, err
+func WithReminders(reminders *reminder.Scheduler) WsConnOption {
+	return func(w *ConnWrapper) {
+		w.reminders = reminders
+	}
+}
+
+func WithRecorder(recorder *record.Recorder) WsConnOption {
+	return func(w *ConnWrapper) {
+		w.recorder = recorder
+	}
+}
+
+func WithWebhooks(hooks *webhook.Sink) WsConnOption {
+	return func(w *ConnWrapper) {
+		w.hooks = hooks
+	}
+}
+
+func WithModerator(moderator *moderation.Moderator) WsConnOption {
+	return func(w *ConnWrapper) {
+		w.moderator = moderator
+	}
+}
+
+func WithLimits(limits *parental.Tracker) WsConnOption {
+	return func(w *ConnWrapper) {
+		w.limits = limits
+	}
+}
+
+func WithProxyHandler(handler base.WsHandler) WsConnOption {
+	return func(w *ConnWrapper) {
+		w.handler = handler
 	}
+}
 
+func NewConnWrapper(ctx context.Context, conn *websocket.Conn, ops ...WsConnOption) (*ConnWrapper, error) {
 	wsConn := &ConnWrapper{
 		ctx:         ctx,
 		conn:        conn,
-		handler:     hdl,
 		done:        make(chan struct{}),
 		idleTimeout: 0,
 	}
@@ -60,6 +118,25 @@ func NewConnWrapper(ctx context.Context, conn *websocket.Conn, ops ...WsConnOpti
 		op(wsConn)
 	}
 
+	header := http.Header{}
+	if wsConn.originReq != nil {
+		header = wsConn.originReq.Header
+	}
+	if wsConn.session == nil {
+		wsConn.session = registry.NewSession(utils.UniqueID(),
+			header.Get("Device-Id"), header.Get("Client-Id"), "openai")
+	}
+	wsConn.session.SetController(wsConn)
+
+	if wsConn.handler == nil {
+		hdl, err := NewXiaozhiHandler(ctx, conn, header, wsConn.session, wsConn.reminders, wsConn.recorder,
+			wsConn.hooks, wsConn.moderator, wsConn.limits)
+		if err != nil {
+			return nil, err
+		}
+		wsConn.handler = hdl
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error { wsConn.WriteLoop(ctx); return nil })
 	g.Go(func() error { wsConn.WatchIdle(ctx); return nil })
@@ -85,7 +162,13 @@ func (w *ConnWrapper) Pong(data string) error {
 	return w.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
 }
 
+// Close says goodbye to the device and disconnects it.
 func (w *ConnWrapper) Close() error {
+	w.goodbye()
+	return w.close()
+}
+
+func (w *ConnWrapper) close() error {
 	_ = w.conn.Close()
 	if err := w.handler.Close(w.ctx); err != nil {
 		return err
@@ -96,6 +179,71 @@ func (w *ConnWrapper) Close() error {
 	return nil
 }
 
+// UpdateSession applies an admin update to the realtime session.
+func (w *ConnWrapper) UpdateSession(update registry.Update) error {
+	updater, ok := w.handler.(interface {
+		UpdateSession(update registry.Update) error
+	})
+	if !ok {
+		return registry.ErrNotSupported
+	}
+	return updater.UpdateSession(update)
+}
+
+// Speak queues speech pushed to the device.
+func (w *ConnWrapper) Speak(speech registry.Speech) error {
+	speaker, ok := w.handler.(interface {
+		Speak(speech registry.Speech) error
+	})
+	if !ok {
+		return registry.ErrNotSupported
+	}
+	return speaker.Speak(speech)
+}
+
+// SendEvent queues a server event for the device after the events already
+// queued.
+func (w *ConnWrapper) SendEvent(event xiaozhiapi.ServerEvent) error {
+	sender, ok := w.handler.(interface {
+		SendServerEvent(ctx context.Context, event xiaozhiapi.ServerEvent) error
+	})
+	if !ok {
+		return registry.ErrNotSupported
+	}
+	return sender.SendServerEvent(w.ctx, event)
+}
+
+// goodbye tells the device the session is over, so that it closes the audio
+// channel instead of reconnecting.
+func (w *ConnWrapper) goodbye() {
+	event := &xiaozhiapi.ServerEventGoodbye{}
+	xiaozhiapi.SetServerEventType(event)
+	if s, ok := w.handler.(interface{ GetSessionId() string }); ok {
+		event.SetSessionId(s.GetSessionId())
+	}
+	data, err := w.handler.MarshalServerEvent(event)
+	if err != nil {
+		return
+	}
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	// 随后即断开，设备不读时也不阻塞关闭
+	_ = w.conn.SetWriteDeadline(time.Now().Add(goodbyeTimeout))
+	_ = w.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (w *ConnWrapper) write(msgType int, data []byte) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return w.conn.WriteMessage(msgType, data)
+}
+
+func (w *ConnWrapper) writeJSON(v any) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return w.conn.WriteJSON(v)
+}
+
 func (w *ConnWrapper) WriteLoop(ctx context.Context) {
 	activeTimer := time.NewTimer(PingTick)
 	for {
@@ -112,13 +260,15 @@ func (w *ConnWrapper) WriteLoop(ctx context.Context) {
 				if err != nil {
 					continue
 				}
-				_ = w.conn.WriteMessage(websocket.TextMessage, writeBuf)
+				_ = w.write(websocket.TextMessage, writeBuf)
+				w.session.AddOut(len(writeBuf))
 			} else {
-				binData, ok := event.([]byte)
-				if !ok {
+				binData, err := w.handler.MarshalServerBinEvent(event)
+				if err != nil {
 					continue
 				}
-				_ = w.conn.WriteMessage(websocket.BinaryMessage, binData)
+				_ = w.write(websocket.BinaryMessage, binData)
+				w.session.AddOut(len(binData))
 			}
 			w.resetIdleTimer()
 		case <-w.done:
@@ -133,15 +283,17 @@ func (w *ConnWrapper) WriteLoop(ctx context.Context) {
 func (w *ConnWrapper) ReadLoop(ctx context.Context) (err error) {
 
 	defer func() {
-		_ = w.Close()
+		_ = w.close()
 	}()
 
 	for {
 		msgType, msg, merr := w.conn.ReadMessage()
 		if merr != nil {
+			w.session.Logger().Debug("read from device failed", "err", merr)
 			w.done <- struct{}{}
 			break
 		}
+		w.session.AddIn(len(msg))
 
 		var event any
 		switch msgType {
@@ -152,16 +304,18 @@ func (w *ConnWrapper) ReadLoop(ctx context.Context) (err error) {
 		}
 
 		if err != nil {
+			w.session.Logger().Warn("invalid event from device", "err", err)
 			errEvent := w.handler.BuildErrorEvent(ctx, errors.New("invalid event format"))
-			_ = w.conn.WriteJSON(errEvent)
+			_ = w.writeJSON(errEvent)
 			continue
 		}
 
 		quit := false
 		err, quit = w.handler.DispatchClientEvent(ctx, event)
 		if err != nil {
+			w.session.Logger().Warn("handle event from device failed", "err", err)
 			errEvent := w.handler.BuildErrorEvent(ctx, err)
-			_ = w.conn.WriteJSON(errEvent)
+			_ = w.writeJSON(errEvent)
 		}
 
 		if quit {
@@ -182,7 +336,9 @@ func (w *ConnWrapper) WatchIdle(ctx context.Context) {
 	}
 
 	<-w.idleTimer.C
-	_ = w.conn.WriteJSON(w.handler.BuildErrorEvent(w.ctx, errors.New("too long without operation")))
+	w.session.Logger().Info("closing idle connection", "timeout", w.idleTimeout)
+	_ = w.writeJSON(w.handler.BuildErrorEvent(w.ctx, errors.New("too long without operation")))
+	w.goodbye()
 	_ = w.conn.Close()
 }
 
@@ -0,0 +1,1176 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
+	"github.com/xdimtech/go-xiaozhi/pkg/config"
+	"github.com/xdimtech/go-xiaozhi/pkg/logger"
+	"github.com/xdimtech/go-xiaozhi/pkg/moderation"
+	"github.com/xdimtech/go-xiaozhi/pkg/parental"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai/mock"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/reminder"
+	"github.com/xdimtech/go-xiaozhi/pkg/tracing"
+	"github.com/xdimtech/go-xiaozhi/pkg/webhook"
+
+	"github.com/gorilla/websocket"
+	"github.com/samber/lo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	testDeviceId = "aa:bb:cc:dd:ee:ff"
+	// 设备上行 16 kHz、60 ms 一帧
+	testSampleRate    = 16000
+	testFrameDuration = 60
+	waitTimeout       = 5 * time.Second
+	// 上行 pcm 为 24 kHz，4 帧 60 ms 的音频算一句话，重采样有少量延迟，需发送 5 帧
+	testVADBytes = 4 * 24000 * testFrameDuration / 1000 * 2
+)
+
+func TestMain(m *testing.M) {
+	mock.Main(m, filepath.Join("..", "..", "conf", "biz.yaml"))
+}
+
+// device drives a handler connected to a mock realtime server, as the
+// websocket connection of a device would.
+type device struct {
+	t       *testing.T
+	ctx     context.Context
+	handler *XiaozhiHandler
+	server  *mock.Server
+	events  chan any
+}
+
+// deviceOptions are the optional services of the handler under test.
+type deviceOptions struct {
+	reminders *reminder.Scheduler
+	hooks     *webhook.Sink
+	moderator *moderation.Moderator
+	limits    *parental.Tracker
+}
+
+func newDevice(t *testing.T, server *mock.Server, reminders *reminder.Scheduler) *device {
+	t.Helper()
+	return newDeviceWith(t, server, deviceOptions{reminders: reminders})
+}
+
+func newDeviceWith(t *testing.T, server *mock.Server, opts deviceOptions) *device {
+	t.Helper()
+	server.Use(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	header := http.Header{}
+	header.Set("Device-Id", testDeviceId)
+	header.Set("Client-Id", "test-client")
+	entry := registry.NewSession("test-session", testDeviceId, "test-client", "openai")
+	h, err := NewXiaozhiHandler(ctx, nil, header, entry, opts.reminders, nil, opts.hooks, opts.moderator, opts.limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &device{t: t, ctx: ctx, handler: h, server: server, events: make(chan any, WriteQueueSize)}
+	go func() {
+		for ev := range h.Recv(ctx) {
+			d.events <- ev
+		}
+		close(d.events)
+	}()
+	t.Cleanup(func() {
+		_ = h.Close(ctx)
+		cancel()
+	})
+	return d
+}
+
+func (d *device) dispatch(ev xiaozhi.ClientEvent) error {
+	err, _ := d.handler.DispatchClientEvent(d.ctx, ev)
+	return err
+}
+
+func (d *device) hello() *xiaozhi.ServerEventHello {
+	d.t.Helper()
+	err := d.dispatch(&xiaozhi.ClientEventHello{ClientEventBase: xiaozhi.ClientEventBase{
+		Type:      xiaozhi.ClientEventTypeHello,
+		Version:   1,
+		Transport: "websocket",
+		AudioParams: &xiaozhi.AudioParams{
+			Format:        "opus",
+			SampleRate:    testSampleRate,
+			Channels:      1,
+			FrameDuration: testFrameDuration,
+		},
+	}})
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	events := d.until(func(ev any) bool { _, ok := ev.(*xiaozhi.ServerEventHello); return ok })
+	return events[len(events)-1].(*xiaozhi.ServerEventHello)
+}
+
+// speak starts listening in auto mode and sends frames of silence.
+func (d *device) speak(frames int) {
+	d.t.Helper()
+	enc, err := opus.NewEncoder(testSampleRate, 1, opus.AppVoIP)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	pcm := make([]int16, testSampleRate*testFrameDuration/1000)
+	packet := make([]byte, 1000)
+	_ = d.dispatch(&xiaozhi.ClientEventListen{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeListen},
+		State:           xiaozhi.ClientStateListenStart,
+		Mode:            xiaozhi.ClientModeAuto,
+	})
+	for i := 0; i < frames; i++ {
+		n, err := enc.Encode(pcm, packet)
+		if err != nil {
+			d.t.Fatal(err)
+		}
+		if err := d.dispatch(&xiaozhi.ClientEventAppendBuffer{
+			ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeAppendBuffer},
+			Bytes:           append([]byte(nil), packet[:n]...),
+		}); err != nil {
+			d.t.Fatal(err)
+		}
+	}
+}
+
+// until collects the events sent to the device up to the first that matches.
+func (d *device) until(match func(any) bool) []any {
+	d.t.Helper()
+	var events []any
+	timeout := time.After(waitTimeout)
+	for {
+		select {
+		case ev, ok := <-d.events:
+			if !ok {
+				d.t.Fatalf("handler closed, got %s", describe(events))
+			}
+			events = append(events, ev)
+			if match(ev) {
+				return events
+			}
+		case <-timeout:
+			d.t.Fatalf("timed out, got %s", describe(events))
+		}
+	}
+}
+
+// waitClosed waits for the handler to close, dropping the events left.
+func (d *device) waitClosed() {
+	d.t.Helper()
+	timeout := time.After(waitTimeout)
+	for {
+		select {
+		case _, ok := <-d.events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			d.t.Fatal("handler not closed")
+		}
+	}
+}
+
+func isTTS(state xiaozhi.ServerTTSState) func(any) bool {
+	return func(ev any) bool {
+		tts, ok := ev.(*xiaozhi.ServerEventTTS)
+		return ok && tts.State == state
+	}
+}
+
+func describe(events []any) string {
+	var kinds []string
+	for _, ev := range events {
+		switch ev := ev.(type) {
+		case *xiaozhi.ServerEventTTS:
+			kinds = append(kinds, "tts:"+string(ev.State))
+		case xiaozhi.ServerEvent:
+			kinds = append(kinds, string(ev.GetType()))
+		default:
+			kinds = append(kinds, "audio")
+		}
+	}
+	return "[" + strings.Join(kinds, " ") + "]"
+}
+
+// reply sums up the events of a reply.
+type reply struct {
+	stt       string
+	sentences []string
+	frames    int
+	errors    []string
+}
+
+func summarize(events []any) reply {
+	var r reply
+	for _, ev := range events {
+		switch ev := ev.(type) {
+		case *xiaozhi.ServerEventSTT:
+			r.stt = ev.Text
+		case *xiaozhi.ServerEventTTS:
+			if ev.State != xiaozhi.ServerTTSStateSentenceStart {
+				break
+			}
+			// sentence_start 随转写逐步更新同一句
+			if n := len(r.sentences); n > 0 && strings.HasPrefix(ev.Text, r.sentences[n-1]) {
+				r.sentences[n-1] = ev.Text
+			} else {
+				r.sentences = append(r.sentences, ev.Text)
+			}
+		case *xiaozhi.ServerEventError:
+			r.errors = append(r.errors, ev.Error)
+		case *xiaozhi.ServerAudioFrame:
+			r.frames++
+		}
+	}
+	return r
+}
+
+func TestHello(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+	d := newDevice(t, server, nil)
+
+	hello := d.hello()
+	if hello.AudioParams.Format != "opus" || hello.AudioParams.SampleRate == 0 {
+		t.Errorf("hello audio params = %+v", hello.AudioParams)
+	}
+	ev, ok := server.WaitFor(waitTimeout, mock.Type(openai.ClientEventTypeSessionUpdate))
+	if !ok {
+		t.Fatal("no session.update")
+	}
+	session := ev.(*openai.SessionUpdateEvent).Session
+	if session.Instructions == nil || *session.Instructions == "" || session.TurnDetection == nil {
+		t.Errorf("session.update = %+v", session)
+	}
+	if session.ToolChoice != string(sessionToolChoice) {
+		t.Errorf("tool_choice = %v, want %s", session.ToolChoice, sessionToolChoice)
+	}
+	if auth := server.Requests()[0].Header.Get("Authorization"); !strings.HasPrefix(auth, "Bearer ") {
+		t.Errorf("authorization = %q", auth)
+	}
+}
+
+func TestTextTurn(t *testing.T) {
+	server := mock.NewServer(mock.WithTurns(mock.Turn{
+		Reply: "你好呀。今天想聊点什么？",
+		Audio: mock.Tone(24000, 600*time.Millisecond),
+	}))
+	defer server.Close()
+	d := newDevice(t, server, nil)
+	d.hello()
+
+	if err := d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "你好",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	events := d.until(isTTS(xiaozhi.ServerTTSStateStop))
+	if !isTTS(xiaozhi.ServerTTSStateStart)(events[0]) {
+		t.Errorf("first event is not tts start: %s", describe(events))
+	}
+	r := summarize(events)
+	if strings.Join(r.sentences, "") != "你好呀。今天想聊点什么？" {
+		t.Errorf("sentences = %q", r.sentences)
+	}
+	// 600 ms 的回复按 60 ms 一帧下发
+	if r.frames < 9 || r.frames > 11 {
+		t.Errorf("%d audio frames for 600 ms", r.frames)
+	}
+	if info := d.handler.entry.Info(); info.State != registry.StateIdle || info.OutputTokens == 0 {
+		t.Errorf("session info = %+v", info)
+	}
+}
+
+func TestTextBeforeHello(t *testing.T) {
+	server := mock.NewServer(mock.WithTurns(mock.Turn{Reply: "你好呀。"}))
+	defer server.Close()
+	d := newDevice(t, server, nil)
+	text := &xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "你好",
+	}
+
+	if err := d.dispatch(text); !errors.Is(err, errSessionNotReady) {
+		t.Fatalf("text before hello: %v", err)
+	}
+	if d.handler.responding.Load() {
+		t.Fatal("responding set by text before hello")
+	}
+	if ev, ok := server.WaitFor(100*time.Millisecond, mock.Type(openai.ClientEventTypeConversationItemCreate)); ok {
+		t.Fatalf("text before hello sent upstream: %+v", ev)
+	}
+	d.hello()
+	if err := d.dispatch(text); err != nil {
+		t.Fatal(err)
+	}
+	if r := summarize(d.until(isTTS(xiaozhi.ServerTTSStateStop))); strings.Join(r.sentences, "") != "你好呀。" {
+		t.Errorf("sentences = %q", r.sentences)
+	}
+}
+
+func TestTextBargeIn(t *testing.T) {
+	server := mock.NewServer(mock.WithDeltaInterval(50*time.Millisecond), mock.WithTurns(
+		mock.Turn{Reply: "从前有座山，山里有座庙，庙里有个老和尚在讲故事。", Audio: mock.Tone(24000, 3*time.Second)},
+		mock.Turn{Reply: "好的，不讲了。"},
+	))
+	defer server.Close()
+	d := newDevice(t, server, nil)
+	d.hello()
+
+	text := func(text string) {
+		if err := d.dispatch(&xiaozhi.ClientEventText{
+			ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+			Text:            text,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	text("讲个故事")
+	d.until(isTTS(xiaozhi.ServerTTSStateSentenceStart))
+	text("别讲了")
+	events := d.until(func(ev any) bool {
+		tts, ok := ev.(*xiaozhi.ServerEventTTS)
+		return ok && tts.State == xiaozhi.ServerTTSStateSentenceStart && strings.Contains(tts.Text, "不讲了")
+	})
+	if r := summarize(events); len(r.errors) > 0 {
+		t.Errorf("errors: %q", r.errors)
+	}
+	d.until(isTTS(xiaozhi.ServerTTSStateStop))
+
+	// 先取消进行中的回复，再为新的文本创建回复
+	types := lo.FilterMap(server.Received(), func(ev openai.ClientEvent, _ int) (openai.ClientEventType, bool) {
+		t := ev.ClientEventType()
+		return t, t == openai.ClientEventTypeResponseCreate || t == openai.ClientEventTypeResponseCancel
+	})
+	want := []openai.ClientEventType{openai.ClientEventTypeResponseCreate,
+		openai.ClientEventTypeResponseCancel, openai.ClientEventTypeResponseCreate}
+	if !slices.Equal(types, want) {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+}
+
+func TestVoiceTurn(t *testing.T) {
+	server := mock.NewServer(mock.WithVAD(testVADBytes), mock.WithTurns(mock.Turn{
+		Transcript: "现在几点了",
+		Reply:      "我也不知道呢。",
+		Audio:      mock.Tone(24000, 300*time.Millisecond),
+	}))
+	defer server.Close()
+	d := newDevice(t, server, nil)
+	d.hello()
+
+	d.speak(5)
+
+	events := d.until(isTTS(xiaozhi.ServerTTSStateStop))
+	r := summarize(events)
+	if r.stt != "现在几点了" {
+		t.Errorf("stt = %q in %s", r.stt, describe(events))
+	}
+	if strings.Join(r.sentences, "") != "我也不知道呢。" || r.frames == 0 {
+		t.Errorf("reply = %+v", r)
+	}
+	appended := 0
+	for _, ev := range server.Received() {
+		if ev.ClientEventType() == openai.ClientEventTypeInputAudioBufferAppend {
+			appended++
+		}
+	}
+	if appended != 5 {
+		t.Errorf("%d frames appended, want 5", appended)
+	}
+}
+
+func TestTranscriptionFailed(t *testing.T) {
+	transcription := config.OpenAIConfig().Transcription
+	config.OpenAIConfig().Transcription.FallbackText = "（没听清）"
+	t.Cleanup(func() { config.OpenAIConfig().Transcription = transcription })
+	server := mock.NewServer(mock.WithVAD(testVADBytes), mock.WithTurns(mock.Turn{
+		Transcript:         "现在几点",
+		TranscriptionError: "audio too noisy",
+		Reply:              "你说什么？",
+	}))
+	defer server.Close()
+	d := newDevice(t, server, nil)
+	d.hello()
+
+	d.speak(5)
+	events := d.until(isTTS(xiaozhi.ServerTTSStateStop))
+	// 部分转写逐步下发，失败后以兜底文本替换
+	stt := lo.FilterMap(events, func(ev any, _ int) (string, bool) {
+		e, ok := ev.(*xiaozhi.ServerEventSTT)
+		return lo.FromPtr(e).Text, ok
+	})
+	if len(stt) < 2 || !strings.HasPrefix("现在几点", stt[0]) || stt[len(stt)-1] != "（没听清）" {
+		t.Errorf("stt = %q", stt)
+	}
+}
+
+func TestReminderTool(t *testing.T) {
+	scheduler, err := reminder.New(filepath.Join(t.TempDir(), "reminders.json"),
+		func(reminder.Reminder) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := mock.NewServer(mock.WithTurns(
+		mock.Turn{FunctionCall: &mock.FunctionCall{Name: toolSetReminder, Arguments: `{"text":"喝水","in_minutes":10}`}},
+		mock.Turn{Reply: "好的，十分钟后提醒你喝水。"},
+	))
+	defer server.Close()
+	d := newDevice(t, server, scheduler)
+	d.hello()
+
+	// 工具在 hello 之后注册
+	if _, ok := server.WaitFor(waitTimeout, func(ev openai.ClientEvent) bool {
+		update, ok := ev.(*openai.SessionUpdateEvent)
+		return ok && len(update.Session.Tools) > 0
+	}); !ok {
+		t.Fatal("tools not registered")
+	}
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "十分钟后提醒我喝水",
+	})
+	events := d.until(func(ev any) bool {
+		tts, ok := ev.(*xiaozhi.ServerEventTTS)
+		return ok && tts.State == xiaozhi.ServerTTSStateSentenceStart && strings.Contains(tts.Text, "喝水")
+	})
+	if r := summarize(events); len(r.errors) > 0 {
+		t.Errorf("errors: %q", r.errors)
+	}
+	ev, ok := server.WaitFor(waitTimeout, func(ev openai.ClientEvent) bool {
+		create, ok := ev.(*openai.ConversationItemCreateEvent)
+		return ok && create.Item.Type == openai.MessageItemTypeFunctionCallOutput
+	})
+	if !ok {
+		t.Fatal("no function call output")
+	}
+	if output := ev.(*openai.ConversationItemCreateEvent).Item.Output; !strings.Contains(output, "喝水") {
+		t.Errorf("output = %s", output)
+	}
+	if list := scheduler.List(testDeviceId); len(list) != 1 || list[0].Text != "喝水" {
+		t.Errorf("reminders = %+v", list)
+	}
+}
+
+func TestParallelToolCalls(t *testing.T) {
+	scheduler, err := reminder.New(filepath.Join(t.TempDir(), "reminders.json"),
+		func(reminder.Reminder) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := mock.NewServer(mock.WithTurns(
+		mock.Turn{
+			FunctionCall: &mock.FunctionCall{Name: toolSetReminder, Arguments: `{"text":"喝水","in_minutes":10}`},
+			FunctionCalls: []mock.FunctionCall{
+				{Name: toolSetReminder, Arguments: `{"text":"吃药","in_minutes":20}`},
+				{Name: "no_such_tool", Arguments: `{}`},
+			},
+		},
+		mock.Turn{Reply: "好的，都记下了。"},
+	))
+	defer server.Close()
+	d := newDevice(t, server, scheduler)
+	d.hello()
+
+	if _, ok := server.WaitFor(waitTimeout, func(ev openai.ClientEvent) bool {
+		update, ok := ev.(*openai.SessionUpdateEvent)
+		return ok && len(update.Session.Tools) > 0
+	}); !ok {
+		t.Fatal("tools not registered")
+	}
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "提醒我喝水和吃药",
+	})
+	events := d.until(func(ev any) bool {
+		tts, ok := ev.(*xiaozhi.ServerEventTTS)
+		return ok && tts.State == xiaozhi.ServerTTSStateSentenceStart && strings.Contains(tts.Text, "记下")
+	})
+	if r := summarize(events); len(r.errors) > 0 {
+		t.Errorf("errors: %q", r.errors)
+	}
+
+	// 三个调用结果都在唯一的续写请求之前发出
+	var outputs, creates int
+	for _, ev := range server.Received() {
+		switch ev := ev.(type) {
+		case *openai.ConversationItemCreateEvent:
+			if ev.Item.Type != openai.MessageItemTypeFunctionCallOutput {
+				break
+			}
+			outputs++
+			if creates > 1 {
+				t.Errorf("function call output after the continuation")
+			}
+		case *openai.ResponseCreateEvent:
+			creates++
+		}
+	}
+	if outputs != 3 {
+		t.Errorf("%d function call outputs, want 3", outputs)
+	}
+	if creates != 2 {
+		t.Errorf("%d response.create, want 2", creates)
+	}
+	if list := scheduler.List(testDeviceId); len(list) != 2 {
+		t.Errorf("reminders = %+v", list)
+	}
+}
+
+func TestSpeakPlayed(t *testing.T) {
+	server := mock.NewServer(mock.WithTurns(mock.Turn{Reply: "该喝水了。"}))
+	defer server.Close()
+	d := newDevice(t, server, nil)
+
+	played := make(chan error, 2)
+	speech := registry.Speech{Text: "提醒：喝水", Played: func(err error) { played <- err }}
+	// hello 之前不会播报
+	if err := d.handler.Speak(speech); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-played:
+		t.Fatalf("played before hello: %v", err)
+	case <-time.After(3 * pushPollInterval):
+	}
+	d.hello()
+	d.until(isTTS(xiaozhi.ServerTTSStateStop))
+	select {
+	case err := <-played:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("played not reported")
+	}
+
+	// 会话在播报前结束
+	server.AddTurns(mock.Turn{Reply: "好的。"})
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "你好",
+	})
+	d.until(isTTS(xiaozhi.ServerTTSStateStart))
+	if err := d.handler.Speak(speech); err != nil {
+		t.Fatal(err)
+	}
+	_ = d.handler.Close(d.ctx)
+	select {
+	case err := <-played:
+		if !errors.Is(err, registry.ErrSessionClosed) {
+			t.Fatalf("played = %v, want session closed", err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("closed session did not fail the speech")
+	}
+	if err := d.handler.Speak(speech); !errors.Is(err, registry.ErrSessionClosed) {
+		t.Errorf("speak after close = %v", err)
+	}
+}
+
+func TestPushAudioInterrupted(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+	d := newDevice(t, server, nil)
+	d.hello()
+
+	played := make(chan error, 1)
+	err := d.handler.Speak(registry.Speech{
+		Text:       "一段很长的录音",
+		PCM:        mock.Tone(16000, 5*time.Second),
+		SampleRate: 16000,
+		Played:     func(err error) { played <- err },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := d.until(func(ev any) bool {
+		_, ok := ev.(*xiaozhi.ServerAudioFrame)
+		return ok
+	})
+
+	// 播报期间仍处理上游事件，用户开口后剩余的音频不再下发
+	start := time.Now()
+	if err := d.handler.handleRealtimeApiEvent(websocket.TextMessage,
+		[]byte(`{"type":"input_audio_buffer.speech_started","event_id":"event_1","item_id":"item_1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("speech_started handled after %s", elapsed)
+	}
+	events = append(events, d.until(isTTS(xiaozhi.ServerTTSStateStop))...)
+	if r := summarize(events); r.frames == 0 || r.frames > 40 {
+		t.Errorf("%d frames of a 5 s clip sent before the interruption", r.frames)
+	}
+	// 用户说完后设备空闲，播报算作结束
+	if err := d.handler.handleRealtimeApiEvent(websocket.TextMessage,
+		[]byte(`{"type":"input_audio_buffer.speech_stopped","event_id":"event_2","item_id":"item_1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-played:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("played not reported")
+	}
+}
+
+func TestApiError(t *testing.T) {
+	server := mock.NewServer(mock.WithTurns(mock.Turn{Error: "rate limited"}))
+	defer server.Close()
+	d := newDevice(t, server, nil)
+	d.hello()
+
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "你好",
+	})
+	events := d.until(func(ev any) bool { _, ok := ev.(*xiaozhi.ServerEventError); return ok })
+	if r := summarize(events); !strings.Contains(r.errors[0], "rate limited") {
+		t.Errorf("error = %q", r.errors[0])
+	}
+}
+
+// syncBuffer collects log lines written from the handler goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var m map[string]any
+		if json.Unmarshal([]byte(line), &m) == nil {
+			lines = append(lines, m)
+		}
+	}
+	return lines
+}
+
+func TestPushRejected(t *testing.T) {
+	server := mock.NewServer(mock.WithTurns(mock.Turn{Error: "rate limited"}, mock.Turn{Reply: "该喝水了。"}))
+	defer server.Close()
+	d := newDevice(t, server, nil)
+	d.hello()
+
+	if err := d.handler.Speak(registry.Speech{Text: "提醒：吃药"}); err != nil {
+		t.Fatal(err)
+	}
+	events := d.until(func(ev any) bool { _, ok := ev.(*xiaozhi.ServerEventError); return ok })
+	if !slices.ContainsFunc(events, isTTS(xiaozhi.ServerTTSStateStop)) {
+		t.Errorf("no tts stop: %s", describe(events))
+	}
+	if d.handler.responding.Load() {
+		t.Error("still responding after the response was rejected")
+	}
+
+	// 播报队列没有卡住
+	if err := d.handler.Speak(registry.Speech{Text: "提醒：喝水"}); err != nil {
+		t.Fatal(err)
+	}
+	events = d.until(isTTS(xiaozhi.ServerTTSStateStop))
+	if r := summarize(events); strings.Join(r.sentences, "") != "该喝水了。" {
+		t.Errorf("events = %s", describe(events))
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var buf syncBuffer
+	l, err := logger.New(&buf, "debug", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultLogger, audioSample := slog.Default(), config.Log().AudioSample
+	slog.SetDefault(l)
+	config.Log().AudioSample = 1000
+	defer func() {
+		slog.SetDefault(defaultLogger)
+		config.Log().AudioSample = audioSample
+	}()
+
+	server := mock.NewServer(mock.WithTurns(
+		mock.Turn{Reply: "好的。", Audio: mock.Tone(24000, 300*time.Millisecond)},
+		mock.Turn{Error: "rate limited"},
+	))
+	defer server.Close()
+	d := newDevice(t, server, nil)
+	d.hello()
+	text := &xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "你好",
+	}
+	_ = d.dispatch(text)
+	d.until(isTTS(xiaozhi.ServerTTSStateStop))
+	_ = d.dispatch(text)
+	d.until(func(ev any) bool { _, ok := ev.(*xiaozhi.ServerEventError); return ok })
+
+	counts := map[string]int{}
+	for _, line := range buf.lines() {
+		if line["session_id"] != "test-session" || line["device_id"] != testDeviceId || line["provider"] != "openai" {
+			t.Fatalf("line without session attributes: %v", line)
+		}
+		counts[line["msg"].(string)]++
+		if line["msg"] == "realtime api error" && !strings.Contains(line["error"].(string), "rate limited") {
+			t.Errorf("error line = %v", line)
+		}
+	}
+	// 音频事件按采样只记录第一条
+	for _, msg := range []string{"audio from realtime api", "audio to device"} {
+		if counts[msg] != 1 {
+			t.Errorf("%q logged %d times", msg, counts[msg])
+		}
+	}
+	for _, msg := range []string{"event from device", "event to realtime api", "event from realtime api", "event to device", "realtime api error"} {
+		if counts[msg] == 0 {
+			t.Errorf("%q not logged", msg)
+		}
+	}
+}
+
+func TestApiDisconnect(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+	d := newDevice(t, server, nil)
+	d.hello()
+
+	server.Disconnect()
+	deadline := time.Now().Add(waitTimeout)
+	text := &xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "你好",
+	}
+	for d.dispatch(text) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("dispatch still succeeds after the api disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defaultProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(defaultProvider)
+
+	scheduler, err := reminder.New(filepath.Join(t.TempDir(), "reminders.json"),
+		func(reminder.Reminder) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := mock.NewServer(mock.WithTurns(
+		mock.Turn{FunctionCall: &mock.FunctionCall{Name: toolSetReminder, Arguments: `{"text":"喝水","in_minutes":10}`}},
+		mock.Turn{Reply: "好的。", Audio: mock.Tone(24000, 300*time.Millisecond)},
+	))
+	defer server.Close()
+	d := newDevice(t, server, scheduler)
+	d.hello()
+	if _, ok := server.WaitFor(waitTimeout, func(ev openai.ClientEvent) bool {
+		update, ok := ev.(*openai.SessionUpdateEvent)
+		return ok && len(update.Session.Tools) > 0
+	}); !ok {
+		t.Fatal("tools not registered")
+	}
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "十分钟后提醒我喝水",
+	})
+	// 工具调用的回复结束时也会下发 tts stop，等到第二个回复播完
+	d.until(func(ev any) bool {
+		tts, ok := ev.(*xiaozhi.ServerEventTTS)
+		return ok && tts.State == xiaozhi.ServerTTSStateSentenceStart && tts.Text == "好的。"
+	})
+	d.until(isTTS(xiaozhi.ServerTTSStateStop))
+	_ = d.handler.Close(d.ctx)
+
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	if len(spans[tracing.SpanSession]) != 1 || len(spans[tracing.SpanDial]) != 1 ||
+		len(spans[tracing.SpanTurn]) != 1 || len(spans[tracing.SpanTool]) != 1 {
+		t.Fatalf("spans = %v", lo.MapValues(spans, func(s []sdktrace.ReadOnlySpan, _ string) int { return len(s) }))
+	}
+	session, turn := spans[tracing.SpanSession][0], spans[tracing.SpanTurn][0]
+	if spans[tracing.SpanDial][0].Parent().SpanID() != session.SpanContext().SpanID() ||
+		turn.Parent().SpanID() != session.SpanContext().SpanID() {
+		t.Error("dial and turn are not children of the session")
+	}
+	attrs := lo.SliceToMap(turn.Attributes(), func(kv attribute.KeyValue) (string, string) {
+		return string(kv.Key), kv.Value.Emit()
+	})
+	if attrs["turn.input"] != "text" || attrs["turn.status"] != "completed" || attrs["usage.output_tokens"] == "" {
+		t.Errorf("turn attributes = %v", attrs)
+	}
+	events := lo.Map(turn.Events(), func(e sdktrace.Event, _ int) string { return e.Name })
+	want := []string{turnResponseCreated, turnToolDone, turnResponseCreated, turnFirstAudio}
+	if strings.Join(events, " ") != strings.Join(want, " ") {
+		t.Errorf("turn events = %v, want %v", events, want)
+	}
+	children := append(spans[tracing.SpanTool], spans[tracing.SpanOpusEncode]...)
+	if len(spans[tracing.SpanOpusEncode]) == 0 {
+		t.Error("no opus encode spans")
+	}
+	for _, span := range children {
+		if span.Parent().SpanID() != turn.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of the turn", span.Name())
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []webhook.Event
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev struct {
+			webhook.Event
+			Data json.RawMessage `json:"data"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		ev.Event.Data = ev.Data
+		mu.Lock()
+		events = append(events, ev.Event)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+	hooks, err := webhook.New(webhook.Options{
+		Dir:       t.TempDir(),
+		Endpoints: []webhook.Endpoint{{Name: "backend", URL: receiver.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hooks.Run(ctx)
+
+	scheduler, err := reminder.New(filepath.Join(t.TempDir(), "reminders.json"),
+		func(reminder.Reminder) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := mock.NewServer(mock.WithTurns(
+		mock.Turn{FunctionCall: &mock.FunctionCall{Name: toolSetReminder, Arguments: `{"text":"喝水","in_minutes":10}`}},
+		mock.Turn{Reply: "好的。"},
+	))
+	defer server.Close()
+	d := newDeviceWith(t, server, deviceOptions{reminders: scheduler, hooks: hooks})
+	d.hello()
+	if _, ok := server.WaitFor(waitTimeout, func(ev openai.ClientEvent) bool {
+		update, ok := ev.(*openai.SessionUpdateEvent)
+		return ok && len(update.Session.Tools) > 0
+	}); !ok {
+		t.Fatal("tools not registered")
+	}
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "十分钟后提醒我喝水",
+	})
+
+	// 用户输入、工具调用、两次回复的用量、助手回复，工具在另一协程调用，不比较顺序
+	want := []string{webhook.TypeToolCall, webhook.TypeAssistantTranscript, webhook.TypeUserTranscript,
+		webhook.TypeUsage, webhook.TypeUsage}
+	var got []webhook.Event
+	for deadline := time.Now().Add(waitTimeout); len(got) < len(want); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d events", len(got))
+		}
+		mu.Lock()
+		got = append([]webhook.Event(nil), events...)
+		mu.Unlock()
+	}
+	types := lo.Map(got, func(ev webhook.Event, _ int) string { return ev.Type })
+	slices.Sort(types)
+	if strings.Join(types, " ") != strings.Join(want, " ") {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+	for _, ev := range got {
+		if ev.SessionID != "test-session" || ev.DeviceId != testDeviceId {
+			t.Errorf("event without session: %+v", ev)
+		}
+		data := string(ev.Data.(json.RawMessage))
+		switch ev.Type {
+		case webhook.TypeUserTranscript:
+			if !strings.Contains(data, `"source":"text"`) || !strings.Contains(data, "十分钟后提醒我喝水") {
+				t.Errorf("user transcript = %s", data)
+			}
+		case webhook.TypeToolCall:
+			if !strings.Contains(data, toolSetReminder) || !strings.Contains(data, "喝水") {
+				t.Errorf("tool call = %s", data)
+			}
+		case webhook.TypeAssistantTranscript:
+			if !strings.Contains(data, "好的。") {
+				t.Errorf("assistant transcript = %s", data)
+			}
+		}
+	}
+}
+
+const testSafeReply = "我们换个话题吧。"
+
+// classifierFunc is a moderation.Classifier.
+type classifierFunc func(source, text string) moderation.Verdict
+
+func (f classifierFunc) Classify(_ context.Context, source, text string) (moderation.Verdict, error) {
+	return f(source, text), nil
+}
+
+func newModerator(t *testing.T, classifier moderation.Classifier) (*moderation.Moderator, string) {
+	audit := filepath.Join(t.TempDir(), "moderation.jsonl")
+	mod, err := moderation.New(moderation.Options{
+		Keywords:   []string{"坏话"},
+		Classifier: classifier,
+		SafeReply:  testSafeReply,
+		AuditFile:  audit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = mod.Close() })
+	return mod, audit
+}
+
+// audited waits for the audit log to hold an entry and returns it.
+func audited(t *testing.T, file string) moderation.Entry {
+	t.Helper()
+	for deadline := time.Now().Add(waitTimeout); ; time.Sleep(10 * time.Millisecond) {
+		if data, _ := os.ReadFile(file); len(data) > 0 {
+			var e moderation.Entry
+			if err := json.Unmarshal(bytes.SplitN(data, []byte("\n"), 2)[0], &e); err != nil {
+				t.Fatal(err)
+			}
+			return e
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("nothing audited")
+		}
+	}
+}
+
+// untilSafeReply collects the events up to the end of the safe reply.
+func (d *device) untilSafeReply() reply {
+	d.t.Helper()
+	var events []any
+	for !slices.Contains(summarize(events).sentences, testSafeReply) {
+		events = append(events, d.until(isTTS(xiaozhi.ServerTTSStateStop))...)
+	}
+	return summarize(events)
+}
+
+func TestModerateReply(t *testing.T) {
+	mod, audit := newModerator(t, nil)
+	server := mock.NewServer(mock.WithDeltaInterval(20*time.Millisecond), mock.WithTurns(
+		mock.Turn{Reply: "好呀，我们来说点坏话吧，比如这一句。", Audio: mock.Tone(24000, 600*time.Millisecond)},
+		mock.Turn{Reply: testSafeReply},
+	))
+	defer server.Close()
+	d := newDeviceWith(t, server, deviceOptions{moderator: mod})
+	d.hello()
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "说点什么",
+	})
+
+	r := d.untilSafeReply()
+	for _, s := range r.sentences {
+		if strings.Contains(s, "坏") {
+			t.Errorf("blocked text reached the device: %q", r.sentences)
+		}
+	}
+	// 安全回复没有音频，收到的帧都来自被拦截的回复
+	if r.frames != 0 {
+		t.Errorf("%d audio frames of the blocked reply reached the device", r.frames)
+	}
+	if _, ok := server.WaitFor(waitTimeout, mock.Type(openai.ClientEventTypeResponseCancel)); !ok {
+		t.Error("blocked response not cancelled")
+	}
+	if _, ok := server.WaitFor(waitTimeout, mock.Type(openai.ClientEventTypeConversationItemDelete)); !ok {
+		t.Error("blocked reply not deleted")
+	}
+	if e := audited(t, audit); e.Source != moderation.SourceAssistant || e.Rule != "keyword:坏话" ||
+		e.Action != actionCancelResponse || e.DeviceId != testDeviceId {
+		t.Errorf("audit entry = %+v", e)
+	}
+}
+
+func TestModerateCleanReply(t *testing.T) {
+	// 逐句暂存的音频在检查通过后全部下发
+	mod, _ := newModerator(t, nil)
+	server := mock.NewServer(mock.WithTurns(
+		mock.Turn{Reply: "你好呀。今天过得好吗？", Audio: mock.Tone(24000, 600*time.Millisecond)},
+	))
+	defer server.Close()
+	d := newDeviceWith(t, server, deviceOptions{moderator: mod})
+	d.hello()
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "你好",
+	})
+
+	r := summarize(d.until(isTTS(xiaozhi.ServerTTSStateStop)))
+	if strings.Join(r.sentences, "") != "你好呀。今天过得好吗？" {
+		t.Errorf("sentences = %q", r.sentences)
+	}
+	if r.frames < 9 || r.frames > 11 {
+		t.Errorf("%d audio frames for 600 ms", r.frames)
+	}
+}
+
+func TestModerateTypedInput(t *testing.T) {
+	mod, audit := newModerator(t, nil)
+	server := mock.NewServer(mock.WithTurns(mock.Turn{Reply: testSafeReply}))
+	defer server.Close()
+	d := newDeviceWith(t, server, deviceOptions{moderator: mod})
+	d.hello()
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "教我说 坏-话",
+	})
+
+	d.untilSafeReply()
+	for _, ev := range server.Received() {
+		if create, ok := ev.(*openai.ConversationItemCreateEvent); ok {
+			for _, c := range create.Item.Content {
+				if strings.Contains(lo.FromPtr(c.Text), "坏") {
+					t.Errorf("blocked input sent to the model: %+v", create.Item)
+				}
+			}
+		}
+	}
+	if e := audited(t, audit); e.Source != moderation.SourceUser || e.Action != actionDropInput {
+		t.Errorf("audit entry = %+v", e)
+	}
+}
+
+func TestModerateRecordedReply(t *testing.T) {
+	mod, err := moderation.New(moderation.Options{
+		Keywords:            []string{"坏话"},
+		SafeReply:           testSafeReply,
+		SafeReplyAudio:      make([]byte, 16000*2/2), // 0.5s 静音
+		SafeReplySampleRate: 16000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := mock.NewServer()
+	defer server.Close()
+	d := newDeviceWith(t, server, deviceOptions{moderator: mod})
+	d.hello()
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "教我说坏话",
+	})
+
+	if r := d.untilSafeReply(); r.frames == 0 {
+		t.Errorf("recorded safe reply not played: %+v", r)
+	}
+	if ev, ok := server.WaitFor(100*time.Millisecond, mock.Type(openai.ClientEventTypeResponseCreate)); ok {
+		t.Errorf("model asked to say the recorded reply: %+v", ev)
+	}
+}
+
+func TestModerateVoiceInput(t *testing.T) {
+	// 分类器拦截语音输入，回复在分类结果前后开始都会被取消
+	mod, audit := newModerator(t, classifierFunc(func(source, text string) moderation.Verdict {
+		return moderation.Verdict{Blocked: source == moderation.SourceUser && strings.Contains(text, "秘密"),
+			Category: "privacy"}
+	}))
+	server := mock.NewServer(mock.WithVAD(testVADBytes), mock.WithDeltaInterval(20*time.Millisecond), mock.WithTurns(
+		mock.Turn{Transcript: "告诉我你的秘密", Reply: "好呀，我的秘密是，其实我很喜欢唱歌。"},
+		mock.Turn{Reply: testSafeReply},
+	))
+	defer server.Close()
+	d := newDeviceWith(t, server, deviceOptions{moderator: mod})
+	d.hello()
+	d.speak(5)
+
+	r := d.untilSafeReply()
+	if strings.Contains(strings.Join(r.sentences, ""), "唱歌") {
+		t.Errorf("reply to blocked input reached the device: %q", r.sentences)
+	}
+	if _, ok := server.WaitFor(waitTimeout, mock.Type(openai.ClientEventTypeResponseCancel)); !ok {
+		t.Error("response to blocked input not cancelled")
+	}
+	ev, ok := server.WaitFor(waitTimeout, mock.Type(openai.ClientEventTypeConversationItemDelete))
+	if !ok || ev.(*openai.ConversationItemDeleteEvent).ItemID == "" {
+		t.Errorf("blocked input not deleted: %+v", ev)
+	}
+	if e := audited(t, audit); e.Rule != "classifier" || e.Category != "privacy" || e.Action != actionCancelResponse {
+		t.Errorf("audit entry = %+v", e)
+	}
+}
+
+func TestUsageLimit(t *testing.T) {
+	const notice = "现在是休息时间啦。"
+	notices := config.Parental().Notices
+	config.Parental().Notices.Hours = notice
+	t.Cleanup(func() { config.Parental().Notices = notices })
+
+	controls, err := parental.New(filepath.Join(t.TempDir(), "parental.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := controls.Start(testDeviceId)
+	defer limits.Stop()
+	server := mock.NewServer(mock.WithTurns(mock.Turn{Reply: notice}))
+	defer server.Close()
+	d := newDeviceWith(t, server, deviceOptions{limits: limits})
+	d.hello()
+
+	// 会话中设置策略，当前时刻不在允许时段内
+	now := time.Now().UTC()
+	start := now.Add(6 * time.Hour).Format("15:04")
+	end := now.Add(7 * time.Hour).Format("15:04")
+	if err := controls.Set(testDeviceId, parental.Policy{Timezone: "UTC", Hours: []string{start + "-" + end}}); err != nil {
+		t.Fatal(err)
+	}
+	r := summarize(d.until(isTTS(xiaozhi.ServerTTSStateStop)))
+	if strings.Join(r.sentences, "") != notice {
+		t.Errorf("sentences = %q, want the notice", r.sentences)
+	}
+	_ = d.dispatch(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            "再聊一会儿",
+	})
+	// 播报完成后断开
+	d.waitClosed()
+	for _, ev := range server.Received() {
+		if create, ok := ev.(*openai.ConversationItemCreateEvent); ok && create.Item.Role == openai.MessageRoleUser {
+			t.Errorf("input after the limit sent to the model: %+v", create.Item)
+		}
+	}
+}
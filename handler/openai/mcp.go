@@ -0,0 +1,243 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+)
+
+const (
+	mcpCallTimeout = 10 * time.Second
+	// 防止设备返回的 nextCursor 异常导致无限翻页
+	mcpMaxToolPages = 16
+	// 函数名最长 64 个字符
+	maxFunctionName = 64
+)
+
+var errMcpClosed = errors.New("mcp client closed")
+
+// mcpClient talks JSON-RPC to the MCP server running on the device over the
+// xiaozhi websocket, and exposes the device tools to the model.
+type mcpClient struct {
+	send    func(req *xiaozhi.McpRequest) error
+	log     *slog.Logger
+	nextId  atomic.Int64
+	mu      sync.Mutex
+	pending map[int64]chan *xiaozhi.McpMessage
+	closed  bool
+	tools   []openai.Tool
+	names   map[string]string // openai 函数名 -> 设备工具名
+	// 网关自带工具的函数名，设备工具不能使用
+	reserved []string
+}
+
+func newMcpClient(send func(req *xiaozhi.McpRequest) error, log *slog.Logger, reserved []string) *mcpClient {
+	return &mcpClient{
+		send:     send,
+		log:      log,
+		pending:  make(map[int64]chan *xiaozhi.McpMessage),
+		names:    make(map[string]string),
+		reserved: reserved,
+	}
+}
+
+// Init runs initialize and tools/list against the device.
+func (c *mcpClient) Init(ctx context.Context) error {
+	_, err := c.call(ctx, xiaozhi.McpMethodInitialize, &xiaozhi.McpInitializeParams{
+		ProtocolVersion: xiaozhi.McpProtocolVersion,
+		Capabilities:    map[string]any{},
+		ClientInfo: xiaozhi.McpClientInfo{
+			Name:    "go-xiaozhi",
+			Version: "1.0.0",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("mcp initialize: %w", err)
+	}
+
+	var tools []xiaozhi.McpTool
+	cursor := ""
+	for i := 0; i < mcpMaxToolPages; i++ {
+		result, err := c.call(ctx, xiaozhi.McpMethodToolsList, &xiaozhi.McpToolsListParams{Cursor: cursor})
+		if err != nil {
+			return fmt.Errorf("mcp tools/list: %w", err)
+		}
+		var page xiaozhi.McpToolsListResult
+		if err := json.Unmarshal(result, &page); err != nil {
+			return fmt.Errorf("mcp tools/list: %w", err)
+		}
+		tools = append(tools, page.Tools...)
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	c.setTools(tools)
+	return nil
+}
+
+func (c *mcpClient) setTools(tools []xiaozhi.McpTool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tools = make([]openai.Tool, 0, len(tools))
+	c.names = make(map[string]string, len(tools))
+	for _, t := range tools {
+		name := mcpFunctionName(t.Name)
+		// 不同的设备工具名替换字符后可能相同（a.b 与 a_b），也可能和网关工具重名，加序号区分
+		for i := 2; c.names[name] != "" || lo.Contains(c.reserved, name); i++ {
+			name = withSuffix(mcpFunctionName(t.Name), i)
+		}
+		if name != mcpFunctionName(t.Name) {
+			c.log.Warn("mcp tool renamed to avoid a name clash", "tool", t.Name, "function", name)
+		}
+		c.names[name] = t.Name
+		c.tools = append(c.tools, openai.Tool{
+			Type:        openai.ToolTypeFunction,
+			Name:        name,
+			Description: t.Description,
+			Parameters:  lo.Ternary[any](len(t.InputSchema) > 0, t.InputSchema, map[string]any{"type": "object"}),
+		})
+	}
+}
+
+// mcpFunctionName maps a device tool name such as self.audio_speaker.set_volume
+// to a valid function name, which only allows [a-zA-Z0-9_-].
+func mcpFunctionName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	if len(name) > maxFunctionName {
+		name = name[:maxFunctionName]
+	}
+	return name
+}
+
+// withSuffix appends _<i> to a function name, keeping it within the length
+// limit.
+func withSuffix(name string, i int) string {
+	suffix := fmt.Sprintf("_%d", i)
+	return name[:min(len(name), maxFunctionName-len(suffix))] + suffix
+}
+
+func (c *mcpClient) Tools() []openai.Tool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tools
+}
+
+func (c *mcpClient) Call(ctx context.Context, name, arguments string) (string, error) {
+	c.mu.Lock()
+	toolName, ok := c.names[name]
+	c.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("unknown mcp tool: %s", name)
+	}
+	params := &xiaozhi.McpToolsCallParams{Name: toolName}
+	if arguments != "" {
+		params.Arguments = json.RawMessage(arguments)
+	}
+	result, err := c.call(ctx, xiaozhi.McpMethodToolsCall, params)
+	if err != nil {
+		return "", err
+	}
+	var res xiaozhi.McpToolsCallResult
+	if err := json.Unmarshal(result, &res); err != nil {
+		return "", err
+	}
+	text := strings.Join(lo.FilterMap(res.Content, func(c xiaozhi.McpContent, _ int) (string, bool) {
+		return c.Text, c.Type == "text"
+	}), "\n")
+	if res.IsError {
+		return "", errors.New(text)
+	}
+	return text, nil
+}
+
+// call sends a request and waits for the matching response, which is
+// delivered by Dispatch from the websocket read loop.
+func (c *mcpClient) call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	id := c.nextId.Add(1)
+	ch := make(chan *xiaozhi.McpMessage, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errMcpClosed
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	err := c.send(&xiaozhi.McpRequest{
+		JSONRPC: xiaozhi.McpJSONRPCVersion,
+		Method:  method,
+		Params:  params,
+		ID:      id,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mcpCallTimeout)
+	defer cancel()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return nil, errMcpClosed
+		}
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return msg.Result, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s: %w", method, ctx.Err())
+	}
+}
+
+// Dispatch delivers a message received from the device.
+func (c *mcpClient) Dispatch(msg *xiaozhi.McpMessage) {
+	if !msg.IsResponse() {
+		// 设备主动发来的通知/请求暂不处理
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.pending[*msg.ID]
+	if !ok {
+		c.log.Warn("mcp response without pending request", "id", *msg.ID)
+		return
+	}
+	// 持锁投递并移除，避免与 Close 关闭 channel 竞争
+	delete(c.pending, *msg.ID)
+	ch <- msg
+}
+
+func (c *mcpClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,350 @@
+package openai
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
+	"github.com/xdimtech/go-xiaozhi/pkg/moderation"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
+	"github.com/xdimtech/go-xiaozhi/pkg/utils"
+)
+
+// Actions recorded in the moderation audit log.
+const (
+	actionDropInput      = "drop_input"      // 文本输入未发给模型
+	actionCancelResponse = "cancel_response" // 取消进行中或即将开始的回复
+	actionAfterResponse  = "after_response"  // 分类结果晚于回复结束，只播报安全回复
+)
+
+// guard moderates a session: the user input before the model answers it and
+// the reply transcript as it streams in. A blocked response is cancelled,
+// the rest of its output dropped and the safe reply spoken instead. The
+// reply audio and subtitles are held sentence by sentence until the lists
+// pass the transcript, so no audio of a blocked sentence is played. The
+// classifier runs in the background and does not hold up the audio.
+type guard struct {
+	h   *XiaozhiHandler
+	mod *moderation.Moderator
+
+	mu        sync.Mutex
+	response  string // 进行中的回复
+	blocked   string // 已取消、输出需丢弃的回复
+	awaiting  bool   // 输入已发给模型，回复尚未开始
+	blockNext bool   // 被拦截的输入尚未触发回复，回复开始即取消
+	reply     strings.Builder
+	checked   int // 已交给分类器的回复文本长度
+	// 回复的音频和字幕按到达顺序暂存，所在句通过列表检查后才下发
+	holding bool
+	held    []func() error
+}
+
+func newGuard(h *XiaozhiHandler, mod *moderation.Moderator) *guard {
+	return &guard{h: h, mod: mod}
+}
+
+// Input checks user text, typed or transcribed, and reports whether it was
+// blocked by the lists. Typed text that is blocked is not sent to the model.
+func (g *guard) Input(itemId, text string, typed bool) bool {
+	if g.mod == nil {
+		return false
+	}
+	v := g.mod.Match(text)
+	if !typed || !v.Blocked {
+		g.mu.Lock()
+		g.awaiting = true
+		g.mu.Unlock()
+	}
+	if v.Blocked {
+		g.blockInput(itemId, text, v, typed)
+		return true
+	}
+	if g.mod.HasClassifier() {
+		go func() {
+			v, err := g.mod.Classify(g.h.ctx, moderation.SourceUser, text)
+			if err != nil {
+				g.h.log.Warn("moderation classifier failed", "source", moderation.SourceUser, "err", err)
+				return
+			}
+			if v.Blocked {
+				// 文本已发给模型，按语音输入处理
+				g.blockInput(itemId, text, v, false)
+			}
+		}()
+	}
+	return false
+}
+
+// Created notes a new response and reports whether it is cancelled right
+// away for a blocked input.
+func (g *guard) Created(responseId string) bool {
+	if g.mod == nil {
+		return false
+	}
+	g.mu.Lock()
+	g.response = responseId
+	g.reply.Reset()
+	g.checked = 0
+	// 第一句文本到达前的音频内容未知，也先暂存
+	g.holding, g.held = true, nil
+	block := g.blockNext
+	g.awaiting, g.blockNext = false, false
+	if block {
+		g.blocked = responseId
+	}
+	g.mu.Unlock()
+	if block {
+		g.cancel()
+	}
+	return block
+}
+
+// Delta checks the reply transcript so far and reports whether the response
+// is blocked, in which case the delta must not reach the device.
+func (g *guard) Delta(responseId, itemId, delta string) bool {
+	if g.mod == nil {
+		return false
+	}
+	g.mu.Lock()
+	if g.blocked == responseId {
+		g.mu.Unlock()
+		return true
+	}
+	g.reply.WriteString(delta)
+	text := g.reply.String()
+	var sentences string
+	if g.mod.HasClassifier() && strings.ContainsAny(delta, sentenceEnds) {
+		sentences, g.checked = text[g.checked:], len(text)
+	}
+	g.mu.Unlock()
+
+	if v := g.mod.Match(text); v.Blocked {
+		g.blockResponse(responseId, itemId, text, v)
+		return true
+	}
+	g.mu.Lock()
+	if g.response == responseId {
+		// 句末之后又有文本时，之后的音频可能属于尚未检查完的下一句
+		g.holding = !endsSentence(text)
+	}
+	g.mu.Unlock()
+	if sentences != "" {
+		go g.classifyReply(responseId, itemId, sentences)
+	}
+	return false
+}
+
+// Output sends audio or subtitles of a response to the device, or holds
+// them with the earlier output while the sentence in progress has not
+// passed the lists. Output of a blocked response is dropped.
+func (g *guard) Output(responseId string, out func() error) error {
+	if g.mod == nil {
+		return out()
+	}
+	g.mu.Lock()
+	if g.blocked == responseId {
+		g.mu.Unlock()
+		return nil
+	}
+	g.held = append(g.held, out)
+	if g.holding && g.response == responseId {
+		g.mu.Unlock()
+		return nil
+	}
+	held := g.held
+	g.held = nil
+	g.mu.Unlock()
+	return release(held)
+}
+
+// Flush sends the held output once the whole transcript of the response
+// has passed the lists.
+func (g *guard) Flush(responseId string) error {
+	if g.mod == nil {
+		return nil
+	}
+	g.mu.Lock()
+	if g.response != responseId || g.blocked == responseId {
+		g.mu.Unlock()
+		return nil
+	}
+	held := g.held
+	g.holding, g.held = false, nil
+	g.mu.Unlock()
+	return release(held)
+}
+
+func release(held []func() error) error {
+	var errs []error
+	for _, out := range held {
+		errs = append(errs, out())
+	}
+	return errors.Join(errs...)
+}
+
+func endsSentence(text string) bool {
+	r, _ := utf8.DecodeLastRuneInString(strings.TrimRight(text, " "))
+	return strings.ContainsRune(sentenceEnds, r)
+}
+
+// Blocked reports whether the output of a response is dropped.
+func (g *guard) Blocked(responseId string) bool {
+	if g.mod == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.blocked == responseId
+}
+
+// Done ends the response, the rest of its transcript is checked by the
+// classifier. Output still held, e.g. of an interrupted response, is dropped.
+func (g *guard) Done(responseId, itemId string) {
+	if g.mod == nil {
+		return
+	}
+	g.mu.Lock()
+	if g.response != responseId {
+		g.mu.Unlock()
+		return
+	}
+	rest := ""
+	if g.blocked != responseId && g.mod.HasClassifier() {
+		rest = g.reply.String()[g.checked:]
+	}
+	g.response, g.blocked = "", ""
+	g.holding, g.held = false, nil
+	g.reply.Reset()
+	g.checked = 0
+	g.mu.Unlock()
+	if strings.TrimSpace(rest) != "" {
+		go g.classifyReply(responseId, itemId, rest)
+	}
+}
+
+func (g *guard) classifyReply(responseId, itemId, text string) {
+	v, err := g.mod.Classify(g.h.ctx, moderation.SourceAssistant, text)
+	if err != nil {
+		g.h.log.Warn("moderation classifier failed", "source", moderation.SourceAssistant, "err", err)
+		return
+	}
+	if v.Blocked {
+		g.blockResponse(responseId, itemId, text, v)
+	}
+}
+
+// blockInput cancels the response to blocked user input, or the one about
+// to start for it, and removes the input from the conversation.
+func (g *guard) blockInput(itemId, text string, v moderation.Verdict, typed bool) {
+	action := actionDropInput
+	if !typed {
+		action = actionAfterResponse
+		g.mu.Lock()
+		cancel := g.response != "" && g.blocked != g.response
+		switch {
+		case cancel:
+			g.blocked, g.held = g.response, nil
+			action = actionCancelResponse
+		case g.awaiting:
+			g.blockNext = true
+			action = actionCancelResponse
+		}
+		g.mu.Unlock()
+		if cancel {
+			g.cancel()
+		}
+		g.deleteItem(itemId)
+	}
+	g.audit(moderation.SourceUser, text, v, action)
+	g.speakSafeReply()
+}
+
+// blockResponse cancels a response whose transcript is blocked. A verdict
+// arriving after the response ended only brings the safe reply.
+func (g *guard) blockResponse(responseId, itemId, text string, v moderation.Verdict) {
+	g.mu.Lock()
+	if g.blocked == responseId {
+		g.mu.Unlock()
+		return
+	}
+	current := g.response == responseId
+	if current {
+		g.blocked, g.held = responseId, nil
+	}
+	g.mu.Unlock()
+	action := actionAfterResponse
+	if current {
+		action = actionCancelResponse
+		g.cancel()
+	}
+	g.deleteItem(itemId)
+	g.audit(moderation.SourceAssistant, text, v, action)
+	g.speakSafeReply()
+}
+
+// cancel stops the response in progress. Subtitles already scheduled are
+// dropped, the audio is reset when the response is done.
+func (g *guard) cancel() {
+	g.h.subtitles.Drop()
+	err := g.h.SendToRealtimeAPI(&openai.ResponseCancelEvent{
+		ClientEventBase: openai.ClientEventBase{
+			EventID: utils.UniqueID(),
+			Type:    openai.ClientEventTypeResponseCancel,
+		},
+	})
+	if err != nil {
+		g.h.log.Warn("cancel blocked response failed", "err", err)
+	}
+}
+
+// deleteItem keeps blocked text out of the context of later responses.
+func (g *guard) deleteItem(itemId string) {
+	if itemId == "" {
+		return
+	}
+	err := g.h.SendToRealtimeAPI(&openai.ConversationItemDeleteEvent{
+		ClientEventBase: openai.ClientEventBase{
+			EventID: utils.UniqueID(),
+			Type:    openai.ClientEventTypeConversationItemDelete,
+		},
+		ItemID: itemId,
+	})
+	if err != nil {
+		g.h.log.Warn("delete blocked item failed", "item_id", itemId, "err", err)
+	}
+}
+
+func (g *guard) audit(source, text string, v moderation.Verdict, action string) {
+	g.h.log.Warn("content blocked", "source", source, "rule", v.Rule, "category", v.Category, "action", action)
+	err := g.mod.Audit(moderation.Entry{
+		SessionID: g.h.entry.ID,
+		DeviceId:  g.h.sess.DeviceId,
+		Source:    source,
+		Text:      text,
+		Rule:      v.Rule,
+		Category:  v.Category,
+		Action:    action,
+	})
+	if err != nil {
+		g.h.log.Error("write moderation audit failed", "err", err)
+	}
+}
+
+// speakSafeReply says the safe reply once the blocked response is over. A
+// recorded reply is played as is; otherwise the model is asked to say the
+// text verbatim, which it may still paraphrase slightly.
+func (g *guard) speakSafeReply() {
+	text := g.mod.SafeReply()
+	if text == "" {
+		return
+	}
+	speech := registry.Speech{Text: text, Instructions: verbatimInstructions}
+	if pcm, rate := g.mod.SafeReplyAudio(); len(pcm) > 0 {
+		speech = registry.Speech{Text: text, PCM: pcm, SampleRate: rate}
+	}
+	if err := g.h.Speak(speech); err != nil {
+		g.h.log.Warn("speak safe reply failed", "err", err)
+	}
+}
@@ -0,0 +1,56 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
+	"github.com/xdimtech/go-xiaozhi/pkg/config"
+	"github.com/xdimtech/go-xiaozhi/pkg/parental"
+)
+
+// 限制提醒迟迟播不完时（如设备未发 hello）也要断开
+const limitNoticeTimeout = 30 * time.Second
+
+// watchLimits ends the session once the device runs out of allowed time,
+// right away if it connected outside of it. The user input is dropped from
+// then on and the notice spoken before disconnecting.
+func (r *XiaozhiHandler) watchLimits(ctx context.Context, limits *parental.Tracker) {
+	v, ok := limits.Wait(ctx)
+	if !ok {
+		return
+	}
+	r.limited.Store(true)
+	r.log.Info("usage limit reached", "reason", v.Reason)
+	if notice := limitNotice(v.Reason); notice != "" {
+		played, err := r.speakAndWait(registry.Speech{Text: notice, Instructions: verbatimInstructions})
+		if err != nil {
+			r.log.Warn("speak limit notice failed", "err", err)
+		} else {
+			select {
+			case <-ctx.Done():
+				return
+			case <-played:
+			case <-time.After(limitNoticeTimeout):
+			}
+		}
+	}
+	r.closeSession()
+}
+
+func limitNotice(reason string) string {
+	notices := config.Parental().Notices
+	if reason == parental.ReasonDailyLimit {
+		return notices.DailyLimit
+	}
+	return notices.Hours
+}
+
+// closeSession disconnects the device, or closes the handler alone when it
+// runs without a connection, as in replay.
+func (r *XiaozhiHandler) closeSession() {
+	if err := r.entry.Close(); errors.Is(err, registry.ErrNotSupported) {
+		_ = r.Close(r.ctx)
+	}
+}
@@ -2,36 +2,51 @@ package openai
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"net/http"
-	"strconv"
-	"time"
-
-	"github.com/samber/lo"
 
 	"github.com/gorilla/websocket"
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
 	"github.com/xdimtech/go-xiaozhi/pkg/config"
+	"github.com/xdimtech/go-xiaozhi/pkg/emotion"
 	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
 	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/tracing"
 	"github.com/xdimtech/go-xiaozhi/pkg/utils"
+	"github.com/xdimtech/go-xiaozhi/pkg/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (w *XiaozhiHandler) InitProxy(ctx context.Context) error {
 	headers := http.Header{}
 	headers.Add("Authorization", "Bearer "+config.OpenAIConfig().APIKey)
 	wsUrl := config.OpenAIConfig().BaseURL + "?model=" + config.OpenAIConfig().Model
-	conn, _, err := websocket.DefaultDialer.Dial(wsUrl, headers)
+	_, span := tracing.Tracer().Start(ctx, tracing.SpanDial,
+		trace.WithAttributes(attribute.String("model", config.OpenAIConfig().Model)))
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsUrl, headers)
 	if err != nil {
-		fmt.Errorf("connect to step openai api failed, err: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "dial failed")
+		span.End()
+		w.log.Error("connect to realtime api failed", "url", wsUrl, "err", err)
 		return err
 	}
+	span.End()
+	w.log.Info("realtime api connected", "url", wsUrl)
 
 	w.apiConn = conn
 	go func() {
 		for {
 			msgType, message, err := conn.ReadMessage()
 			if err != nil {
-				fmt.Errorf("read message from openai api failed, err: %v", err)
+				if !w.closed.Load() {
+					w.log.Warn("read message from realtime api failed", "err", err)
+				}
+				// 断开后后续发送直接报错，而不是写入已失效的连接
+				w.closeRealtimeAPI()
 				return
 			}
 			_ = w.handleRealtimeApiEvent(msgType, message)
@@ -43,35 +58,46 @@ func (w *XiaozhiHandler) InitProxy(ctx context.Context) error {
 
 func (w *XiaozhiHandler) SendToRealtimeAPI(event openai.ClientEvent) error {
 	if event == nil {
-		fmt.Errorf("send to openai api event is nil")
+		w.log.Warn("send nil event to realtime api")
 		return nil
 	}
 
-	switch event.ClientEventType() {
-	case openai.ClientEventTypeSessionUpdate,
-		openai.ClientEventTypeInputAudioBufferAppend,
-		openai.ClientEventTypeInputAudioBufferCommit:
+	switch ev := event.(type) {
+	case *openai.InputAudioBufferAppendEvent:
+		w.logAudio("audio to realtime api", "bytes", len(ev.Audio))
 	default:
-
+		w.log.Debug("event to realtime api", "type", event.ClientEventType(), "event", event)
+	}
+	w.recordApiRequest(event)
+	w.apiMu.Lock()
+	defer w.apiMu.Unlock()
+	if w.apiConn == nil {
+		return errors.New("realtime api closed")
 	}
 	return w.apiConn.WriteJSON(event)
 }
 
+// logServerEvent logs an event from the realtime api at debug level, audio
+// deltas sampled.
 func (w *XiaozhiHandler) logServerEvent(event openai.ServerEvent) {
-	switch event.ServerEventType() {
-	case openai.ServerEventTypeResponseAudioDelta,
-		openai.ServerEventTypeResponseAudioDone:
+	switch ev := event.(type) {
+	case *openai.ResponseAudioDeltaEvent:
+		w.logAudio("audio from realtime api", "response_id", ev.ResponseID, "bytes", len(ev.Delta))
 	default:
+		w.log.Debug("event from realtime api", "type", event.ServerEventType(), "event", event)
 	}
 }
 
 func (w *XiaozhiHandler) handleRealtimeApiEvent(messageType int, p []byte) error {
 	event, err := openai.UnmarshalServerEvent(p)
 	if err != nil {
-		fmt.Errorf("unmarshal server event failed, err: %v", err)
+		w.log.Warn("unmarshal realtime api event failed", "err", err)
 		return err
 	}
 	w.logServerEvent(event)
+	w.recordApiEvent(event, p)
+	w.downMu.Lock()
+	defer w.downMu.Unlock()
 	var ev xiaozhi.ServerEvent = nil
 	switch event.ServerEventType() {
 	case openai.ServerEventTypeError:
@@ -92,8 +118,12 @@ func (w *XiaozhiHandler) handleRealtimeApiEvent(messageType int, p []byte) error
 		ev, err = w.handleResponseCreated(w.ctx, event)
 	case openai.ServerEventTypeResponseContentPartAdded:
 		ev, err = w.handleContentPartAdded(w.ctx, event)
+	case openai.ServerEventTypeConversationItemInputAudioTranscriptionDelta:
+		ev, err = w.handleAsrDelta(w.ctx, event)
 	case openai.ServerEventTypeConversationItemInputAudioTranscriptionCompleted:
 		ev, err = w.handleAsrDone(w.ctx, event)
+	case openai.ServerEventTypeConversationItemInputAudioTranscriptionFailed:
+		ev, err = w.handleAsrFailed(w.ctx, event)
 	case openai.ServerEventTypeResponseAudioTranscriptDelta:
 		ev, err = w.handleResponseAudioTranscriptDelta(w.ctx, event)
 	case openai.ServerEventTypeResponseAudioTranscriptDone:
@@ -104,12 +134,16 @@ func (w *XiaozhiHandler) handleRealtimeApiEvent(messageType int, p []byte) error
 		ev, err = w.handleAudioDone(w.ctx, event)
 	case openai.ServerEventTypeResponseContentPartDone:
 		ev, err = w.handleContentPartDone(w.ctx, event)
+	case openai.ServerEventTypeResponseCancelled:
+		ev, err = w.handleResponseCancelled(w.ctx, event)
 	case openai.ServerEventTypeResponseDone:
 		ev, err = w.handleResponseDone(w.ctx, event)
 	case openai.ServerEventTypeResponseOutputItemDone:
 		ev, err = w.handleResponseOutputItemDone(w.ctx, event)
 	case openai.ServerEventTypeConversationItemCreated:
 		ev, err = w.handleConversationItemCreated(w.ctx, event)
+	case openai.ServerEventTypeResponseFunctionCallArgumentsDone:
+		ev, err = w.handleFunctionCallArgumentsDone(w.ctx, event)
 	}
 
 	if ev != nil {
@@ -119,12 +153,14 @@ func (w *XiaozhiHandler) handleRealtimeApiEvent(messageType int, p []byte) error
 }
 
 func (w *XiaozhiHandler) closeRealtimeAPI() {
+	w.apiMu.Lock()
+	defer w.apiMu.Unlock()
 	if w.apiConn == nil {
 		return
 	}
 	err := w.apiConn.Close()
 	if err != nil {
-		fmt.Errorf("close session fail, err: %v", err)
+		w.log.Debug("close realtime api failed", "err", err)
 	}
 	w.apiConn = nil
 }
@@ -134,6 +170,20 @@ func (w *XiaozhiHandler) handleServerError(
 
 	_ev := event.(*openai.ErrorEvent)
 	msg := utils.MustToJSON(_ev.Error)
+	w.log.Warn("realtime api error", "error", msg)
+	w.turns.Error(errors.New(msg))
+	// 网关发出的 response.create 被拒绝时不会有 response.done，在此结束回复；
+	// 错误未带 event_id 时，按尚未创建回复处理
+	if id, _ := w.pendingCreate.Load().(string); id != "" && (_ev.Error.EventID == id || _ev.Error.EventID == "") &&
+		w.pendingCreate.CompareAndSwap(id, "") {
+		w.responding.Store(false)
+		_ = w.WriteRespEvent(ctx, w.ttsEvent(xiaozhi.ServerTTSStateStop, ""))
+		w.entry.SetState(registry.StateIdle)
+	}
+	// 回复进行中的错误随 response.done 结束该轮，否则该轮到此为止
+	if !w.responding.Load() {
+		w.turns.End("failed")
+	}
 	return &xiaozhi.ServerEventError{
 		ServerEventBase: xiaozhi.ServerEventBase{
 			Type:      xiaozhi.ServerEventTypeError,
@@ -147,6 +197,12 @@ func (w *XiaozhiHandler) handleSessionCreateOrUpdate(ctx context.Context,
 	event openai.ServerEvent, update bool) (xiaozhi.ServerEvent, error) {
 	if update {
 		w.sess.Update(&event.(*openai.SessionUpdatedEvent).Session)
+		// 只有首次 session.updated 回复设备 hello，后续更新（如注册工具）不再回复
+		if !w.helloSent.CompareAndSwap(false, true) {
+			return nil, nil
+		}
+		w.entry.SetState(registry.StateIdle)
+		go w.initTools()
 		return &xiaozhi.ServerEventHello{
 			ServerEventBase: xiaozhi.ServerEventBase{
 				Type:      xiaozhi.ServerEventTypeHello,
@@ -154,10 +210,10 @@ func (w *XiaozhiHandler) handleSessionCreateOrUpdate(ctx context.Context,
 			},
 			Transport: config.Xiaozhi().Transport,
 			AudioParams: xiaozhi.AudioParams{
-				Format:        w.sess.CliConfig.Format,
-				SampleRate:    24000,
-				Channels:      1,
-				FrameDuration: 60,
+				Format:        w.sess.DownConfig.Format,
+				SampleRate:    w.sess.DownConfig.SampleRate,
+				Channels:      w.sess.DownConfig.Channels,
+				FrameDuration: w.sess.DownConfig.FrameDuration,
 			},
 		}, nil
 	}
@@ -167,13 +223,43 @@ func (w *XiaozhiHandler) handleSessionCreateOrUpdate(ctx context.Context,
 
 func (w *XiaozhiHandler) handleInputAudioBufferCommitted(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
+	w.turns.Ensure("voice")
+	w.turns.Mark(turnCommitted)
+	return w.ttsStartEvent(), nil
+}
+
+// ttsStartEvent starts a new reply. Subtitles of the previous reply that are
+// still waiting for playback are dropped, otherwise its delayed tts stop
+// would end the new one on the device.
+func (w *XiaozhiHandler) ttsStartEvent() *xiaozhi.ServerEventTTS {
+	w.subtitles.Drop()
+	w.entry.SetState(registry.StateSpeaking)
+	ev := w.ttsEvent(xiaozhi.ServerTTSStateStart, "")
+	ev.SampleRate = w.sess.DownConfig.SampleRate
+	return ev
+}
+
+// llmEvent shows the emotion of the reply on the device.
+func (w *XiaozhiHandler) llmEvent(em emotion.Emotion) *xiaozhi.ServerEventLLM {
+	return &xiaozhi.ServerEventLLM{
+		ServerEventBase: xiaozhi.ServerEventBase{
+			Type:      xiaozhi.ServerEventTypeLLM,
+			SessionId: w.GetSessionId(),
+		},
+		Text:    em.Emoji,
+		Emotion: em.Name,
+	}
+}
+
+func (w *XiaozhiHandler) ttsEvent(state xiaozhi.ServerTTSState, text string) *xiaozhi.ServerEventTTS {
 	return &xiaozhi.ServerEventTTS{
 		ServerEventBase: xiaozhi.ServerEventBase{
 			Type:      xiaozhi.ServerEventTypeTTS,
 			SessionId: w.GetSessionId(),
 		},
-		State: xiaozhi.ServerTTSStateStart,
-	}, nil
+		State: state,
+		Text:  text,
+	}
 }
 
 func (w *XiaozhiHandler) handleInputAudioBufferCleared(
@@ -183,41 +269,77 @@ func (w *XiaozhiHandler) handleInputAudioBufferCleared(
 
 func (w *XiaozhiHandler) handleInputAudioBufferSpeechStarted(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
+	w.entry.SetState(registry.StateListening)
+	w.userSpeaking.Store(true)
+	w.interruptPush()
+	// 用户开口即开始新的一轮，进行中的回复会被打断
+	w.turns.Begin("voice")
+	w.turns.Mark(turnSpeechStarted)
 	return nil, nil
 }
 
 func (w *XiaozhiHandler) handleInputAudioBufferSpeechStopped(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
+	w.userSpeaking.Store(false)
+	w.turns.Mark(turnSpeechStopped)
 	return nil, nil
 }
 
 func (w *XiaozhiHandler) handleResponseCreated(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
+	w.responding.Store(true)
+	w.pendingCreate.Store("")
+	// 主动播报等没有用户输入的回复也算一轮
+	_event := event.(*openai.ResponseCreatedEvent)
+	w.turns.Respond(_event.Response.ID)
+	w.guard.Created(_event.Response.ID)
 	return nil, nil
 }
 
+// handleAsrDelta forwards partial transcripts, each stt event carrying the
+// text recognized so far.
+func (w *XiaozhiHandler) handleAsrDelta(
+	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
+	_event := event.(*openai.ConversationItemInputAudioTranscriptionDeltaEvent)
+	text := w.userTranscripts[_event.ItemID] + _event.Delta
+	w.userTranscripts[_event.ItemID] = text
+	return w.sttEvent(text), nil
+}
+
 func (w *XiaozhiHandler) handleAsrDone(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
 	_event := event.(*openai.ConversationItemInputAudioTranscriptionCompletedEvent)
-	sttEvent := &xiaozhi.ServerEventSTT{
-		ServerEventBase: xiaozhi.ServerEventBase{
-			Type:      xiaozhi.ServerEventTypeSTT,
-			SessionId: w.GetSessionId(),
-		},
-		Text: _event.Transcript,
+	delete(w.userTranscripts, _event.ItemID)
+	w.turns.Mark(turnTranscript, attribute.Int("transcript.chars", len([]rune(_event.Transcript))))
+	w.emit(webhook.TypeUserTranscript, webhook.Transcript{
+		ItemID: _event.ItemID, Source: "voice", Text: _event.Transcript,
+	})
+	w.guard.Input(_event.ItemID, _event.Transcript, false)
+	return w.sttEvent(_event.Transcript), nil
+}
+
+// handleAsrFailed shows the fallback text so the device does not keep the
+// partial transcript, or nothing, as if it had not been heard.
+func (w *XiaozhiHandler) handleAsrFailed(
+	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
+	_event := event.(*openai.ConversationItemInputAudioTranscriptionFailedEvent)
+	delete(w.userTranscripts, _event.ItemID)
+	w.log.Warn("input audio transcription failed", "item_id", _event.ItemID, "error", utils.MustToJSON(_event.Error))
+	fallback := w.sess.Persona.Transcription.FallbackText
+	if fallback == "" {
+		return nil, nil
 	}
-	_ = w.WriteRespEvent(w.ctx, sttEvent)
+	return w.sttEvent(fallback), nil
+}
 
-	llmEvent := &xiaozhi.ServerEventLLM{
+func (w *XiaozhiHandler) sttEvent(text string) *xiaozhi.ServerEventSTT {
+	return &xiaozhi.ServerEventSTT{
 		ServerEventBase: xiaozhi.ServerEventBase{
-			Type:      xiaozhi.ServerEventTypeLLM,
+			Type:      xiaozhi.ServerEventTypeSTT,
 			SessionId: w.GetSessionId(),
 		},
-		Text:    strconv.Itoa('😊'),
-		Emotion: "happy",
+		Text: text,
 	}
-	_ = w.WriteRespEvent(w.ctx, llmEvent)
-	return nil, nil
 }
 
 func (w *XiaozhiHandler) handleContentPartAdded(
@@ -227,31 +349,75 @@ func (w *XiaozhiHandler) handleContentPartAdded(
 
 func (w *XiaozhiHandler) handleContentPartDone(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
+	// sentence_end 由字幕按句下发
+	return nil, nil
+}
 
-	_event := event.(*openai.ResponseContentPartDoneEvent)
-	return &xiaozhi.ServerEventTTS{
-		ServerEventBase: xiaozhi.ServerEventBase{
-			Type:      xiaozhi.ServerEventTypeTTS,
-			SessionId: w.GetSessionId(),
-		},
-		State: xiaozhi.ServerTTSStateSentenceEnd,
-		Text:  lo.FromPtr(_event.Part.Transcript),
-	}, nil
+func (w *XiaozhiHandler) handleResponseCancelled(
+	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
+	if w.audioConverter != nil {
+		w.audioConverter.Reset()
+	}
+	w.subtitles.Reset()
+	return nil, nil
 }
 
 func (w *XiaozhiHandler) handleResponseDone(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
-	if w.getWait() > 0 {
-		time.Sleep(time.Duration(w.getWait()) * time.Millisecond)
+	_event := event.(*openai.ResponseDoneEvent)
+	if usage := _event.Response.Usage; usage != nil {
+		w.entry.AddUsage(usage.InputTokens, usage.OutputTokens)
+		w.emit(webhook.TypeUsage, webhook.Usage{
+			ResponseID:   _event.Response.ID,
+			Status:       string(_event.Response.Status),
+			InputTokens:  usage.InputTokens,
+			OutputTokens: usage.OutputTokens,
+		})
 	}
+	if _event.Response.Status == openai.ResponseStatusCancelled {
+		if w.audioConverter != nil {
+			w.audioConverter.Reset()
+		}
+		w.subtitles.Reset()
+		// 被打断时立即结束，不等待已下发音频播完
+		w.resetFrameTs()
+	} else if err := w.guard.Flush(_event.Response.ID); err != nil {
+		// 没有转写结束事件的回复，暂存的输出在这里下发
+		w.log.Warn("send held reply output failed", "err", err)
+	}
+	// tts stop 在音频播完时随字幕一起下发
+	w.subtitles.Stop(w.ttsEvent(xiaozhi.ServerTTSStateStop, ""))
+	w.entry.SetState(registry.StateIdle)
 	w.resetFrameTs()
-	return &xiaozhi.ServerEventTTS{
-		ServerEventBase: xiaozhi.ServerEventBase{
-			Type:      xiaozhi.ServerEventTypeTTS,
-			SessionId: w.GetSessionId(),
-		},
-		State: xiaozhi.ServerTTSStateStop,
-	}, nil
+	w.responding.Store(false)
+	w.endTurn(&_event.Response)
+	w.calls.responseDone(_event.Response.ID, _event.Response.Status == openai.ResponseStatusCancelled)
+	w.continueTools()
+	w.replyToPendingText(ctx)
+	item, _ := lo.Find(_event.Response.Output, func(item openai.ResponseMessageItem) bool {
+		return item.Type == openai.MessageItemTypeMessage
+	})
+	w.guard.Done(_event.Response.ID, item.ID)
+	return nil, nil
+}
+
+// endTurn ends the turn with its response, unless the response called tools
+// and the model goes on with another one.
+func (w *XiaozhiHandler) endTurn(resp *openai.Response) {
+	calls := lo.CountBy(resp.Output, func(item openai.ResponseMessageItem) bool {
+		return item.Type == openai.MessageItemTypeFunctionCall
+	})
+	// 工具调用后模型会继续回复，该轮在后续回复结束时结束
+	if calls > 0 && resp.Status == openai.ResponseStatusCompleted {
+		w.turns.Mark(turnToolDone, attribute.Int("tool.calls", calls))
+		return
+	}
+	var attrs []attribute.KeyValue
+	if usage := resp.Usage; usage != nil {
+		attrs = append(attrs, attribute.Int("usage.input_tokens", usage.InputTokens),
+			attribute.Int("usage.output_tokens", usage.OutputTokens))
+	}
+	w.turns.Done(resp.ID, string(resp.Status), attrs...)
 }
 
 func (w *XiaozhiHandler) handleResponseOutputItemDone(
@@ -266,35 +432,75 @@ func (w *XiaozhiHandler) handleConversationItemCreated(
 
 func (w *XiaozhiHandler) handleResponseAudioTranscriptDelta(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
-	return nil, nil
+	_event := event.(*openai.ResponseAudioTranscriptDeltaEvent)
+	// 命中审核的回复已取消，剩余字幕不再下发
+	if w.guard.Delta(_event.ResponseID, _event.ItemID, _event.Delta) {
+		return nil, nil
+	}
+	return nil, w.guard.Output(_event.ResponseID, func() error {
+		w.subtitles.Delta(_event.Delta)
+		return nil
+	})
 }
 
 func (w *XiaozhiHandler) handleResponseAudioTranscriptDone(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
 	_event := event.(*openai.ResponseAudioTranscriptDoneEvent)
-	return &xiaozhi.ServerEventTTS{
-		ServerEventBase: xiaozhi.ServerEventBase{
-			Type:      xiaozhi.ServerEventTypeTTS,
-			SessionId: w.GetSessionId(),
-		},
-		State: xiaozhi.ServerTTSStateSentenceStart,
-		Text:  _event.Transcript,
-	}, nil
+	if w.guard.Blocked(_event.ResponseID) {
+		return nil, nil
+	}
+	if err := w.guard.Flush(_event.ResponseID); err != nil {
+		return nil, err
+	}
+	w.subtitles.Finish()
+	w.emit(webhook.TypeAssistantTranscript, webhook.Transcript{
+		ItemID: _event.ItemID, ResponseID: _event.ResponseID, Text: _event.Transcript,
+	})
+	return nil, nil
 }
 
 func (w *XiaozhiHandler) handleAudioDelta(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
 	_event := event.(*openai.ResponseAudioDeltaEvent)
+	if w.guard.Blocked(_event.ResponseID) {
+		return nil, nil
+	}
+	return nil, w.guard.Output(_event.ResponseID, func() error {
+		return w.encodeAudio(_event.Delta)
+	})
+}
+
+func (w *XiaozhiHandler) encodeAudio(delta string) error {
 	w.setFrameTs()
-	err := w.audioConverter.ResolvePCM(_event.Delta)
+	w.turns.FirstAudio()
+	_, span := tracing.Tracer().Start(w.turns.Context(), tracing.SpanOpusEncode,
+		trace.WithAttributes(attribute.Int("pcm.base64_bytes", len(delta))))
+	err := w.audioConverter.ResolvePCM(delta)
+	endSpan(span, err)
 	if err != nil {
-		fmt.Errorf("pcm base64 to opus failed, err: %v", err)
-		return nil, err
+		w.log.Error("pcm base64 to opus failed", "err", err)
+		return err
 	}
-	return nil, nil
+	return nil
 }
 
 func (w *XiaozhiHandler) handleAudioDone(
 	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
-	return nil, nil
+	_event := event.(*openai.ResponseAudioDoneEvent)
+	if w.guard.Blocked(_event.ResponseID) {
+		return nil, nil
+	}
+	return nil, w.guard.Output(_event.ResponseID, w.flushAudio)
+}
+
+func (w *XiaozhiHandler) flushAudio() error {
+	_, span := tracing.Tracer().Start(w.turns.Context(), tracing.SpanOpusEncode,
+		trace.WithAttributes(attribute.Bool("flush", true)))
+	err := w.audioConverter.Flush()
+	endSpan(span, err)
+	if err != nil {
+		w.log.Error("flush opus tail failed", "err", err)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,289 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
+	"github.com/xdimtech/go-xiaozhi/pkg/audio"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/utils"
+)
+
+const (
+	// 每个设备最多排队的主动播报
+	pushQueueSize = 16
+	// 设备对话中时，每隔该时间检查一次是否空闲
+	pushPollInterval = 200 * time.Millisecond
+	// 主动播报时追加在会话指令之后
+	defaultPushInstructions = "现在由你主动开口，把下面这条通知用自己的语气告诉用户，简短自然，不要提及这是系统消息。"
+	// 让模型原样说出安全回复、使用限制提醒等固定内容
+	verbatimInstructions = "请原样说出下面这句话，不要增减内容，也不要解释原因。"
+	// 主动播报的音频领先播放进度下发的时长
+	pushAudioLead = 500 * time.Millisecond
+)
+
+// Speak queues speech pushed by the backend. It is spoken once the device is
+// neither listening to the user nor playing a reply.
+func (r *XiaozhiHandler) Speak(speech registry.Speech) error {
+	if strings.TrimSpace(speech.Text) == "" && len(speech.PCM) == 0 {
+		return errors.New("text or audio is required")
+	}
+	if len(speech.PCM) > 0 && speech.SampleRate <= 0 {
+		return errors.New("invalid audio sample rate")
+	}
+	r.pushMu.Lock()
+	defer r.pushMu.Unlock()
+	if r.pushStopped || r.closed.Load() {
+		return registry.ErrSessionClosed
+	}
+	select {
+	case r.pushQueue <- speech:
+		return nil
+	default:
+		return errors.New("push queue is full")
+	}
+}
+
+// speakAndWait queues speech like Speak and returns a channel closed once it
+// has been spoken, or failed to.
+func (r *XiaozhiHandler) speakAndWait(speech registry.Speech) (<-chan struct{}, error) {
+	played := make(chan struct{})
+	speech.Played = func(error) { close(played) }
+	if err := r.Speak(speech); err != nil {
+		return nil, err
+	}
+	return played, nil
+}
+
+func (r *XiaozhiHandler) pushLoop(ctx context.Context) {
+	ticker := time.NewTicker(pushPollInterval)
+	defer ticker.Stop()
+	defer r.stopPush()
+	for {
+		var speech registry.Speech
+		select {
+		case <-ctx.Done():
+			return
+		case speech = <-r.pushQueue:
+		}
+		if !r.waitIdle(ctx, ticker) {
+			played(speech, registry.ErrSessionClosed)
+			return
+		}
+		var err error
+		if len(speech.PCM) > 0 {
+			err = r.pushAudio(ctx, speech)
+		} else {
+			err = r.pushText(ctx, speech)
+		}
+		if err != nil {
+			r.log.Warn("push speech failed", "err", err)
+		}
+		// pushText 返回时回复已开始，等设备再次空闲即播完
+		if err == nil && !r.waitIdle(ctx, ticker) {
+			played(speech, registry.ErrSessionClosed)
+			return
+		}
+		played(speech, err)
+	}
+}
+
+// stopPush refuses further speech and fails the speech still queued.
+func (r *XiaozhiHandler) stopPush() {
+	r.pushMu.Lock()
+	r.pushStopped = true
+	r.pushMu.Unlock()
+	for {
+		select {
+		case speech := <-r.pushQueue:
+			played(speech, registry.ErrSessionClosed)
+		default:
+			return
+		}
+	}
+}
+
+func played(speech registry.Speech, err error) {
+	if speech.Played != nil {
+		speech.Played(err)
+	}
+}
+
+// waitIdle polls until the device is idle, reporting false if ctx is done
+// first.
+func (r *XiaozhiHandler) waitIdle(ctx context.Context, ticker *time.Ticker) bool {
+	for !r.idle() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// idle reports whether pushed speech would not cut into the conversation.
+// A device in auto mode listens again right after a reply, so listening
+// counts as idle until the user actually starts talking.
+func (r *XiaozhiHandler) idle() bool {
+	return r.helloSent.Load() &&
+		r.entry.State() != registry.StateSpeaking &&
+		!r.userSpeaking.Load() &&
+		!r.responding.Load() &&
+		r.subtitles.Pending() == 0
+}
+
+// pushText adds the text as a system message and asks the model to say it.
+func (r *XiaozhiHandler) pushText(ctx context.Context, speech registry.Speech) error {
+	err := r.SendToRealtimeAPI(&openai.ConversationItemCreateEvent{
+		ClientEventBase: openai.ClientEventBase{
+			EventID: utils.UniqueID(),
+			Type:    openai.ClientEventTypeConversationItemCreate,
+		},
+		Item: openai.MessageItem{
+			Type: openai.MessageItemTypeMessage,
+			Role: openai.MessageRoleSystem,
+			Content: []openai.MessageContentPart{{
+				Type: openai.MessageContentTypeInputText,
+				Text: lo.ToPtr(strings.TrimSpace(speech.Text)),
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// 在 response.created 之前置位，避免下一条播报在回复开始前插入
+	r.responding.Store(true)
+	_ = r.WriteRespEvent(ctx, r.ttsStartEvent())
+	err = r.createResponse(openai.ResponseCreateParams{
+		Modalities: []openai.Modality{
+			openai.ModalityText,
+			openai.ModalityAudio,
+		},
+		Instructions: lo.ToPtr(r.pushInstructions(speech.Instructions)),
+	})
+	if err != nil {
+		r.responding.Store(false)
+		_ = r.WriteRespEvent(ctx, r.ttsEvent(xiaozhi.ServerTTSStateStop, ""))
+		r.entry.SetState(registry.StateIdle)
+	}
+	return err
+}
+
+// createResponse sends a response.create of the gateway, with responding
+// already set. Its event id is kept until response.created, so that an error
+// rejecting it ends the response that will never be created.
+func (r *XiaozhiHandler) createResponse(params openai.ResponseCreateParams) error {
+	id := utils.UniqueID()
+	r.pendingCreate.Store(id)
+	err := r.SendToRealtimeAPI(&openai.ResponseCreateEvent{
+		ClientEventBase: openai.ClientEventBase{
+			EventID: id,
+			Type:    openai.ClientEventTypeResponseCreate,
+		},
+		Response: params,
+	})
+	if err != nil {
+		r.pendingCreate.CompareAndSwap(id, "")
+	}
+	return err
+}
+
+// pushInstructions keeps the persona of the session, response instructions
+// replace the session ones for that response.
+func (r *XiaozhiHandler) pushInstructions(instructions string) string {
+	base := r.sess.Persona.SystemPrompt
+	if r.sess.RtSession != nil && r.sess.RtSession.Instructions != "" {
+		base = r.sess.RtSession.Instructions
+	}
+	return base + "\n\n" + lo.CoalesceOrEmpty(strings.TrimSpace(instructions), defaultPushInstructions)
+}
+
+// pushAudio plays the pcm as a reply, with the text if any as its subtitle.
+// The clip is encoded up front and its frames written at playback pace, each
+// under the downlink lock so model output cannot interleave with it while
+// upstream events are still handled in between. The user starting to speak
+// drops the frames not yet written.
+func (r *XiaozhiHandler) pushAudio(ctx context.Context, speech registry.Speech) error {
+	var frames [][]byte
+	// 录音音量已正常，不做模型输出那样的放大
+	converter := audio.NewConverter(r.sess.CliConfig.AudioParams(),
+		r.sess.DownConfig.AudioParams(), func(_ context.Context, data any) error {
+			frames = append(frames, data.([]byte))
+			return nil
+		},
+		audio.WithEncoderProfile(encoderProfile(r.sess.DeviceId, r.sess.Persona)),
+		audio.WithUpstream(audio.Upstream{
+			InputFormat:   audio.FormatPcm16,
+			OutputFormat:  audio.FormatPcm16,
+			PcmSampleRate: speech.SampleRate,
+		}),
+		audio.WithDownGain(1))
+	err := converter.EncodePCM(speech.PCM)
+	if err == nil {
+		err = converter.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	gen := r.pushGen.Load()
+	r.downMu.Lock()
+	err = r.WriteRespEvent(ctx, r.ttsStartEvent())
+	if err == nil {
+		r.setFrameTs()
+		if text := strings.TrimSpace(speech.Text); text != "" {
+			r.subtitles.Delta(text)
+		}
+	}
+	r.downMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	frameDuration := time.Duration(r.sess.DownConfig.FrameDuration) * time.Millisecond
+	start := time.Now()
+	interrupted := false
+	for i, frame := range frames {
+		// 保持设备端约 pushAudioLead 的缓冲，其余按播放进度下发
+		if wait := time.Until(start.Add(time.Duration(i)*frameDuration - pushAudioLead)); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		if interrupted = r.pushGen.Load() != gen; interrupted {
+			break
+		}
+		r.downMu.Lock()
+		err = r.WriteRespEvent(ctx, frame)
+		r.downMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	r.downMu.Lock()
+	defer r.downMu.Unlock()
+	if interrupted {
+		r.log.Info("pushed audio interrupted by the user")
+		r.subtitles.Reset()
+		_ = r.WriteRespEvent(ctx, r.ttsEvent(xiaozhi.ServerTTSStateStop, ""))
+	} else {
+		r.subtitles.Stop(r.ttsEvent(xiaozhi.ServerTTSStateStop, ""))
+		r.entry.SetState(registry.StateIdle)
+	}
+	r.resetFrameTs()
+	return nil
+}
+
+// interruptPush drops the pushed audio not yet written to the device.
+func (r *XiaozhiHandler) interruptPush() {
+	r.pushGen.Add(1)
+}
@@ -0,0 +1,64 @@
+package openai
+
+import (
+	"encoding/base64"
+
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/record"
+)
+
+// recordClientEvent records an event received from the device.
+func (r *XiaozhiHandler) recordClientEvent(event xiaozhi.ClientEvent) {
+	if r.rec == nil {
+		return
+	}
+	if ev, ok := event.(*xiaozhi.ClientEventAppendBuffer); ok {
+		if c := r.sess.CliConfig; c != nil {
+			r.rec.Uplink(ev.Bytes, c.SampleRate, c.Channels)
+		}
+		return
+	}
+	r.rec.Event(record.StreamXiaozhi, record.DirIn, string(event.ClientEventType()), event)
+}
+
+// recordServerEvent records an event or opus frame sent to the device.
+func (r *XiaozhiHandler) recordServerEvent(event any) {
+	if r.rec == nil {
+		return
+	}
+	switch ev := event.(type) {
+	case xiaozhi.ServerEvent:
+		r.rec.Event(record.StreamXiaozhi, record.DirOut, string(ev.GetType()), ev)
+	case *xiaozhi.ServerAudioFrame:
+		c := r.sess.DownConfig
+		r.rec.Downlink(ev.Payload, c.SampleRate, c.Channels)
+	}
+}
+
+// recordApiEvent records an event received from the realtime api. Audio is
+// only noted with its size, it is in the downlink recording once encoded.
+func (r *XiaozhiHandler) recordApiEvent(event openai.ServerEvent, raw []byte) {
+	if r.rec == nil {
+		return
+	}
+	if ev, ok := event.(*openai.ResponseAudioDeltaEvent); ok {
+		r.rec.Audio(record.StreamOpenAI, record.DirIn, string(ev.ServerEventType()),
+			base64.StdEncoding.DecodedLen(len(ev.Delta)))
+		return
+	}
+	r.rec.Event(record.StreamOpenAI, record.DirIn, string(event.ServerEventType()), raw)
+}
+
+// recordApiRequest records an event sent to the realtime api.
+func (r *XiaozhiHandler) recordApiRequest(event openai.ClientEvent) {
+	if r.rec == nil {
+		return
+	}
+	if ev, ok := event.(*openai.InputAudioBufferAppendEvent); ok {
+		r.rec.Audio(record.StreamOpenAI, record.DirOut, string(ev.ClientEventType()),
+			base64.StdEncoding.DecodedLen(len(ev.Audio)))
+		return
+	}
+	r.rec.Event(record.StreamOpenAI, record.DirOut, string(event.ClientEventType()), event)
+}
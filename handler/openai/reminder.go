@@ -0,0 +1,192 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
+	"github.com/xdimtech/go-xiaozhi/pkg/config"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
+	"github.com/xdimtech/go-xiaozhi/pkg/reminder"
+	"github.com/xdimtech/go-xiaozhi/pkg/utils"
+)
+
+const (
+	toolSetReminder    = "set_reminder"
+	toolListReminders  = "list_reminders"
+	toolCancelReminder = "cancel_reminder"
+
+	reminderTimeLayout = "2006-01-02 15:04"
+	// 提醒到点时的播报指令
+	reminderInstructions = "这是用户之前让你设置的提醒，现在到时间了。请用自然的语气提醒用户这件事，简短一些。"
+	missedInstructions   = "这是用户之前让你设置的提醒，提醒时间是 %s，当时设备不在线。请告诉用户错过了这个提醒，并提醒用户这件事，简短一些。"
+)
+
+// reminderTools lets the model set, list and cancel reminders of the device.
+// Wall clock times are in the timezone of the device.
+type reminderTools struct {
+	scheduler *reminder.Scheduler
+	deviceId  string
+	loc       *time.Location
+	now       func() time.Time
+}
+
+func newReminderTools(scheduler *reminder.Scheduler, deviceId string) *reminderTools {
+	return &reminderTools{
+		scheduler: scheduler,
+		deviceId:  deviceId,
+		loc:       config.ReminderLocation(deviceId),
+		now:       time.Now,
+	}
+}
+
+func (t *reminderTools) Tools() []openai.Tool {
+	return []openai.Tool{
+		{
+			Type:        openai.ToolTypeFunction,
+			Name:        toolSetReminder,
+			Description: "设置提醒，到时间后会主动提醒用户。in_minutes 与 at 二选一。",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"text": map[string]any{
+						"type":        "string",
+						"description": "提醒的内容，如：喝水",
+					},
+					"in_minutes": map[string]any{
+						"type":        "number",
+						"description": "多少分钟后提醒",
+					},
+					"at": map[string]any{
+						"type":        "string",
+						"description": "提醒时间，格式为 HH:MM 或 YYYY-MM-DD HH:MM，只给时分时取最近的该时刻",
+					},
+				},
+				"required": []string{"text"},
+			},
+		},
+		{
+			Type:        openai.ToolTypeFunction,
+			Name:        toolListReminders,
+			Description: "查看用户设置的所有提醒",
+			Parameters:  map[string]any{"type": "object", "properties": map[string]any{}},
+		},
+		{
+			Type:        openai.ToolTypeFunction,
+			Name:        toolCancelReminder,
+			Description: "取消一个提醒，id 由 list_reminders 或 set_reminder 返回",
+			Parameters: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"id": map[string]any{"type": "integer"},
+				},
+				"required": []string{"id"},
+			},
+		},
+	}
+}
+
+type setReminderArgs struct {
+	Text      string   `json:"text"`
+	InMinutes *float64 `json:"in_minutes"`
+	At        string   `json:"at"`
+}
+
+type reminderView struct {
+	ID   int64  `json:"id"`
+	Text string `json:"text"`
+	Time string `json:"time"`
+}
+
+func (t *reminderTools) view(r reminder.Reminder) reminderView {
+	return reminderView{ID: r.ID, Text: r.Text, Time: r.DueAt.In(t.loc).Format(reminderTimeLayout)}
+}
+
+func (t *reminderTools) Call(ctx context.Context, name, arguments string) (string, error) {
+	switch name {
+	case toolSetReminder:
+		var args setReminderArgs
+		if err := json.Unmarshal([]byte(lo.CoalesceOrEmpty(arguments, "{}")), &args); err != nil {
+			return "", err
+		}
+		due, err := t.dueTime(args)
+		if err != nil {
+			return "", err
+		}
+		r, err := t.scheduler.Add(t.deviceId, args.Text, due)
+		if err != nil {
+			return "", err
+		}
+		return utils.MustToJSON(map[string]any{
+			"reminder": t.view(r),
+			"now":      t.now().In(t.loc).Format(reminderTimeLayout),
+		}), nil
+	case toolListReminders:
+		return utils.MustToJSON(map[string]any{
+			"reminders": lo.Map(t.scheduler.List(t.deviceId), func(r reminder.Reminder, _ int) reminderView {
+				return t.view(r)
+			}),
+			"now": t.now().In(t.loc).Format(reminderTimeLayout),
+		}), nil
+	case toolCancelReminder:
+		var args struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(lo.CoalesceOrEmpty(arguments, "{}")), &args); err != nil {
+			return "", err
+		}
+		if err := t.scheduler.Cancel(t.deviceId, args.ID); err != nil {
+			return "", err
+		}
+		return `{"cancelled":true}`, nil
+	}
+	return "", fmt.Errorf("unknown reminder tool: %s", name)
+}
+
+// dueTime resolves the relative or wall clock time of a reminder.
+func (t *reminderTools) dueTime(args setReminderArgs) (time.Time, error) {
+	now := t.now().In(t.loc)
+	if args.InMinutes != nil {
+		if *args.InMinutes <= 0 {
+			return time.Time{}, errors.New("in_minutes must be positive")
+		}
+		return now.Add(time.Duration(*args.InMinutes * float64(time.Minute))), nil
+	}
+	at := strings.TrimSpace(args.At)
+	if at == "" {
+		return time.Time{}, errors.New("in_minutes or at is required")
+	}
+	if due, err := time.ParseInLocation(reminderTimeLayout, at, now.Location()); err == nil {
+		if !due.After(now) {
+			return time.Time{}, errors.New("reminder time has passed")
+		}
+		return due, nil
+	}
+	clock, err := time.ParseInLocation("15:04", at, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, want HH:MM or YYYY-MM-DD HH:MM", at)
+	}
+	due := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if !due.After(now) {
+		due = due.AddDate(0, 0, 1)
+	}
+	return due, nil
+}
+
+// ReminderSpeech is the speech of a due reminder.
+func ReminderSpeech(r reminder.Reminder) registry.Speech {
+	instructions := reminderInstructions
+	if r.Missed {
+		due := r.DueAt.In(config.ReminderLocation(r.DeviceId))
+		instructions = fmt.Sprintf(missedInstructions, due.Format(reminderTimeLayout))
+	}
+	return registry.Speech{
+		Text:         "提醒：" + r.Text,
+		Instructions: instructions,
+	}
+}
@@ -3,6 +3,8 @@ package openai
 import (
 	"context"
 
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/pkg/audio"
 	"github.com/xdimtech/go-xiaozhi/pkg/config"
 	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
 )
@@ -15,24 +17,111 @@ type ClientConfig struct {
 	FrameSize     int
 }
 
+func (c *ClientConfig) AudioParams() audio.Params {
+	return audio.Params{
+		SampleRate:    c.SampleRate,
+		Channels:      c.Channels,
+		FrameDuration: c.FrameDuration,
+	}
+}
+
+// negotiateDownConfig picks the params of the opus stream sent to the device.
+// Per-device config wins over the params the device announced in its hello,
+// which win over the global xiaozhi config. Unset or invalid values fall
+// through to the next source.
+func negotiateDownConfig(up *ClientConfig, deviceId string) *ClientConfig {
+	global := config.Xiaozhi()
+	device := global.Device(deviceId)
+	down := &ClientConfig{
+		Format: up.Format,
+		SampleRate: firstValid(audio.IsOpusSampleRate, audio.DeviceOpusRate24k,
+			device.SampleRate, up.SampleRate, global.SampleRate),
+		Channels: firstValid(func(n int) bool { return n == 1 || n == 2 }, 1,
+			device.Channels, up.Channels, global.Channels),
+		FrameDuration: firstValid(audio.IsOpusFrameDuration, audio.DefaultFrameDuration,
+			device.FrameDuration, up.FrameDuration, global.FrameDuration),
+	}
+	down.FrameSize = down.AudioParams().FrameSize()
+	return down
+}
+
+// firstValid returns the first of values that valid accepts, or fallback.
+func firstValid(valid func(int) bool, fallback int, values ...int) int {
+	if v, ok := lo.Find(values, valid); ok {
+		return v
+	}
+	return fallback
+}
+
+// encoderProfile resolves the downlink opus profile: the device's profile wins
+// over the persona's, which wins over the default one.
+func encoderProfile(deviceId string, persona config.PersonaConf) audio.EncoderProfile {
+	name := lo.CoalesceOrEmpty(config.Xiaozhi().Device(deviceId).OpusProfile, persona.OpusProfile)
+	p := config.OpusProfile(name)
+	return audio.EncoderProfile{
+		Application: p.Application,
+		Bitrate:     p.Bitrate,
+		Complexity:  p.Complexity,
+		DTX:         p.DTX,
+		FEC:         p.FEC,
+		PacketLoss:  p.PacketLoss,
+		Adaptive:    p.Adaptive,
+	}
+}
+
+// upstreamAudio returns the audio formats configured for the realtime provider.
+func upstreamAudio() audio.Upstream {
+	c := config.OpenAIConfig()
+	return audio.Upstream{
+		InputFormat:   lo.CoalesceOrEmpty(c.InputAudioFormat, audio.FormatPcm16),
+		OutputFormat:  lo.CoalesceOrEmpty(c.OutputAudioFormat, audio.FormatPcm16),
+		PcmSampleRate: lo.CoalesceOrEmpty(c.PcmSampleRate, audio.DefaultUpPcmSR),
+	}
+}
+
+// inputTranscription returns the transcription settings of the session, or
+// nil to keep the provider default.
+func inputTranscription(c config.TranscriptionConf) *openai.InputAudioTranscription {
+	if c.Model == "" && c.Language == "" && c.Prompt == "" {
+		return nil
+	}
+	return &openai.InputAudioTranscription{
+		Model:    c.Model,
+		Language: c.Language,
+		Prompt:   c.Prompt,
+	}
+}
+
 type ApiSession struct {
-	ctx          context.Context
-	cancel       context.CancelFunc
-	CliConfig    *ClientConfig
-	defaultVoice string
-	modelId      string
-	ID           string
-	Object       string
-	RtSession    *openai.ServerSession
+	ctx        context.Context
+	cancel     context.CancelFunc
+	CliConfig  *ClientConfig
+	DownConfig *ClientConfig
+	DeviceId   string
+	ClientId   string
+	// 二进制帧协议版本，来自握手请求头 Protocol-Version
+	ProtocolVersion int
+	Persona         config.PersonaConf
+	Upstream        audio.Upstream
+	defaultVoice    string
+	modelId         string
+	ID              string
+	Object          string
+	RtSession       *openai.ServerSession
 }
 
-func NewApiSession(ctx context.Context, modelId string) *ApiSession {
+func NewApiSession(ctx context.Context, modelId string, deviceId, clientId string) *ApiSession {
 	ctx, cancel := context.WithCancel(ctx)
+	persona := config.Persona(config.Xiaozhi().Device(deviceId).Persona)
 	return &ApiSession{
 		ctx:          ctx,
 		cancel:       cancel,
 		modelId:      modelId,
-		defaultVoice: config.OpenAIConfig().Voice,
+		DeviceId:     deviceId,
+		ClientId:     clientId,
+		Persona:      persona,
+		Upstream:     upstreamAudio(),
+		defaultVoice: persona.Voice,
 		Object:       openai.ObjectRealtimeSession,
 	}
 }
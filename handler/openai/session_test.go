@@ -0,0 +1,142 @@
+package openai
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/pkg/config"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/reminder"
+)
+
+func TestNegotiateDownConfig(t *testing.T) {
+	global := *config.Xiaozhi()
+	t.Cleanup(func() { *config.Xiaozhi() = global })
+	config.Xiaozhi().SampleRate = 24000
+	config.Xiaozhi().Channels = 1
+	config.Xiaozhi().FrameDuration = 60
+	config.Xiaozhi().Devices = map[string]config.XiaozhiDeviceConf{
+		testDeviceId:        {SampleRate: 16000, FrameDuration: 20},
+		"11:22:33:44:55:66": {SampleRate: 44100, Channels: 3, FrameDuration: 25},
+	}
+
+	tests := []struct {
+		name     string
+		deviceId string
+		hello    ClientConfig
+		want     ClientConfig
+	}{
+		{
+			name:  "hello only",
+			hello: ClientConfig{SampleRate: 16000, Channels: 2, FrameDuration: 20},
+			want:  ClientConfig{SampleRate: 16000, Channels: 2, FrameDuration: 20},
+		},
+		{
+			name: "global",
+			want: ClientConfig{SampleRate: 24000, Channels: 1, FrameDuration: 60},
+		},
+		{
+			name:     "device override",
+			deviceId: testDeviceId,
+			hello:    ClientConfig{SampleRate: 48000, Channels: 2, FrameDuration: 60},
+			want:     ClientConfig{SampleRate: 16000, Channels: 2, FrameDuration: 20},
+		},
+		{
+			name:  "invalid hello",
+			hello: ClientConfig{SampleRate: 44100, Channels: 6, FrameDuration: 30},
+			want:  ClientConfig{SampleRate: 24000, Channels: 1, FrameDuration: 60},
+		},
+		{
+			name:     "invalid device",
+			deviceId: "11:22:33:44:55:66",
+			hello:    ClientConfig{SampleRate: 8000, FrameDuration: 40},
+			want:     ClientConfig{SampleRate: 8000, Channels: 1, FrameDuration: 40},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.hello.Format = "opus"
+			down := negotiateDownConfig(&tt.hello, tt.deviceId)
+			tt.want.Format = "opus"
+			tt.want.FrameSize = tt.want.AudioParams().FrameSize()
+			if *down != tt.want {
+				t.Errorf("down = %+v, want %+v", *down, tt.want)
+			}
+		})
+	}
+}
+
+func TestInputTranscription(t *testing.T) {
+	tests := []struct {
+		conf config.TranscriptionConf
+		want string
+	}{
+		{config.TranscriptionConf{FallbackText: "（没听清）"}, `null`},
+		{config.TranscriptionConf{Language: "zh"}, `{"language":"zh"}`},
+		{config.TranscriptionConf{Prompt: "小智"}, `{"prompt":"小智"}`},
+		{config.TranscriptionConf{Model: "whisper-1", Language: "en"}, `{"model":"whisper-1","language":"en"}`},
+	}
+	for _, tt := range tests {
+		data, _ := json.Marshal(inputTranscription(tt.conf))
+		if string(data) != tt.want {
+			t.Errorf("inputTranscription(%+v) = %s, want %s", tt.conf, data, tt.want)
+		}
+	}
+}
+
+func TestMcpFunctionNames(t *testing.T) {
+	c := newMcpClient(nil, slog.Default(), []string{toolSetReminder})
+	long := strings.Repeat("x", 70)
+	c.setTools([]xiaozhi.McpTool{
+		{Name: "self.audio.volume"},
+		{Name: "self_audio_volume"},
+		{Name: "self.audio-volume"},
+		{Name: toolSetReminder},
+		{Name: long},
+		{Name: long + ".y"},
+	})
+	want := map[string]string{
+		"self_audio_volume":    "self.audio.volume",
+		"self_audio_volume_2":  "self_audio_volume",
+		"self_audio-volume":    "self.audio-volume",
+		toolSetReminder + "_2": toolSetReminder,
+		long[:64]:              long,
+		long[:62] + "_2":       long + ".y",
+	}
+	if !maps.Equal(c.names, want) {
+		t.Errorf("names = %v, want %v", c.names, want)
+	}
+	if len(c.Tools()) != len(want) {
+		t.Errorf("tools = %+v", c.Tools())
+	}
+}
+
+func TestReminderTimezone(t *testing.T) {
+	shanghai := time.FixedZone("CST", 8*3600)
+	tools := &reminderTools{
+		loc: shanghai,
+		// 北京时间 21:00
+		now: func() time.Time { return time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC) },
+	}
+	tests := []struct {
+		at   string
+		want time.Time
+	}{
+		{"22:00", time.Date(2026, 10, 18, 14, 0, 0, 0, time.UTC)},
+		{"20:00", time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)},
+		{"2026-10-19 08:00", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		due, err := tools.dueTime(setReminderArgs{At: tt.at})
+		if err != nil || !due.Equal(tt.want) {
+			t.Errorf("dueTime(%q) = %v, %v, want %v", tt.at, due, err, tt.want)
+		}
+	}
+	if v := tools.view(reminder.Reminder{DueAt: time.Date(2026, 10, 18, 14, 0, 0, 0, time.UTC)}); v.Time != "2026-10-18 22:00" {
+		t.Errorf("view time = %s", v.Time)
+	}
+}
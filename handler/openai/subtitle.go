@@ -0,0 +1,259 @@
+package openai
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/pkg/emotion"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+)
+
+const (
+	// 句末标点，遇到即切分出一句字幕
+	sentenceEnds = "。！？!?；;…\n"
+	// 长回复的字幕会领先播放进度很多，超出后先丢弃被后续更新覆盖的句子
+	maxSubtitleCues = 256
+)
+
+// subtitleCue is a server event due when playback reaches a point of the
+// response audio.
+type subtitleCue struct {
+	due   time.Time
+	gen   int64
+	event xiaozhi.ServerEvent
+}
+
+// subtitler turns transcript deltas into tts sentence events aligned with the
+// opus frames sent to the device. Transcript deltas arrive interleaved with
+// the audio they describe, so the audio already queued when a piece of text
+// arrives marks where it is spoken. Events are released when the device,
+// playing in real time from the first frame, reaches that point.
+//
+// Everything except the release loop runs on the realtime api read goroutine.
+type subtitler struct {
+	h      *XiaozhiHandler
+	mu     sync.Mutex
+	cues   []subtitleCue
+	notify chan struct{}
+	gen    atomic.Int64  // 打断后递增，丢弃旧回复尚未下发的字幕
+	drop   chan struct{} // 唤醒正在等待旧字幕的 Run
+	// 下发与计时，测试时替换
+	write func(ctx context.Context, event any) error
+	now   func() time.Time
+	after func(d time.Duration) <-chan time.Time
+	// 回复开头的情绪标签，解析完成前先缓存
+	emotions *emotion.Parser
+	head     strings.Builder
+	headDone bool
+	current  strings.Builder
+	open     bool
+	ended    string // 已读到句末但音频可能未播完的句子，等下一句开始或回复结束时下发 sentence_end
+}
+
+func newSubtitler(h *XiaozhiHandler, emotions *emotion.Parser) *subtitler {
+	return &subtitler{
+		h:        h,
+		notify:   make(chan struct{}, 1),
+		drop:     make(chan struct{}, 1),
+		write:    h.WriteRespEvent,
+		now:      time.Now,
+		after:    time.After,
+		emotions: emotions,
+	}
+}
+
+// Run releases cues in order until ctx is done.
+func (s *subtitler) Run(ctx context.Context) {
+	for {
+		cue, ok := s.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.notify:
+			}
+			continue
+		}
+		for wait := cue.due.Sub(s.now()); wait > 0 && cue.gen == s.gen.Load(); wait = cue.due.Sub(s.now()) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.after(wait):
+			case <-s.drop:
+			}
+		}
+		if cue.gen != s.gen.Load() {
+			continue
+		}
+		_ = s.write(ctx, cue.event)
+	}
+}
+
+func (s *subtitler) next() (subtitleCue, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.cues) == 0 {
+		return subtitleCue{}, false
+	}
+	cue := s.cues[0]
+	s.cues = s.cues[1:]
+	return cue, true
+}
+
+// Pending is the number of cues of the current response not yet released.
+func (s *subtitler) Pending() int {
+	gen := s.gen.Load()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(lo.Filter(s.cues, func(cue subtitleCue, _ int) bool {
+		return cue.gen == gen
+	}))
+}
+
+// audioPos is the playback time of the audio queued so far.
+func (s *subtitler) audioPos() time.Time {
+	if s.h.firstDeltaTs == 0 {
+		return s.now()
+	}
+	return time.UnixMilli(s.h.firstDeltaTs + int64(s.h.totalOpusDuration))
+}
+
+func (s *subtitler) schedule(event xiaozhi.ServerEvent) {
+	gen := s.gen.Load()
+	s.mu.Lock()
+	s.cues = append(s.cues, subtitleCue{due: s.audioPos(), gen: gen, event: event})
+	if len(s.cues) > maxSubtitleCues {
+		s.trim(gen)
+	}
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// trim bounds the cue list, dropping the cues of interrupted responses, then
+// a sentence update superseded by the next one, and as a last resort the
+// oldest cue.
+func (s *subtitler) trim(gen int64) {
+	s.cues = lo.Filter(s.cues, func(cue subtitleCue, _ int) bool { return cue.gen == gen })
+	if len(s.cues) <= maxSubtitleCues {
+		return
+	}
+	drop := 0
+	for i := 0; i+1 < len(s.cues); i++ {
+		// 紧接着又更新了同一句，这一条可以不显示
+		if isSentenceStart(s.cues[i]) && isSentenceStart(s.cues[i+1]) {
+			drop = i
+			break
+		}
+	}
+	s.cues = slices.Delete(s.cues, drop, drop+1)
+}
+
+func isSentenceStart(cue subtitleCue) bool {
+	tts, ok := cue.event.(*xiaozhi.ServerEventTTS)
+	return ok && tts.State == xiaozhi.ServerTTSStateSentenceStart
+}
+
+// Delta appends transcript text, updating the current sentence incrementally.
+// The leading emotion tags of a reply become an llm event and are stripped.
+func (s *subtitler) Delta(delta string) {
+	if !s.headDone {
+		s.head.WriteString(delta)
+		em, rest, done := s.emotions.Parse(s.head.String())
+		if !done {
+			return
+		}
+		s.startReply(em)
+		delta = rest
+	}
+	for delta != "" {
+		piece, terminated := delta, false
+		if i := strings.IndexAny(delta, sentenceEnds); i >= 0 {
+			_, size := utf8.DecodeRuneInString(delta[i:])
+			piece, terminated = delta[:i+size], true
+		}
+		delta = delta[len(piece):]
+
+		if !s.open {
+			piece = strings.TrimLeft(piece, " \n")
+			if piece == "" {
+				continue
+			}
+			s.endPrevious()
+			s.open = true
+		}
+		s.current.WriteString(piece)
+		if text := strings.TrimSpace(s.current.String()); text != "" {
+			s.schedule(s.h.ttsEvent(xiaozhi.ServerTTSStateSentenceStart, text))
+		}
+		if terminated {
+			s.ended = strings.TrimSpace(s.current.String())
+			s.current.Reset()
+			s.open = false
+		}
+	}
+}
+
+func (s *subtitler) endPrevious() {
+	if s.ended == "" {
+		return
+	}
+	s.schedule(s.h.ttsEvent(xiaozhi.ServerTTSStateSentenceEnd, s.ended))
+	s.ended = ""
+}
+
+func (s *subtitler) startReply(em emotion.Emotion) {
+	s.headDone = true
+	s.head.Reset()
+	s.schedule(s.h.llmEvent(em))
+}
+
+// Finish ends the last sentence once the response transcript is complete.
+func (s *subtitler) Finish() {
+	if !s.headDone && s.head.Len() > 0 {
+		em, rest, _ := s.emotions.Parse(s.head.String())
+		s.startReply(em)
+		s.Delta(rest)
+	}
+	s.headDone = false
+	if s.open {
+		s.ended = strings.TrimSpace(s.current.String())
+		s.current.Reset()
+		s.open = false
+	}
+	s.endPrevious()
+}
+
+// Stop schedules an event after the whole response has been played.
+func (s *subtitler) Stop(event xiaozhi.ServerEvent) {
+	s.Finish()
+	s.schedule(event)
+}
+
+// Drop discards the cues not yet released, e.g. when a new response starts
+// while the previous one is still playing. Safe to call from any goroutine.
+func (s *subtitler) Drop() {
+	s.gen.Add(1)
+	select {
+	case s.drop <- struct{}{}:
+	default:
+	}
+}
+
+// Reset drops the pending subtitles of an interrupted response.
+func (s *subtitler) Reset() {
+	s.Drop()
+	s.head.Reset()
+	s.headDone = false
+	s.current.Reset()
+	s.open = false
+	s.ended = ""
+}
@@ -0,0 +1,199 @@
+package openai
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/pkg/emotion"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+)
+
+// fakeClock only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance waits for someone to wait on the clock, then moves it forward.
+func (c *fakeClock) Advance(t *testing.T, d time.Duration) {
+	t.Helper()
+	for deadline := time.Now().Add(waitTimeout); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		if len(c.waiters) > 0 {
+			break
+		}
+		c.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("nothing waits on the clock")
+		}
+	}
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var waiting []fakeTimer
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+type subtitleTest struct {
+	t     *testing.T
+	h     *XiaozhiHandler
+	s     *subtitler
+	clock *fakeClock
+	out   chan xiaozhi.ServerEvent
+}
+
+func newSubtitleTest(t *testing.T, run bool) *subtitleTest {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	h := &XiaozhiHandler{}
+	s := newSubtitler(h, emotion.NewParser(nil, ""))
+	s.now, s.after = clock.Now, clock.After
+	st := &subtitleTest{t: t, h: h, s: s, clock: clock, out: make(chan xiaozhi.ServerEvent, 16)}
+	s.write = func(_ context.Context, event any) error {
+		st.out <- event.(xiaozhi.ServerEvent)
+		return nil
+	}
+	st.startAudio()
+	if run {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go s.Run(ctx)
+	}
+	return st
+}
+
+// startAudio starts the audio of a response at the current time.
+func (st *subtitleTest) startAudio() {
+	st.h.firstDeltaTs = st.clock.Now().UnixMilli()
+	st.h.totalOpusDuration = 0
+}
+
+// queueAudio adds d of response audio, moving where the next text is spoken.
+func (st *subtitleTest) queueAudio(d time.Duration) {
+	st.h.totalOpusDuration += int(d.Milliseconds())
+}
+
+// expect checks the next released events.
+func (st *subtitleTest) expect(want ...string) {
+	st.t.Helper()
+	for _, w := range want {
+		select {
+		case ev := <-st.out:
+			if got := cueString(ev); got != w {
+				st.t.Fatalf("released %s, want %s", got, w)
+			}
+		case <-time.After(waitTimeout):
+			st.t.Fatalf("%s not released", w)
+		}
+	}
+	select {
+	case ev := <-st.out:
+		st.t.Fatalf("released %s early", cueString(ev))
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func cueString(ev xiaozhi.ServerEvent) string {
+	switch ev := ev.(type) {
+	case *xiaozhi.ServerEventTTS:
+		return strings.TrimSpace(string(ev.State) + " " + ev.Text)
+	case *xiaozhi.ServerEventLLM:
+		return "llm"
+	}
+	return "?"
+}
+
+func TestSubtitleOrder(t *testing.T) {
+	st := newSubtitleTest(t, true)
+	st.s.Delta("你好。")
+	st.queueAudio(time.Second)
+	st.s.Delta("再见")
+	st.s.Delta("啦。")
+	st.queueAudio(time.Second)
+	st.s.Stop(st.h.ttsEvent(xiaozhi.ServerTTSStateStop, ""))
+
+	st.expect("llm", "sentence_start 你好。")
+	st.clock.Advance(t, 500*time.Millisecond)
+	st.expect()
+	st.clock.Advance(t, 500*time.Millisecond)
+	st.expect("sentence_end 你好。", "sentence_start 再见", "sentence_start 再见啦。")
+	st.clock.Advance(t, time.Second)
+	st.expect("sentence_end 再见啦。", "stop")
+	if n := st.s.Pending(); n != 0 {
+		t.Errorf("pending = %d", n)
+	}
+}
+
+func TestSubtitleDrop(t *testing.T) {
+	st := newSubtitleTest(t, true)
+	st.s.Delta("第一句。")
+	st.queueAudio(time.Second)
+	st.s.Delta("第二句。")
+	st.expect("llm", "sentence_start 第一句。")
+
+	// 打断后旧回复的字幕不再下发，也不耽误新回复
+	st.s.Reset()
+	st.startAudio()
+	st.s.Delta("新的回复。")
+	st.expect("llm", "sentence_start 新的回复。")
+	if n := st.s.Pending(); n != 0 {
+		t.Errorf("pending = %d", n)
+	}
+}
+
+func TestSubtitleBound(t *testing.T) {
+	st := newSubtitleTest(t, false)
+	st.s.Delta("一句。")
+	st.queueAudio(time.Second)
+	for range 2 * maxSubtitleCues {
+		st.s.Delta("字")
+	}
+
+	cues := st.s.cues
+	if len(cues) != maxSubtitleCues {
+		t.Fatalf("%d cues, want %d", len(cues), maxSubtitleCues)
+	}
+	want := []string{"llm", "sentence_start 一句。", "sentence_end 一句。"}
+	for i, w := range want {
+		if got := cueString(cues[i].event); got != w {
+			t.Errorf("cue %d = %s, want %s", i, got, w)
+		}
+	}
+	if got, w := cueString(cues[len(cues)-1].event), "sentence_start "+strings.Repeat("字", 2*maxSubtitleCues); got != w {
+		t.Errorf("last cue = %s, want %s", got, w)
+	}
+
+	st.s.Drop()
+	st.s.Delta("字")
+	if n := st.s.Pending(); n != 1 {
+		t.Errorf("pending = %d after drop", n)
+	}
+}
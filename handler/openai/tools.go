@@ -0,0 +1,235 @@
+package openai
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/tracing"
+	"github.com/xdimtech/go-xiaozhi/pkg/utils"
+	"github.com/xdimtech/go-xiaozhi/pkg/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sessionToolChoice is set by every session.update. With required the model
+// would have to call a tool in each response, so plain chat and the reply
+// after tool outputs would turn into more calls; auto lets it decide.
+const sessionToolChoice = openai.ToolChoiceAuto
+
+// toolProvider exposes a set of functions to the model.
+type toolProvider interface {
+	Tools() []openai.Tool
+	// Call runs the named tool with its JSON arguments and returns the output
+	// passed back to the model.
+	Call(ctx context.Context, name, arguments string) (string, error)
+}
+
+func (w *XiaozhiHandler) sessionTools() []openai.Tool {
+	return lo.FlatMap(w.toolProviders(), func(p toolProvider, _ int) []openai.Tool {
+		return p.Tools()
+	})
+}
+
+func (w *XiaozhiHandler) toolProviders() []toolProvider {
+	var providers []toolProvider
+	if w.reminders != nil {
+		providers = append(providers, w.reminders)
+	}
+	if w.mcp != nil {
+		providers = append(providers, w.mcp)
+	}
+	return providers
+}
+
+// gatewayToolNames returns the names of the functions the gateway provides
+// itself, which device tools must not shadow.
+func (w *XiaozhiHandler) gatewayToolNames() []string {
+	if w.reminders == nil {
+		return nil
+	}
+	return lo.Map(w.reminders.Tools(), func(t openai.Tool, _ int) string { return t.Name })
+}
+
+func (w *XiaozhiHandler) findTool(name string) (toolProvider, bool) {
+	return lo.Find(w.toolProviders(), func(p toolProvider) bool {
+		return lo.ContainsBy(p.Tools(), func(t openai.Tool) bool { return t.Name == name })
+	})
+}
+
+// updateTools registers the current tool set with the realtime session.
+func (w *XiaozhiHandler) updateTools() error {
+	tools := w.sessionTools()
+	if len(tools) == 0 {
+		return nil
+	}
+	return w.SendToRealtimeAPI(&openai.SessionUpdateEvent{
+		ClientEventBase: openai.ClientEventBase{
+			EventID: utils.UniqueID(),
+			Type:    openai.ClientEventTypeSessionUpdate,
+		},
+		Session: openai.ClientSession{
+			// turn_detection 不带 omitempty，必须每次带上，否则会被关掉
+			TurnDetection: &openai.TurnDetection{
+				Type: openai.ClientTurnDetectionTypeServerVad,
+			},
+			Tools:      tools,
+			ToolChoice: sessionToolChoice,
+		},
+	})
+}
+
+// toolCalls tracks the function calls of each response. The model is asked
+// to go on once a response is done and all of its calls have returned.
+type toolCalls struct {
+	mu      sync.Mutex
+	pending map[string]int  // response id -> 未返回的调用数
+	done    map[string]bool // 已收到 response.done 的回复
+	ready   bool            // 有调用结果等待模型继续回复
+}
+
+func newToolCalls() *toolCalls {
+	return &toolCalls{pending: make(map[string]int), done: make(map[string]bool)}
+}
+
+func (c *toolCalls) start(responseId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending[responseId]++
+}
+
+// finish records a returned call.
+func (c *toolCalls) finish(responseId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.pending[responseId]
+	if !ok {
+		return
+	}
+	if n > 1 {
+		c.pending[responseId] = n - 1
+		return
+	}
+	c.pending[responseId] = 0
+	if c.done[responseId] {
+		c.forget(responseId)
+		c.ready = true
+	}
+}
+
+// responseDone records the end of a response. The outputs of a cancelled
+// one are still added to the conversation, but the model is not asked to
+// go on since the user has moved on.
+func (c *toolCalls) responseDone(responseId string, cancelled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.pending[responseId]
+	switch {
+	case !ok:
+	case cancelled:
+		c.forget(responseId)
+	case n == 0:
+		c.forget(responseId)
+		c.ready = true
+	default:
+		c.done[responseId] = true
+	}
+}
+
+func (c *toolCalls) forget(responseId string) {
+	delete(c.pending, responseId)
+	delete(c.done, responseId)
+}
+
+func (c *toolCalls) hasReady() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ready
+}
+
+func (c *toolCalls) takeReady() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ready := c.ready
+	c.ready = false
+	return ready
+}
+
+func (w *XiaozhiHandler) handleFunctionCallArgumentsDone(
+	ctx context.Context, event openai.ServerEvent) (xiaozhi.ServerEvent, error) {
+	_event := event.(*openai.ResponseFunctionCallArgumentsDoneEvent)
+	w.calls.start(_event.ResponseID)
+	provider, ok := w.findTool(_event.Name)
+	if !ok {
+		output := fmt.Sprintf("unknown tool: %s", _event.Name)
+		w.emit(webhook.TypeToolCall, webhook.ToolCall{
+			CallID: _event.CallID, Name: _event.Name, Arguments: _event.Arguments, Error: output,
+		})
+		err := w.sendToolOutput(_event.CallID, output)
+		w.calls.finish(_event.ResponseID)
+		return nil, err
+	}
+	// 设备侧调用需要等待 ReadLoop 收到结果，不能阻塞当前读协程
+	callCtx, span := tracing.Tracer().Start(w.turns.Context(), tracing.SpanTool, trace.WithAttributes(
+		attribute.String("tool.name", _event.Name), attribute.String("tool.call_id", _event.CallID)))
+	go func() {
+		start := time.Now()
+		output, err := provider.Call(callCtx, _event.Name, _event.Arguments)
+		endSpan(span, err)
+		call := webhook.ToolCall{
+			CallID:     _event.CallID,
+			Name:       _event.Name,
+			Arguments:  _event.Arguments,
+			Output:     output,
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			output = fmt.Sprintf("tool call failed: %v", err)
+			call.Error = err.Error()
+		}
+		w.emit(webhook.TypeToolCall, call)
+		if err := w.sendToolOutput(_event.CallID, output); err != nil {
+			w.log.Error("send tool output failed", "call_id", _event.CallID, "err", err)
+		}
+		w.calls.finish(_event.ResponseID)
+		w.continueTools()
+	}()
+	return nil, nil
+}
+
+// sendToolOutput adds a function call result to the conversation.
+func (w *XiaozhiHandler) sendToolOutput(callId, output string) error {
+	err := w.SendToRealtimeAPI(&openai.ConversationItemCreateEvent{
+		ClientEventBase: openai.ClientEventBase{
+			EventID: utils.UniqueID(),
+			Type:    openai.ClientEventTypeConversationItemCreate,
+		},
+		Item: openai.MessageItem{
+			Type:   openai.MessageItemTypeFunctionCallOutput,
+			CallID: callId,
+			Output: output,
+		},
+	})
+	return err
+}
+
+// continueTools asks the model to go on with the tool outputs of finished
+// responses. It waits for a response in progress, whose response.done
+// tries again.
+func (w *XiaozhiHandler) continueTools() {
+	if !w.calls.hasReady() || !w.responding.CompareAndSwap(false, true) {
+		return
+	}
+	if !w.calls.takeReady() {
+		w.responding.Store(false)
+		return
+	}
+	if err := w.createResponse(openai.ResponseCreateParams{}); err != nil {
+		w.responding.Store(false)
+		w.log.Error("continue after tool calls failed", "err", err)
+	}
+}
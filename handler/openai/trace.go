@@ -0,0 +1,161 @@
+package openai
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Milestones of a turn, recorded as span events with the time since the
+// turn started.
+const (
+	turnSpeechStarted   = "speech_started"
+	turnSpeechStopped   = "speech_stopped"
+	turnCommitted       = "committed"
+	turnTranscript      = "transcript"
+	turnResponseCreated = "response_created"
+	turnFirstAudio      = "first_audio"
+	turnToolDone        = "tool_response_done"
+)
+
+// turnTracer follows each user turn, from the start of the input to the
+// last response done, as a span under the session span. Tool calls and
+// opus encoding are child spans of the turn.
+type turnTracer struct {
+	session context.Context
+
+	mu         sync.Mutex
+	ctx        context.Context // 当前轮次，没有进行中的轮次时为 nil
+	span       trace.Span
+	start      time.Time
+	firstAudio bool
+	response   string // 该轮最近一次回复的 id
+}
+
+func newTurnTracer(session context.Context) *turnTracer {
+	return &turnTracer{session: session}
+}
+
+// Begin starts a turn of the input kind (voice, text or response for one
+// the model starts itself), ending the previous turn as interrupted.
+func (t *turnTracer) Begin(input string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.end("interrupted")
+	t.start = time.Now()
+	t.firstAudio = false
+	t.response = ""
+	t.ctx, t.span = tracing.Tracer().Start(t.session, tracing.SpanTurn,
+		trace.WithTimestamp(t.start), trace.WithAttributes(attribute.String("turn.input", input)))
+}
+
+// Ensure starts a turn of the input kind unless one is in progress.
+func (t *turnTracer) Ensure(input string) {
+	t.mu.Lock()
+	open := t.span != nil
+	t.mu.Unlock()
+	if !open {
+		t.Begin(input)
+	}
+}
+
+// Mark records a milestone of the turn in progress.
+func (t *turnTracer) Mark(name string, attrs ...attribute.KeyValue) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mark(name, attrs...)
+}
+
+func (t *turnTracer) mark(name string, attrs ...attribute.KeyValue) {
+	if t.span == nil {
+		return
+	}
+	elapsed := time.Since(t.start).Milliseconds()
+	t.span.AddEvent(name, trace.WithAttributes(append(attrs, attribute.Int64("elapsed_ms", elapsed))...))
+	t.span.SetAttributes(attribute.Int64("turn."+name+"_ms", elapsed))
+}
+
+// Respond marks a response created for the turn in progress, starting a
+// turn for a response without user input.
+func (t *turnTracer) Respond(id string) {
+	t.Ensure("response")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.response = id
+	t.mark(turnResponseCreated, attribute.String("response.id", id))
+}
+
+// FirstAudio marks the first audio delta of the turn.
+func (t *turnTracer) FirstAudio() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.span == nil || t.firstAudio {
+		return
+	}
+	t.firstAudio = true
+	t.mark(turnFirstAudio)
+}
+
+// Done ends the turn with the status of its last response. A response
+// interrupted by the next turn no longer ends anything.
+func (t *turnTracer) Done(id, status string, attrs ...attribute.KeyValue) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.span == nil || t.response != id {
+		return
+	}
+	t.span.SetAttributes(attrs...)
+	t.end(status)
+}
+
+// End ends the turn in progress.
+func (t *turnTracer) End(status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.end(status)
+}
+
+func (t *turnTracer) end(status string) {
+	if t.span == nil {
+		return
+	}
+	t.span.SetAttributes(attribute.String("turn.status", status))
+	if status == "failed" {
+		t.span.SetStatus(codes.Error, status)
+	}
+	t.span.End()
+	t.ctx, t.span = nil, nil
+}
+
+// Error records an error on the turn in progress.
+func (t *turnTracer) Error(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.span != nil {
+		t.span.RecordError(err)
+	}
+}
+
+// Context is the turn in progress for child spans, or the session.
+func (t *turnTracer) Context() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ctx != nil {
+		return t.ctx
+	}
+	return t.session
+}
+
+// endSpan ends a child span, recording err if the step failed.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
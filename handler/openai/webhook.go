@@ -0,0 +1,15 @@
+package openai
+
+import (
+	"github.com/xdimtech/go-xiaozhi/pkg/webhook"
+)
+
+// emit sends a conversation event to the webhooks, if any are configured.
+func (r *XiaozhiHandler) emit(typ string, data any) {
+	r.hooks.Send(webhook.Event{
+		Type:      typ,
+		SessionID: r.entry.ID,
+		DeviceId:  r.sess.DeviceId,
+		Data:      data,
+	})
+}
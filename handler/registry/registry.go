@@ -0,0 +1,289 @@
+package registry
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+)
+
+type State string
+
+const (
+	StateConnecting State = "connecting"
+	StateIdle       State = "idle"
+	StateListening  State = "listening"
+	StateSpeaking   State = "speaking"
+	StateClosed     State = "closed"
+)
+
+var (
+	ErrNotFound     = errors.New("session not found")
+	ErrNotSupported = errors.New("not supported by the session provider")
+)
+
+// Update changes the realtime session of a connected device. Nil fields are
+// left unchanged.
+type Update struct {
+	Voice        *string `json:"voice,omitempty"`
+	Instructions *string `json:"instructions,omitempty"`
+}
+
+// Speech is spoken by a device without being asked. Text is said by the
+// model, following Instructions if set, unless PCM is given, which is then
+// played as is with Text as its subtitle.
+type Speech struct {
+	Text         string `json:"text,omitempty"`
+	Instructions string `json:"instructions,omitempty"`
+
+	PCM        []byte `json:"-"` // mono pcm16
+	SampleRate int    `json:"-"`
+
+	// Played, if set, is called once the queued speech has been played, or
+	// with an error if it failed or the session ended first.
+	Played func(err error) `json:"-"`
+}
+
+// ErrSessionClosed is reported for speech the session ended before playing.
+var ErrSessionClosed = errors.New("session closed")
+
+// Controller is implemented by the connection serving a session.
+type Controller interface {
+	// Close says goodbye to the device and disconnects it.
+	Close() error
+	UpdateSession(update Update) error
+	Speak(speech Speech) error
+	SendEvent(event xiaozhi.ServerEvent) error
+}
+
+// Session is a connected device.
+type Session struct {
+	ID        string
+	DeviceId  string
+	ClientId  string
+	Provider  string
+	StartTime time.Time
+
+	BytesIn      atomic.Int64
+	BytesOut     atomic.Int64
+	FramesIn     atomic.Int64
+	FramesOut    atomic.Int64
+	InputTokens  atomic.Int64
+	OutputTokens atomic.Int64
+
+	mu         sync.Mutex
+	state      State
+	persona    string
+	controller Controller
+}
+
+func NewSession(id, deviceId, clientId, provider string) *Session {
+	return &Session{
+		ID:        id,
+		DeviceId:  deviceId,
+		ClientId:  clientId,
+		Provider:  provider,
+		StartTime: time.Now(),
+		state:     StateConnecting,
+	}
+}
+
+// Logger returns the default logger with the session id, device id and
+// provider on every line.
+func (s *Session) Logger() *slog.Logger {
+	return slog.Default().With("session_id", s.ID, "device_id", s.DeviceId, "provider", s.Provider)
+}
+
+func (s *Session) SetState(state State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+func (s *Session) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *Session) SetPersona(persona string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.persona = persona
+}
+
+func (s *Session) SetController(c Controller) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.controller = c
+}
+
+func (s *Session) getController() (Controller, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.controller == nil {
+		return nil, ErrNotSupported
+	}
+	return s.controller, nil
+}
+
+// AddIn counts a message received from the device.
+func (s *Session) AddIn(n int) {
+	s.FramesIn.Add(1)
+	s.BytesIn.Add(int64(n))
+}
+
+// AddOut counts a message sent to the device.
+func (s *Session) AddOut(n int) {
+	s.FramesOut.Add(1)
+	s.BytesOut.Add(int64(n))
+}
+
+func (s *Session) AddUsage(input, output int) {
+	s.InputTokens.Add(int64(input))
+	s.OutputTokens.Add(int64(output))
+}
+
+func (s *Session) Close() error {
+	c, err := s.getController()
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+func (s *Session) Update(update Update) error {
+	c, err := s.getController()
+	if err != nil {
+		return err
+	}
+	return c.UpdateSession(update)
+}
+
+// Speak queues the speech, it is played once the device is idle.
+func (s *Session) Speak(speech Speech) error {
+	c, err := s.getController()
+	if err != nil {
+		return err
+	}
+	return c.Speak(speech)
+}
+
+// SendEvent sends a server event such as iot, system, alert or goodbye to
+// the device.
+func (s *Session) SendEvent(event xiaozhi.ServerEvent) error {
+	c, err := s.getController()
+	if err != nil {
+		return err
+	}
+	return c.SendEvent(event)
+}
+
+// Info is a snapshot of a session.
+type Info struct {
+	ID           string    `json:"id"`
+	DeviceId     string    `json:"device_id"`
+	ClientId     string    `json:"client_id"`
+	Provider     string    `json:"provider"`
+	Persona      string    `json:"persona"`
+	StartTime    time.Time `json:"start_time"`
+	State        State     `json:"state"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	FramesIn     int64     `json:"frames_in"`
+	FramesOut    int64     `json:"frames_out"`
+	InputTokens  int64     `json:"input_tokens"`
+	OutputTokens int64     `json:"output_tokens"`
+}
+
+func (s *Session) Info() Info {
+	s.mu.Lock()
+	state, persona := s.state, s.persona
+	s.mu.Unlock()
+	return Info{
+		ID:           s.ID,
+		DeviceId:     s.DeviceId,
+		ClientId:     s.ClientId,
+		Provider:     s.Provider,
+		Persona:      persona,
+		StartTime:    s.StartTime,
+		State:        state,
+		BytesIn:      s.BytesIn.Load(),
+		BytesOut:     s.BytesOut.Load(),
+		FramesIn:     s.FramesIn.Load(),
+		FramesOut:    s.FramesOut.Load(),
+		InputTokens:  s.InputTokens.Load(),
+		OutputTokens: s.OutputTokens.Load(),
+	}
+}
+
+// Registry keeps the sessions of connected devices in memory.
+type Registry struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+func New() *Registry {
+	return &Registry{sessions: make(map[string]*Session)}
+}
+
+func (r *Registry) Add(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.ID] = s
+}
+
+func (r *Registry) Remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+func (r *Registry) Get(id string) (*Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s, nil
+}
+
+// ByDevice returns the most recent session of the device. Device ids are
+// compared case-insensitively, like in the config.
+func (r *Registry) ByDevice(deviceId string) (*Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var found *Session
+	for _, s := range r.sessions {
+		if !strings.EqualFold(s.DeviceId, deviceId) {
+			continue
+		}
+		if found == nil || s.StartTime.After(found.StartTime) {
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// List returns the sessions ordered by start time.
+func (r *Registry) List() []*Session {
+	r.mu.RLock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mu.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartTime.Before(sessions[j].StartTime)
+	})
+	return sessions
+}
@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+)
+
+type fakeController struct {
+	closed   bool
+	updates  []Update
+	speeches []Speech
+	events   []xiaozhi.ServerEvent
+}
+
+func (c *fakeController) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *fakeController) UpdateSession(update Update) error {
+	c.updates = append(c.updates, update)
+	return nil
+}
+
+func (c *fakeController) Speak(speech Speech) error {
+	c.speeches = append(c.speeches, speech)
+	return nil
+}
+
+func (c *fakeController) SendEvent(event xiaozhi.ServerEvent) error {
+	c.events = append(c.events, event)
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	reg := New()
+	old := NewSession("s1", "AA:BB", "c1", "openai")
+	old.StartTime = time.Now().Add(-time.Minute)
+	cur := NewSession("s2", "aa:bb", "c2", "openai")
+	reg.Add(old)
+	reg.Add(cur)
+
+	if got := reg.List(); len(got) != 2 || got[0].ID != "s1" {
+		t.Fatalf("list should be ordered by start time, got %v", got)
+	}
+	if got, err := reg.ByDevice("aa:BB"); err != nil || got.ID != "s2" {
+		t.Fatalf("ByDevice should return the latest session, got %v, %v", got, err)
+	}
+
+	ctrl := &fakeController{}
+	cur.SetController(ctrl)
+	voice := "voice-xxx"
+	if err := cur.Update(Update{Voice: &voice}); err != nil || len(ctrl.updates) != 1 {
+		t.Fatalf("update not forwarded: %v", err)
+	}
+	if err := cur.Speak(Speech{Text: "该喝水了"}); err != nil || len(ctrl.speeches) != 1 {
+		t.Fatalf("speech not forwarded: %v", err)
+	}
+	if err := cur.SendEvent(&xiaozhi.ServerEventGoodbye{}); err != nil || len(ctrl.events) != 1 {
+		t.Fatalf("event not forwarded: %v", err)
+	}
+	if err := cur.Close(); err != nil || !ctrl.closed {
+		t.Fatalf("close not forwarded: %v", err)
+	}
+	if err := old.Close(); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("session without controller: got %v", err)
+	}
+
+	reg.Remove("s2")
+	if _, err := reg.Get("s2"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("removed session still found: %v", err)
+	}
+}
+
+func TestSessionInfo(t *testing.T) {
+	s := NewSession("s1", "dev", "cli", "openai")
+	s.SetPersona("storyteller")
+	s.SetState(StateSpeaking)
+	s.AddIn(100)
+	s.AddOut(40)
+	s.AddOut(60)
+	s.AddUsage(10, 20)
+	info := s.Info()
+	if info.Persona != "storyteller" || info.State != StateSpeaking ||
+		info.BytesIn != 100 || info.FramesIn != 1 || info.BytesOut != 100 || info.FramesOut != 2 ||
+		info.InputTokens != 10 || info.OutputTokens != 20 {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+}
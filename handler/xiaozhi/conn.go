@@ -2,15 +2,18 @@ package xiaozhi
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/xdimtech/go-xiaozhi/handler/registry"
 	"github.com/xdimtech/go-xiaozhi/pkg/config"
 
 	"github.com/gorilla/websocket"
 	xiaozhiapi "github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/utils"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -22,6 +25,7 @@ type ConnWrapper struct {
 	idleTimeout time.Duration
 	idleTimer   *time.Timer
 	originReq   *http.Request
+	session     *registry.Session
 }
 
 type WsConnOption func(*ConnWrapper)
@@ -39,6 +43,12 @@ func WithOriginReq(originReq *http.Request) WsConnOption {
 	}
 }
 
+func WithSession(session *registry.Session) WsConnOption {
+	return func(w *ConnWrapper) {
+		w.session = session
+	}
+}
+
 func NewConnWrapper(ctx context.Context, conn *websocket.Conn, ops ...WsConnOption) (*ConnWrapper, error) {
 	wsConn := &ConnWrapper{
 		ctx:         ctx,
@@ -53,6 +63,12 @@ func NewConnWrapper(ctx context.Context, conn *websocket.Conn, ops ...WsConnOpti
 	if wsConn.originReq == nil {
 		return nil, errors.New("origin request is nil")
 	}
+	if wsConn.session == nil {
+		wsConn.session = registry.NewSession(utils.UniqueID(), wsConn.originReq.Header.Get("Device-Id"),
+			wsConn.originReq.Header.Get("Client-Id"), "xiaozhi")
+	}
+	wsConn.session.SetController(wsConn)
+	wsConn.session.SetState(registry.StateIdle)
 
 	if err := wsConn.ConnectProxy(); err != nil {
 		return nil, err
@@ -112,6 +128,21 @@ func (w *ConnWrapper) Close() error {
 	return nil
 }
 
+// UpdateSession is not supported, the upstream xiaozhi server owns the session.
+func (w *ConnWrapper) UpdateSession(update registry.Update) error {
+	return registry.ErrNotSupported
+}
+
+// Speak is not supported, the upstream xiaozhi server owns the dialogue.
+func (w *ConnWrapper) Speak(speech registry.Speech) error {
+	return registry.ErrNotSupported
+}
+
+// SendEvent is not supported, the upstream xiaozhi server owns the session.
+func (w *ConnWrapper) SendEvent(event xiaozhiapi.ServerEvent) error {
+	return registry.ErrNotSupported
+}
+
 func (w *ConnWrapper) WriteLoop(ctx context.Context) {
 	for {
 		msgType, msg, merr := w.proxyConn.ReadMessage()
@@ -120,6 +151,7 @@ func (w *ConnWrapper) WriteLoop(ctx context.Context) {
 			break
 		}
 
+		w.session.AddOut(len(msg))
 		var err error
 		switch msgType {
 		case websocket.TextMessage:
@@ -147,10 +179,11 @@ func (w *ConnWrapper) ReadLoop(ctx context.Context) (err error) {
 			w.done <- struct{}{}
 			break
 		}
+		w.session.AddIn(len(msg))
 
 		switch msgType {
 		case websocket.TextMessage:
-			err = w.proxyConn.WriteMessage(websocket.TextMessage, msg)
+			err = w.proxyConn.WriteMessage(websocket.TextMessage, textToDetect(msg))
 		case websocket.BinaryMessage:
 			err = w.proxyConn.WriteMessage(websocket.BinaryMessage, msg)
 		}
@@ -184,6 +217,29 @@ func (w *ConnWrapper) resetIdleTimer() {
 	w.idleTimer.Reset(w.idleTimeout)
 }
 
+// textToDetect rewrites a typed text message as the listen detect message
+// the upstream xiaozhi server takes text input from, leaving other messages
+// as they are.
+func textToDetect(msg []byte) []byte {
+	var ev xiaozhiapi.ClientEventText
+	if err := json.Unmarshal(msg, &ev); err != nil || ev.Type != xiaozhiapi.ClientEventTypeText {
+		return msg
+	}
+	detect, err := json.Marshal(&xiaozhiapi.ClientEventListen{
+		ClientEventBase: xiaozhiapi.ClientEventBase{
+			Type:      xiaozhiapi.ClientEventTypeListen,
+			SessionID: ev.SessionID,
+		},
+		State: xiaozhiapi.ClientStateListenDetect,
+		Mode:  xiaozhiapi.ClientModeManual,
+		Text:  ev.Text,
+	})
+	if err != nil {
+		return msg
+	}
+	return detect
+}
+
 func (w *ConnWrapper) errorEvent(ctx context.Context, err error) xiaozhiapi.ServerEvent {
 	return &xiaozhiapi.ServerEventError{
 		ServerEventBase: xiaozhiapi.ServerEventBase{
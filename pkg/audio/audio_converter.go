@@ -1,24 +1,107 @@
 package audio
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"math"
 
 	"gopkg.in/hraban/opus.v2"
 )
 
 const (
-	DeviceOpusRate24k = 24000
-	DeviceOpusRate48k = 48000
-	DefaultDownPcmSR  = 24000
-	DefaultUpPcmSR    = 24000
+	DeviceOpusRate24k    = 24000
+	DeviceOpusRate48k    = 48000
+	DefaultDownPcmSR     = 24000
+	DefaultUpPcmSR       = 24000
+	DefaultFrameDuration = 60
+	// 上行丢包时最多补偿的帧数
+	maxConcealFrames = 5
+	// 上游输出音量偏小，下行默认放大
+	defaultDownGain = 8
 )
 
+// Upstream audio formats, named as in the realtime api.
+const (
+	FormatPcm16    = "pcm16"
+	FormatG711Ulaw = "g711_ulaw"
+	FormatG711Alaw = "g711_alaw"
+)
+
+// Upstream describes the audio exchanged with the realtime api.
+type Upstream struct {
+	InputFormat  string
+	OutputFormat string
+	// PcmSampleRate is the pcm16 sample rate, g711 is always 8 kHz.
+	PcmSampleRate int
+}
+
+// DefaultUpstream is pcm16 at 24 kHz in both directions.
+func DefaultUpstream() Upstream {
+	return Upstream{
+		InputFormat:   FormatPcm16,
+		OutputFormat:  FormatPcm16,
+		PcmSampleRate: DefaultUpPcmSR,
+	}
+}
+
+func (u Upstream) InputRate() int {
+	return u.rate(u.InputFormat)
+}
+
+func (u Upstream) OutputRate() int {
+	return u.rate(u.OutputFormat)
+}
+
+func (u Upstream) rate(format string) int {
+	if IsG711(format) {
+		return G711SampleRate
+	}
+	if u.PcmSampleRate > 0 {
+		return u.PcmSampleRate
+	}
+	return DefaultUpPcmSR
+}
+
+// IsUpstreamFormat reports whether the converter can exchange the format with the realtime api.
+func IsUpstreamFormat(format string) bool {
+	return format == FormatPcm16 || IsG711(format)
+}
+
+func IsG711(format string) bool {
+	return format == FormatG711Ulaw || format == FormatG711Alaw
+}
+
+// Params describes one direction of the opus stream exchanged with the device.
+type Params struct {
+	SampleRate    int
+	Channels      int
+	FrameDuration int
+}
+
+// FrameSize returns the number of samples per channel in one frame.
+func (p Params) FrameSize() int {
+	return p.FrameDuration * p.SampleRate / 1000
+}
+
+// IsOpusSampleRate reports whether opus can encode at the given sample rate.
+func IsOpusSampleRate(sampleRate int) bool {
+	switch sampleRate {
+	case 8000, 12000, 16000, 24000, 48000:
+		return true
+	}
+	return false
+}
+
+// IsOpusFrameDuration reports whether opus supports frames of the given duration in ms.
+func IsOpusFrameDuration(frameDuration int) bool {
+	switch frameDuration {
+	case 10, 20, 40, 60:
+		return true
+	}
+	return false
+}
+
 type AudioGainConfig struct {
 	DefaultGain    float32
 	MinGain        float32
@@ -41,6 +124,7 @@ type Converter struct {
 	SampleRate     int
 	DownSampleRate int
 	Channels       int
+	DownChannels   int
 	FrameSize      int
 	FrameDuration  int
 	DownDuration   int
@@ -50,41 +134,90 @@ type Converter struct {
 	Encoder        *opus.Encoder
 	Decoder        *opus.Decoder
 	cb             Callback
+	upTimestamp    uint32
 	gainConfig     AudioGainConfig
+	profile        EncoderProfile
+	degraded       bool
+	upstream       Upstream
+	downGain       float32
+
+	// 复用的缓冲区：上行 up* 只在设备读 goroutine 中使用，下行 down* 只在 realtime api 读 goroutine 中使用，
+	// 两组各自只被一个 goroutine 访问，无需加锁
+	upPcm     []int16
+	upBytes   []byte
+	upCodec   []byte
+	downPcm   []int16
+	downCodec []byte
 }
 
 type Callback func(ctx context.Context, data any) error
 
-func NewConverter(sampleRate, channels, frameDuration, frameSize int, cb Callback) *Converter {
-	upSampler, err := NewGoResampler(channels, sampleRate, DefaultUpPcmSR)
+type ConverterOption func(*Converter)
+
+// WithEncoderProfile sets the downlink opus encoder profile.
+func WithEncoderProfile(profile EncoderProfile) ConverterOption {
+	return func(c *Converter) {
+		c.profile = profile
+	}
+}
+
+// WithUpstream sets the audio formats exchanged with the realtime api.
+func WithUpstream(upstream Upstream) ConverterOption {
+	return func(c *Converter) {
+		c.upstream = upstream
+	}
+}
+
+// WithDownGain sets the gain applied to the downlink audio. The default
+// boosts the quiet realtime api output; pre-recorded audio usually wants 1.
+func WithDownGain(gain float32) ConverterOption {
+	return func(c *Converter) {
+		c.downGain = gain
+	}
+}
+
+// NewConverter creates a converter between the device opus streams and the
+// upstream pcm16 or g711 streams. up describes the audio sent by the device, down the
+// audio sent to the device; the encoder and resampler follow down.
+func NewConverter(up, down Params, cb Callback, ops ...ConverterOption) *Converter {
+	c := &Converter{
+		SampleRate:     up.SampleRate,
+		DownSampleRate: down.SampleRate,
+		Channels:       up.Channels,
+		DownChannels:   down.Channels,
+		FrameDuration:  up.FrameDuration,
+		DownDuration:   down.FrameDuration,
+		FrameSize:      up.FrameSize(),
+		cb:             cb,
+		upstream:       DefaultUpstream(),
+		downGain:       defaultDownGain,
+	}
+	for _, op := range ops {
+		op(c)
+	}
+
+	upSampler, err := NewGoResampler(up.Channels, up.SampleRate, c.upstream.InputRate())
 	if err != nil {
 		panic(err)
 	}
-	downSampler, err := NewGoResampler(channels, DefaultDownPcmSR, DeviceOpusRate24k)
+	// 上游输出为单声道，多声道在编码前复制
+	downSampler, err := NewGoResampler(1, c.upstream.OutputRate(), down.SampleRate)
 	if err != nil {
 		panic(err)
 	}
-	enc, err := opus.NewEncoder(DeviceOpusRate24k, 1, opus.Application(opus.AppVoIP))
+	enc, err := newEncoder(down.SampleRate, down.Channels, c.profile)
 	if err != nil {
 		panic(err)
 	}
-	dec, err := opus.NewDecoder(DeviceOpusRate24k, 1)
+	dec, err := opus.NewDecoder(up.SampleRate, up.Channels)
 	if err != nil {
 		panic(err)
 	}
-	return &Converter{
-		SampleRate:     sampleRate,
-		DownSampleRate: DeviceOpusRate24k,
-		Channels:       channels,
-		FrameDuration:  frameDuration,
-		DownDuration:   frameDuration,
-		FrameSize:      frameSize,
-		upReSampler:    upSampler,
-		downReSampler:  downSampler,
-		Encoder:        enc,
-		Decoder:        dec,
-		cb:             cb,
-	}
+	c.upReSampler = upSampler
+	c.downReSampler = downSampler
+	c.Encoder = enc
+	c.Decoder = dec
+	return c
 }
 
 func (c *Converter) SetGainConfig(config AudioGainConfig) error {
@@ -95,113 +228,198 @@ func (c *Converter) SetGainConfig(config AudioGainConfig) error {
 	return nil
 }
 
-func (c *Converter) OpusToPcmBase64(opusData []byte) (string, error) {
+// OpusToPcmBase64 converts a device opus packet to base64 audio in the
+// upstream input format. timestamp is the packet time in ms from binary
+// protocol v2, or 0 when the framing carries none.
+func (c *Converter) OpusToPcmBase64(opusData []byte, timestamp uint32) (string, error) {
 	if len(opusData) == 0 {
 		return "", errors.New("empty opus data")
 	}
 	// 解码为pcm
-	pcmData, err := c.opus2pcm(opusData)
+	pcmData, err := c.opus2pcm(opusData, c.lostFrames(timestamp))
 	if err != nil {
 		return "", errors.New("opus decode failed, err: " + err.Error())
 	}
-	// 重采样为24k
+	// 重采样为上游采样率
 	resampledData, err := c.upReSampler.Handle(pcmData)
 	if err != nil {
 		return "", errors.New("upReSampler handle failed, err: " + err.Error())
 	}
+	resampledData = c.encodeUpstream(resampledData)
 	// 编码为base64
-	encodedData := base64.StdEncoding.EncodeToString(resampledData)
-	return encodedData, nil
+	buf := getBytes(base64.StdEncoding.EncodedLen(len(resampledData)))
+	defer putBytes(buf)
+	base64.StdEncoding.Encode(*buf, resampledData)
+	return string(*buf), nil
 }
 
-func (c *Converter) opus2pcm(audioData []byte) ([]byte, error) {
+// opus2pcm decodes one packet into c.upBytes, valid until the next call.
+// lost frames before the packet are filled with packet loss concealment.
+func (c *Converter) opus2pcm(audioData []byte, lost int) ([]byte, error) {
 	if len(audioData) == 0 {
 		return nil, nil
 	}
-	pcm := make([]int16, 4096)
-	dec, err := opus.NewDecoder(c.SampleRate, 1)
+	// 最长120ms一帧
+	maxFrame := c.SampleRate * 120 / 1000 * c.Channels
+	plcFrame := c.FrameSize * c.Channels
+	c.upPcm = grow(c.upPcm, lost*plcFrame+maxFrame)
+	n := 0
+	for i := 0; i < lost; i++ {
+		// DecodePLC 按容量确定补偿时长
+		if err := c.Decoder.DecodePLC(c.upPcm[n : n+plcFrame : n+plcFrame]); err != nil {
+			break
+		}
+		n += plcFrame
+	}
+	size, err := c.Decoder.Decode(audioData, c.upPcm[n:n+maxFrame])
 	if err != nil {
 		return nil, err
 	}
-	size, err := dec.Decode(audioData, pcm)
+	pcm := c.upPcm[:n+size*c.Channels]
+	applyGain(pcm, 3)
+	c.upBytes = Int16ToBytes(c.upBytes, pcm)
+	return c.upBytes, nil
+}
+
+// lostFrames returns how many uplink frames are missing before the packet
+// with the given timestamp, capped at maxConcealFrames.
+func (c *Converter) lostFrames(timestamp uint32) int {
+	if timestamp == 0 {
+		return 0
+	}
+	last := c.upTimestamp
+	c.upTimestamp = timestamp
+	if last == 0 || timestamp <= last || c.FrameDuration <= 0 {
+		return 0
+	}
+	lost := int(timestamp-last)/c.FrameDuration - 1
+	return min(max(lost, 0), maxConcealFrames)
+}
+
+func (c *Converter) ResolvePCM(base64Str string) error {
+	buf := getBytes(base64.StdEncoding.DecodedLen(len(base64Str)))
+	defer putBytes(buf)
+	n, err := base64.StdEncoding.Decode(*buf, strBytes(base64Str))
 	if err != nil {
-		return nil, err
+		return errors.New("base64 decode failed, err: " + err.Error())
 	}
-	pcm = pcm[:size]
-	return c.int16ToBytes(c.gain(pcm, 3)), nil
+	return c.parseFrames(c.decodeUpstream((*buf)[:n]))
 }
 
-func (c *Converter) int16ToBytes(s []int16) []byte {
-	var buf bytes.Buffer
-	for _, v := range s {
-		err := binary.Write(&buf, binary.LittleEndian, v)
-		if err != nil {
-			return nil
-		}
+// EncodePCM encodes raw mono pcm16 at the upstream output rate to downlink
+// opus frames, e.g. audio pushed to the device instead of model output.
+func (c *Converter) EncodePCM(pcm []byte) error {
+	return c.parseFrames(pcm)
+}
+
+// encodeUpstream transcodes pcm16 to the upstream input format.
+func (c *Converter) encodeUpstream(pcm []byte) []byte {
+	if !IsG711(c.upstream.InputFormat) {
+		return pcm
+	}
+	c.upPcm = BytesToInt16(c.upPcm, pcm)
+	if c.upstream.InputFormat == FormatG711Ulaw {
+		c.upCodec = ULawEncode(c.upCodec, c.upPcm)
+	} else {
+		c.upCodec = ALawEncode(c.upCodec, c.upPcm)
 	}
-	return buf.Bytes()
+	return c.upCodec
 }
 
-func (c *Converter) gain(input []int16, f float32) []int16 {
-	output := make([]int16, len(input))
-	for i, sample := range input {
-		adjustedSample := float32(sample) * f
-		if adjustedSample > math.MaxInt16 {
-			output[i] = math.MaxInt16
-		} else if adjustedSample < math.MinInt16 {
-			output[i] = math.MinInt16
-		} else {
-			output[i] = int16(adjustedSample)
-		}
+// decodeUpstream transcodes upstream output audio to pcm16.
+func (c *Converter) decodeUpstream(data []byte) []byte {
+	if !IsG711(c.upstream.OutputFormat) {
+		return data
 	}
-	return output
+	if c.upstream.OutputFormat == FormatG711Ulaw {
+		c.downPcm = ULawDecode(c.downPcm, data)
+	} else {
+		c.downPcm = ALawDecode(c.downPcm, data)
+	}
+	c.downCodec = Int16ToBytes(c.downCodec, c.downPcm)
+	return c.downCodec
 }
 
-func (c *Converter) ResolvePCM(base64Str string) error {
-	delta, err := base64.StdEncoding.DecodeString(base64Str)
+func (c *Converter) parseFrames(audioDelta []byte) error {
+	resampled, err := c.downReSampler.Handle(audioDelta)
 	if err != nil {
-		return errors.New("base64 decode failed, err: " + err.Error())
+		return fmt.Errorf("resample pcm delta: %w", err)
 	}
-	c.parseFrames(delta)
-	return nil
+	c.appendDown(resampled)
+	return c.encodeFrames(false)
+}
+
+// appendDown converts resampled mono pcm to downlink samples in c.delta.
+func (c *Converter) appendDown(pcm []byte) {
+	c.downPcm = BytesToInt16(c.downPcm, pcm)
+	applyGain(c.downPcm, c.downGain)
+	c.delta = c.interleave(c.delta, c.downPcm)
+}
+
+// Flush encodes the pcm still pending at the end of a response. The last
+// frame is padded with silence so no audio is dropped or carried over.
+func (c *Converter) Flush() error {
+	tail, err := c.downReSampler.Flush()
+	if err != nil {
+		c.Reset()
+		return errors.New("downReSampler flush failed, err: " + err.Error())
+	}
+	if len(tail) > 0 {
+		c.appendDown(tail)
+	}
+	return c.encodeFrames(true)
 }
 
-func (c *Converter) parseFrames(audioDelta []byte) {
-	c.delta = append(c.delta, c.gain(c.bytesToInt16(audioDelta), 8)...)
-	chunk := c.DownDuration * c.DownSampleRate / 1000
+// Reset drops the pending downlink audio, e.g. when a response is cancelled.
+func (c *Converter) Reset() {
+	c.delta = c.delta[:0]
+	c.downReSampler.Reset()
+	_ = c.Encoder.Reset()
+}
 
-	var rest []int16
-	if len(c.delta)%chunk != 0 {
-		rest = c.delta[len(c.delta)-len(c.delta)%chunk:]
-		c.delta = c.delta[:len(c.delta)-len(c.delta)%chunk]
+// encodeFrames encodes every complete frame in c.delta and keeps the rest,
+// or pads the rest to a complete frame when pad is set. A frame that fails
+// to encode is skipped, the first error is returned.
+func (c *Converter) encodeFrames(pad bool) error {
+	chunk := c.DownDuration * c.DownSampleRate / 1000 * c.DownChannels
+	if rest := len(c.delta) % chunk; pad && rest != 0 {
+		n := len(c.delta)
+		c.delta = grow(c.delta, n+chunk-rest)
+		clear(c.delta[n:])
 	}
 
-	for i := 0; i < len(c.delta); i += chunk {
-		data := make([]byte, 2048)
-		n, err := c.Encoder.Encode(c.delta[i:i+chunk], data)
+	buf := getBytes(maxOpusPacket)
+	defer putBytes(buf)
+	full := len(c.delta) - len(c.delta)%chunk
+	var firstErr error
+	for i := 0; i < full; i += chunk {
+		n, err := c.Encoder.Encode(c.delta[i:i+chunk], *buf)
 		if err != nil {
-			fmt.Println("Error encoding Opus frame:", err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("encode opus frame: %w", err)
+			}
+			continue
 		}
-		c.cb(nil, data[:n])
+		// 数据包会进入写队列，必须拷贝
+		c.cb(nil, append([]byte(nil), (*buf)[:n]...))
 	}
-	c.delta = rest
+	c.delta = c.delta[:copy(c.delta, c.delta[full:])]
+	return firstErr
 }
 
-func (c *Converter) bytesToInt16(b []byte) []int16 {
-	buf := bytes.NewReader(b)
-	var result []int16
-	for {
-		var num int16
-		err := binary.Read(buf, binary.LittleEndian, &num)
-		if err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
-			return nil
+// interleave appends mono samples to dst, duplicated into every downlink channel.
+func (c *Converter) interleave(dst, mono []int16) []int16 {
+	if c.DownChannels <= 1 {
+		return append(dst, mono...)
+	}
+	n := len(dst)
+	dst = grow(dst, n+len(mono)*c.DownChannels)
+	for i, v := range mono {
+		for ch := 0; ch < c.DownChannels; ch++ {
+			dst[n+i*c.DownChannels+ch] = v
 		}
-		result = append(result, num)
 	}
-	return result
+	return dst
 }
 
 func (c *Converter) pcm2opus(audioData []byte) ([][]byte, error) {
@@ -212,10 +430,7 @@ func (c *Converter) pcm2opus(audioData []byte) ([][]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create encoder: %w", err)
 	}
-	samples := make([]int16, len(audioData)/2)
-	for i := 0; i < len(audioData); i += 2 {
-		samples[i/2] = int16(binary.LittleEndian.Uint16(audioData[i:]))
-	}
+	samples := BytesToInt16(nil, audioData)
 
 	numFrames := (len(samples) + c.FrameSize - 1) / c.FrameSize
 	opusFrames := make([][]byte, 0, numFrames)
@@ -248,23 +463,9 @@ func (c *Converter) pcm2opus(audioData []byte) ([][]byte, error) {
 }
 
 func (c *Converter) Pcm16encode(data []byte) []int16 {
-	var pcm []int16
-	buf := bytes.NewBuffer(data)
-	for {
-		var sample int16
-		err := binary.Read(buf, binary.LittleEndian, &sample)
-		if err != nil {
-			break
-		}
-		pcm = append(pcm, sample)
-	}
-	return pcm
+	return BytesToInt16(nil, data)
 }
 
 func (c *Converter) Pcm16decode(pcm []int16) []byte {
-	buf := new(bytes.Buffer)
-	for _, sample := range pcm {
-		_ = binary.Write(buf, binary.LittleEndian, sample)
-	}
-	return buf.Bytes()
+	return Int16ToBytes(nil, pcm)
 }
@@ -0,0 +1,150 @@
+package audio
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func sinePcm(sampleRate, ms int) []byte {
+	n := sampleRate * ms / 1000
+	pcm := make([]byte, n*2)
+	for i := 0; i < n; i++ {
+		v := int16(3000 * math.Sin(2*math.Pi*440*float64(i)/float64(sampleRate)))
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(v))
+	}
+	return pcm
+}
+
+// feed sends pcm to the converter as 24k deltas of deltaMs each.
+func feed(t *testing.T, c *Converter, pcm []byte, deltaMs int) {
+	t.Helper()
+	step := DefaultDownPcmSR * deltaMs / 1000 * 2
+	for i := 0; i < len(pcm); i += step {
+		end := min(i+step, len(pcm))
+		if err := c.ResolvePCM(base64.StdEncoding.EncodeToString(pcm[i:end])); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestConverter(down Params, frames *int) *Converter {
+	up := Params{SampleRate: 16000, Channels: 1, FrameDuration: 60}
+	return NewConverter(up, down, func(ctx context.Context, data any) error {
+		*frames++
+		return nil
+	})
+}
+
+func ceilFrames(ms, frameMs int) int {
+	return (ms + frameMs - 1) / frameMs
+}
+
+func TestConverterFlushKeepsDuration(t *testing.T) {
+	cases := []struct {
+		name    string
+		down    Params
+		inputMs int
+		deltaMs int
+	}{
+		{"24k exact frames", Params{24000, 1, 60}, 1200, 100},
+		{"24k partial tail", Params{24000, 1, 60}, 1030, 70},
+		{"24k 20ms frames", Params{24000, 1, 20}, 1010, 50},
+		{"16k partial tail", Params{16000, 1, 60}, 1030, 70},
+		{"16k 20ms frames", Params{16000, 1, 20}, 990, 30},
+		{"48k stereo", Params{48000, 2, 40}, 1050, 90},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			frames := 0
+			c := newTestConverter(tc.down, &frames)
+			feed(t, c, sinePcm(DefaultDownPcmSR, tc.inputMs), tc.deltaMs)
+			if err := c.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			want := ceilFrames(tc.inputMs, tc.down.FrameDuration)
+			if frames != want {
+				t.Fatalf("got %d frames (%dms), want %d (%dms)",
+					frames, frames*tc.down.FrameDuration, want, tc.inputMs)
+			}
+			if len(c.delta) != 0 {
+				t.Fatalf("pending %d samples after flush", len(c.delta))
+			}
+		})
+	}
+}
+
+func TestConverterFlushDoesNotLeakIntoNextResponse(t *testing.T) {
+	frames := 0
+	down := Params{SampleRate: 16000, Channels: 1, FrameDuration: 60}
+	c := newTestConverter(down, &frames)
+	for i := 0; i < 3; i++ {
+		frames = 0
+		feed(t, c, sinePcm(DefaultDownPcmSR, 1030), 70)
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if want := ceilFrames(1030, 60); frames != want {
+			t.Fatalf("response %d: got %d frames, want %d", i, frames, want)
+		}
+	}
+}
+
+func TestConverterResetDropsPending(t *testing.T) {
+	frames := 0
+	down := Params{SampleRate: 24000, Channels: 1, FrameDuration: 60}
+	c := newTestConverter(down, &frames)
+	feed(t, c, sinePcm(DefaultDownPcmSR, 90), 90)
+	if frames != 1 {
+		t.Fatalf("got %d frames before reset, want 1", frames)
+	}
+	c.Reset()
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if frames != 1 {
+		t.Fatalf("got %d frames after reset and flush, want 1", frames)
+	}
+}
+
+func TestConverterG711Upstream(t *testing.T) {
+	frames := 0
+	upstream := Upstream{InputFormat: FormatG711Alaw, OutputFormat: FormatG711Ulaw}
+	c := NewConverter(Params{16000, 1, 60}, Params{16000, 1, 60},
+		func(ctx context.Context, data any) error {
+			frames++
+			return nil
+		}, WithUpstream(upstream))
+
+	ulaw := ULawEncode(nil, BytesToInt16(nil, sinePcm(G711SampleRate, 1030)))
+	for i := 0; i < len(ulaw); i += 560 {
+		end := min(i+560, len(ulaw))
+		if err := c.ResolvePCM(base64.StdEncoding.EncodeToString(ulaw[i:end])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := ceilFrames(1030, 60); frames != want {
+		t.Fatalf("got %d frames, want %d", frames, want)
+	}
+
+	// 上行 16k 60ms 一帧，转为 8k A-law 应为 480 字节
+	enc, _ := newEncoder(16000, 1, EncoderProfile{})
+	packet := make([]byte, maxOpusPacket)
+	n, err := enc.Encode(BytesToInt16(nil, sinePcm(16000, 60)), packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64, err := c.OpusToPcmBase64(packet[:n], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alaw, _ := base64.StdEncoding.DecodeString(b64)
+	if len(alaw) < 440 || len(alaw) > 480 {
+		t.Fatalf("got %d a-law bytes for 60ms, want about 480", len(alaw))
+	}
+}
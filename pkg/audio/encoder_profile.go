@@ -0,0 +1,111 @@
+package audio
+
+import (
+	"fmt"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	// 下行积压超过该时长时降级编码，低于恢复阈值时还原
+	adaptDegradeBacklogMs = 600
+	adaptRestoreBacklogMs = 120
+	adaptDegradedBitrate  = 12000
+	adaptDegradedLoss     = 20
+)
+
+// EncoderProfile configures the downlink opus encoder.
+type EncoderProfile struct {
+	Application string // voip, audio, lowdelay
+	Bitrate     int    // bps, 0 keeps the encoder default
+	Complexity  int    // 1-10, 0 keeps the encoder default
+	DTX         bool
+	FEC         bool
+	PacketLoss  int  // expected loss percent, tunes FEC
+	Adaptive    bool // degrade while downlink frames back up
+}
+
+func (p EncoderProfile) application() (opus.Application, error) {
+	switch p.Application {
+	case "", "voip":
+		return opus.AppVoIP, nil
+	case "audio":
+		return opus.AppAudio, nil
+	case "lowdelay":
+		return opus.AppRestrictedLowdelay, nil
+	default:
+		return 0, fmt.Errorf("invalid opus application: %s", p.Application)
+	}
+}
+
+// apply sets the profile on the encoder, leaving zero values at their defaults.
+func (p EncoderProfile) apply(enc *opus.Encoder) error {
+	if p.Bitrate > 0 {
+		if err := enc.SetBitrate(p.Bitrate); err != nil {
+			return fmt.Errorf("set bitrate %d: %w", p.Bitrate, err)
+		}
+	} else if err := enc.SetBitrateToAuto(); err != nil {
+		return fmt.Errorf("set bitrate auto: %w", err)
+	}
+	if p.Complexity > 0 {
+		if err := enc.SetComplexity(p.Complexity); err != nil {
+			return fmt.Errorf("set complexity %d: %w", p.Complexity, err)
+		}
+	}
+	if err := enc.SetDTX(p.DTX); err != nil {
+		return fmt.Errorf("set dtx: %w", err)
+	}
+	if err := enc.SetInBandFEC(p.FEC); err != nil {
+		return fmt.Errorf("set fec: %w", err)
+	}
+	if err := enc.SetPacketLossPerc(p.PacketLoss); err != nil {
+		return fmt.Errorf("set packet loss %d: %w", p.PacketLoss, err)
+	}
+	return nil
+}
+
+// degraded returns the profile used while the downlink is congested.
+func (p EncoderProfile) degraded() EncoderProfile {
+	d := p
+	d.Bitrate = adaptDegradedBitrate
+	if p.Bitrate > 0 && p.Bitrate/2 < d.Bitrate {
+		d.Bitrate = max(p.Bitrate/2, 6000)
+	}
+	d.FEC = true
+	d.PacketLoss = max(p.PacketLoss, adaptDegradedLoss)
+	return d
+}
+
+func newEncoder(sampleRate, channels int, profile EncoderProfile) (*opus.Encoder, error) {
+	app, err := profile.application()
+	if err != nil {
+		return nil, err
+	}
+	enc, err := opus.NewEncoder(sampleRate, channels, app)
+	if err != nil {
+		return nil, err
+	}
+	if err := profile.apply(enc); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// AdaptToBacklog switches an adaptive encoder to a lower bitrate with FEC
+// while backlogMs of downlink audio is waiting to be written, and restores
+// the configured profile once the backlog drains.
+func (c *Converter) AdaptToBacklog(backlogMs int) {
+	if !c.profile.Adaptive {
+		return
+	}
+	switch {
+	case !c.degraded && backlogMs >= adaptDegradeBacklogMs:
+		if err := c.profile.degraded().apply(c.Encoder); err == nil {
+			c.degraded = true
+		}
+	case c.degraded && backlogMs <= adaptRestoreBacklogMs:
+		if err := c.profile.apply(c.Encoder); err == nil {
+			c.degraded = false
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package audio
+
+import "testing"
+
+func TestAdaptToBacklog(t *testing.T) {
+	profile := EncoderProfile{Bitrate: 32000, PacketLoss: 5, Adaptive: true}
+	c := NewConverter(Params{16000, 1, 60}, Params{24000, 1, 60}, nil, WithEncoderProfile(profile))
+
+	check := func(bitrate int, fec bool) {
+		t.Helper()
+		if got, _ := c.Encoder.Bitrate(); got != bitrate {
+			t.Fatalf("bitrate = %d, want %d", got, bitrate)
+		}
+		if got, _ := c.Encoder.InBandFEC(); got != fec {
+			t.Fatalf("fec = %v, want %v", got, fec)
+		}
+	}
+
+	check(32000, false)
+	c.AdaptToBacklog(adaptDegradeBacklogMs)
+	check(adaptDegradedBitrate, true)
+	c.AdaptToBacklog(adaptRestoreBacklogMs + 1)
+	check(adaptDegradedBitrate, true)
+	c.AdaptToBacklog(0)
+	check(32000, false)
+}
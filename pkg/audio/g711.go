@@ -0,0 +1,129 @@
+package audio
+
+// G.711 μ-law and A-law codecs, 8 bits per sample at 8 kHz.
+
+const (
+	G711SampleRate = 8000
+
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+var (
+	ulawTable  [256]int16
+	alawTable  [256]int16
+	alawSegEnd = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+)
+
+func init() {
+	for i := 0; i < 256; i++ {
+		ulawTable[i] = ulawToLinear(byte(i))
+		alawTable[i] = alawToLinear(byte(i))
+	}
+}
+
+func linearToULaw(sample int16) byte {
+	v := int(sample)
+	sign := 0
+	if v < 0 {
+		v = -v
+		sign = 0x80
+	}
+	if v > ulawClip {
+		v = ulawClip
+	}
+	v += ulawBias
+	exponent := 7
+	for mask := 0x4000; v&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (v >> (exponent + 3)) & 0x0F
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0F) << 3) + ulawBias
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return int16(ulawBias - t)
+	}
+	return int16(t - ulawBias)
+}
+
+func linearToALaw(sample int16) byte {
+	v := int(sample) >> 3
+	mask := 0xD5
+	if v < 0 {
+		mask = 0x55
+		v = -v - 1
+	}
+	seg := 0
+	for seg < len(alawSegEnd) && v > alawSegEnd[seg] {
+		seg++
+	}
+	if seg >= len(alawSegEnd) {
+		return byte(0x7F ^ mask)
+	}
+	aval := seg << 4
+	if seg < 2 {
+		aval |= (v >> 1) & 0x0F
+	} else {
+		aval |= (v >> seg) & 0x0F
+	}
+	return byte(aval ^ mask)
+}
+
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0F) << 4
+	switch seg := int(a&0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// ULawEncode encodes the samples as μ-law into dst, reusing its capacity.
+func ULawEncode(dst []byte, pcm []int16) []byte {
+	dst = grow(dst, len(pcm))
+	for i, v := range pcm {
+		dst[i] = linearToULaw(v)
+	}
+	return dst
+}
+
+// ULawDecode decodes μ-law bytes into dst, reusing its capacity.
+func ULawDecode(dst []int16, b []byte) []int16 {
+	dst = grow(dst, len(b))
+	for i, v := range b {
+		dst[i] = ulawTable[v]
+	}
+	return dst
+}
+
+// ALawEncode encodes the samples as A-law into dst, reusing its capacity.
+func ALawEncode(dst []byte, pcm []int16) []byte {
+	dst = grow(dst, len(pcm))
+	for i, v := range pcm {
+		dst[i] = linearToALaw(v)
+	}
+	return dst
+}
+
+// ALawDecode decodes A-law bytes into dst, reusing its capacity.
+func ALawDecode(dst []int16, b []byte) []int16 {
+	dst = grow(dst, len(b))
+	for i, v := range b {
+		dst[i] = alawTable[v]
+	}
+	return dst
+}
@@ -0,0 +1,60 @@
+package audio
+
+import "testing"
+
+func TestG711KnownValues(t *testing.T) {
+	if got := linearToULaw(0); got != 0xFF {
+		t.Fatalf("ulaw(0) = %#x, want 0xff", got)
+	}
+	if got := linearToALaw(0); got != 0xD5 {
+		t.Fatalf("alaw(0) = %#x, want 0xd5", got)
+	}
+	if got := ulawToLinear(0xFF); got != 0 {
+		t.Fatalf("ulaw⁻¹(0xff) = %d, want 0", got)
+	}
+	if got := alawToLinear(0xD5); got != 8 {
+		t.Fatalf("alaw⁻¹(0xd5) = %d, want 8", got)
+	}
+}
+
+func TestG711RoundTrip(t *testing.T) {
+	codecs := []struct {
+		name   string
+		encode func([]byte, []int16) []byte
+		decode func([]int16, []byte) []int16
+	}{
+		{"ulaw", ULawEncode, ULawDecode},
+		{"alaw", ALawEncode, ALawDecode},
+	}
+	pcm := make([]int16, 0, 65536/16)
+	for v := -32768; v < 32768; v += 16 {
+		pcm = append(pcm, int16(v))
+	}
+	for _, codec := range codecs {
+		t.Run(codec.name, func(t *testing.T) {
+			got := codec.decode(nil, codec.encode(nil, pcm))
+			for i, v := range pcm {
+				diff := int(got[i]) - int(v)
+				if diff < 0 {
+					diff = -diff
+				}
+				// 8 位对数量化，误差不超过所在段步长的一半左右
+				if limit := max(abs(int(v))/16, 16); diff > limit {
+					t.Fatalf("%d decoded as %d, diff %d > %d", v, got[i], diff, limit)
+				}
+			}
+			// 编解码后再编码应保持不变
+			again := codec.encode(nil, got)
+			if first := codec.encode(nil, pcm); string(first) != string(again) {
+				t.Fatal("re-encoding decoded samples changed the code words")
+			}
+		})
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
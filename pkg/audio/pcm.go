@@ -0,0 +1,78 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"unsafe"
+)
+
+// maxOpusPacket is the packet buffer size recommended by libopus.
+const maxOpusPacket = 4000
+
+// bytePool holds transient byte buffers shared by all sessions.
+var bytePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, maxOpusPacket)
+		return &b
+	},
+}
+
+func getBytes(n int) *[]byte {
+	b := bytePool.Get().(*[]byte)
+	if cap(*b) < n {
+		*b = make([]byte, n)
+	}
+	*b = (*b)[:n]
+	return b
+}
+
+func putBytes(b *[]byte) {
+	bytePool.Put(b)
+}
+
+// grow returns s resized to n elements, reusing its backing array if possible.
+func grow[T any](s []T, n int) []T {
+	if cap(s) < n {
+		return make([]T, n, n+n/4)
+	}
+	return s[:n]
+}
+
+// BytesToInt16 decodes little-endian pcm16 into dst, reusing its capacity.
+// A trailing odd byte is ignored.
+func BytesToInt16(dst []int16, b []byte) []int16 {
+	dst = grow(dst, len(b)/2)
+	for i := range dst {
+		dst[i] = int16(binary.LittleEndian.Uint16(b[2*i:]))
+	}
+	return dst
+}
+
+// Int16ToBytes encodes samples as little-endian pcm16 into dst, reusing its capacity.
+func Int16ToBytes(dst []byte, s []int16) []byte {
+	dst = grow(dst, len(s)*2)
+	for i, v := range s {
+		binary.LittleEndian.PutUint16(dst[2*i:], uint16(v))
+	}
+	return dst
+}
+
+// applyGain scales the samples in place, clipping to the int16 range.
+func applyGain(pcm []int16, f float32) {
+	for i, sample := range pcm {
+		adjustedSample := float32(sample) * f
+		if adjustedSample > math.MaxInt16 {
+			pcm[i] = math.MaxInt16
+		} else if adjustedSample < math.MinInt16 {
+			pcm[i] = math.MinInt16
+		} else {
+			pcm[i] = int16(adjustedSample)
+		}
+	}
+}
+
+// strBytes returns the bytes of s without copying; they must not be modified.
+func strBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
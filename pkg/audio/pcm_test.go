@@ -0,0 +1,120 @@
+package audio
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+var benchRates = []int{16000, 24000, 48000}
+
+func TestPcmRoundTrip(t *testing.T) {
+	pcm := sinePcm(24000, 60)
+	samples := BytesToInt16(nil, pcm)
+	if len(samples) != len(pcm)/2 {
+		t.Fatalf("got %d samples, want %d", len(samples), len(pcm)/2)
+	}
+	if got := Int16ToBytes(nil, samples); string(got) != string(pcm) {
+		t.Fatal("pcm round trip mismatch")
+	}
+}
+
+// In steady state a downlink frame only allocates the packet handed to the
+// callback and its boxing into the callback's any argument.
+func TestResolvePCMAllocsPerFrame(t *testing.T) {
+	for _, rate := range benchRates {
+		t.Run(fmt.Sprint(rate), func(t *testing.T) {
+			c := NewConverter(Params{16000, 1, 60}, Params{rate, 1, 60},
+				func(ctx context.Context, data any) error { return nil })
+			delta := base64.StdEncoding.EncodeToString(sinePcm(DefaultDownPcmSR, 60))
+			allocs := testing.AllocsPerRun(100, func() {
+				_ = c.ResolvePCM(delta)
+			})
+			if allocs > 2 {
+				t.Fatalf("%.1f allocs per frame, want <= 2", allocs)
+			}
+		})
+	}
+}
+
+func BenchmarkBytesToInt16(b *testing.B) {
+	pcm := sinePcm(24000, 60)
+	var dst []int16
+	b.SetBytes(int64(len(pcm)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = BytesToInt16(dst, pcm)
+	}
+}
+
+func BenchmarkInt16ToBytes(b *testing.B) {
+	samples := BytesToInt16(nil, sinePcm(24000, 60))
+	var dst []byte
+	b.SetBytes(int64(len(samples) * 2))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = Int16ToBytes(dst, samples)
+	}
+}
+
+func BenchmarkResample(b *testing.B) {
+	for _, rate := range benchRates {
+		b.Run(fmt.Sprintf("24k-%dk", rate/1000), func(b *testing.B) {
+			r, _ := NewGoResampler(1, DefaultDownPcmSR, rate)
+			pcm := sinePcm(DefaultDownPcmSR, 60)
+			b.SetBytes(int64(len(pcm)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.Handle(pcm); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkResolvePCM measures one 60ms upstream delta, i.e. one downlink frame.
+func BenchmarkResolvePCM(b *testing.B) {
+	for _, rate := range benchRates {
+		b.Run(fmt.Sprintf("%dk", rate/1000), func(b *testing.B) {
+			c := NewConverter(Params{16000, 1, 60}, Params{rate, 1, 60},
+				func(ctx context.Context, data any) error { return nil })
+			pcm := sinePcm(DefaultDownPcmSR, 60)
+			delta := base64.StdEncoding.EncodeToString(pcm)
+			b.SetBytes(int64(len(pcm)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := c.ResolvePCM(delta); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkOpusToPcmBase64 measures one uplink frame from the device.
+func BenchmarkOpusToPcmBase64(b *testing.B) {
+	for _, rate := range benchRates {
+		b.Run(fmt.Sprintf("%dk", rate/1000), func(b *testing.B) {
+			up := Params{rate, 1, 60}
+			c := NewConverter(up, Params{24000, 1, 60}, nil)
+			enc, err := newEncoder(rate, 1, EncoderProfile{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			packet := make([]byte, maxOpusPacket)
+			n, err := enc.Encode(BytesToInt16(nil, sinePcm(rate, 60)), packet)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(up.FrameSize() * 2))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.OpusToPcmBase64(packet[:n], 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,14 +1,19 @@
 package audio
 
 import (
+	"encoding/binary"
 	"fmt"
 )
 
 type ResampleOperator interface {
 	// 获取执行参数
 	GetRate() (int, int, int)
-	// 执行重采样
+	// 执行重采样，返回的数据在下次调用前有效
 	Handle(pcm []byte) (npcm []byte, err error)
+	// 输出缓存的尾部样本并重置状态
+	Flush() (npcm []byte, err error)
+	// 丢弃缓存并重置状态
+	Reset()
 }
 
 // sample rate resampler.
@@ -28,6 +33,11 @@ type goResampler struct {
 	// Total consumed samples.
 	lcs uint64 // For channel=0
 	rcs uint64 // For channel=1
+
+	// Reused buffers: cache+input samples, output samples and output pcm.
+	lin, rin   []int16
+	lout, rout []int16
+	out        []byte
 }
 
 // NewGoResampler Create resampler to transform pcm
@@ -74,74 +84,102 @@ func (v *goResampler) Handle(pcm []byte) (npcm []byte, err error) {
 		return nil, fmt.Errorf("invalid pcm, atleast 4samples, actual %vsamples", nbSamles)
 	}
 
-	// Convert pcm to int16 values
-	ipcmLeft := resampleInitChannel(pcm, v.channels, 0)
-	ipcmRight := resampleInitChannel(pcm, v.channels, 1)
-	if ipcmRight != nil && len(ipcmLeft) != len(ipcmRight) {
-		return nil, fmt.Errorf("invalid pcm, L%v!=%v", len(ipcmLeft), len(ipcmRight))
-	}
-
-	// Insert the cache at the beginning.
-	if v.lcache != nil {
-		ipcmLeft = append(v.lcache, ipcmLeft...)
-		v.lcache = nil
-	}
-	if ipcmRight != nil && v.rcache != nil {
-		ipcmRight = append(v.rcache, ipcmRight...)
-		v.rcache = nil
+	// Convert pcm to int16 values, after the cached samples.
+	v.lin = resampleInitChannel(append(v.lin[:0], v.lcache...), pcm, v.channels, 0)
+	if v.channels > 1 {
+		v.rin = resampleInitChannel(append(v.rin[:0], v.rcache...), pcm, v.channels, 1)
 	}
 
 	// Resample all channels
 	var consumed int
-	var opcmLeft []int16
-	if opcmLeft, consumed, err = resampleChannel(ipcmLeft, v.isr, v.osr, v.lws, v.lcs); err != nil {
+	if v.lout, consumed, err = resampleChannel(v.lout[:0], v.lin, v.isr, v.osr, v.lws, v.lcs); err != nil {
 		return nil, err
 	}
-	v.lws += uint64(len(opcmLeft))
+	v.lws += uint64(len(v.lout))
 	v.lcs += uint64(consumed)
-	if consumed < len(ipcmLeft) {
-		v.lcache = ipcmLeft[consumed:]
-	}
+	v.lcache = append(v.lcache[:0], v.lin[consumed:]...)
 
 	var opcmRight []int16
-	if ipcmRight != nil {
-		if opcmRight, consumed, err = resampleChannel(ipcmRight, v.isr, v.osr, v.rws, v.rcs); err != nil {
+	if v.channels > 1 {
+		if v.rout, consumed, err = resampleChannel(v.rout[:0], v.rin, v.isr, v.osr, v.rws, v.rcs); err != nil {
 			return nil, err
 		}
-		v.rws += uint64(len(opcmRight))
+		v.rws += uint64(len(v.rout))
 		v.rcs += uint64(consumed)
-		if consumed < len(ipcmRight) {
-			v.rcache = ipcmRight[consumed:]
+		v.rcache = append(v.rcache[:0], v.rin[consumed:]...)
+		if len(v.rout) != len(v.lout) {
+			return nil, fmt.Errorf("invalid pcm, L%v!=%v", len(v.lout), len(v.rout))
 		}
+		opcmRight = v.rout
 	}
 
 	// Convert int16 samples to bytes.
-	npcm = resampleMerge(opcmLeft, opcmRight)
-
-	return
+	v.out = resampleMerge(v.out, v.lout, opcmRight)
+	return v.out, nil
 }
 
-// merge left and right(can be nil).
-func resampleMerge(left, right []int16) (npcm []byte) {
-	npcm = []byte{}
-	for i := 0; i < len(left); i++ {
-		v := left[i]
-		npcm = append(npcm, byte(v))
-		npcm = append(npcm, byte(v>>8))
-
-		if right != nil {
-			v = right[i]
-			npcm = append(npcm, byte(v))
-			npcm = append(npcm, byte(v>>8))
+// Flush resamples the samples held back for interpolation, padding them with
+// the last sample, then resets the resampler for the next stream.
+func (v *goResampler) Flush() (npcm []byte, err error) {
+	defer v.Reset()
+	if v.isr == v.osr {
+		return nil, nil
+	}
+
+	var opcmRight []int16
+	if v.lout, err = resampleFlushChannel(v.lout[:0], v.lcache, v.isr, v.osr, v.lws, v.lcs); err != nil {
+		return nil, err
+	}
+	if v.channels > 1 {
+		if v.rout, err = resampleFlushChannel(v.rout[:0], v.rcache, v.isr, v.osr, v.rws, v.rcs); err != nil {
+			return nil, err
+		}
+		if len(v.rout) != len(v.lout) {
+			return nil, fmt.Errorf("invalid flush, L%v!=%v", len(v.lout), len(v.rout))
 		}
+		opcmRight = v.rout
 	}
-	return
+	v.out = resampleMerge(v.out, v.lout, opcmRight)
+	return v.out, nil
+}
+
+func (v *goResampler) Reset() {
+	v.lcache, v.rcache = v.lcache[:0], v.rcache[:0]
+	v.lws, v.rws = 0, 0
+	v.lcs, v.rcs = 0, 0
+}
+
+func resampleFlushChannel(opcm, cache []int16, isr, osr int, written, org uint64) ([]int16, error) {
+	if len(cache) == 0 {
+		return opcm, nil
+	}
+	// resampleChannel keeps the last 16 samples, pad so all cached ones are used.
+	last := cache[len(cache)-1]
+	for i := 0; i < 16; i++ {
+		cache = append(cache, last)
+	}
+	opcm, _, err := resampleChannel(opcm, cache, isr, osr, written, org)
+	return opcm, err
+}
+
+// merge left and right(can be nil) into dst.
+func resampleMerge(dst []byte, left, right []int16) []byte {
+	if right == nil {
+		return Int16ToBytes(dst, left)
+	}
+	dst = grow(dst, len(left)*4)
+	for i := range left {
+		binary.LittleEndian.PutUint16(dst[4*i:], uint16(left[i]))
+		binary.LittleEndian.PutUint16(dst[4*i+2:], uint16(right[i]))
+	}
+	return dst
 }
 
 // x is the position of output pcm
-func resampleChannel(ipcm []int16, isr, osr int, written, org uint64) (opcm []int16, consumed int, err error) {
+func resampleChannel(opcm, ipcm []int16, isr, osr int, written, org uint64) ([]int16, int, error) {
+	consumed := 0
 	if len(ipcm) <= 16 {
-		return nil, 0, nil
+		return opcm, 0, nil
 	}
 
 	// The samples we can use to resample
@@ -158,69 +196,41 @@ func resampleChannel(ipcm []int16, isr, osr int, written, org uint64) (opcm []in
 	for x := x0; x < float64(last); x += step {
 		// Generate xi,yi,xo,yo
 		xi0 := float64(uint64(x))
-		xi := []float64{xi0, xi0 + 1, xi0 + 2, xi0 + 3}
+		xi := [4]float64{xi0, xi0 + 1, xi0 + 2, xi0 + 3}
 		yi0 := int(uint64(xi0) - org)
-		yi := []float64{float64(ipcm[yi0]), float64(ipcm[yi0+1]), float64(ipcm[yi0+2]), float64(ipcm[yi0+3])}
-		xo := []float64{x}
-		yo := []float64{0.0}
-		if err = spline(xi, yi, xo, yo); err != nil {
-			return
-		}
+		yi := [4]float64{float64(ipcm[yi0]), float64(ipcm[yi0+1]), float64(ipcm[yi0+2]), float64(ipcm[yi0+3])}
 
 		// convert yo
-		opcm = append(opcm, int16(yo[0]))
+		opcm = append(opcm, int16(spline(xi, yi, x)))
 		consumed = int(uint64(x)-org) + 1
 	}
 
-	return
+	return opcm, consumed, nil
 }
 
-func resampleInitChannel(pcm []byte, channels, channel int) (ipcm []int16) {
-	if channel >= channels {
-		return
-	}
-
-	ipcm = []int16{}
+// resampleInitChannel appends the samples of one channel of pcm to ipcm.
+func resampleInitChannel(ipcm []int16, pcm []byte, channels, channel int) []int16 {
 	for i := 2 * channel; i < len(pcm); i += 2 * channels {
 		// 16bits le sample
-		v := (int16(pcm[i])) | (int16(pcm[i+1]) << 8)
-		ipcm = append(ipcm, v)
+		ipcm = append(ipcm, int16(binary.LittleEndian.Uint16(pcm[i:])))
 	}
-
-	return
+	return ipcm
 }
 
-func spline(xi, yi, xo, yo []float64) (err error) {
-	if len(xi) != 4 {
-		return fmt.Errorf("invalid xi")
-	}
-	if len(yi) != 4 {
-		return fmt.Errorf("invalid yi")
-	}
-	if len(xo) == 0 {
-		return fmt.Errorf("invalid xo")
-	}
-	if len(yo) != len(xo) {
-		return fmt.Errorf("invalid yo")
-	}
-
+// spline interpolates the value at x from 4 points with a natural cubic spline.
+func spline(xi, yi [4]float64, x float64) float64 {
 	x0, x1, x2, x3 := xi[0], xi[1], xi[2], xi[3]
 	y0, y1, y2, y3 := yi[0], yi[1], yi[2], yi[3]
 	h0, h1, h2, _, u1, l2, _ := spline_lu(xi)
 	c1, c2 := spline_c1(yi, h0, h1), spline_c2(yi, h1, h2)
 	m1, m2 := spline_m1(c1, c2, u1, l2), spline_m2(c1, c2, u1, l2) // m0=m3=0
 
-	for k, v := range xo {
-		if v <= x1 {
-			yo[k] = spline_z0(m1, h0, x0, x1, y0, y1, v)
-		} else if v <= x2 {
-			yo[k] = spline_z1(m1, m2, h1, x1, x2, y1, y2, v)
-		} else {
-			yo[k] = spline_z2(m2, h2, x2, x3, y2, y3, v)
-		}
+	if x <= x1 {
+		return spline_z0(m1, h0, x0, x1, y0, y1, x)
+	} else if x <= x2 {
+		return spline_z1(m1, m2, h1, x1, x2, y1, y2, x)
 	}
-
-	return
+	return spline_z2(m2, h2, x2, x3, y2, y3, x)
 }
 
 func spline_z0(m1, h0, x0, x1, y0, y1, x float64) float64 {
@@ -257,17 +267,17 @@ func spline_m2(c1, c2, u1, l2 float64) float64 {
 	return (c1/2 - c2/l2) / (u1/2 - 2/l2)
 }
 
-func spline_c1(yi []float64, h0, h1 float64) float64 {
+func spline_c1(yi [4]float64, h0, h1 float64) float64 {
 	y0, y1, y2, _ := yi[0], yi[1], yi[2], yi[3]
 	return 6.0 / (h0 + h1) * ((y2-y1)/h1 - (y1-y0)/h0)
 }
 
-func spline_c2(yi []float64, h1, h2 float64) float64 {
+func spline_c2(yi [4]float64, h1, h2 float64) float64 {
 	_, y1, y2, y3 := yi[0], yi[1], yi[2], yi[3]
 	return 6.0 / (h1 + h2) * ((y3-y2)/h2 - (y2-y1)/h1)
 }
 
-func spline_lu(xi []float64) (h0, h1, h2, l1, u1, l2, u2 float64) {
+func spline_lu(xi [4]float64) (h0, h1, h2, l1, u1, l2, u2 float64) {
 	x0, x1, x2, x3 := xi[0], xi[1], xi[2], xi[3]
 
 	h0, h1, h2 = x1-x0, x2-x1, x3-x2
@@ -0,0 +1,110 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Wav is the pcm16 content of a wav file.
+type Wav struct {
+	SampleRate int
+	Channels   int
+	PCM        []byte // little-endian pcm16, interleaved
+}
+
+// DecodeWav reads a 16-bit pcm wav file.
+func DecodeWav(r io.Reader) (*Wav, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, err
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errors.New("not a wav file")
+	}
+
+	wav := &Wav{}
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("wav data chunk not found")
+			}
+			return nil, err
+		}
+		id, size := string(chunk[0:4]), binary.LittleEndian.Uint32(chunk[4:8])
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("invalid wav fmt chunk")
+			}
+			fmtChunk := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, fmtChunk); err != nil {
+				return nil, err
+			}
+			format := binary.LittleEndian.Uint16(fmtChunk[0:2])
+			bits := binary.LittleEndian.Uint16(fmtChunk[14:16])
+			// 0xFFFE 为 WAVE_FORMAT_EXTENSIBLE
+			if (format != 1 && format != 0xFFFE) || bits != 16 {
+				return nil, fmt.Errorf("unsupported wav format %d with %d bits, only pcm16 is supported", format, bits)
+			}
+			wav.Channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+			wav.SampleRate = int(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+		case "data":
+			if wav.SampleRate == 0 {
+				return nil, errors.New("wav data chunk before fmt chunk")
+			}
+			pcm, err := io.ReadAll(io.LimitReader(r, int64(size)))
+			if err != nil {
+				return nil, err
+			}
+			wav.PCM = pcm[:len(pcm)/2*2]
+			return wav, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size+size%2)); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Mono returns the pcm mixed down to a single channel.
+func (w *Wav) Mono() []byte {
+	if w.Channels <= 1 {
+		return w.PCM
+	}
+	samples := BytesToInt16(nil, w.PCM)
+	mono := make([]int16, len(samples)/w.Channels)
+	for i := range mono {
+		var sum int32
+		for ch := 0; ch < w.Channels; ch++ {
+			sum += int32(samples[i*w.Channels+ch])
+		}
+		mono[i] = int16(sum / int32(w.Channels))
+	}
+	return Int16ToBytes(nil, mono)
+}
+
+// EncodeWav writes the pcm as a 16-bit pcm wav file.
+func EncodeWav(w io.Writer, wav *Wav) error {
+	channels := max(wav.Channels, 1)
+	header := make([]byte, 44)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(36+len(wav.PCM)))
+	copy(header[8:16], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], 1) // pcm
+	binary.LittleEndian.PutUint16(header[22:24], uint16(channels))
+	binary.LittleEndian.PutUint32(header[24:28], uint32(wav.SampleRate))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(wav.SampleRate*channels*2))
+	binary.LittleEndian.PutUint16(header[32:34], uint16(channels*2))
+	binary.LittleEndian.PutUint16(header[34:36], 16)
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], uint32(len(wav.PCM)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(wav.PCM)
+	return err
+}
@@ -0,0 +1,68 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func wavFile(sampleRate, channels int, samples []int16) []byte {
+	var buf bytes.Buffer
+	data := Int16ToBytes(nil, samples)
+	buf.WriteString("RIFF")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(36+len(data)+10))
+	buf.WriteString("WAVE")
+	buf.WriteString("fmt ")
+	for _, v := range []any{
+		uint32(16), uint16(1), uint16(channels), uint32(sampleRate),
+		uint32(sampleRate * channels * 2), uint16(channels * 2), uint16(16),
+	} {
+		_ = binary.Write(&buf, binary.LittleEndian, v)
+	}
+	// 无关的 chunk 应被跳过
+	buf.WriteString("LIST")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(2))
+	buf.Write([]byte{0, 0})
+	buf.WriteString("data")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestDecodeWav(t *testing.T) {
+	wav, err := DecodeWav(bytes.NewReader(wavFile(16000, 2, []int16{100, 300, -100, -300})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wav.SampleRate != 16000 || wav.Channels != 2 || len(wav.PCM) != 8 {
+		t.Fatalf("unexpected wav: %+v", wav)
+	}
+	mono := BytesToInt16(nil, wav.Mono())
+	if len(mono) != 2 || mono[0] != 200 || mono[1] != -200 {
+		t.Fatalf("unexpected mono mix: %v", mono)
+	}
+}
+
+func TestDecodeWavRejectsNonPcm16(t *testing.T) {
+	if _, err := DecodeWav(bytes.NewReader([]byte("RIFF\x00\x00\x00\x00WAVEfmt "))); err == nil {
+		t.Fatal("expected error for truncated wav")
+	}
+	if _, err := DecodeWav(bytes.NewReader([]byte("ID3 not a wav file"))); err == nil {
+		t.Fatal("expected error for non wav input")
+	}
+}
+
+func TestEncodeWav(t *testing.T) {
+	var buf bytes.Buffer
+	in := &Wav{SampleRate: 24000, Channels: 1, PCM: Int16ToBytes(nil, []int16{1, -2, 3})}
+	if err := EncodeWav(&buf, in); err != nil {
+		t.Fatal(err)
+	}
+	out, err := DecodeWav(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.SampleRate != 24000 || out.Channels != 1 || !bytes.Equal(out.PCM, in.PCM) {
+		t.Fatalf("round trip mismatch: %+v", out)
+	}
+}
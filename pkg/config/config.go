@@ -2,19 +2,19 @@ package config
 
 import (
 	"fmt"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
+	"github.com/samber/lo"
 	"github.com/spf13/viper"
 )
 
-func init() {
-	if err := loadConfig(); err != nil {
-		panic(fmt.Sprintf("Failed to load configuration: %v", err))
-	}
-}
-
-var conf BizConf
+var (
+	conf     BizConf
+	confPath string
+)
 
 type OpenAIConf struct {
 	BaseURL      string `yaml:"base_url"`
@@ -22,14 +22,83 @@ type OpenAIConf struct {
 	Model        string `yaml:"model"`
 	Voice        string `yaml:"voice"`
 	SystemPrompt string `yaml:"system_prompt"`
+	// 上游音频格式：pcm16, g711_ulaw, g711_alaw，默认 pcm16
+	InputAudioFormat  string `yaml:"input_audio_format"`
+	OutputAudioFormat string `yaml:"output_audio_format"`
+	// pcm16 的采样率，默认 24000；g711 固定 8000
+	PcmSampleRate int               `yaml:"pcm_sample_rate"`
+	Transcription TranscriptionConf `yaml:"transcription"`
+}
+
+// TranscriptionConf configures the transcription of user audio, shown on the
+// device as stt text. An empty model keeps the provider default.
+type TranscriptionConf struct {
+	Model    string `yaml:"model"`
+	Language string `yaml:"language"`
+	Prompt   string `yaml:"prompt"`
+	// 转写失败时下发给设备的 stt 文本，为空则不下发
+	FallbackText string `yaml:"fallback_text"`
 }
 
 type XiaozhiConf struct {
-	Format        string `yaml:"format"`
-	Transport     string `yaml:"transport"`
+	Format        string                       `yaml:"format"`
+	Transport     string                       `yaml:"transport"`
+	SampleRate    int                          `yaml:"sample_rate"`
+	Channels      int                          `yaml:"channels"`
+	FrameDuration int                          `yaml:"frame_duration"`
+	Devices       map[string]XiaozhiDeviceConf `yaml:"devices"`
+}
+
+// XiaozhiDeviceConf overrides the global config for a single device.
+// Zero fields fall back to the global config.
+type XiaozhiDeviceConf struct {
 	SampleRate    int    `yaml:"sample_rate"`
 	Channels      int    `yaml:"channels"`
 	FrameDuration int    `yaml:"frame_duration"`
+	Persona       string `yaml:"persona"`
+	OpusProfile   string `yaml:"opus_profile"`
+	// Record records the sessions of the device under record.dir.
+	Record bool `yaml:"record"`
+	// Timezone is the IANA name of the device's local time, overriding
+	// reminder.timezone.
+	Timezone string `yaml:"timezone"`
+}
+
+// PersonaConf is a character the assistant plays. Empty fields fall back to
+// the openai config.
+type PersonaConf struct {
+	Name         string `yaml:"-"`
+	Voice        string `yaml:"voice"`
+	SystemPrompt string `yaml:"system_prompt"`
+	OpusProfile  string `yaml:"opus_profile"`
+	// 回复开头（标签）到设备表情的映射，为空时使用 emotion.tags
+	EmotionTags   map[string]string `yaml:"emotion_tags"`
+	Transcription TranscriptionConf `yaml:"transcription"`
+}
+
+// EmotionConf maps the tags the model puts at the start of a reply, such as
+// （哀愁 1）, to xiaozhi emotion names.
+type EmotionConf struct {
+	Default string            `yaml:"default"`
+	Tags    map[string]string `yaml:"tags"`
+}
+
+// OpusConf configures the downlink opus encoder. The opus binding does not
+// expose OPUS_SET_VBR, so the encoder always runs in its default VBR mode and
+// CBR is not supported; a vbr or cbr key is rejected rather than ignored.
+type OpusConf struct {
+	Application string `yaml:"application"` // voip, audio, lowdelay
+	Bitrate     int    `yaml:"bitrate"`     // bps, 0 keeps the encoder default
+	Complexity  int    `yaml:"complexity"`  // 1-10, 0 keeps the encoder default
+	DTX         bool   `yaml:"dtx"`
+	FEC         bool   `yaml:"fec"`
+	PacketLoss  int    `yaml:"packet_loss"` // expected loss percent, tunes FEC
+	Adaptive    bool   `yaml:"adaptive"`    // degrade when downlink frames back up
+}
+
+// AdminConf configures the admin HTTP API, which is disabled without a token.
+type AdminConf struct {
+	Token string `yaml:"token"`
 }
 
 type ProviderConf struct {
@@ -41,16 +110,114 @@ type XiaozhiProvider struct {
 	BaseURL string `yaml:"base_url"`
 }
 
+// ReminderConf configures reminders set by the model, disabled without a path.
+type ReminderConf struct {
+	Path string `yaml:"path"`
+	// Timezone is the IANA name, such as Asia/Shanghai, of the wall clock
+	// times the model sets and reads, the server's local time if empty.
+	Timezone string `yaml:"timezone"`
+}
+
+// RecordConf configures session recording, disabled without a dir. Zero
+// limits mean unlimited.
+type RecordConf struct {
+	Dir           string `yaml:"dir"`
+	MaxSessionMB  int    `yaml:"max_session_mb"`
+	MaxTotalMB    int    `yaml:"max_total_mb"`
+	RetentionDays int    `yaml:"retention_days"`
+}
+
+// LogConf configures the structured log. Audio events come many per second,
+// so at debug level only one of every AudioSample is logged, none if zero.
+type LogConf struct {
+	Level       string `yaml:"level"`  // debug, info, warn, error
+	Format      string `yaml:"format"` // text or json
+	AudioSample int    `yaml:"audio_sample"`
+}
+
+// TraceConf configures OpenTelemetry tracing of conversation turns, disabled
+// without an exporter.
+type TraceConf struct {
+	Exporter string `yaml:"exporter"` // otlp or file
+	// otlp http 地址，如 localhost:4318，为空时使用 OTEL_EXPORTER_OTLP_ENDPOINT
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+	// file 导出器写入的文件，每行一个 span
+	File        string  `yaml:"file"`
+	SampleRatio float64 `yaml:"sample_ratio"` // 0-1，0 为全部采样
+}
+
+// WebhookConf configures the webhooks, disabled without endpoints. Zero
+// values use the defaults of the webhook package.
+type WebhookConf struct {
+	QueueDir       string            `yaml:"queue_dir"`
+	MaxAttempts    int               `yaml:"max_attempts"`
+	TimeoutSeconds int               `yaml:"timeout_seconds"`
+	MaxQueued      int               `yaml:"max_queued"` // 每个接收方排队的事件上限
+	Endpoints      []WebhookEndpoint `yaml:"endpoints"`
+}
+
+type WebhookEndpoint struct {
+	Name   string   `yaml:"name"`
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"`
+	Events []string `yaml:"events"` // 为空时接收全部事件
+}
+
+// ModerationConf configures the content safety filter, disabled without
+// keywords, patterns or a classifier.
+type ModerationConf struct {
+	Keywords  []string `yaml:"keywords"`
+	Patterns  []string `yaml:"patterns"`
+	SafeReply string   `yaml:"safe_reply"`
+	// safe_reply 的录音（16 位 pcm wav），设置后原样播放，否则由模型念出，可能略有改动
+	SafeReplyAudio string `yaml:"safe_reply_audio"`
+	AuditFile      string `yaml:"audit_file"`
+	// 外部分类服务，POST {"source","text"}，返回 {"blocked","category"}
+	Classifier struct {
+		URL       string `yaml:"url"`
+		TimeoutMs int    `yaml:"timeout_ms"`
+	} `yaml:"classifier"`
+}
+
+// Enabled reports whether there is anything to check text against.
+func (c *ModerationConf) Enabled() bool {
+	return len(c.Keywords) > 0 || len(c.Patterns) > 0 || c.Classifier.URL != ""
+}
+
+// ParentalConf configures per-device usage policies, which are set through
+// the admin api and kept at path. Disabled without a path.
+type ParentalConf struct {
+	Path string `yaml:"path"`
+	// 超出允许时段或当日时长时播报，播完后断开
+	Notices struct {
+		Hours      string `yaml:"hours"`
+		DailyLimit string `yaml:"daily_limit"`
+	} `yaml:"notices"`
+}
+
 type BizConf struct {
-	Provider ProviderConf `yaml:"provider"`
-	OpenAI   OpenAIConf   `yaml:"openai"`
-	Xiaozhi  XiaozhiConf  `yaml:"xiaozhi"`
-	Audio    struct {
-		InputFormat  string `yaml:"input_format"`
-		OutputFormat string `yaml:"output_format"`
-		SampleRate   int    `yaml:"sample_rate"`
-		Channels     int    `yaml:"channels"`
-		MaxDuration  int    `yaml:"max_duration"`
+	Provider   ProviderConf           `yaml:"provider"`
+	OpenAI     OpenAIConf             `yaml:"openai"`
+	Xiaozhi    XiaozhiConf            `yaml:"xiaozhi"`
+	Personas   map[string]PersonaConf `yaml:"personas"`
+	Emotion    EmotionConf            `yaml:"emotion"`
+	Admin      AdminConf              `yaml:"admin"`
+	Reminder   ReminderConf           `yaml:"reminder"`
+	Record     RecordConf             `yaml:"record"`
+	Log        LogConf                `yaml:"log"`
+	Trace      TraceConf              `yaml:"trace"`
+	Webhook    WebhookConf            `yaml:"webhook"`
+	Moderation ModerationConf         `yaml:"moderation"`
+	Parental   ParentalConf           `yaml:"parental"`
+	Audio      struct {
+		InputFormat  string              `yaml:"input_format"`
+		OutputFormat string              `yaml:"output_format"`
+		SampleRate   int                 `yaml:"sample_rate"`
+		Channels     int                 `yaml:"channels"`
+		MaxDuration  int                 `yaml:"max_duration"`
+		Opus         OpusConf            `yaml:"opus"`
+		OpusProfiles map[string]OpusConf `yaml:"opus_profiles"`
 	} `yaml:"audio"`
 	DefaultParams struct {
 		ChatCompletions struct {
@@ -73,16 +240,121 @@ func Xiaozhi() *XiaozhiConf {
 	return &conf.Xiaozhi
 }
 
+// Device returns the overrides configured for the device.
+// viper lowercases map keys, so the lookup is case-insensitive.
+func (c *XiaozhiConf) Device(deviceId string) XiaozhiDeviceConf {
+	if deviceId == "" {
+		return XiaozhiDeviceConf{}
+	}
+	return c.Devices[strings.ToLower(deviceId)]
+}
+
+// Persona returns the named persona with empty fields taken from the openai
+// config. An unknown or empty name yields the openai config itself.
+func Persona(name string) PersonaConf {
+	p := conf.Personas[strings.ToLower(name)]
+	p.Name = name
+	if p.Voice == "" {
+		p.Voice = conf.OpenAI.Voice
+	}
+	if p.SystemPrompt == "" {
+		p.SystemPrompt = conf.OpenAI.SystemPrompt
+	}
+	if len(p.EmotionTags) == 0 {
+		p.EmotionTags = conf.Emotion.Tags
+	}
+	global := conf.OpenAI.Transcription
+	p.Transcription.Model = lo.CoalesceOrEmpty(p.Transcription.Model, global.Model)
+	p.Transcription.Language = lo.CoalesceOrEmpty(p.Transcription.Language, global.Language)
+	p.Transcription.Prompt = lo.CoalesceOrEmpty(p.Transcription.Prompt, global.Prompt)
+	p.Transcription.FallbackText = lo.CoalesceOrEmpty(p.Transcription.FallbackText, global.FallbackText)
+	return p
+}
+
+func Admin() *AdminConf {
+	return &conf.Admin
+}
+
+func Reminder() *ReminderConf {
+	return &conf.Reminder
+}
+
+// ReminderLocation returns the timezone reminder times of the device are
+// given in. Timezones are checked when the config is loaded.
+func ReminderLocation(deviceId string) *time.Location {
+	name := conf.Xiaozhi.Device(deviceId).Timezone
+	if name == "" {
+		name = conf.Reminder.Timezone
+	}
+	if name == "" {
+		return time.Local
+	}
+	if loc, err := time.LoadLocation(name); err == nil {
+		return loc
+	}
+	return time.Local
+}
+
+func Record() *RecordConf {
+	return &conf.Record
+}
+
+func Log() *LogConf {
+	return &conf.Log
+}
+
+func Trace() *TraceConf {
+	return &conf.Trace
+}
+
+func Webhook() *WebhookConf {
+	return &conf.Webhook
+}
+
+func Moderation() *ModerationConf {
+	return &conf.Moderation
+}
+
+func Parental() *ParentalConf {
+	return &conf.Parental
+}
+
+func Emotion() *EmotionConf {
+	return &conf.Emotion
+}
+
+// OpusProfile returns the named encoder profile, or the default one.
+func OpusProfile(name string) OpusConf {
+	if p, ok := conf.Audio.OpusProfiles[strings.ToLower(name)]; ok {
+		return p
+	}
+	return conf.Audio.Opus
+}
+
 func Provider() *ProviderConf {
 	return &conf.Provider
 }
 
+// Load reads the configuration from path. An empty path takes the file
+// named by XDIM_CONFIG, or biz.yaml under conf or the working directory.
+func Load(path string) error {
+	if path == "" {
+		path = os.Getenv("XDIM_CONFIG")
+	}
+	confPath = path
+	return loadConfig()
+}
+
 func loadConfig() error {
 	v := viper.New()
-	v.SetConfigName("biz")
 	v.SetConfigType("yaml")
-	v.AddConfigPath("conf")
-	v.AddConfigPath(".")
+	if confPath != "" {
+		v.SetConfigFile(confPath)
+	} else {
+		v.SetConfigName("biz")
+		v.AddConfigPath("conf")
+		v.AddConfigPath(".")
+	}
 
 	v.AutomaticEnv()
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
@@ -90,15 +362,20 @@ func loadConfig() error {
 		return fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	var md mapstructure.Metadata
 	if decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
 		WeaklyTypedInput: true,
 		Result:           &conf,
 		TagName:          "yaml",
+		Metadata:         &md,
 	}); err != nil {
 		return fmt.Errorf("failed to create decoder: %w", err)
 	} else if err = decoder.Decode(v.AllSettings()); err != nil {
 		return fmt.Errorf("failed to decode config: %w", err)
 	}
+	if err := checkOpusKeys(md.Unused); err != nil {
+		return err
+	}
 
 	conf.LoadEnv(v)
 	if err := conf.Validate(); err != nil {
@@ -109,6 +386,18 @@ func loadConfig() error {
 	return nil
 }
 
+// checkOpusKeys rejects encoder settings the opus binding cannot apply, so
+// that asking for CBR does not silently keep VBR.
+func checkOpusKeys(unused []string) error {
+	for _, key := range unused {
+		name := key[strings.LastIndex(key, ".")+1:]
+		if strings.HasPrefix(key, "audio.opus") && (name == "vbr" || name == "cbr") {
+			return fmt.Errorf("%s: cbr is not supported, the opus encoder always runs in vbr mode", key)
+		}
+	}
+	return nil
+}
+
 func GetConfigFilePath() string {
 	return viper.ConfigFileUsed()
 }
@@ -122,6 +411,9 @@ func (c *BizConf) LoadEnv(v *viper.Viper) {
 	if c.OpenAI.APIKey == "" {
 		panic("api_key is required")
 	}
+	if token := strings.TrimSpace(v.GetString("XDIM_ADMIN_TOKEN")); token != "" {
+		c.Admin.Token = token
+	}
 }
 
 func (c *BizConf) Validate() error {
@@ -131,11 +423,94 @@ func (c *BizConf) Validate() error {
 	if c.OpenAI.BaseURL == "" {
 		return fmt.Errorf("openai.base_url is required")
 	}
+	for _, format := range []string{c.OpenAI.InputAudioFormat, c.OpenAI.OutputAudioFormat} {
+		switch format {
+		case "", "pcm16", "g711_ulaw", "g711_alaw":
+		default:
+			return fmt.Errorf("openai audio format %q is not supported", format)
+		}
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("log level %q is not supported", c.Log.Level)
+	}
+	switch c.Log.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("log format %q is not supported", c.Log.Format)
+	}
+	switch c.Trace.Exporter {
+	case "", "otlp":
+	case "file":
+		if c.Trace.File == "" {
+			return fmt.Errorf("trace.file is required by the file exporter")
+		}
+	default:
+		return fmt.Errorf("trace exporter %q is not supported", c.Trace.Exporter)
+	}
+	if len(c.Webhook.Endpoints) > 0 && c.Webhook.QueueDir == "" {
+		return fmt.Errorf("webhook.queue_dir is required by the endpoints")
+	}
 	if c.Xiaozhi.Format == "" {
 		return fmt.Errorf("xiaozhi.format is required")
 	}
 	if c.Xiaozhi.Transport == "" {
 		return fmt.Errorf("xiaozhi.transport is required")
 	}
+	if _, err := time.LoadLocation(c.Reminder.Timezone); err != nil {
+		return fmt.Errorf("reminder.timezone: %w", err)
+	}
+	for id, d := range c.Xiaozhi.Devices {
+		if _, err := time.LoadLocation(d.Timezone); err != nil {
+			return fmt.Errorf("xiaozhi.devices.%s.timezone: %w", id, err)
+		}
+	}
+	return c.validateOpus()
+}
+
+// validateOpus checks the encoder profiles and the references to them, an
+// invalid one would only fail once a device says hello.
+func (c *BizConf) validateOpus() error {
+	if err := c.Audio.Opus.validate("audio.opus"); err != nil {
+		return err
+	}
+	for name, p := range c.Audio.OpusProfiles {
+		if err := p.validate("audio.opus_profiles." + name); err != nil {
+			return err
+		}
+	}
+	profileExists := func(name string) bool {
+		_, ok := c.Audio.OpusProfiles[strings.ToLower(name)]
+		return name == "" || ok
+	}
+	for name, p := range c.Personas {
+		if !profileExists(p.OpusProfile) {
+			return fmt.Errorf("personas.%s: unknown opus_profile %q", name, p.OpusProfile)
+		}
+	}
+	for id, d := range c.Xiaozhi.Devices {
+		if !profileExists(d.OpusProfile) {
+			return fmt.Errorf("xiaozhi.devices.%s: unknown opus_profile %q", id, d.OpusProfile)
+		}
+	}
+	return nil
+}
+
+func (c OpusConf) validate(key string) error {
+	switch c.Application {
+	case "", "voip", "audio", "lowdelay":
+	default:
+		return fmt.Errorf("%s: opus application %q is not supported", key, c.Application)
+	}
+	if c.Bitrate != 0 && (c.Bitrate < 500 || c.Bitrate > 512000) {
+		return fmt.Errorf("%s: opus bitrate %d is out of range 500-512000", key, c.Bitrate)
+	}
+	if c.Complexity < 0 || c.Complexity > 10 {
+		return fmt.Errorf("%s: opus complexity %d is out of range 1-10", key, c.Complexity)
+	}
+	if c.PacketLoss < 0 || c.PacketLoss > 100 {
+		return fmt.Errorf("%s: opus packet_loss %d is out of range 0-100", key, c.PacketLoss)
+	}
 	return nil
 }
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateOpus(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(c *BizConf)
+		err   string
+	}{
+		{"valid", func(c *BizConf) {}, ""},
+		{"application", func(c *BizConf) { c.Audio.Opus.Application = "music" }, `opus application "music"`},
+		{"bitrate", func(c *BizConf) { c.Audio.OpusProfiles["story"] = OpusConf{Bitrate: 100} }, "audio.opus_profiles.story: opus bitrate"},
+		{"complexity", func(c *BizConf) { c.Audio.Opus.Complexity = 11 }, "opus complexity 11"},
+		{"packet loss", func(c *BizConf) { c.Audio.Opus.PacketLoss = -1 }, "opus packet_loss -1"},
+		{"persona profile", func(c *BizConf) {
+			c.Personas = map[string]PersonaConf{"storyteller": {OpusProfile: "stroy"}}
+		}, `personas.storyteller: unknown opus_profile "stroy"`},
+		{"device profile", func(c *BizConf) {
+			c.Xiaozhi.Devices = map[string]XiaozhiDeviceConf{"aa:bb": {OpusProfile: "Story"}, "cc:dd": {OpusProfile: "weak"}}
+		}, `xiaozhi.devices.cc:dd: unknown opus_profile "weak"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c BizConf
+			c.OpenAI.APIKey, c.OpenAI.BaseURL = "test", "ws://localhost"
+			c.Xiaozhi.Format, c.Xiaozhi.Transport = "opus", "websocket"
+			c.Audio.Opus = OpusConf{Application: "voip"}
+			c.Audio.OpusProfiles = map[string]OpusConf{"story": {Application: "audio", Bitrate: 48000, Complexity: 10}}
+			tt.setup(&c)
+
+			err := c.Validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("Validate() = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("Validate() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckOpusKeys(t *testing.T) {
+	if err := checkOpusKeys([]string{"audio.opus_profiles[story].vbr"}); err == nil {
+		t.Error("vbr accepted")
+	}
+	if err := checkOpusKeys([]string{"openai.cbr", "audio.opus.unknown"}); err != nil {
+		t.Error(err)
+	}
+}
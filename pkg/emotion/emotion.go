@@ -0,0 +1,129 @@
+package emotion
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	Neutral = "neutral"
+	// 超过该长度的括号内容视为正文而不是标签
+	maxTagLen = 12
+)
+
+// Emotion is an emotion shown by the device, sent in the llm event.
+type Emotion struct {
+	Name  string
+	Emoji string
+}
+
+// 与 xiaozhi 固件内置表情对应
+var emojis = map[string]string{
+	"neutral":     "😶",
+	"happy":       "🙂",
+	"laughing":    "😆",
+	"funny":       "😂",
+	"sad":         "😔",
+	"angry":       "😠",
+	"crying":      "😭",
+	"loving":      "😍",
+	"embarrassed": "😳",
+	"surprised":   "😯",
+	"shocked":     "😱",
+	"thinking":    "🤔",
+	"winking":     "😉",
+	"cool":        "😎",
+	"relaxed":     "😌",
+	"delicious":   "🤤",
+	"kissy":       "😘",
+	"confident":   "😏",
+	"sleepy":      "😴",
+	"silly":       "😜",
+	"confused":    "🙄",
+}
+
+// Lookup returns the named emotion, or neutral if the device does not know it.
+func Lookup(name string) Emotion {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if emoji, ok := emojis[name]; ok {
+		return Emotion{Name: name, Emoji: emoji}
+	}
+	return Emotion{Name: Neutral, Emoji: emojis[Neutral]}
+}
+
+// Parser extracts the leading tags of a reply, e.g. （哀愁 1）（慢速 1）.
+type Parser struct {
+	tags map[string]string
+	def  Emotion
+}
+
+// NewParser maps tags to emotion names. Tags are matched ignoring spaces, and
+// a tag with a level such as 哀愁 2 falls back to 哀愁 when only that is mapped.
+func NewParser(tags map[string]string, def string) *Parser {
+	p := &Parser{
+		tags: make(map[string]string, len(tags)),
+		def:  Lookup(def),
+	}
+	for tag, name := range tags {
+		p.tags[normalize(tag)] = name
+	}
+	return p
+}
+
+func normalize(tag string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, tag)
+}
+
+func (p *Parser) lookup(tag string) (Emotion, bool) {
+	tag = normalize(tag)
+	name, ok := p.tags[tag]
+	if !ok {
+		name, ok = p.tags[strings.TrimRightFunc(tag, unicode.IsDigit)]
+	}
+	if !ok {
+		return Emotion{}, false
+	}
+	return Lookup(name), true
+}
+
+// Parse strips the leading tags of text and returns the emotion of the first
+// mapped one, or the default emotion. Unmapped tags, such as speed tags, are
+// stripped as well. done is false while text may still be the beginning of a
+// tag, in which case the caller should wait for more text.
+func (p *Parser) Parse(text string) (em Emotion, rest string, done bool) {
+	em, found := p.def, false
+	for {
+		rest = strings.TrimLeftFunc(text, unicode.IsSpace)
+		r, size := utf8.DecodeRuneInString(rest)
+		if r != '（' && r != '(' {
+			return em, rest, rest != ""
+		}
+		end := strings.IndexAny(rest[size:], "）)")
+		if end < 0 {
+			if utf8.RuneCountInString(rest) <= maxTagLen {
+				return em, rest, false
+			}
+			return em, rest, true
+		}
+		tag := rest[size : size+end]
+		if utf8.RuneCountInString(tag) > maxTagLen {
+			return em, rest, true
+		}
+		if e, ok := p.lookup(tag); ok && !found {
+			em, found = e, true
+		}
+		_, closeSize := utf8.DecodeRuneInString(rest[size+end:])
+		text = rest[size+end+closeSize:]
+	}
+}
+
+// Default is the emotion of replies without a mapped tag.
+func (p *Parser) Default() Emotion {
+	return p.def
+}
@@ -0,0 +1,45 @@
+package emotion
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	p := NewParser(map[string]string{
+		"哀愁 1": "sad",
+		"哀愁 2": "crying",
+		"娇嗔":   "angry",
+	}, "neutral")
+
+	cases := []struct {
+		text    string
+		emotion string
+		rest    string
+		done    bool
+	}{
+		{"（哀愁 1）花谢花飞飞满天", "sad", "花谢花飞飞满天", true},
+		{"(哀愁2) 红消香断", "crying", "红消香断", true},
+		{"（娇嗔 2）宝玉哥哥", "angry", "宝玉哥哥", true},
+		{"（慢速 1）（哀愁 1）秋花惨淡", "sad", "秋花惨淡", true},
+		{"（哀愁 1）（娇嗔 1）秋草黄", "sad", "秋草黄", true},
+		{"今日天气甚好", "neutral", "今日天气甚好", true},
+		{"（哀", "neutral", "（哀", false},
+		{"（哀愁 1）", "sad", "", false},
+		{"  ", "neutral", "", false},
+		{"（这是一段很长很长的括号里的正文内容）后文", "neutral", "（这是一段很长很长的括号里的正文内容）后文", true},
+	}
+	for _, c := range cases {
+		em, rest, done := p.Parse(c.text)
+		if em.Name != c.emotion || rest != c.rest || done != c.done {
+			t.Errorf("Parse(%q) = %q, %q, %v; want %q, %q, %v",
+				c.text, em.Name, rest, done, c.emotion, c.rest, c.done)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if e := Lookup("Sad"); e.Name != "sad" || e.Emoji != "😔" {
+		t.Fatalf("got %+v", e)
+	}
+	if e := Lookup("unknown"); e.Name != Neutral {
+		t.Fatalf("unknown emotion should fall back to neutral, got %+v", e)
+	}
+}
@@ -0,0 +1,250 @@
+// Package loadtest runs simulated devices against the gateway in stages of
+// increasing concurrency, and reports the latency, cost and failures of each
+// stage.
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/sim"
+)
+
+// SampleRate is the sample rate of Options.Speech.
+const SampleRate = 16000
+
+const (
+	// 设备上行每帧时长，同 sim 默认
+	frameDuration      = 60 * time.Millisecond
+	defaultTurnTimeout = 30 * time.Second
+)
+
+// Kinds of errors counted in a stage.
+const (
+	ErrDial    = "dial"
+	ErrHello   = "hello"
+	ErrTimeout = "timeout"
+	ErrClosed  = "closed"
+	ErrSend    = "send"
+	ErrServer  = "server"   // 网关下发的 error 事件
+	ErrNoAudio = "no_audio" // 回复没有音频
+)
+
+type Options struct {
+	// URL is the gateway, e.g. ws://127.0.0.1:8000/xiaozhi/v1/.
+	URL string
+	// Stages are the numbers of concurrent devices, each reached in turn.
+	Stages []int
+	// Ramp is how long the devices added by a stage take to connect, spread
+	// evenly, and Hold how long the stage runs at full concurrency after.
+	Ramp time.Duration
+	Hold time.Duration
+	// Speech is the user speech of every turn, mono pcm16 at SampleRate,
+	// followed by Silence for the server VAD to end the utterance.
+	Speech  []byte
+	Silence time.Duration
+	// Think is the pause between the end of a reply and the next turn.
+	Think time.Duration
+	// TurnTimeout bounds connecting and each turn, 30s by default.
+	TurnTimeout time.Duration
+	// Overflows returns the write queue overflows of the gateway, if it runs
+	// in this process.
+	Overflows func() int64
+}
+
+// VADBytes is the 24 kHz pcm16 the gateway forwards upstream for a turn of
+// opts, less half a frame: a mock server with this VAD threshold ends the
+// utterance on the last frame, so no trailing frame starts another one.
+func VADBytes(opts Options) int {
+	frames := func(d time.Duration) int {
+		return int((d + frameDuration - 1) / frameDuration)
+	}
+	speech := time.Duration(len(opts.Speech)/2) * time.Second / SampleRate
+	total := time.Duration(frames(speech)+frames(opts.Silence))*frameDuration - frameDuration/2
+	return int(total.Milliseconds()) * 24000 * 2 / 1000
+}
+
+type runner struct {
+	opts Options
+
+	mu        sync.Mutex
+	stage     *Stage
+	connected int
+}
+
+// Run runs the stages in order and returns their results. It stops early
+// when ctx is done, returning the stages finished so far.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	if len(opts.Stages) == 0 || !slices.IsSorted(opts.Stages) {
+		return nil, errors.New("stages must be increasing device counts")
+	}
+	if len(opts.Speech) == 0 {
+		return nil, errors.New("speech is required")
+	}
+	if opts.TurnTimeout <= 0 {
+		opts.TurnTimeout = defaultTurnTimeout
+	}
+	r := &runner{opts: opts}
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	report := &Report{}
+	started := 0
+	for _, n := range opts.Stages {
+		stage := &Stage{Devices: n, Errors: map[string]int{}}
+		r.mu.Lock()
+		r.stage = stage
+		r.mu.Unlock()
+		wall, cpu, overflows := time.Now(), cpuTime(), r.overflows()
+
+		// 新增设备在 Ramp 内均匀接入
+		interval := opts.Ramp / time.Duration(max(n-started, 1))
+		for ; started < n && ctx.Err() == nil; started++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				r.device(ctx, id)
+			}(started)
+			sleep(ctx, interval)
+		}
+		sleep(ctx, opts.Hold)
+		if ctx.Err() != nil {
+			break
+		}
+
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		r.mu.Lock()
+		stage.Wall = time.Since(wall)
+		stage.CPU = cpuTime() - cpu
+		stage.Overflows = r.overflows() - overflows
+		stage.Connected = r.connected
+		stage.Goroutines = runtime.NumGoroutine()
+		stage.HeapBytes = mem.HeapAlloc
+		slices.Sort(stage.TTFA)
+		// 阶段结束后到达的结果不再计入
+		r.stage = &Stage{Errors: map[string]int{}}
+		r.mu.Unlock()
+		report.Stages = append(report.Stages, *stage)
+	}
+	return report, nil
+}
+
+func (r *runner) overflows() int64 {
+	if r.opts.Overflows == nil {
+		return 0
+	}
+	return r.opts.Overflows()
+}
+
+// fail counts an error, unless it is the run being stopped.
+func (r *runner) fail(ctx context.Context, kind string) {
+	if ctx.Err() != nil {
+		return
+	}
+	r.mu.Lock()
+	r.stage.Errors[kind]++
+	r.mu.Unlock()
+}
+
+func (r *runner) device(ctx context.Context, id int) {
+	dialCtx, cancel := context.WithTimeout(ctx, r.opts.TurnTimeout)
+	defer cancel()
+	d, err := sim.Dial(dialCtx, r.opts.URL,
+		sim.WithDeviceId(fmt.Sprintf("load:%06d", id), "loadtest"), sim.WithDiscardAudio())
+	if err != nil {
+		r.fail(ctx, ErrDial)
+		return
+	}
+	defer d.Close()
+	if _, err := d.Hello(dialCtx); err != nil {
+		r.fail(ctx, ErrHello)
+		return
+	}
+
+	r.mu.Lock()
+	r.connected++
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.connected--
+		r.mu.Unlock()
+	}()
+	for ctx.Err() == nil {
+		if err := r.turn(ctx, d); err != nil {
+			select {
+			case <-d.Done():
+				r.fail(ctx, ErrClosed)
+				return
+			default:
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				r.fail(ctx, ErrTimeout)
+			} else {
+				r.fail(ctx, ErrSend)
+			}
+		}
+		sleep(ctx, r.opts.Think)
+	}
+}
+
+// turn speaks once and waits for the whole reply.
+func (r *runner) turn(ctx context.Context, d *sim.Device) error {
+	turnCtx, cancel := context.WithTimeout(ctx, r.opts.TurnTimeout)
+	defer cancel()
+	from := len(d.Events())
+	if err := d.Listen(xiaozhi.ClientStateListenStart, xiaozhi.ClientModeAuto); err != nil {
+		return err
+	}
+	if err := d.SendPCM(turnCtx, r.opts.Speech, SampleRate); err != nil {
+		return err
+	}
+	d.Mark(sim.KindSpeechEnd, "")
+	if err := d.SendSilence(turnCtx, r.opts.Silence); err != nil {
+		return err
+	}
+	_, err := d.Wait(turnCtx, sim.Kind(sim.KindTTSStop))
+
+	events := d.Events()[from:]
+	for _, e := range events {
+		if e.Dir == sim.DirRecv && e.Kind == string(xiaozhi.ServerEventTypeError) {
+			r.fail(ctx, ErrServer)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, t := range sim.Turns(events) {
+		if t.FirstAudio == 0 {
+			r.fail(ctx, ErrNoAudio)
+			continue
+		}
+		r.mu.Lock()
+		r.stage.Turns++
+		r.stage.TTFA = append(r.stage.TTFA, t.Latency(t.FirstAudio))
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,77 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/handler"
+	handleropenai "github.com/xdimtech/go-xiaozhi/handler/openai"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai/mock"
+)
+
+func TestMain(m *testing.M) {
+	mock.Main(m, filepath.Join("..", "..", "conf", "biz.yaml"))
+}
+
+func TestRun(t *testing.T) {
+	opts := Options{
+		Stages:    []int{1, 3},
+		Ramp:      300 * time.Millisecond,
+		Hold:      2 * time.Second,
+		Speech:    mock.Tone(SampleRate, 300*time.Millisecond),
+		Silence:   120 * time.Millisecond,
+		Think:     100 * time.Millisecond,
+		Overflows: handleropenai.QueueOverflows,
+	}
+	opts.URL, _ = mock.Gateway(t, handler.NewWebSocketServer().RealTime, mock.WithoutHistory(), mock.WithVAD(VADBytes(opts)),
+		mock.WithDefaultTurn(mock.Turn{Transcript: "你好", Reply: "你好呀。", Audio: mock.Tone(24000, 300*time.Millisecond)}))
+
+	report, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Stages) != 2 {
+		t.Fatalf("stages = %+v", report.Stages)
+	}
+	for _, s := range report.Stages {
+		if s.Connected != s.Devices || s.Turns < s.Devices || len(s.Errors) != 0 {
+			t.Errorf("stage = %+v", s)
+		}
+		// 首帧音频在静音发完后才可能到达
+		if p50 := s.Percentile(50); p50 < 60*time.Millisecond || p50 > time.Second {
+			t.Errorf("ttfa p50 = %s", p50)
+		}
+	}
+	var buf bytes.Buffer
+	WriteReport(&buf, report)
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 3 {
+		t.Errorf("report:\n%s", buf.String())
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	s := Stage{}
+	for i := 1; i <= 100; i++ {
+		s.TTFA = append(s.TTFA, time.Duration(i)*time.Millisecond)
+	}
+	for p, want := range map[float64]time.Duration{50: 50, 90: 90, 99: 99, 100: 100, 0: 1} {
+		if got := s.Percentile(p); got != want*time.Millisecond {
+			t.Errorf("p%v = %s, want %dms", p, got, want)
+		}
+	}
+	if (Stage{}).Percentile(50) != 0 {
+		t.Error("percentile without turns")
+	}
+}
+
+func TestVADBytes(t *testing.T) {
+	// 300 ms 语音与 120 ms 静音各为整帧，共 7 帧减去半帧
+	opts := Options{Speech: make([]byte, SampleRate*2*300/1000), Silence: 120 * time.Millisecond}
+	if got, want := VADBytes(opts), 390*48; got != want {
+		t.Errorf("VADBytes = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+package loadtest
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// Stage is the result of running at a number of concurrent devices.
+type Stage struct {
+	Devices   int // 目标并发数
+	Connected int // 阶段结束时在线的设备数
+	Wall      time.Duration
+	// CPU is the cpu time of this process during the stage, zero where it
+	// cannot be measured. It includes the simulated devices and the mock
+	// server when they run in the same process as the gateway.
+	CPU   time.Duration
+	Turns int
+	// TTFA are the times from the end of the user speech to the first reply
+	// audio frame, sorted.
+	TTFA       []time.Duration
+	Errors     map[string]int
+	Overflows  int64
+	Goroutines int
+	HeapBytes  uint64
+}
+
+// Percentile is the p-th percentile of the time to first audio, zero
+// without turns.
+func (s Stage) Percentile(p float64) time.Duration {
+	if len(s.TTFA) == 0 {
+		return 0
+	}
+	i := int(p/100*float64(len(s.TTFA))+0.5) - 1
+	return s.TTFA[min(max(i, 0), len(s.TTFA)-1)]
+}
+
+// Cores is the average number of cores busy during the stage.
+func (s Stage) Cores() float64 {
+	if s.Wall <= 0 {
+		return 0
+	}
+	return s.CPU.Seconds() / s.Wall.Seconds()
+}
+
+// DevicesPerCore is how many devices one fully busy core serves at this
+// load, zero if cpu time is unknown.
+func (s Stage) DevicesPerCore() float64 {
+	if s.Cores() == 0 {
+		return 0
+	}
+	return float64(s.Connected) / s.Cores()
+}
+
+// TurnsPerCPUSecond is the throughput normalized by the cpu time spent.
+func (s Stage) TurnsPerCPUSecond() float64 {
+	if s.CPU <= 0 {
+		return 0
+	}
+	return float64(s.Turns) / s.CPU.Seconds()
+}
+
+type Report struct {
+	Stages []Stage
+}
+
+// WriteReport prints a line per stage and the errors of each.
+func WriteReport(w io.Writer, r *Report) {
+	fmt.Fprintf(w, "%7s %9s %6s %7s %6s %9s %9s %8s %8s %8s %8s %9s %6s %10s %8s\n",
+		"devices", "connected", "turns", "turns/s", "cores", "dev/core", "turns/cpu",
+		"ttfa p50", "p90", "p99", "max", "overflows", "errors", "goroutines", "heap MB")
+	for _, s := range r.Stages {
+		fmt.Fprintf(w, "%7d %9d %6d %7.2f %6s %9s %9s %8s %8s %8s %8s %9d %6d %10d %8.1f\n",
+			s.Devices, s.Connected, s.Turns, float64(s.Turns)/s.Wall.Seconds(),
+			formatRate(s.Cores(), "%.2f"), formatRate(s.DevicesPerCore(), "%.1f"),
+			formatRate(s.TurnsPerCPUSecond(), "%.2f"),
+			formatLatency(s.Percentile(50)), formatLatency(s.Percentile(90)),
+			formatLatency(s.Percentile(99)), formatLatency(s.Percentile(100)),
+			s.Overflows, lo.Sum(lo.Values(s.Errors)), s.Goroutines, float64(s.HeapBytes)/(1<<20))
+	}
+	for _, s := range r.Stages {
+		if len(s.Errors) == 0 {
+			continue
+		}
+		kinds := lo.Keys(s.Errors)
+		sort.Strings(kinds)
+		fmt.Fprintf(w, "errors at %d devices: %s\n", s.Devices, strings.Join(lo.Map(kinds, func(k string, _ int) string {
+			return fmt.Sprintf("%s %d", k, s.Errors[k])
+		}), ", "))
+	}
+}
+
+func formatRate(v float64, format string) string {
+	if v == 0 {
+		return "-"
+	}
+	return fmt.Sprintf(format, v)
+}
+
+func formatLatency(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond).String()
+}
@@ -0,0 +1,70 @@
+// Package logger builds the structured logger of the gateway and samples
+// high-rate events such as audio frames.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// New returns a logger writing to w at level (debug, info, warn or error,
+// info if empty) as text or json (text if empty).
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// Init makes New the default logger, which the log package also writes to.
+func Init(w io.Writer, level, format string) error {
+	l, err := New(w, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(l)
+	return nil
+}
+
+// Sampler passes one of every n events of each kind, so that audio can be
+// logged without a line per frame. A nil Sampler passes nothing.
+type Sampler struct {
+	every  int64
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// NewSampler passes one of every n events, nil if n is not positive.
+func NewSampler(n int) *Sampler {
+	if n <= 0 {
+		return nil
+	}
+	return &Sampler{every: int64(n), counts: make(map[string]int64)}
+}
+
+// Sample counts an event of kind and reports whether to log it, along with
+// the number of events of the kind so far. The first one is always logged.
+func (s *Sampler) Sample(kind string) (int64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[kind]++
+	n := s.counts[kind]
+	return n, (n-1)%s.every == 0
+}
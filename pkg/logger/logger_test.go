@@ -0,0 +1,55 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, "warn", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.With("session_id", "s1").Info("dropped")
+	l.With("session_id", "s1").Warn("kept", "n", 2)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("lines = %q", lines)
+	}
+	var line map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["msg"] != "kept" || line["session_id"] != "s1" || line["level"] != "WARN" {
+		t.Errorf("line = %v", line)
+	}
+
+	if _, err := New(&buf, "verbose", ""); err == nil {
+		t.Error("invalid level accepted")
+	}
+	if _, err := New(&buf, "", "xml"); err == nil {
+		t.Error("invalid format accepted")
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := NewSampler(3)
+	var logged []int64
+	for i := 0; i < 7; i++ {
+		if n, ok := s.Sample("audio"); ok {
+			logged = append(logged, n)
+		}
+	}
+	if len(logged) != 3 || logged[0] != 1 || logged[1] != 4 || logged[2] != 7 {
+		t.Errorf("logged = %v", logged)
+	}
+	if _, ok := s.Sample("delta"); !ok {
+		t.Error("kinds are not counted apart")
+	}
+	if _, ok := NewSampler(0).Sample("audio"); ok {
+		t.Error("nil sampler logged")
+	}
+}
@@ -0,0 +1,245 @@
+// Package moderation checks conversation text against keyword and pattern
+// lists and an optional classifier, and keeps an audit log of what it blocks.
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Sources of checked text.
+const (
+	SourceUser      = "user"
+	SourceAssistant = "assistant"
+)
+
+const defaultClassifierTimeout = 2 * time.Second
+
+// Verdict is the outcome of a check, the text passes unless Blocked.
+type Verdict struct {
+	Blocked  bool   `json:"blocked"`
+	Rule     string `json:"rule,omitempty"` // 命中的关键词或正则
+	Category string `json:"category,omitempty"`
+}
+
+// Classifier judges text the lists cannot, e.g. with a moderation model.
+type Classifier interface {
+	Classify(ctx context.Context, source, text string) (Verdict, error)
+}
+
+type Options struct {
+	// Keywords match case-insensitively, ignoring spaces and punctuation
+	// inserted between the characters.
+	Keywords []string
+	Patterns []string // Go 正则
+	// Classifier, if set, is asked about the text the lists let through.
+	Classifier        Classifier
+	ClassifierTimeout time.Duration
+	// SafeReply is spoken instead of a blocked response.
+	SafeReply string
+	// SafeReplyAudio, if set, is a recording of SafeReply played as is,
+	// mono pcm16 at SafeReplySampleRate.
+	SafeReplyAudio      []byte
+	SafeReplySampleRate int
+	// AuditFile receives a json line per blocked text, none if empty.
+	AuditFile string
+}
+
+// Moderator checks text for a session. A nil Moderator lets everything
+// through.
+type Moderator struct {
+	opts     Options
+	keywords []string
+	patterns []*regexp.Regexp
+
+	mu    sync.Mutex
+	audit *os.File
+}
+
+func New(opts Options) (*Moderator, error) {
+	if opts.ClassifierTimeout <= 0 {
+		opts.ClassifierTimeout = defaultClassifierTimeout
+	}
+	m := &Moderator{opts: opts}
+	for _, k := range opts.Keywords {
+		if k = normalize(k); k != "" {
+			m.keywords = append(m.keywords, k)
+		}
+	}
+	for _, p := range opts.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid moderation pattern %q: %w", p, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	if opts.AuditFile != "" {
+		if err := os.MkdirAll(filepath.Dir(opts.AuditFile), 0o755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(opts.AuditFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		m.audit = f
+	}
+	return m, nil
+}
+
+// SafeReply is spoken instead of a blocked response.
+func (m *Moderator) SafeReply() string {
+	if m == nil {
+		return ""
+	}
+	return m.opts.SafeReply
+}
+
+// SafeReplyAudio returns the recorded safe reply and its sample rate, nil if
+// there is none.
+func (m *Moderator) SafeReplyAudio() ([]byte, int) {
+	if m == nil {
+		return nil, 0
+	}
+	return m.opts.SafeReplyAudio, m.opts.SafeReplySampleRate
+}
+
+// HasClassifier reports whether Classify has anything to ask.
+func (m *Moderator) HasClassifier() bool {
+	return m != nil && m.opts.Classifier != nil
+}
+
+// Match checks text against the keyword and pattern lists. It is cheap
+// enough to run on every transcript delta.
+func (m *Moderator) Match(text string) Verdict {
+	if m == nil || text == "" {
+		return Verdict{}
+	}
+	if len(m.keywords) > 0 {
+		normalized := normalize(text)
+		for _, k := range m.keywords {
+			if strings.Contains(normalized, k) {
+				return Verdict{Blocked: true, Rule: "keyword:" + k, Category: "keyword"}
+			}
+		}
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(text) {
+			return Verdict{Blocked: true, Rule: "pattern:" + re.String(), Category: "pattern"}
+		}
+	}
+	return Verdict{}
+}
+
+// Classify asks the classifier, within the configured timeout. Text passes
+// when there is no classifier.
+func (m *Moderator) Classify(ctx context.Context, source, text string) (Verdict, error) {
+	if !m.HasClassifier() || strings.TrimSpace(text) == "" {
+		return Verdict{}, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.opts.ClassifierTimeout)
+	defer cancel()
+	v, err := m.opts.Classifier.Classify(ctx, source, text)
+	if err != nil {
+		return Verdict{}, err
+	}
+	if v.Blocked && v.Rule == "" {
+		v.Rule = "classifier"
+	}
+	return v, nil
+}
+
+// Entry is a line of the audit log.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"session_id"`
+	DeviceId  string    `json:"device_id"`
+	Source    string    `json:"source"`
+	Text      string    `json:"text"`
+	Rule      string    `json:"rule"`
+	Category  string    `json:"category,omitempty"`
+	Action    string    `json:"action"`
+}
+
+// Audit appends an entry to the audit log, if there is one.
+func (m *Moderator) Audit(e Entry) error {
+	if m == nil || m.audit == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.audit.Write(append(data, '\n'))
+	return err
+}
+
+func (m *Moderator) Close() error {
+	if m == nil || m.audit == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.audit.Close()
+}
+
+// normalize lowercases text and drops spaces and punctuation, so that a
+// keyword still matches when split up by them.
+func normalize(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, text)
+}
+
+// HTTPClassifier posts {"source", "text"} to a URL that answers with a
+// Verdict.
+type HTTPClassifier struct {
+	URL    string
+	Client *http.Client // 为空时使用 http.DefaultClient
+}
+
+func (c *HTTPClassifier) Classify(ctx context.Context, source, text string) (Verdict, error) {
+	body, err := json.Marshal(map[string]string{"source": source, "text": text})
+	if err != nil {
+		return Verdict{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return Verdict{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return Verdict{}, fmt.Errorf("classifier status %d", resp.StatusCode)
+	}
+	var v Verdict
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return Verdict{}, err
+	}
+	return v, nil
+}
@@ -0,0 +1,107 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	m, err := New(Options{Keywords: []string{"Bad Word", "坏话"}, Patterns: []string{`\d{11}`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		text string
+		rule string
+	}{
+		{"say a BAD-word now", "keyword:badword"},
+		{"别说坏 ，话", "keyword:坏话"},
+		{"我的号码是13800138000", `pattern:\d{11}`},
+		{"今天天气不错", ""},
+	} {
+		v := m.Match(c.text)
+		if v.Blocked != (c.rule != "") || v.Rule != c.rule {
+			t.Errorf("Match(%q) = %+v, want rule %q", c.text, v, c.rule)
+		}
+	}
+	if _, err := New(Options{Patterns: []string{"("}}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+func TestHTTPClassifier(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Source, Text string }
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case strings.Contains(req.Text, "slow"):
+			time.Sleep(200 * time.Millisecond)
+		case req.Source == SourceAssistant && strings.Contains(req.Text, "暴力"):
+			_ = json.NewEncoder(w).Encode(Verdict{Blocked: true, Category: "violence"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(Verdict{})
+	}))
+	defer server.Close()
+	m, err := New(Options{
+		Classifier:        &HTTPClassifier{URL: server.URL},
+		ClassifierTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if v, err := m.Classify(ctx, SourceAssistant, "一段暴力内容"); err != nil || !v.Blocked || v.Rule != "classifier" || v.Category != "violence" {
+		t.Errorf("Classify = %+v, %v", v, err)
+	}
+	if v, err := m.Classify(ctx, SourceUser, "一段暴力内容"); err != nil || v.Blocked {
+		t.Errorf("Classify user = %+v, %v", v, err)
+	}
+	if _, err := m.Classify(ctx, SourceUser, "slow"); err == nil {
+		t.Error("classifier timeout not applied")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit", "moderation.jsonl")
+	m, err := New(Options{AuditFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"a", "b"} {
+		if err := m.Audit(Entry{SessionID: "s1", Source: SourceUser, Text: text, Rule: "keyword:x", Action: "drop_input"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d audit lines, want 2", len(lines))
+	}
+	var e Entry
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Text != "b" || e.SessionID != "s1" || e.Time.IsZero() {
+		t.Errorf("entry = %+v", e)
+	}
+
+	// nil Moderator 放行所有内容
+	var none *Moderator
+	if none.Match("anything").Blocked || none.HasClassifier() || none.Audit(e) != nil || none.Close() != nil {
+		t.Error("nil moderator is not a no-op")
+	}
+}
@@ -0,0 +1,491 @@
+// Package parental keeps per-device usage policies: the hours a device may
+// be used, how long per day and which personas it may talk as. Usage is the
+// time devices are connected, counted per day in the policy's timezone.
+package parental
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a device may not be used.
+const (
+	ReasonHours      = "hours"       // 不在允许的时段内
+	ReasonDailyLimit = "daily_limit" // 当日时长已用完
+)
+
+// DefaultPersona stands for the persona of the openai config in
+// Policy.Personas.
+const DefaultPersona = "default"
+
+const dayLayout = "2006-01-02"
+
+// Policy limits the use of a device. Zero fields do not limit.
+type Policy struct {
+	// Timezone is an IANA name such as Asia/Shanghai, the server's local
+	// time if empty.
+	Timezone string `json:"timezone,omitempty"`
+	// Hours are the allowed time windows such as "07:00-20:30", a window
+	// ending before it starts runs past midnight.
+	Hours        []string `json:"hours,omitempty"`
+	DailyMinutes int      `json:"daily_minutes,omitempty"`
+	// Personas the device may talk as, the first replaces any other. The
+	// persona is chosen when a device connects, a change applies from its
+	// next session.
+	Personas []string `json:"personas,omitempty"`
+}
+
+// Validate checks the timezone and hours.
+func (p Policy) Validate() error {
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", p.Timezone, err)
+	}
+	for _, h := range p.Hours {
+		if _, err := parseWindow(h); err != nil {
+			return err
+		}
+	}
+	if p.DailyMinutes < 0 {
+		return errors.New("daily_minutes must not be negative")
+	}
+	return nil
+}
+
+// Persona returns the persona a device configured with name talks as.
+func (p Policy) Persona(name string) string {
+	if len(p.Personas) == 0 {
+		return name
+	}
+	allowed := lower(p.Personas)
+	if slices.Contains(allowed, strings.ToLower(orDefault(name))) {
+		return name
+	}
+	if allowed[0] == DefaultPersona {
+		return ""
+	}
+	return p.Personas[0]
+}
+
+func (p Policy) location() *time.Location {
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// window is an allowed time of day, in minutes since midnight.
+type window struct {
+	start, end int
+}
+
+func parseWindow(s string) (window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return window{}, fmt.Errorf("invalid hours %q, want HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return window{}, fmt.Errorf("invalid hours %q: %w", s, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return window{}, fmt.Errorf("invalid hours %q: %w", s, err)
+	}
+	if start == end || start == 24*60 {
+		return window{}, fmt.Errorf("invalid hours %q", s)
+	}
+	return window{start: start, end: end}, nil
+}
+
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &h, &m); err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// until returns the end of the window if now falls in it.
+func (w window) until(now time.Time) (time.Time, bool) {
+	y, mo, d := now.Date()
+	// 跨午夜的时段可能是前一天开始的
+	for _, day := range []int{d - 1, d} {
+		start := time.Date(y, mo, day, 0, w.start, 0, 0, now.Location())
+		endDay := day
+		if w.end <= w.start {
+			endDay++
+		}
+		end := time.Date(y, mo, endDay, 0, w.end, 0, 0, now.Location())
+		if !now.Before(start) && now.Before(end) {
+			return end, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Verdict tells whether a device may be used now.
+type Verdict struct {
+	Allowed bool
+	Reason  string
+	// Until is when the allowed time runs out, zero if it does not.
+	Until time.Time
+}
+
+// Status is the policy and usage of a device today.
+type Status struct {
+	DeviceId    string     `json:"device_id"`
+	Policy      *Policy    `json:"policy"`
+	UsedSeconds int64      `json:"used_seconds"`
+	Allowed     bool       `json:"allowed"`
+	Reason      string     `json:"reason,omitempty"`
+	Until       *time.Time `json:"until,omitempty"`
+}
+
+// usage is the connected time of a device on a day.
+type usage struct {
+	Day    string `json:"day"`
+	UsedMs int64  `json:"used_ms"`
+}
+
+type state struct {
+	Policies map[string]*Policy `json:"policies"`
+	Usage    map[string]*usage  `json:"usage"`
+}
+
+// Controls keeps the policies and usage in a json file. Device ids are
+// compared case-insensitively.
+type Controls struct {
+	path string
+	now  func() time.Time
+
+	mu      sync.Mutex
+	state   state
+	active  map[*Tracker]struct{}
+	changed chan struct{} // 策略变更时关闭并替换
+}
+
+// New loads the policies stored at path, the file is created on first save.
+func New(path string) (*Controls, error) {
+	c := &Controls{
+		path:    path,
+		now:     time.Now,
+		active:  make(map[*Tracker]struct{}),
+		changed: make(chan struct{}),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &c.state); err != nil {
+			return nil, err
+		}
+	}
+	if c.state.Policies == nil {
+		c.state.Policies = make(map[string]*Policy)
+	}
+	if c.state.Usage == nil {
+		c.state.Usage = make(map[string]*usage)
+	}
+	return c, nil
+}
+
+// Set replaces the policy of the device, connected devices are checked
+// against it right away.
+func (c *Controls) Set(deviceId string, p Policy) error {
+	if deviceId == "" {
+		return errors.New("device id is required")
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	key := strings.ToLower(deviceId)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.state.Policies[key]
+	c.state.Policies[key] = &p
+	if err := c.save(); err != nil {
+		c.restore(key, prev)
+		return err
+	}
+	c.notify()
+	return nil
+}
+
+// Delete removes the policy of the device, which is then not limited.
+func (c *Controls) Delete(deviceId string) error {
+	key := strings.ToLower(deviceId)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, ok := c.state.Policies[key]
+	if !ok {
+		return nil
+	}
+	delete(c.state.Policies, key)
+	if err := c.save(); err != nil {
+		c.restore(key, prev)
+		return err
+	}
+	c.notify()
+	return nil
+}
+
+func (c *Controls) restore(key string, prev *Policy) {
+	if prev == nil {
+		delete(c.state.Policies, key)
+	} else {
+		c.state.Policies[key] = prev
+	}
+}
+
+// Status returns the policy of the device, nil if none, and its usage today
+// including connected sessions.
+func (c *Controls) Status(deviceId string) Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := strings.ToLower(deviceId)
+	now := c.now()
+	v := c.check(key, now)
+	s := Status{
+		DeviceId:    deviceId,
+		UsedSeconds: int64(c.used(key, now) / time.Second),
+		Allowed:     v.Allowed,
+		Reason:      v.Reason,
+	}
+	if !v.Until.IsZero() {
+		s.Until = &v.Until
+	}
+	if p, ok := c.state.Policies[key]; ok {
+		policy := *p
+		s.Policy = &policy
+	}
+	return s
+}
+
+// Start counts the usage of a connected device until the tracker is
+// stopped. A nil Controls returns a nil Tracker, which never limits.
+func (c *Controls) Start(deviceId string) *Tracker {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &Tracker{c: c, key: strings.ToLower(deviceId), start: c.now()}
+	c.active[t] = struct{}{}
+	return t
+}
+
+func (c *Controls) policy(key string) Policy {
+	if p, ok := c.state.Policies[key]; ok {
+		return *p
+	}
+	return Policy{}
+}
+
+// used returns the connected time of the device today, in the timezone of
+// its policy.
+func (c *Controls) used(key string, now time.Time) time.Duration {
+	now = now.In(c.policy(key).location())
+	var used time.Duration
+	if u, ok := c.state.Usage[key]; ok && u.Day == now.Format(dayLayout) {
+		used = time.Duration(u.UsedMs) * time.Millisecond
+	}
+	for t := range c.active {
+		if t.key == key {
+			used += now.Sub(later(t.start, startOfDay(now)))
+		}
+	}
+	return used
+}
+
+func (c *Controls) check(key string, now time.Time) Verdict {
+	p, ok := c.state.Policies[key]
+	if !ok {
+		return Verdict{Allowed: true}
+	}
+	now = now.In(p.location())
+	v := Verdict{Allowed: true}
+	if len(p.Hours) > 0 {
+		in := false
+		for _, h := range p.Hours {
+			w, err := parseWindow(h)
+			if err != nil {
+				continue
+			}
+			if end, ok := w.until(now); ok {
+				in = true
+				// 相邻的时段在前一个结束时重新检查
+				v.Until = later(v.Until, end)
+			}
+		}
+		if !in {
+			return Verdict{Reason: ReasonHours}
+		}
+	}
+	if p.DailyMinutes > 0 {
+		left := time.Duration(p.DailyMinutes)*time.Minute - c.used(key, now)
+		if left <= 0 {
+			return Verdict{Reason: ReasonDailyLimit}
+		}
+		if end := now.Add(left); v.Until.IsZero() || end.Before(v.Until) {
+			v.Until = end
+		}
+	}
+	return v
+}
+
+func (c *Controls) stop(t *Tracker) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.active[t]; !ok {
+		return
+	}
+	delete(c.active, t)
+	if t.key == "" {
+		return
+	}
+	now := c.now().In(c.policy(t.key).location())
+	day := now.Format(dayLayout)
+	u, ok := c.state.Usage[t.key]
+	if !ok || u.Day != day {
+		u = &usage{Day: day}
+		c.state.Usage[t.key] = u
+	}
+	// 跨午夜的会话只计入当天的部分
+	u.UsedMs += now.Sub(later(t.start, startOfDay(now))).Milliseconds()
+	_ = c.save()
+}
+
+func (c *Controls) save() error {
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *Controls) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Tracker is the usage of a connected device. Its methods may be called on
+// nil.
+type Tracker struct {
+	c     *Controls
+	key   string
+	start time.Time
+}
+
+// Check tells whether the device may be used now.
+func (t *Tracker) Check() Verdict {
+	if t == nil {
+		return Verdict{Allowed: true}
+	}
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.c.check(t.key, t.c.now())
+}
+
+// Persona returns the persona the device talks as, given the configured one.
+func (t *Tracker) Persona(name string) string {
+	if t == nil {
+		return name
+	}
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.c.policy(t.key).Persona(name)
+}
+
+// Wait blocks until the device may no longer be used, and returns why. It
+// returns false if ctx is done first.
+func (t *Tracker) Wait(ctx context.Context) (Verdict, bool) {
+	if t == nil {
+		<-ctx.Done()
+		return Verdict{}, false
+	}
+	for {
+		t.c.mu.Lock()
+		now := t.c.now()
+		v, changed := t.c.check(t.key, now), t.c.changed
+		t.c.mu.Unlock()
+		if !v.Allowed {
+			return v, true
+		}
+		if !sleep(ctx, changed, v.Until.Sub(now)) {
+			return Verdict{}, false
+		}
+	}
+}
+
+// sleep waits for d, forever if d is negative, or until the policies change.
+// It reports false if ctx is done first.
+func sleep(ctx context.Context, changed <-chan struct{}, d time.Duration) bool {
+	var expired <-chan time.Time
+	if d >= 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-changed:
+	case <-expired:
+	}
+	return true
+}
+
+// Stop adds the connected time to the usage of the day.
+func (t *Tracker) Stop() {
+	if t == nil {
+		return
+	}
+	t.c.stop(t)
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func orDefault(name string) string {
+	if name == "" {
+		return DefaultPersona
+	}
+	return name
+}
+
+func lower(names []string) []string {
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = strings.ToLower(n)
+	}
+	return out
+}
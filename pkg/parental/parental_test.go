@@ -0,0 +1,153 @@
+package parental
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testDevice = "AA:BB:CC:DD:EE:FF"
+
+func newControls(t *testing.T, path string, now *time.Time) *Controls {
+	c, err := New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return *now }
+	return c
+}
+
+func TestHours(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 10, day, hour, min, 0, 0, shanghai) }
+	var now time.Time
+	c := newControls(t, filepath.Join(t.TempDir(), "parental.json"), &now)
+	if err := c.Set(testDevice, Policy{Timezone: "Asia/Shanghai", Hours: []string{"07:00-12:00", "19:00-07:30"}}); err != nil {
+		t.Fatal(err)
+	}
+	tracker := c.Start("aa:bb:cc:dd:ee:ff")
+	defer tracker.Stop()
+	for _, tc := range []struct {
+		now   time.Time
+		until time.Time
+	}{
+		{at(18, 8, 0), at(18, 12, 0)},
+		{at(18, 12, 0), time.Time{}},
+		{at(18, 23, 0), at(19, 7, 30)},
+		// 跨午夜的时段与早上的时段重叠，到后结束的时刻
+		{at(19, 7, 10), at(19, 12, 0)},
+		{at(19, 6, 0).UTC(), at(19, 7, 30)},
+	} {
+		now = tc.now
+		v := tracker.Check()
+		if v.Allowed != !tc.until.IsZero() || !v.Until.Equal(tc.until) {
+			t.Errorf("at %v: %+v, want until %v", tc.now, v, tc.until)
+		}
+		if !v.Allowed && v.Reason != ReasonHours {
+			t.Errorf("at %v: reason %q", tc.now, v.Reason)
+		}
+	}
+}
+
+func TestDailyLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "parental.json")
+	now := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	c := newControls(t, path, &now)
+	if err := c.Set(testDevice, Policy{Timezone: "UTC", DailyMinutes: 30}); err != nil {
+		t.Fatal(err)
+	}
+	tracker := c.Start(testDevice)
+	now = now.Add(20 * time.Minute)
+	if v := tracker.Check(); !v.Allowed || !v.Until.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("after 20 minutes: %+v", v)
+	}
+	tracker.Stop()
+
+	// 用量保存在文件中，重启后继续计算
+	c = newControls(t, path, &now)
+	if s := c.Status(testDevice); s.UsedSeconds != 20*60 || s.Policy == nil || !s.Allowed {
+		t.Errorf("status after restart = %+v", s)
+	}
+	tracker = c.Start(testDevice)
+	now = now.Add(10 * time.Minute)
+	if v := tracker.Check(); v.Allowed || v.Reason != ReasonDailyLimit {
+		t.Errorf("after 30 minutes: %+v", v)
+	}
+	tracker.Stop()
+
+	now = time.Date(2026, 10, 19, 0, 5, 0, 0, time.UTC)
+	if s := c.Status(testDevice); !s.Allowed || s.UsedSeconds != 0 {
+		t.Errorf("status the next day = %+v", s)
+	}
+}
+
+func TestWait(t *testing.T) {
+	c, err := New(filepath.Join(t.TempDir(), "parental.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := c.Start(testDevice)
+	defer tracker.Stop()
+	result := make(chan Verdict, 1)
+	go func() {
+		v, _ := tracker.Wait(context.Background())
+		result <- v
+	}()
+
+	// 没有策略时一直等待，设置策略后重新检查，剩余时间用完时返回
+	c.mu.Lock()
+	c.state.Usage["aa:bb:cc:dd:ee:ff"] = &usage{Day: c.now().Format(dayLayout), UsedMs: 59_900}
+	c.mu.Unlock()
+	if err := c.Set(testDevice, Policy{DailyMinutes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-result:
+		if v.Reason != ReasonDailyLimit {
+			t.Errorf("verdict = %+v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return when the time ran out")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := c.Start("other").Wait(ctx); ok {
+		t.Error("unlimited device ran out of time")
+	}
+	var none *Tracker
+	if _, ok := none.Wait(ctx); ok || !none.Check().Allowed {
+		t.Error("nil tracker limits")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	for _, p := range []Policy{
+		{Timezone: "Mars/Olympus"},
+		{Hours: []string{"07:00"}},
+		{Hours: []string{"25:00-07:00"}},
+		{Hours: []string{"07:00-07:00"}},
+		{DailyMinutes: -1},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("policy %+v accepted", p)
+		}
+	}
+	if err := (Policy{Hours: []string{"00:00-24:00"}}).Validate(); err != nil {
+		t.Error(err)
+	}
+
+	p := Policy{Personas: []string{"Storyteller", DefaultPersona}}
+	for name, want := range map[string]string{"teacher": "Storyteller", "storyteller": "storyteller", "": ""} {
+		if got := p.Persona(name); got != want {
+			t.Errorf("Persona(%q) = %q, want %q", name, got, want)
+		}
+	}
+	if got := (Policy{Personas: []string{DefaultPersona}}).Persona("teacher"); got != "" {
+		t.Errorf("Persona = %q, want the default", got)
+	}
+}
@@ -0,0 +1,607 @@
+// Package mock is an in-process OpenAI Realtime server for tests. It speaks
+// enough of the protocol for the gateway to run a session end to end: session
+// created and updated, server VAD, input transcription, and scripted replies
+// streamed as transcript and pcm16 audio deltas, plus errors and disconnects
+// on demand.
+package mock
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
+	"github.com/xdimtech/go-xiaozhi/pkg/utils"
+)
+
+const (
+	// 24 kHz pcm16 下 500 ms 的音频视为一句话
+	defaultSpeechBytes = 24000
+	// 每个 audio delta 100 ms
+	defaultChunkBytes = 4800
+	// 没有音频时每个字幕 delta 的字数
+	transcriptChunkRunes = 4
+	// 剩余剧本为空时的回复
+	defaultReply = "好的。"
+)
+
+// FunctionCall makes a turn call a tool instead of replying.
+type FunctionCall struct {
+	Name      string
+	Arguments string
+}
+
+// Turn is the scripted outcome of a user utterance or a response.create.
+// Each response consumes the next turn.
+type Turn struct {
+	// Transcript is the transcription of the user audio, sent when the
+	// utterance is committed.
+	Transcript string
+	// TranscriptionError fails the transcription after the deltas of
+	// Transcript, if any.
+	TranscriptionError string
+	// Reply is the transcript of the spoken reply.
+	Reply string
+	// Audio is the pcm16 reply audio, split into deltas along with Reply.
+	Audio []byte
+	// FunctionCall replaces the reply with a tool call, the reply usually
+	// comes in the next turn once the tool output is sent back.
+	FunctionCall *FunctionCall
+	// FunctionCalls are further calls made in parallel in the same response.
+	FunctionCalls []FunctionCall
+	// Error replaces the response with an error event.
+	Error string
+}
+
+type Option func(*Server)
+
+// WithTurns scripts the replies in order.
+func WithTurns(turns ...Turn) Option {
+	return func(s *Server) {
+		s.turns = append(s.turns, turns...)
+	}
+}
+
+// WithVAD sets how many bytes of appended audio make an utterance in server
+// VAD mode. Audio is not inspected, every speechBytes is one utterance.
+func WithVAD(speechBytes int) Option {
+	return func(s *Server) {
+		s.speechBytes = speechBytes
+	}
+}
+
+// WithChunkSize sets the size of the audio deltas.
+func WithChunkSize(chunkBytes int) Option {
+	return func(s *Server) {
+		s.chunkBytes = chunkBytes
+	}
+}
+
+// WithDeltaInterval paces the deltas of a response, so that it can be
+// interrupted or cancelled midway.
+func WithDeltaInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		s.deltaInterval = interval
+	}
+}
+
+// WithDefaultTurn sets the outcome of the turns once the script runs out,
+// by default a short reply without audio.
+func WithDefaultTurn(turn Turn) Option {
+	return func(s *Server) {
+		s.defaultTurn = turn
+	}
+}
+
+// WithoutHistory stops keeping the received events, so that a long run with
+// many connections does not grow. Received and WaitFor see nothing.
+func WithoutHistory() Option {
+	return func(s *Server) {
+		s.noHistory = true
+	}
+}
+
+// Server is a Realtime API server on a local port. Close it when done.
+type Server struct {
+	srv           *httptest.Server
+	upgrader      websocket.Upgrader
+	speechBytes   int
+	chunkBytes    int
+	deltaInterval time.Duration
+	defaultTurn   Turn
+	noHistory     bool
+
+	mu       sync.Mutex
+	turns    []Turn
+	received []openai.ClientEvent
+	changed  chan struct{} // 收到新事件时关闭并替换
+	conns    map[*conn]bool
+	requests []*http.Request
+}
+
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		speechBytes: defaultSpeechBytes,
+		chunkBytes:  defaultChunkBytes,
+		defaultTurn: Turn{Reply: defaultReply},
+		changed:     make(chan struct{}),
+		conns:       make(map[*conn]bool),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// URL is the websocket url of the server, to be used as openai.base_url.
+func (s *Server) URL() string {
+	return "ws" + strings.TrimPrefix(s.srv.URL, "http")
+}
+
+// Close disconnects all clients and stops the server.
+func (s *Server) Close() {
+	s.Disconnect()
+	s.srv.Close()
+}
+
+// AddTurns appends replies to the script.
+func (s *Server) AddTurns(turns ...Turn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.turns = append(s.turns, turns...)
+}
+
+// Requests returns the handshake requests, e.g. to check the api key.
+func (s *Server) Requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+// Received returns the client events received so far on all connections.
+func (s *Server) Received() []openai.ClientEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]openai.ClientEvent(nil), s.received...)
+}
+
+// WaitFor waits for a received event that matches.
+func (s *Server) WaitFor(timeout time.Duration, match func(openai.ClientEvent) bool) (openai.ClientEvent, bool) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		ev, ok := lo.Find(s.received, match)
+		changed := s.changed
+		s.mu.Unlock()
+		if ok {
+			return ev, true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, false
+		}
+	}
+}
+
+// Type matches events of a type, for WaitFor.
+func Type(typ openai.ClientEventType) func(openai.ClientEvent) bool {
+	return func(ev openai.ClientEvent) bool {
+		return ev.ClientEventType() == typ
+	}
+}
+
+// Send sends an event to all connected clients.
+func (s *Server) Send(ev openai.ServerEvent) error {
+	var errs []error
+	for _, c := range s.connections() {
+		errs = append(errs, c.send(ev))
+	}
+	return errors.Join(errs...)
+}
+
+// SendError sends an error event to all connected clients.
+func (s *Server) SendError(code, message string) error {
+	return s.Send(errorEvent(code, message))
+}
+
+// Disconnect drops all connections without a close handshake, as a network
+// failure would. New connections are still accepted.
+func (s *Server) Disconnect() {
+	for _, c := range s.connections() {
+		_ = c.ws.UnderlyingConn().Close()
+	}
+}
+
+func (s *Server) connections() []*conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return lo.Keys(s.conns)
+}
+
+func (s *Server) nextTurn() Turn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.turns) == 0 {
+		return s.defaultTurn
+	}
+	turn := s.turns[0]
+	s.turns = s.turns[1:]
+	return turn
+}
+
+func (s *Server) receive(ev openai.ClientEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.noHistory {
+		return
+	}
+	s.received = append(s.received, ev)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{
+		server: s,
+		ws:     ws,
+		session: openai.ServerSession{
+			ID:                utils.UniqueID(),
+			Object:            openai.ObjectRealtimeSession,
+			Model:             r.URL.Query().Get("model"),
+			Modalities:        []openai.Modality{openai.ModalityText, openai.ModalityAudio},
+			InputAudioFormat:  openai.AudioFormatPcm16,
+			OutputAudioFormat: openai.AudioFormatPcm16,
+			TurnDetection:     &openai.TurnDetection{Type: openai.ClientTurnDetectionTypeServerVad},
+		},
+	}
+	s.mu.Lock()
+	s.conns[c] = true
+	s.requests = append(s.requests, r)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		_ = ws.Close()
+	}()
+
+	_ = c.send(&openai.SessionCreatedEvent{Session: c.session})
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			c.cancel()
+			return
+		}
+		ev, err := openai.UnmarshalClientEvent(data)
+		if err != nil {
+			_ = c.send(errorEvent("invalid_event", err.Error()))
+			continue
+		}
+		s.receive(ev)
+		c.handle(ev)
+	}
+}
+
+// conn is the state of a client connection.
+type conn struct {
+	server  *Server
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	// 以下字段只在读协程中访问
+	session  openai.ServerSession
+	buffered int // 当前这句话已收到的音频字节数
+	speechAt time.Time
+	itemId   string
+	lastItem string
+
+	// 进行中的回复，response.cancel 时置位
+	responding atomic.Pointer[atomic.Bool]
+	// response.created 到 response.done 之间，期间的 response.create 会被拒绝
+	active    atomic.Bool
+	responses sync.WaitGroup
+}
+
+func (c *conn) send(ev openai.ServerEvent) error {
+	data, err := openai.MarshalServerEvent(ev)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *conn) handle(ev openai.ClientEvent) {
+	switch ev := ev.(type) {
+	case *openai.SessionUpdateEvent:
+		c.updateSession(ev.Session)
+		_ = c.send(&openai.SessionUpdatedEvent{Session: c.session})
+	case *openai.InputAudioBufferAppendEvent:
+		c.append(ev.Audio)
+	case *openai.InputAudioBufferCommitEvent:
+		c.commit(ev.Transcript)
+	case *openai.InputAudioBufferClearEvent:
+		c.buffered, c.itemId = 0, ""
+		_ = c.send(&openai.InputAudioBufferClearedEvent{})
+	case *openai.ConversationItemCreateEvent:
+		item := ev.Item
+		item.ID = lo.CoalesceOrEmpty(item.ID, utils.UniqueID())
+		item.Status = openai.ItemStatusCompleted
+		_ = c.send(&openai.ConversationItemCreatedEvent{
+			PreviousItemID: c.lastItem,
+			Item:           openai.ResponseMessageItem{MessageItem: item, Object: openai.ObjectItem},
+		})
+		c.lastItem = item.ID
+	case *openai.ResponseCreateEvent:
+		if c.active.Load() {
+			rejected := errorEvent("conversation_already_has_active_response",
+				"Conversation already has an active response")
+			rejected.Error.EventID = ev.EventID
+			_ = c.send(rejected)
+			return
+		}
+		c.respond(c.server.nextTurn())
+	case *openai.ResponseCancelEvent:
+		c.cancel()
+	}
+}
+
+func (c *conn) updateSession(update openai.ClientSession) {
+	if update.Modalities != nil {
+		c.session.Modalities = update.Modalities
+	}
+	if update.Instructions != nil {
+		c.session.Instructions = *update.Instructions
+	}
+	if update.Voice != nil {
+		c.session.Voice = *update.Voice
+	}
+	if update.InputAudioFormat != nil {
+		c.session.InputAudioFormat = *update.InputAudioFormat
+	}
+	if update.OutputAudioFormat != nil {
+		c.session.OutputAudioFormat = *update.OutputAudioFormat
+	}
+	if update.InputAudioTranscription != nil {
+		c.session.InputAudioTranscription = update.InputAudioTranscription
+	}
+	if update.Tools != nil {
+		c.session.Tools = update.Tools
+	}
+	// turn_detection 为 null 时切换到手动提交
+	c.session.TurnDetection = update.TurnDetection
+	if update.TurnDetection != nil && update.TurnDetection.Type == openai.ClientTurnDetectionTypeUnspecified {
+		c.session.TurnDetection = nil
+	}
+}
+
+func (c *conn) vad() bool {
+	return c.session.TurnDetection != nil && c.server.speechBytes > 0
+}
+
+func (c *conn) append(b64 string) {
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	if c.itemId == "" {
+		c.itemId = utils.UniqueID()
+		c.speechAt = time.Now()
+		if c.vad() {
+			// 用户开口即打断进行中的回复
+			c.cancel()
+			_ = c.send(&openai.InputAudioBufferSpeechStartedEvent{ItemID: c.itemId})
+		}
+	}
+	c.buffered += len(data)
+	if c.vad() && c.buffered >= c.server.speechBytes {
+		_ = c.send(&openai.InputAudioBufferSpeechStoppedEvent{
+			AudioEndMs: time.Since(c.speechAt).Milliseconds(),
+			ItemID:     c.itemId,
+		})
+		c.commit("")
+	}
+}
+
+// commit ends the utterance, transcribes it with the next turn and replies.
+func (c *conn) commit(transcript string) {
+	itemId := lo.CoalesceOrEmpty(c.itemId, utils.UniqueID())
+	c.buffered, c.itemId = 0, ""
+	_ = c.send(&openai.InputAudioBufferCommittedEvent{PreviousItemID: c.lastItem, ItemID: itemId})
+	c.lastItem = itemId
+
+	turn := c.server.nextTurn()
+	transcript = lo.CoalesceOrEmpty(transcript, turn.Transcript)
+	for _, delta := range splitText(transcript, transcriptChunkRunes) {
+		_ = c.send(&openai.ConversationItemInputAudioTranscriptionDeltaEvent{ItemID: itemId, Delta: delta})
+	}
+	if turn.TranscriptionError != "" {
+		_ = c.send(&openai.ConversationItemInputAudioTranscriptionFailedEvent{
+			ItemID: itemId,
+			Error:  openai.Error{Type: "transcription_error", Message: turn.TranscriptionError},
+		})
+	} else if transcript != "" {
+		_ = c.send(&openai.ConversationItemInputAudioTranscriptionCompletedEvent{ItemID: itemId, Transcript: transcript})
+	}
+	c.respond(turn)
+}
+
+// cancel stops the response in progress, if any.
+func (c *conn) cancel() {
+	if cancelled := c.responding.Load(); cancelled != nil {
+		cancelled.Store(true)
+	}
+	c.responses.Wait()
+}
+
+func (c *conn) respond(turn Turn) {
+	if turn.Error != "" {
+		_ = c.send(errorEvent("server_error", turn.Error))
+		return
+	}
+	c.cancel()
+	c.active.Store(true)
+	cancelled := &atomic.Bool{}
+	c.responding.Store(cancelled)
+	c.responses.Add(1)
+	go func() {
+		defer c.responses.Done()
+		c.stream(turn, cancelled)
+	}()
+}
+
+// stream sends a response the way the api does, transcript and audio deltas
+// interleaved. A cancelled response ends early with status cancelled.
+func (c *conn) stream(turn Turn, cancelled *atomic.Bool) {
+	responseId, itemId := utils.UniqueID(), utils.UniqueID()
+	response := openai.Response{ID: responseId, Object: openai.ObjectResponse, Status: openai.ResponseStatusInProgress}
+	_ = c.send(&openai.ResponseCreatedEvent{Response: response})
+
+	calls := turn.FunctionCalls
+	if turn.FunctionCall != nil {
+		calls = append([]FunctionCall{*turn.FunctionCall}, calls...)
+	}
+	if len(calls) > 0 {
+		c.streamCalls(response, calls, cancelled)
+		return
+	}
+
+	item := openai.MessageItem{ID: itemId, Type: openai.MessageItemTypeMessage, Role: openai.MessageRoleAssistant}
+	_ = c.send(&openai.ResponseOutputItemAddedEvent{
+		ResponseID: responseId,
+		Item:       openai.ResponseMessageItem{MessageItem: item, Object: openai.ObjectItem},
+	})
+
+	var sent string
+	part := openai.MessageContentPart{Type: openai.MessageContentTypeAudio}
+	_ = c.send(&openai.ResponseContentPartAddedEvent{ResponseID: responseId, ItemID: itemId, Part: part})
+	chunks := lo.Chunk(turn.Audio, max(c.server.chunkBytes, 2))
+	texts := splitText(turn.Reply, transcriptChunkRunes)
+	if len(chunks) > 0 {
+		texts = splitParts(turn.Reply, len(chunks))
+	}
+	for i := 0; i < max(len(chunks), len(texts)); i++ {
+		if cancelled.Load() {
+			break
+		}
+		if i < len(texts) && texts[i] != "" {
+			sent += texts[i]
+			_ = c.send(&openai.ResponseAudioTranscriptDeltaEvent{ResponseID: responseId, ItemID: itemId, Delta: texts[i]})
+		}
+		if i < len(chunks) {
+			_ = c.send(&openai.ResponseAudioDeltaEvent{
+				ResponseID: responseId,
+				ItemID:     itemId,
+				Delta:      base64.StdEncoding.EncodeToString(chunks[i]),
+			})
+		}
+		time.Sleep(c.server.deltaInterval)
+	}
+	_ = c.send(&openai.ResponseAudioDoneEvent{ResponseID: responseId, ItemID: itemId})
+	_ = c.send(&openai.ResponseAudioTranscriptDoneEvent{ResponseID: responseId, ItemID: itemId, Transcript: sent})
+	part.Transcript = lo.ToPtr(sent)
+	_ = c.send(&openai.ResponseContentPartDoneEvent{ResponseID: responseId, ItemID: itemId, Part: part})
+	item.Content = []openai.MessageContentPart{part}
+	c.finish(response, []openai.MessageItem{item}, cancelled, &openai.Usage{
+		InputTokens:  utf8.RuneCountInString(turn.Transcript),
+		OutputTokens: utf8.RuneCountInString(sent),
+	})
+}
+
+// streamCalls sends a response made of function calls, one output item each.
+func (c *conn) streamCalls(response openai.Response, calls []FunctionCall, cancelled *atomic.Bool) {
+	items := make([]openai.MessageItem, 0, len(calls))
+	var arguments int
+	for _, call := range calls {
+		item := openai.MessageItem{
+			ID:        utils.UniqueID(),
+			Type:      openai.MessageItemTypeFunctionCall,
+			CallID:    utils.UniqueID(),
+			Name:      call.Name,
+			Arguments: call.Arguments,
+		}
+		_ = c.send(&openai.ResponseOutputItemAddedEvent{
+			ResponseID: response.ID,
+			Item:       openai.ResponseMessageItem{MessageItem: item, Object: openai.ObjectItem},
+		})
+		_ = c.send(&openai.ResponseFunctionCallArgumentsDoneEvent{
+			ResponseID: response.ID,
+			ItemID:     item.ID,
+			CallID:     item.CallID,
+			Arguments:  item.Arguments,
+			Name:       item.Name,
+		})
+		items = append(items, item)
+		arguments += utf8.RuneCountInString(call.Arguments)
+	}
+	c.finish(response, items, cancelled, &openai.Usage{OutputTokens: arguments})
+}
+
+// finish ends the response with its output items, cancelled if it was.
+func (c *conn) finish(response openai.Response, items []openai.MessageItem, cancelled *atomic.Bool, usage *openai.Usage) {
+	response.Status = openai.ResponseStatusCompleted
+	status := openai.ItemStatusCompleted
+	if cancelled.Load() {
+		response.Status = openai.ResponseStatusCancelled
+		status = openai.ItemStatusIncomplete
+	}
+	for _, item := range items {
+		item.Status = status
+		doneItem := openai.ResponseMessageItem{MessageItem: item, Object: openai.ObjectItem}
+		_ = c.send(&openai.ResponseOutputItemDoneEvent{ResponseID: response.ID, Item: doneItem})
+		response.Output = append(response.Output, doneItem)
+	}
+	usage.TotalTokens = usage.InputTokens + usage.OutputTokens
+	response.Usage = usage
+	// 先于 response.done 清除，收到 done 后立即发送的 response.create 不会被拒绝
+	c.active.Store(false)
+	_ = c.send(&openai.ResponseDoneEvent{Response: response})
+}
+
+func errorEvent(code, message string) *openai.ErrorEvent {
+	return &openai.ErrorEvent{Error: openai.Error{Type: "server_error", Code: code, Message: message}}
+}
+
+// splitText splits text into pieces of n runes.
+func splitText(text string, n int) []string {
+	return lo.Map(lo.Chunk([]rune(text), n), func(r []rune, _ int) string { return string(r) })
+}
+
+// splitParts splits text into n pieces of about the same length, some may be
+// empty when the text is short.
+func splitParts(text string, n int) []string {
+	runes := []rune(text)
+	parts := make([]string, n)
+	for i := range parts {
+		parts[i] = string(runes[len(runes)*i/n : len(runes)*(i+1)/n])
+	}
+	return parts
+}
+
+// Tone returns d of a 440 Hz pcm16 tone at sampleRate, as reply audio.
+func Tone(sampleRate int, d time.Duration) []byte {
+	samples := int(int64(sampleRate) * int64(d) / int64(time.Second))
+	pcm := make([]byte, samples*2)
+	for i := 0; i < samples; i++ {
+		v := int16(8000 * math.Sin(2*math.Pi*440*float64(i)/float64(sampleRate)))
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(v))
+	}
+	return pcm
+}
@@ -0,0 +1,195 @@
+package mock
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai"
+)
+
+type client struct {
+	t  *testing.T
+	ws *websocket.Conn
+}
+
+func dial(t *testing.T, s *Server) *client {
+	ws, _, err := websocket.DefaultDialer.Dial(s.URL()+"?model=test-model", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ws.Close() })
+	return &client{t: t, ws: ws}
+}
+
+func (c *client) send(ev openai.ClientEvent) {
+	if err := c.ws.WriteJSON(ev); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) recv() openai.ServerEvent {
+	_ = c.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := c.ws.ReadMessage()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	ev, err := openai.UnmarshalServerEvent(data)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return ev
+}
+
+// until reads events up to one of type typ and returns them.
+func (c *client) until(typ openai.ServerEventType) []openai.ServerEvent {
+	var events []openai.ServerEvent
+	for {
+		ev := c.recv()
+		events = append(events, ev)
+		if ev.ServerEventType() == typ {
+			return events
+		}
+	}
+}
+
+func count(events []openai.ServerEvent, typ openai.ServerEventType) int {
+	n := 0
+	for _, ev := range events {
+		if ev.ServerEventType() == typ {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSessionUpdate(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := dial(t, s)
+
+	created := c.recv().(*openai.SessionCreatedEvent)
+	if created.Session.Model != "test-model" {
+		t.Fatalf("model = %q", created.Session.Model)
+	}
+	instructions := "be brief"
+	c.send(&openai.SessionUpdateEvent{
+		ClientEventBase: openai.ClientEventBase{Type: openai.ClientEventTypeSessionUpdate},
+		Session:         openai.ClientSession{Instructions: &instructions},
+	})
+	updated := c.recv().(*openai.SessionUpdatedEvent)
+	if updated.Session.Instructions != instructions || updated.Session.TurnDetection != nil {
+		t.Fatalf("session = %+v", updated.Session)
+	}
+	if _, ok := s.WaitFor(time.Second, Type(openai.ClientEventTypeSessionUpdate)); !ok {
+		t.Fatal("session.update not received")
+	}
+}
+
+func TestVADTurn(t *testing.T) {
+	s := NewServer(WithVAD(9600), WithChunkSize(4800),
+		WithTurns(Turn{Transcript: "你好", Reply: "你好呀。今天过得好吗？", Audio: Tone(24000, 300*time.Millisecond)}))
+	defer s.Close()
+	c := dial(t, s)
+	c.recv()
+
+	frame := base64.StdEncoding.EncodeToString(make([]byte, 4800))
+	for i := 0; i < 2; i++ {
+		c.send(&openai.InputAudioBufferAppendEvent{
+			ClientEventBase: openai.ClientEventBase{Type: openai.ClientEventTypeInputAudioBufferAppend},
+			Audio:           frame,
+		})
+	}
+	events := c.until(openai.ServerEventTypeResponseDone)
+	for _, typ := range []openai.ServerEventType{
+		openai.ServerEventTypeInputAudioBufferSpeechStarted,
+		openai.ServerEventTypeInputAudioBufferSpeechStopped,
+		openai.ServerEventTypeInputAudioBufferCommitted,
+		openai.ServerEventTypeConversationItemInputAudioTranscriptionCompleted,
+		openai.ServerEventTypeResponseCreated,
+		openai.ServerEventTypeResponseAudioDone,
+	} {
+		if count(events, typ) != 1 {
+			t.Errorf("%s sent %d times", typ, count(events, typ))
+		}
+	}
+	if n := count(events, openai.ServerEventTypeResponseAudioDelta); n != 3 {
+		t.Errorf("audio deltas = %d, want 3", n)
+	}
+	transcript := ""
+	for _, ev := range events {
+		if delta, ok := ev.(*openai.ResponseAudioTranscriptDeltaEvent); ok {
+			transcript += delta.Delta
+		}
+	}
+	if transcript != "你好呀。今天过得好吗？" {
+		t.Errorf("transcript = %q", transcript)
+	}
+	done := events[len(events)-1].(*openai.ResponseDoneEvent)
+	if done.Response.Status != openai.ResponseStatusCompleted || done.Response.Usage == nil {
+		t.Errorf("response = %+v", done.Response)
+	}
+}
+
+func TestFunctionCallAndError(t *testing.T) {
+	s := NewServer(WithTurns(
+		Turn{FunctionCall: &FunctionCall{Name: "list_reminders", Arguments: "{}"}},
+		Turn{Error: "overloaded"},
+	))
+	defer s.Close()
+	c := dial(t, s)
+	c.recv()
+
+	create := &openai.ResponseCreateEvent{ClientEventBase: openai.ClientEventBase{Type: openai.ClientEventTypeResponseCreate}}
+	c.send(create)
+	events := c.until(openai.ServerEventTypeResponseDone)
+	var call *openai.ResponseFunctionCallArgumentsDoneEvent
+	for _, ev := range events {
+		if ev, ok := ev.(*openai.ResponseFunctionCallArgumentsDoneEvent); ok {
+			call = ev
+		}
+	}
+	if call == nil || call.Name != "list_reminders" || call.CallID == "" {
+		t.Fatalf("function call = %+v", call)
+	}
+
+	c.send(create)
+	if ev, ok := c.recv().(*openai.ErrorEvent); !ok || ev.Error.Message != "overloaded" {
+		t.Fatalf("error event = %+v", ev)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	s := NewServer(WithDeltaInterval(50*time.Millisecond), WithChunkSize(480),
+		WithTurns(Turn{Reply: "很长的回复", Audio: Tone(24000, time.Second)}))
+	defer s.Close()
+	c := dial(t, s)
+	c.recv()
+
+	c.send(&openai.ResponseCreateEvent{ClientEventBase: openai.ClientEventBase{Type: openai.ClientEventTypeResponseCreate}})
+	c.until(openai.ServerEventTypeResponseAudioDelta)
+	c.send(&openai.ResponseCancelEvent{ClientEventBase: openai.ClientEventBase{Type: openai.ClientEventTypeResponseCancel}})
+	events := c.until(openai.ServerEventTypeResponseDone)
+	if n := count(events, openai.ServerEventTypeResponseAudioDelta); n > 10 {
+		t.Errorf("%d audio deltas after cancel", n)
+	}
+	if done := events[len(events)-1].(*openai.ResponseDoneEvent); done.Response.Status != openai.ResponseStatusCancelled {
+		t.Errorf("status = %s", done.Response.Status)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := dial(t, s)
+	c.recv()
+
+	s.Disconnect()
+	_ = c.ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := c.ws.ReadMessage(); err == nil {
+		t.Fatal("read after disconnect succeeded")
+	}
+	// 断开后仍可重新连接
+	dial(t, s).recv()
+}
@@ -0,0 +1,46 @@
+package mock
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/xdimtech/go-xiaozhi/pkg/config"
+)
+
+// Main loads the config at confPath and runs the tests of a package that
+// talks to mock servers. They do not check the api key, so a fake one is
+// set if there is none.
+func Main(m *testing.M, confPath string) {
+	if os.Getenv("XDIM_STEP_API_KEY") == "" {
+		_ = os.Setenv("XDIM_STEP_API_KEY", "test")
+	}
+	if err := config.Load(confPath); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+// Use points the realtime api config at the server until the test ends.
+func (s *Server) Use(t testing.TB) {
+	baseURL := config.OpenAIConfig().BaseURL
+	config.OpenAIConfig().BaseURL = s.URL()
+	t.Cleanup(func() { config.OpenAIConfig().BaseURL = baseURL })
+}
+
+// Gateway points the realtime api at a new mock server and serves the
+// gateway over http, returning the websocket url devices connect to. Both
+// servers are closed and the config restored when the test ends.
+func Gateway(t testing.TB, gateway http.HandlerFunc, opts ...Option) (string, *Server) {
+	t.Helper()
+	server := NewServer(opts...)
+	t.Cleanup(server.Close)
+	server.Use(t)
+
+	ts := httptest.NewServer(gateway)
+	t.Cleanup(ts.Close)
+	return "ws" + strings.TrimPrefix(ts.URL, "http") + "/xiaozhi/v1/", server
+}
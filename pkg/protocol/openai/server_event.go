@@ -21,6 +21,7 @@ const (
 	ServerEventTypeConversationItemCreated                          ServerEventType = "conversation.item.created"
 	ServerEventTypeConversationItemInputAudioTranscriptionCompleted ServerEventType = "conversation.item.input_audio_transcription.completed"
 	ServerEventTypeConversationItemInputAudioTranscriptionFailed    ServerEventType = "conversation.item.input_audio_transcription.failed"
+	ServerEventTypeConversationItemInputAudioTranscriptionDelta     ServerEventType = "conversation.item.input_audio_transcription.delta"
 	ServerEventTypeConversationItemTruncated                        ServerEventType = "conversation.item.truncated"
 	ServerEventTypeConversationItemDeleted                          ServerEventType = "conversation.item.deleted"
 	ServerEventTypeResponseCreated                                  ServerEventType = "response.created"
@@ -159,6 +160,15 @@ type ConversationItemInputAudioTranscriptionCompletedEvent struct {
 	Transcript   string `json:"transcript"`
 }
 
+// ConversationItemInputAudioTranscriptionDeltaEvent is a partial transcript of
+// the user audio, sent by providers that stream transcription.
+type ConversationItemInputAudioTranscriptionDeltaEvent struct {
+	ServerEventBase
+	ItemID       string `json:"item_id"`
+	ContentIndex int    `json:"content_index"`
+	Delta        string `json:"delta"`
+}
+
 type ConversationItemInputAudioTranscriptionFailedEvent struct {
 	ServerEventBase
 	ItemID       string `json:"item_id"`
@@ -405,6 +415,7 @@ type ServerEventInterface interface {
 		ConversationItemCreatedEvent |
 		ConversationItemInputAudioTranscriptionCompletedEvent |
 		ConversationItemInputAudioTranscriptionFailedEvent |
+		ConversationItemInputAudioTranscriptionDeltaEvent |
 		ConversationItemTruncatedEvent |
 		ConversationItemDeletedEvent |
 		ResponseCancelledEvent |
@@ -458,6 +469,8 @@ func MarshalServerEvent(event ServerEvent) ([]byte, error) {
 		ev.SetBaseEventType(ServerEventTypeConversationItemInputAudioTranscriptionCompleted)
 	case *ConversationItemInputAudioTranscriptionFailedEvent:
 		ev.SetBaseEventType(ServerEventTypeConversationItemInputAudioTranscriptionFailed)
+	case *ConversationItemInputAudioTranscriptionDeltaEvent:
+		ev.SetBaseEventType(ServerEventTypeConversationItemInputAudioTranscriptionDelta)
 	case *ConversationItemTruncatedEvent:
 		ev.SetBaseEventType(ServerEventTypeConversationItemTruncated)
 	case *ConversationItemDeletedEvent:
@@ -533,12 +546,16 @@ func UnmarshalServerEvent(data []byte) (ServerEvent, error) { //nolint:funlen,cy
 		return unmarshalServerEvent[ConversationItemInputAudioTranscriptionCompletedEvent](data)
 	case ServerEventTypeConversationItemInputAudioTranscriptionFailed:
 		return unmarshalServerEvent[ConversationItemInputAudioTranscriptionFailedEvent](data)
+	case ServerEventTypeConversationItemInputAudioTranscriptionDelta:
+		return unmarshalServerEvent[ConversationItemInputAudioTranscriptionDeltaEvent](data)
 	case ServerEventTypeConversationItemTruncated:
 		return unmarshalServerEvent[ConversationItemTruncatedEvent](data)
 	case ServerEventTypeConversationItemDeleted:
 		return unmarshalServerEvent[ConversationItemDeletedEvent](data)
 	case ServerEventTypeResponseCreated:
 		return unmarshalServerEvent[ResponseCreatedEvent](data)
+	case ServerEventTypeResponseCancelled:
+		return unmarshalServerEvent[ResponseCancelledEvent](data)
 	case ServerEventTypeResponseDone:
 		return unmarshalServerEvent[ResponseDoneEvent](data)
 	case ServerEventTypeResponseOutputItemAdded:
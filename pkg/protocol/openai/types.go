@@ -116,8 +116,12 @@ const (
 )
 
 type InputAudioTranscription struct {
-	// The model used for transcription.
-	Model string `json:"model"`
+	// The model used for transcription, the provider default if empty.
+	Model string `json:"model,omitempty"`
+	// The language of the input audio in ISO-639-1 format, e.g. "zh".
+	Language string `json:"language,omitempty"`
+	// Optional text to guide the transcription style or vocabulary.
+	Prompt string `json:"prompt,omitempty"`
 }
 
 type Tool struct {
@@ -166,15 +170,23 @@ type MessageContentPart struct {
 
 type MessageItem struct {
 	// The unique ID of the item.
-	ID string `json:"id"`
+	ID string `json:"id,omitempty"`
 	// The type of the item ("message", "function_call", "function_call_output").
 	Type MessageItemType `json:"type"`
 	// The final status of the item.
-	Status ItemStatus `json:"status"`
+	Status ItemStatus `json:"status,omitempty"`
 	// The role associated with the item.
-	Role MessageRole `json:"role"`
+	Role MessageRole `json:"role,omitempty"`
 	// The content of the item.
-	Content []MessageContentPart `json:"content"`
+	Content []MessageContentPart `json:"content,omitempty"`
+	// The ID of the function call, for "function_call" and "function_call_output" items.
+	CallID string `json:"call_id,omitempty"`
+	// The name of the function, for "function_call" items.
+	Name string `json:"name,omitempty"`
+	// The arguments of the function call as a JSON string, for "function_call" items.
+	Arguments string `json:"arguments,omitempty"`
+	// The output of the function call, for "function_call_output" items.
+	Output string `json:"output,omitempty"`
 }
 
 type ResponseMessageItem struct {
@@ -0,0 +1,113 @@
+package xiaozhi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// 二进制帧格式由握手时的 Protocol-Version 请求头协商，字段均为网络字节序
+//
+//	v1: payload
+//	v2: version(2) type(2) reserved(4) timestamp(4) payload_size(4) payload
+//	v3: type(1) reserved(1) payload_size(2) payload
+const (
+	BinaryProtocolV1 = 1
+	BinaryProtocolV2 = 2
+	BinaryProtocolV3 = 3
+
+	binaryHeaderSizeV2 = 16
+	binaryHeaderSizeV3 = 4
+)
+
+// BinaryType is the payload type carried in v2 and v3 frames.
+type BinaryType uint16
+
+const (
+	BinaryTypeOpus BinaryType = 0
+	BinaryTypeJSON BinaryType = 1
+)
+
+// BinaryFrame is a decoded binary websocket message.
+type BinaryFrame struct {
+	Type      BinaryType
+	Timestamp uint32 // ms, only carried by v2
+	Payload   []byte
+}
+
+// ParseProtocolVersion parses the Protocol-Version handshake header,
+// defaulting to v1 when it is missing or unknown.
+func ParseProtocolVersion(header string) int {
+	v, err := strconv.Atoi(header)
+	if err != nil {
+		return BinaryProtocolV1
+	}
+	switch v {
+	case BinaryProtocolV2, BinaryProtocolV3:
+		return v
+	default:
+		return BinaryProtocolV1
+	}
+}
+
+// UnmarshalBinaryFrame decodes a binary message in the given protocol version.
+// The payload aliases data.
+func UnmarshalBinaryFrame(version int, data []byte) (*BinaryFrame, error) {
+	switch version {
+	case BinaryProtocolV2:
+		if len(data) < binaryHeaderSizeV2 {
+			return nil, fmt.Errorf("binary frame v2 too short: %d bytes", len(data))
+		}
+		size := binary.BigEndian.Uint32(data[12:16])
+		if int(size) > len(data)-binaryHeaderSizeV2 {
+			return nil, fmt.Errorf("binary frame v2 payload size %d exceeds %d bytes", size, len(data)-binaryHeaderSizeV2)
+		}
+		return &BinaryFrame{
+			Type:      BinaryType(binary.BigEndian.Uint16(data[2:4])),
+			Timestamp: binary.BigEndian.Uint32(data[8:12]),
+			Payload:   data[binaryHeaderSizeV2 : binaryHeaderSizeV2+int(size)],
+		}, nil
+	case BinaryProtocolV3:
+		if len(data) < binaryHeaderSizeV3 {
+			return nil, fmt.Errorf("binary frame v3 too short: %d bytes", len(data))
+		}
+		size := binary.BigEndian.Uint16(data[2:4])
+		if int(size) > len(data)-binaryHeaderSizeV3 {
+			return nil, fmt.Errorf("binary frame v3 payload size %d exceeds %d bytes", size, len(data)-binaryHeaderSizeV3)
+		}
+		return &BinaryFrame{
+			Type:    BinaryType(data[0]),
+			Payload: data[binaryHeaderSizeV3 : binaryHeaderSizeV3+int(size)],
+		}, nil
+	default:
+		return &BinaryFrame{Type: BinaryTypeOpus, Payload: data}, nil
+	}
+}
+
+// MarshalBinaryFrame encodes the frame in the given protocol version.
+func MarshalBinaryFrame(version int, frame *BinaryFrame) ([]byte, error) {
+	switch version {
+	case BinaryProtocolV2:
+		buf := make([]byte, binaryHeaderSizeV2+len(frame.Payload))
+		binary.BigEndian.PutUint16(buf[0:2], BinaryProtocolV2)
+		binary.BigEndian.PutUint16(buf[2:4], uint16(frame.Type))
+		binary.BigEndian.PutUint32(buf[8:12], frame.Timestamp)
+		binary.BigEndian.PutUint32(buf[12:16], uint32(len(frame.Payload)))
+		copy(buf[binaryHeaderSizeV2:], frame.Payload)
+		return buf, nil
+	case BinaryProtocolV3:
+		if len(frame.Payload) > 0xFFFF {
+			return nil, fmt.Errorf("binary frame v3 payload too large: %d bytes", len(frame.Payload))
+		}
+		buf := make([]byte, binaryHeaderSizeV3+len(frame.Payload))
+		buf[0] = byte(frame.Type)
+		binary.BigEndian.PutUint16(buf[2:4], uint16(len(frame.Payload)))
+		copy(buf[binaryHeaderSizeV3:], frame.Payload)
+		return buf, nil
+	default:
+		if frame.Type != BinaryTypeOpus {
+			return nil, fmt.Errorf("binary frame v1 only carries opus, got type %d", frame.Type)
+		}
+		return frame.Payload, nil
+	}
+}
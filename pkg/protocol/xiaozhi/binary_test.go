@@ -0,0 +1,80 @@
+package xiaozhi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBinaryFrameRoundTrip(t *testing.T) {
+	payload := []byte{0xde, 0xad, 0xbe, 0xef}
+	for _, version := range []int{BinaryProtocolV1, BinaryProtocolV2, BinaryProtocolV3} {
+		frame := &BinaryFrame{Type: BinaryTypeOpus, Payload: payload}
+		if version == BinaryProtocolV2 {
+			frame.Timestamp = 123456
+		}
+		data, err := MarshalBinaryFrame(version, frame)
+		if err != nil {
+			t.Fatalf("v%d marshal: %v", version, err)
+		}
+		got, err := UnmarshalBinaryFrame(version, data)
+		if err != nil {
+			t.Fatalf("v%d unmarshal: %v", version, err)
+		}
+		if got.Type != frame.Type || got.Timestamp != frame.Timestamp || !bytes.Equal(got.Payload, payload) {
+			t.Fatalf("v%d round trip: got %+v, want %+v", version, got, frame)
+		}
+	}
+}
+
+func TestBinaryFrameV2Layout(t *testing.T) {
+	data := []byte{
+		0x00, 0x02, // version
+		0x00, 0x00, // type opus
+		0x00, 0x00, 0x00, 0x00, // reserved
+		0x00, 0x00, 0x01, 0x00, // timestamp 256
+		0x00, 0x00, 0x00, 0x02, // payload size
+		0x11, 0x22,
+	}
+	ev, err := UnmarshalClientBinEvent(BinaryProtocolV2, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := ev.(*ClientEventAppendBuffer)
+	if buf.Timestamp != 256 || !bytes.Equal(buf.Bytes, []byte{0x11, 0x22}) {
+		t.Fatalf("got timestamp %d payload %x", buf.Timestamp, buf.Bytes)
+	}
+}
+
+func TestBinaryFrameJSONPayload(t *testing.T) {
+	data, err := MarshalBinaryFrame(BinaryProtocolV3, &BinaryFrame{
+		Type:    BinaryTypeJSON,
+		Payload: []byte(`{"type":"listen","state":"start","mode":"auto"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, err := UnmarshalClientBinEvent(BinaryProtocolV3, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listen, ok := ev.(*ClientEventListen); !ok || listen.State != ClientStateListenStart {
+		t.Fatalf("got %#v, want listen start", ev)
+	}
+}
+
+func TestBinaryFrameTruncated(t *testing.T) {
+	if _, err := UnmarshalBinaryFrame(BinaryProtocolV3, []byte{0, 0, 0, 9, 1}); err == nil {
+		t.Fatal("want error for payload size beyond frame")
+	}
+	if _, err := UnmarshalBinaryFrame(BinaryProtocolV2, []byte{0, 2}); err == nil {
+		t.Fatal("want error for short v2 header")
+	}
+}
+
+func TestParseProtocolVersion(t *testing.T) {
+	for header, want := range map[string]int{"": 1, "1": 1, "2": 2, "3": 3, "9": 1, "x": 1} {
+		if got := ParseProtocolVersion(header); got != want {
+			t.Fatalf("ParseProtocolVersion(%q) = %d, want %d", header, got, want)
+		}
+	}
+}
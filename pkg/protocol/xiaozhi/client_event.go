@@ -14,6 +14,8 @@ const (
 	ClientEventTypeAppendBuffer ClientEventType = "append.buffer"
 	ClientEventTypeAbort        ClientEventType = "abort"
 	ClientEventTypeIot          ClientEventType = "iot"
+	ClientEventTypeMcp          ClientEventType = "mcp"
+	ClientEventTypeText         ClientEventType = "text"
 )
 
 // ClientState 客户端监听状态
@@ -60,6 +62,7 @@ type ClientEventBase struct {
 // ClientEventHello is the hello event.
 type ClientEventHello struct {
 	ClientEventBase
+	Features map[string]bool `json:"features,omitempty"` // 设备能力，如 {"mcp": true}
 }
 
 // {'type': 'hello', 'version': 1, 'transport': 'websocket', 'audio_params': {'format': 'opus', 'sample_rate': 16000, 'channels': 1, 'frame_duration': 20}}
@@ -69,11 +72,13 @@ type ClientEventListen struct {
 	ClientEventBase
 	State ClientState `json:"state"`
 	Mode  ClientMode  `json:"mode"`
+	Text  string      `json:"text,omitempty"` // detect 时为唤醒词或输入的文本
 }
 
 type ClientEventAppendBuffer struct {
 	ClientEventBase
-	Bytes []byte `json:"bytes"` // opus编码的二进制数据
+	Bytes     []byte `json:"bytes"`     // opus编码的二进制数据
+	Timestamp uint32 `json:"timestamp"` // 毫秒，仅 v2 协议携带，0 表示未知
 }
 
 // {'type': 'listen','state': 'start','mode': 'auto'}   然后客户端开始发送二进制的音频数据
@@ -91,6 +96,20 @@ type ClientEventIot struct {
 	Data string `json:"data"`
 }
 
+// ClientEventMcp carries a JSON-RPC message from the device MCP server.
+type ClientEventMcp struct {
+	ClientEventBase
+	Payload McpMessage `json:"payload"`
+}
+
+// ClientEventText is text typed on the device or in the web console.
+type ClientEventText struct {
+	ClientEventBase
+	Text string `json:"text"`
+}
+
+// {'type': 'text', 'text': '今天天气怎么样', 'session_id': '9842a257'}
+
 func (e *ClientEventBase) ClientEventType() ClientEventType {
 	return e.Type
 }
@@ -157,8 +176,32 @@ func (e *ClientEventIot) GetSessionID() string {
 	return e.SessionID
 }
 
+func (e *ClientEventMcp) ClientEventType() ClientEventType {
+	return ClientEventTypeMcp
+}
+
+func (e *ClientEventMcp) GetAudioParams() *AudioParams {
+	return e.AudioParams
+}
+
+func (e *ClientEventMcp) GetSessionID() string {
+	return e.SessionID
+}
+
+func (e *ClientEventText) ClientEventType() ClientEventType {
+	return ClientEventTypeText
+}
+
+func (e *ClientEventText) GetAudioParams() *AudioParams {
+	return e.AudioParams
+}
+
+func (e *ClientEventText) GetSessionID() string {
+	return e.SessionID
+}
+
 type ClientEventInterface interface {
-	ClientEventHello | ClientEventListen | ClientEventAbort | ClientEventIot
+	ClientEventHello | ClientEventListen | ClientEventAbort | ClientEventIot | ClientEventMcp | ClientEventText
 }
 
 func unmarshalClientEvent[T ClientEventInterface](data []byte) (*T, error) {
@@ -193,16 +236,34 @@ func UnmarshalClientEvent(data []byte) (ClientEvent, error) {
 		return unmarshalClientEvent[ClientEventAbort](data)
 	case ClientEventTypeIot:
 		return unmarshalClientEvent[ClientEventIot](data)
+	case ClientEventTypeMcp:
+		return unmarshalClientEvent[ClientEventMcp](data)
+	case ClientEventTypeText:
+		return unmarshalClientEvent[ClientEventText](data)
 	default:
 		return nil, fmt.Errorf("unknown client event type: %s", eventType.Type)
 	}
 }
 
-func UnmarshalClientBinEvent(data []byte) (ClientEvent, error) {
-	return &ClientEventAppendBuffer{
-		ClientEventBase: ClientEventBase{
-			Type: ClientEventTypeAppendBuffer,
-		},
-		Bytes: data,
-	}, nil
+// UnmarshalClientBinEvent unmarshals a binary message framed in the negotiated
+// protocol version. JSON payloads are decoded as text events.
+func UnmarshalClientBinEvent(version int, data []byte) (ClientEvent, error) {
+	frame, err := UnmarshalBinaryFrame(version, data)
+	if err != nil {
+		return nil, err
+	}
+	switch frame.Type {
+	case BinaryTypeOpus:
+		return &ClientEventAppendBuffer{
+			ClientEventBase: ClientEventBase{
+				Type: ClientEventTypeAppendBuffer,
+			},
+			Bytes:     frame.Payload,
+			Timestamp: frame.Timestamp,
+		}, nil
+	case BinaryTypeJSON:
+		return UnmarshalClientEvent(frame.Payload)
+	default:
+		return nil, fmt.Errorf("unknown binary frame type: %d", frame.Type)
+	}
 }
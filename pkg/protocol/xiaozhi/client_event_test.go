@@ -0,0 +1,17 @@
+package xiaozhi
+
+import "testing"
+
+func TestUnmarshalTextEvent(t *testing.T) {
+	ev, err := UnmarshalClientEvent([]byte(`{"type":"text","text":"今天天气怎么样","session_id":"s1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, ok := ev.(*ClientEventText)
+	if !ok {
+		t.Fatalf("got %T, want *ClientEventText", ev)
+	}
+	if text.Text != "今天天气怎么样" || text.GetSessionID() != "s1" {
+		t.Fatalf("unexpected event: %+v", text)
+	}
+}
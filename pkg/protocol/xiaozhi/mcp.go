@@ -0,0 +1,90 @@
+package xiaozhi
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MCP 消息以 JSON-RPC 2.0 承载在 type 为 mcp 的消息的 payload 中
+// {"type":"mcp","payload":{"jsonrpc":"2.0","method":"tools/list","params":{"cursor":""},"id":2}}
+
+const (
+	McpJSONRPCVersion   = "2.0"
+	McpProtocolVersion  = "2024-11-05"
+	McpMethodInitialize = "initialize"
+	McpMethodToolsList  = "tools/list"
+	McpMethodToolsCall  = "tools/call"
+)
+
+// McpRequest is a JSON-RPC request sent to the device.
+type McpRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+	ID      int64  `json:"id"`
+}
+
+// McpMessage is a JSON-RPC message received from the device, either a
+// response (ID with Result or Error) or a request/notification (Method).
+type McpMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *McpError       `json:"error,omitempty"`
+}
+
+func (m *McpMessage) IsResponse() bool {
+	return m.ID != nil && m.Method == ""
+}
+
+type McpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *McpError) Error() string {
+	return fmt.Sprintf("mcp error %d: %s", e.Code, e.Message)
+}
+
+type McpClientInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type McpInitializeParams struct {
+	ProtocolVersion string         `json:"protocolVersion"`
+	Capabilities    map[string]any `json:"capabilities"`
+	ClientInfo      McpClientInfo  `json:"clientInfo"`
+}
+
+type McpToolsListParams struct {
+	Cursor string `json:"cursor"`
+}
+
+type McpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+type McpToolsListResult struct {
+	Tools      []McpTool `json:"tools"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+}
+
+type McpToolsCallParams struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type McpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+}
+
+type McpToolsCallResult struct {
+	Content []McpContent `json:"content"`
+	IsError bool         `json:"isError"`
+}
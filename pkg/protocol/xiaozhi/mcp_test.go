@@ -0,0 +1,51 @@
+package xiaozhi
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUnmarshalMcpResponse(t *testing.T) {
+	data := []byte(`{"session_id":"s1","type":"mcp","payload":{"jsonrpc":"2.0","id":2,"result":{"tools":[{"name":"self.audio_speaker.set_volume","description":"set volume","inputSchema":{"type":"object"}}],"nextCursor":""}}}`)
+	ev, err := UnmarshalClientEvent(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mcp, ok := ev.(*ClientEventMcp)
+	if !ok {
+		t.Fatalf("got %T, want *ClientEventMcp", ev)
+	}
+	if !mcp.Payload.IsResponse() || *mcp.Payload.ID != 2 {
+		t.Fatalf("payload not parsed as response: %+v", mcp.Payload)
+	}
+	var result McpToolsListResult
+	if err := json.Unmarshal(mcp.Payload.Result, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Tools) != 1 || result.Tools[0].Name != "self.audio_speaker.set_volume" {
+		t.Fatalf("unexpected tools: %+v", result.Tools)
+	}
+}
+
+func TestMarshalMcpRequest(t *testing.T) {
+	ev := &ServerEventMcp{
+		ServerEventBase: ServerEventBase{Type: ServerEventTypeMcp, SessionId: "s1"},
+		Payload: &McpRequest{
+			JSONRPC: McpJSONRPCVersion,
+			Method:  McpMethodToolsList,
+			Params:  &McpToolsListParams{},
+			ID:      2,
+		},
+	}
+	if _, ok := IsServerEvent(ev); !ok {
+		t.Fatal("mcp event not recognized as server event")
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"mcp","session_id":"s1","payload":{"jsonrpc":"2.0","method":"tools/list","params":{"cursor":""},"id":2}}`
+	if string(data) != want {
+		t.Fatalf("got %s, want %s", data, want)
+	}
+}
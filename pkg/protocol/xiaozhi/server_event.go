@@ -2,17 +2,29 @@ package xiaozhi
 
 import (
 	"encoding/json"
+	"fmt"
 )
 
 type ServerEventType string
 
 const (
-	ServerEventTypeError ServerEventType = "error"
-	ServerEventTypeHello ServerEventType = "hello"
-	ServerEventTypeSTT   ServerEventType = "stt"
-	ServerEventTypeLLM   ServerEventType = "llm"
-	ServerEventTypeTTS   ServerEventType = "tts"
-	ServerEventTypeIot   ServerEventType = "iot"
+	ServerEventTypeError   ServerEventType = "error"
+	ServerEventTypeHello   ServerEventType = "hello"
+	ServerEventTypeSTT     ServerEventType = "stt"
+	ServerEventTypeLLM     ServerEventType = "llm"
+	ServerEventTypeTTS     ServerEventType = "tts"
+	ServerEventTypeIot     ServerEventType = "iot"
+	ServerEventTypeMcp     ServerEventType = "mcp"
+	ServerEventTypeGoodbye ServerEventType = "goodbye"
+	ServerEventTypeSystem  ServerEventType = "system"
+	ServerEventTypeAlert   ServerEventType = "alert"
+)
+
+type ServerSystemCommand string
+
+const (
+	ServerSystemCommandReboot    ServerSystemCommand = "reboot"
+	ServerSystemCommandSetVolume ServerSystemCommand = "set_volume"
 )
 
 type ServerTTSState string
@@ -26,6 +38,7 @@ const (
 
 type ServerEvent interface {
 	GetType() ServerEventType
+	SetSessionId(id string)
 }
 
 type ServerEventBase struct {
@@ -93,8 +106,82 @@ func (e *ServerEventTTS) GetType() ServerEventType {
 // {'type': 'tts', 'state': 'sentence_start', 'text': '有什么好玩的事吗？', 'session_id': '9842a257'}
 // {'type': 'tts', 'state': 'sentence_end', 'text': '有什么好玩的事吗？', 'session_id': '9842a257'}
 
+type ServerEventMcp struct {
+	ServerEventBase
+	Payload *McpRequest `json:"payload"`
+}
+
+func (e *ServerEventMcp) GetType() ServerEventType {
+	return ServerEventTypeMcp
+}
+
+// {'type': 'mcp', 'payload': {'jsonrpc': '2.0', 'method': 'tools/list', 'params': {'cursor': ''}, 'id': 2}, 'session_id': '9842a257'}
+
+// IotCommand invokes a method of a thing declared by the device iot descriptors.
+type IotCommand struct {
+	Name       string         `json:"name"`
+	Method     string         `json:"method"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+}
+
+type ServerEventIot struct {
+	ServerEventBase
+	Commands []IotCommand `json:"commands"`
+}
+
+func (e *ServerEventIot) GetType() ServerEventType {
+	return ServerEventTypeIot
+}
+
+// {'type': 'iot', 'commands': [{'name': 'Speaker', 'method': 'SetVolume', 'parameters': {'volume': 80}}], 'session_id': '9842a257'}
+
+// ServerEventGoodbye ends the session, the device closes the audio channel.
+type ServerEventGoodbye struct {
+	ServerEventBase
+}
+
+func (e *ServerEventGoodbye) GetType() ServerEventType {
+	return ServerEventTypeGoodbye
+}
+
+// {'type': 'goodbye', 'session_id': '9842a257'}
+
+type ServerEventSystem struct {
+	ServerEventBase
+	Command ServerSystemCommand `json:"command"`
+	Volume  *int                `json:"volume,omitempty"` // set_volume 时有效，0-100
+}
+
+func (e *ServerEventSystem) GetType() ServerEventType {
+	return ServerEventTypeSystem
+}
+
+// {'type': 'system', 'command': 'reboot', 'session_id': '9842a257'}
+
+// ServerEventAlert shows a notification on the device screen.
+type ServerEventAlert struct {
+	ServerEventBase
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Emotion string `json:"emotion,omitempty"`
+}
+
+func (e *ServerEventAlert) GetType() ServerEventType {
+	return ServerEventTypeAlert
+}
+
+// {'type': 'alert', 'status': '提醒', 'message': '该睡觉了', 'emotion': 'sleepy', 'session_id': '9842a257'}
+
+// ServerAudioFrame is an opus packet sent to the device, framed in the
+// negotiated binary protocol version when written.
+type ServerAudioFrame struct {
+	Timestamp uint32 // ms since the response audio started
+	Payload   []byte
+}
+
 type ServerEventInterface interface {
-	ServerEventHello | ServerEventSTT | ServerEventLLM | ServerEventTTS
+	ServerEventError | ServerEventHello | ServerEventSTT | ServerEventLLM | ServerEventTTS |
+		ServerEventMcp | ServerEventIot | ServerEventGoodbye | ServerEventSystem | ServerEventAlert
 }
 
 func unmarshalServerEvent[T ServerEventInterface](data []byte) (*T, error) {
@@ -112,17 +199,76 @@ func IsServerEvent(event any) (ServerEvent, bool) {
 		return nil, false
 	}
 	switch ev.GetType() {
+	case ServerEventTypeError,
+		ServerEventTypeHello,
+		ServerEventTypeSTT,
+		ServerEventTypeLLM,
+		ServerEventTypeTTS,
+		ServerEventTypeMcp,
+		ServerEventTypeIot,
+		ServerEventTypeGoodbye,
+		ServerEventTypeSystem,
+		ServerEventTypeAlert:
+		return ev, true
+	default:
+		return nil, false
+	}
+}
+
+// MarshalServerEvent marshals the server event to JSON, filling in its type.
+func MarshalServerEvent(event ServerEvent) ([]byte, error) {
+	SetServerEventType(event)
+	return json.Marshal(event)
+}
+
+// SetServerEventType sets the type field of the event from its Go type, so
+// callers only need to fill in the payload.
+func SetServerEventType(event ServerEvent) {
+	if b, ok := event.(interface{ base() *ServerEventBase }); ok {
+		b.base().Type = event.GetType()
+	}
+}
+
+func (e *ServerEventBase) base() *ServerEventBase {
+	return e
+}
+
+// SetSessionId sets the session id of the event.
+func (e *ServerEventBase) SetSessionId(id string) {
+	e.SessionId = id
+}
+
+// UnmarshalServerEvent unmarshals the server event from the given JSON data.
+func UnmarshalServerEvent(data []byte) (ServerEvent, error) {
+	var eventType struct {
+		Type ServerEventType `json:"type"`
+	}
+	err := json.Unmarshal(data, &eventType)
+	if err != nil {
+		return nil, err
+	}
+	switch eventType.Type {
 	case ServerEventTypeError:
-		return event.(*ServerEventError), true
+		return unmarshalServerEvent[ServerEventError](data)
 	case ServerEventTypeHello:
-		return event.(*ServerEventHello), true
+		return unmarshalServerEvent[ServerEventHello](data)
 	case ServerEventTypeSTT:
-		return event.(*ServerEventSTT), true
+		return unmarshalServerEvent[ServerEventSTT](data)
 	case ServerEventTypeLLM:
-		return event.(*ServerEventLLM), true
+		return unmarshalServerEvent[ServerEventLLM](data)
 	case ServerEventTypeTTS:
-		return event.(*ServerEventTTS), true
+		return unmarshalServerEvent[ServerEventTTS](data)
+	case ServerEventTypeMcp:
+		return unmarshalServerEvent[ServerEventMcp](data)
+	case ServerEventTypeIot:
+		return unmarshalServerEvent[ServerEventIot](data)
+	case ServerEventTypeGoodbye:
+		return unmarshalServerEvent[ServerEventGoodbye](data)
+	case ServerEventTypeSystem:
+		return unmarshalServerEvent[ServerEventSystem](data)
+	case ServerEventTypeAlert:
+		return unmarshalServerEvent[ServerEventAlert](data)
 	default:
-		return nil, false
+		return nil, fmt.Errorf("unknown server event type: %s", eventType.Type)
 	}
 }
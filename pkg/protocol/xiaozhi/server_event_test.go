@@ -0,0 +1,46 @@
+package xiaozhi
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/samber/lo"
+)
+
+func TestServerEventRoundTrip(t *testing.T) {
+	events := []ServerEvent{
+		&ServerEventIot{Commands: []IotCommand{{
+			Name:       "Speaker",
+			Method:     "SetVolume",
+			Parameters: map[string]any{"volume": float64(80)},
+		}}},
+		&ServerEventGoodbye{},
+		&ServerEventSystem{Command: ServerSystemCommandReboot},
+		&ServerEventSystem{Command: ServerSystemCommandSetVolume, Volume: lo.ToPtr(30)},
+		&ServerEventAlert{Status: "提醒", Message: "该睡觉了", Emotion: "sleepy"},
+		&ServerEventTTS{State: ServerTTSStateStart, SampleRate: 24000},
+	}
+	for _, ev := range events {
+		ev.SetSessionId("s1")
+		data, err := MarshalServerEvent(ev)
+		if err != nil {
+			t.Fatalf("%T marshal: %v", ev, err)
+		}
+		if _, ok := IsServerEvent(ev); !ok {
+			t.Fatalf("%T not recognized as server event", ev)
+		}
+		got, err := UnmarshalServerEvent(data)
+		if err != nil {
+			t.Fatalf("%T unmarshal %s: %v", ev, data, err)
+		}
+		if !reflect.DeepEqual(got, ev) {
+			t.Fatalf("round trip %s: got %+v, want %+v", data, got, ev)
+		}
+	}
+}
+
+func TestUnmarshalUnknownServerEvent(t *testing.T) {
+	if _, err := UnmarshalServerEvent([]byte(`{"type":"unknown"}`)); err == nil {
+		t.Fatal("expected error for unknown type")
+	}
+}
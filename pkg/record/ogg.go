@@ -0,0 +1,197 @@
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Ogg page header flags.
+const (
+	oggFirstPage = 0x02
+	oggLastPage  = 0x04
+)
+
+// opus 的 granule position 固定以 48 kHz 计
+const opusGranuleRate = 48000
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return table
+}()
+
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// OggWriter muxes opus packets into an Ogg Opus stream without re-encoding,
+// one packet per page so a truncated file loses at most the last packet.
+type OggWriter struct {
+	w       io.Writer
+	serial  uint32
+	seq     uint32
+	granule uint64
+	closed  bool
+}
+
+// NewOggWriter writes the Ogg Opus headers for a stream recorded at sampleRate.
+func NewOggWriter(w io.Writer, serial uint32, sampleRate, channels int) (*OggWriter, error) {
+	o := &OggWriter{w: w, serial: serial}
+
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:12], 0) // pre-skip
+	binary.LittleEndian.PutUint32(head[12:16], uint32(sampleRate))
+	binary.LittleEndian.PutUint16(head[16:18], 0) // output gain
+	head[18] = 0                                  // channel mapping family
+	if err := o.writePage(head, oggFirstPage, 0); err != nil {
+		return nil, err
+	}
+
+	vendor := "go-xiaozhi"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:12], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	if err := o.writePage(tags, 0, 0); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// WritePacket appends an opus packet, its duration is read from its TOC byte.
+func (o *OggWriter) WritePacket(packet []byte) error {
+	if o.closed {
+		return errors.New("ogg stream closed")
+	}
+	if len(packet) == 0 {
+		return nil
+	}
+	o.granule += uint64(OpusPacketSamples(packet))
+	return o.writePage(packet, 0, o.granule)
+}
+
+// Close ends the stream with an empty last page.
+func (o *OggWriter) Close() error {
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	return o.writePage(nil, oggLastPage, o.granule)
+}
+
+func (o *OggWriter) writePage(payload []byte, flags byte, granule uint64) error {
+	// 每个 segment 最长 255 字节，长度恰为 255 的倍数时以 0 结尾
+	segments := len(payload)/255 + 1
+	if segments > 255 {
+		return errors.New("ogg packet too large")
+	}
+	page := make([]byte, 27+segments, 27+segments+len(payload))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:14], granule)
+	binary.LittleEndian.PutUint32(page[14:18], o.serial)
+	binary.LittleEndian.PutUint32(page[18:22], o.seq)
+	page[26] = byte(segments)
+	for i := 0; i < segments-1; i++ {
+		page[27+i] = 255
+	}
+	page[27+segments-1] = byte(len(payload) % 255)
+	page = append(page, payload...)
+	binary.LittleEndian.PutUint32(page[22:26], oggCRC(page))
+	o.seq++
+	_, err := o.w.Write(page)
+	return err
+}
+
+// OpusPacketSamples returns the duration of an opus packet in 48 kHz samples,
+// as described by its TOC byte (RFC 6716 section 3.1).
+func OpusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	config := int(toc >> 3)
+	var frame int // 以 1/8 ms 计，便于表示 2.5 ms
+	switch {
+	case config < 12: // SILK
+		frame = []int{80, 160, 320, 480}[config%4]
+	case config < 16: // Hybrid
+		frame = []int{80, 160}[config%2]
+	default: // CELT
+		frame = []int{20, 40, 80, 160}[config%4]
+	}
+	count := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		count = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		count = int(packet[1] & 0x3f)
+	}
+	return frame * count * opusGranuleRate / 8000
+}
+
+// ReadOggPackets reads back the opus packets of a stream written by OggWriter,
+// skipping the two header packets.
+func ReadOggPackets(r io.Reader) ([][]byte, error) {
+	var packets [][]byte
+	var pending []byte
+	header := make([]byte, 27)
+pages:
+	for {
+		// 录音被截断时保留已读到的完整包
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return nil, err
+		}
+		if string(header[0:4]) != "OggS" {
+			return nil, errors.New("invalid ogg page")
+		}
+		table := make([]byte, header[26])
+		if _, err := io.ReadFull(r, table); err != nil {
+			break
+		}
+		for _, size := range table {
+			segment := make([]byte, size)
+			if _, err := io.ReadFull(r, segment); err != nil {
+				break pages
+			}
+			pending = append(pending, segment...)
+			if size < 255 {
+				packets = append(packets, pending)
+				pending = nil
+			}
+		}
+	}
+	if len(packets) < 2 {
+		return nil, errors.New("missing opus headers")
+	}
+	// 去掉 OpusHead、OpusTags，以及结束页的空包
+	packets = packets[2:]
+	if n := len(packets); n > 0 && len(packets[n-1]) == 0 {
+		packets = packets[:n-1]
+	}
+	return packets, nil
+}
@@ -0,0 +1,414 @@
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Streams and directions of timeline entries, directions are relative to
+// the gateway.
+const (
+	StreamXiaozhi = "xiaozhi"
+	StreamOpenAI  = "openai"
+
+	DirIn  = "in"
+	DirOut = "out"
+
+	TypeAudio     = "audio"
+	TypeTruncated = "truncated"
+)
+
+// Files of a recorded session.
+const (
+	MetaFile     = "meta.json"
+	TimelineFile = "timeline.jsonl"
+	UplinkFile   = "uplink.ogg"
+	DownlinkFile = "downlink.ogg"
+)
+
+// 清理过期录音的间隔
+const cleanupInterval = time.Hour
+
+// Options limits the disk space used by recordings. Zero means no limit.
+type Options struct {
+	Dir             string
+	MaxSessionBytes int64
+	MaxTotalBytes   int64
+	Retention       time.Duration
+}
+
+// Meta describes a recorded session.
+type Meta struct {
+	SessionID string    `json:"session_id"`
+	DeviceId  string    `json:"device_id"`
+	ClientId  string    `json:"client_id"`
+	Provider  string    `json:"provider"`
+	Persona   string    `json:"persona,omitempty"`
+	StartTime time.Time `json:"start_time"`
+}
+
+// Entry is a line of the timeline. Audio entries carry the size of the audio
+// instead of the event, the opus frames themselves are in the ogg files.
+type Entry struct {
+	Time   time.Time       `json:"ts"`
+	Offset int64           `json:"ms"` // 距会话开始的毫秒数
+	Stream string          `json:"stream"`
+	Dir    string          `json:"dir"`
+	Type   string          `json:"type"`
+	Audio  int             `json:"audio,omitempty"`
+	Event  json.RawMessage `json:"event,omitempty"`
+}
+
+// Recorder writes sessions under a directory, one directory per session
+// grouped by device, and prunes them to the configured limits.
+type Recorder struct {
+	opts Options
+
+	mu     sync.Mutex
+	active map[string]bool // 录制中的会话目录，清理时跳过
+}
+
+func New(opts Options) *Recorder {
+	return &Recorder{opts: opts, active: make(map[string]bool)}
+}
+
+// Run prunes old recordings periodically until ctx is done.
+func (r *Recorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		_ = r.Cleanup()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Open starts recording a session.
+func (r *Recorder) Open(meta Meta) (*Session, error) {
+	dir := filepath.Join(r.opts.Dir, safeName(meta.DeviceId),
+		meta.StartTime.Format("20060102-150405")+"-"+safeName(meta.SessionID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, MetaFile), data, 0o644); err != nil {
+		return nil, err
+	}
+	timeline, err := os.Create(filepath.Join(dir, TimelineFile))
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.active[dir] = true
+	r.mu.Unlock()
+	return &Session{
+		recorder: r,
+		dir:      dir,
+		start:    meta.StartTime,
+		timeline: timeline,
+		max:      r.opts.MaxSessionBytes,
+		written:  int64(len(data)),
+	}, nil
+}
+
+func (r *Recorder) release(dir string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.active, dir)
+}
+
+type sessionDir struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Cleanup removes the recordings older than the retention, then the oldest
+// ones until the total size fits.
+func (r *Recorder) Cleanup() error {
+	dirs, err := filepath.Glob(filepath.Join(r.opts.Dir, "*", "*"))
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	active := make(map[string]bool, len(r.active))
+	for dir := range r.active {
+		active[dir] = true
+	}
+	r.mu.Unlock()
+
+	var sessions []sessionDir
+	var total int64
+	for _, dir := range dirs {
+		if active[dir] {
+			continue
+		}
+		s, err := stat(dir)
+		if err != nil {
+			continue
+		}
+		if r.opts.Retention > 0 && time.Since(s.modTime) > r.opts.Retention {
+			_ = os.RemoveAll(dir)
+			continue
+		}
+		sessions = append(sessions, s)
+		total += s.size
+	}
+	if r.opts.MaxTotalBytes <= 0 {
+		return nil
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].modTime.Before(sessions[j].modTime)
+	})
+	for _, s := range sessions {
+		if total <= r.opts.MaxTotalBytes {
+			break
+		}
+		if err := os.RemoveAll(s.path); err == nil {
+			total -= s.size
+		}
+	}
+	return nil
+}
+
+func stat(dir string) (sessionDir, error) {
+	s := sessionDir{path: dir}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			s.size += info.Size()
+		}
+		if info.ModTime().After(s.modTime) {
+			s.modTime = info.ModTime()
+		}
+		return nil
+	})
+	return s, err
+}
+
+func safeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		default:
+			return '-'
+		}
+	}, name)
+	if name == "" || strings.Trim(name, ".") == "" {
+		return "unknown"
+	}
+	return name
+}
+
+// Session records the events and audio of a session. All methods are safe
+// for concurrent use and do nothing on a nil session, so callers need not
+// check whether recording is enabled.
+type Session struct {
+	recorder *Recorder
+	dir      string
+	start    time.Time
+
+	mu        sync.Mutex
+	timeline  *os.File
+	uplink    *oggFile
+	downlink  *oggFile
+	written   int64
+	max       int64
+	truncated bool
+	closed    bool
+}
+
+type oggFile struct {
+	file *os.File
+	ogg  *OggWriter
+}
+
+// Dir is the directory of the recording.
+func (s *Session) Dir() string {
+	if s == nil {
+		return ""
+	}
+	return s.dir
+}
+
+// Event adds an event to the timeline. event is marshaled unless it is
+// already json.
+func (s *Session) Event(stream, dir, typ string, event any) {
+	if s == nil {
+		return
+	}
+	var raw json.RawMessage
+	switch ev := event.(type) {
+	case []byte:
+		raw = ev
+	case json.RawMessage:
+		raw = ev
+	default:
+		data, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		raw = data
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeEntry(Entry{Stream: stream, Dir: dir, Type: typ, Event: raw})
+}
+
+// Audio adds audio that is not recorded itself, e.g. the pcm exchanged with
+// the realtime api, to the timeline.
+func (s *Session) Audio(stream, dir, typ string, size int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeEntry(Entry{Stream: stream, Dir: dir, Type: typ, Audio: size})
+}
+
+// Uplink records an opus frame sent by the device.
+func (s *Session) Uplink(packet []byte, sampleRate, channels int) {
+	if s == nil {
+		return
+	}
+	s.opus(&s.uplink, UplinkFile, 1, DirIn, packet, sampleRate, channels)
+}
+
+// Downlink records an opus frame sent to the device.
+func (s *Session) Downlink(packet []byte, sampleRate, channels int) {
+	if s == nil {
+		return
+	}
+	s.opus(&s.downlink, DownlinkFile, 2, DirOut, packet, sampleRate, channels)
+}
+
+func (s *Session) opus(f **oggFile, name string, serial uint32, dir string, packet []byte, sampleRate, channels int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.reserve(int64(len(packet))) {
+		return
+	}
+	if *f == nil {
+		file, err := os.Create(filepath.Join(s.dir, name))
+		if err != nil {
+			return
+		}
+		// 上下行使用不同的 serial，便于合并为一个多路流
+		ogg, err := NewOggWriter(file, serial, sampleRate, channels)
+		if err != nil {
+			_ = file.Close()
+			return
+		}
+		*f = &oggFile{file: file, ogg: ogg}
+	}
+	if err := (*f).ogg.WritePacket(packet); err != nil {
+		return
+	}
+	s.writeEntry(Entry{Stream: StreamXiaozhi, Dir: dir, Type: TypeAudio, Audio: len(packet)})
+}
+
+func (s *Session) writeEntry(e Entry) {
+	now := time.Now()
+	e.Time = now
+	e.Offset = now.Sub(s.start).Milliseconds()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if !s.reserve(int64(len(line) + 1)) {
+		return
+	}
+	_, _ = s.timeline.Write(append(line, '\n'))
+}
+
+// reserve accounts for n bytes about to be written, and stops the recording
+// once the session size limit is reached.
+func (s *Session) reserve(n int64) bool {
+	if s.closed || s.truncated {
+		return false
+	}
+	if s.max > 0 && s.written+n > s.max {
+		s.truncated = true
+		line, _ := json.Marshal(Entry{Time: time.Now(), Offset: time.Since(s.start).Milliseconds(), Type: TypeTruncated})
+		_, _ = s.timeline.Write(append(line, '\n'))
+		return false
+	}
+	s.written += n
+	return true
+}
+
+// Close finishes the ogg streams and the timeline.
+func (s *Session) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var errs []error
+	for _, f := range []*oggFile{s.uplink, s.downlink} {
+		if f == nil {
+			continue
+		}
+		errs = append(errs, f.ogg.Close(), f.file.Close())
+	}
+	errs = append(errs, s.timeline.Close())
+	s.recorder.release(s.dir)
+	return errors.Join(errs...)
+}
+
+// ReadTimeline reads the timeline of a recorded session.
+func ReadTimeline(dir string) ([]Entry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, TimelineFile))
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var e Entry
+		// 进程退出时最后一行可能不完整
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// ReadMeta reads the description of a recorded session.
+func ReadMeta(dir string) (Meta, error) {
+	var meta Meta
+	data, err := os.ReadFile(filepath.Join(dir, MetaFile))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
@@ -0,0 +1,124 @@
+package record
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 20 ms CELT 单帧
+var opusFrame = []byte{0xf8, 0x01, 0x02, 0x03}
+
+func TestOggRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewOggWriter(&buf, 1, 16000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := bytes.Repeat([]byte{0xf8}, 510)
+	for _, p := range [][]byte{opusFrame, long, opusFrame} {
+		if err := w.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.granule != 3*960 {
+		t.Fatalf("granule = %d, want %d", w.granule, 3*960)
+	}
+	packets, err := ReadOggPackets(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 3 || !bytes.Equal(packets[1], long) {
+		t.Fatalf("got %d packets", len(packets))
+	}
+}
+
+func TestOpusPacketSamples(t *testing.T) {
+	cases := map[byte]int{
+		0x08: 960,     // SILK 20 ms
+		0x18: 2880,    // SILK 60 ms
+		0xf8: 960,     // CELT 20 ms
+		0xe0: 120,     // CELT 2.5 ms
+		0xf9: 2 * 960, // 两帧
+		0x60: 480,     // Hybrid 10 ms
+	}
+	for toc, want := range cases {
+		if got := OpusPacketSamples([]byte{toc, 0}); got != want {
+			t.Errorf("OpusPacketSamples(%#x) = %d, want %d", toc, got, want)
+		}
+	}
+}
+
+func TestSessionRecording(t *testing.T) {
+	rec := New(Options{Dir: t.TempDir(), MaxSessionBytes: 2048})
+	sess, err := rec.Open(Meta{SessionID: "s1", DeviceId: "AA:BB", StartTime: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Event(StreamXiaozhi, DirIn, "hello", map[string]string{"type": "hello"})
+	sess.Uplink(opusFrame, 16000, 1)
+	sess.Downlink(opusFrame, 24000, 1)
+	sess.Audio(StreamOpenAI, DirIn, "response.audio.delta", 4800)
+	for i := 0; i < 100; i++ {
+		sess.Uplink(opusFrame, 16000, 1)
+	}
+	if err := sess.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ReadTimeline(sess.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 4 || entries[0].Type != "hello" || entries[1].Audio != len(opusFrame) {
+		t.Fatalf("unexpected timeline: %+v", entries[:min(len(entries), 4)])
+	}
+	if last := entries[len(entries)-1]; last.Type != TypeTruncated {
+		t.Fatalf("recording over the size limit not truncated, last entry %+v", last)
+	}
+	f, err := os.Open(filepath.Join(sess.Dir(), DownlinkFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if packets, err := ReadOggPackets(f); err != nil || len(packets) != 1 {
+		t.Fatalf("downlink packets: %d, %v", len(packets), err)
+	}
+	if meta, err := ReadMeta(sess.Dir()); err != nil || meta.DeviceId != "AA:BB" {
+		t.Fatalf("meta: %+v, %v", meta, err)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	dir := t.TempDir()
+	rec := New(Options{Dir: dir, MaxTotalBytes: 1, Retention: time.Hour})
+	old := filepath.Join(dir, "dev", "old")
+	_ = os.MkdirAll(old, 0o755)
+	_ = os.WriteFile(filepath.Join(old, TimelineFile), []byte("{}\n"), 0o644)
+	past := time.Now().Add(-2 * time.Hour)
+	_ = os.Chtimes(filepath.Join(old, TimelineFile), past, past)
+	_ = os.Chtimes(old, past, past)
+
+	active, err := rec.Open(Meta{SessionID: "s1", DeviceId: "dev", StartTime: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	var nilSession *Session
+	nilSession.Uplink(opusFrame, 16000, 1)
+
+	if err := rec.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("expired recording not removed: %v", err)
+	}
+	if _, err := os.Stat(active.Dir()); err != nil {
+		t.Fatalf("active recording removed: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package reminder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 每个设备最多保留的提醒
+	MaxPerDevice = 50
+	MaxTextLen   = 200
+)
+
+var (
+	ErrNotFound = errors.New("reminder not found")
+	ErrTooMany  = errors.New("too many reminders")
+)
+
+// Reminder is said to a device when it is due.
+type Reminder struct {
+	ID        int64     `json:"id"`
+	DeviceId  string    `json:"device_id"`
+	Text      string    `json:"text"`
+	DueAt     time.Time `json:"due_at"`
+	CreatedAt time.Time `json:"created_at"`
+	// Missed is set when the device was not connected at due time, the
+	// reminder is then delivered on its next connection.
+	Missed bool `json:"missed,omitempty"`
+}
+
+// FireFunc delivers a due reminder and returns once it has been played. An
+// error, e.g. the device is offline or disconnected before playing it, keeps
+// the reminder until Deliver is called for the device.
+type FireFunc func(r Reminder) error
+
+type state struct {
+	NextID    int64       `json:"next_id"`
+	Reminders []*Reminder `json:"reminders"`
+}
+
+// Scheduler keeps reminders in a json file and fires them when due.
+type Scheduler struct {
+	path string
+	fire FireFunc
+	wake chan struct{}
+	now  func() time.Time
+
+	mu     sync.Mutex
+	state  state
+	firing map[*Reminder]bool // 正在播报的提醒，不会重复触发
+}
+
+// New loads the reminders stored at path, the file is created on first save.
+func New(path string, fire FireFunc) (*Scheduler, error) {
+	s := &Scheduler{
+		path:   path,
+		fire:   fire,
+		wake:   make(chan struct{}, 1),
+		now:    time.Now,
+		firing: make(map[*Reminder]bool),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.state); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Add schedules a reminder for the device.
+func (s *Scheduler) Add(deviceId, text string, due time.Time) (Reminder, error) {
+	text = strings.TrimSpace(text)
+	if deviceId == "" || text == "" {
+		return Reminder{}, errors.New("device id and text are required")
+	}
+	if r := []rune(text); len(r) > MaxTextLen {
+		text = string(r[:MaxTextLen])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.byDevice(deviceId)) >= MaxPerDevice {
+		return Reminder{}, ErrTooMany
+	}
+	s.state.NextID++
+	r := &Reminder{
+		ID:        s.state.NextID,
+		DeviceId:  deviceId,
+		Text:      text,
+		DueAt:     due,
+		CreatedAt: s.now(),
+	}
+	s.state.Reminders = append(s.state.Reminders, r)
+	if err := s.save(); err != nil {
+		s.state.Reminders = s.state.Reminders[:len(s.state.Reminders)-1]
+		return Reminder{}, err
+	}
+	s.notify()
+	return *r, nil
+}
+
+// List returns the reminders of the device ordered by due time.
+func (s *Scheduler) List(deviceId string) []Reminder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Reminder, 0)
+	for _, r := range s.byDevice(deviceId) {
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].DueAt.Before(list[j].DueAt)
+	})
+	return list
+}
+
+// Cancel removes a reminder of the device.
+func (s *Scheduler) Cancel(deviceId string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.byDevice(deviceId) {
+		if r.ID == id {
+			return s.remove(r)
+		}
+	}
+	return ErrNotFound
+}
+
+// Run fires reminders as they become due until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		timer.Reset(s.fireDue())
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// Deliver fires the missed reminders of a device that has just connected.
+// It does not wait for them to be played.
+func (s *Scheduler) Deliver(deviceId string) {
+	s.mu.Lock()
+	missed := make([]*Reminder, 0)
+	for _, r := range s.byDevice(deviceId) {
+		if r.Missed && s.claim(r) {
+			missed = append(missed, r)
+		}
+	}
+	s.mu.Unlock()
+	s.fireAll(missed)
+}
+
+// fireDue fires the reminders due now and returns the wait until the next one.
+func (s *Scheduler) fireDue() time.Duration {
+	now := s.now()
+	next := time.Hour
+	s.mu.Lock()
+	due := make([]*Reminder, 0)
+	for _, r := range s.state.Reminders {
+		if r.Missed || s.firing[r] {
+			continue
+		}
+		if wait := r.DueAt.Sub(now); wait > 0 {
+			next = min(next, wait)
+			continue
+		}
+		s.claim(r)
+		due = append(due, r)
+	}
+	s.mu.Unlock()
+	s.fireAll(due)
+	return next
+}
+
+// claim marks a reminder as firing, reporting false if it already is, e.g.
+// for a device that connected twice. The caller holds the lock.
+func (s *Scheduler) claim(r *Reminder) bool {
+	if s.firing[r] {
+		return false
+	}
+	s.firing[r] = true
+	return true
+}
+
+// fireAll fires claimed reminders outside the lock, as fire waits for them to
+// be played. Each device gets its reminders in due order while the others
+// are not held up.
+func (s *Scheduler) fireAll(reminders []*Reminder) {
+	sort.Slice(reminders, func(i, j int) bool {
+		return reminders[i].DueAt.Before(reminders[j].DueAt)
+	})
+	byDevice := make(map[string][]*Reminder)
+	for _, r := range reminders {
+		id := strings.ToLower(r.DeviceId)
+		byDevice[id] = append(byDevice[id], r)
+	}
+	for _, list := range byDevice {
+		go func() {
+			for _, r := range list {
+				s.fireOne(r)
+			}
+		}()
+	}
+}
+
+// fireOne removes a reminder once played, or keeps it as missed.
+func (s *Scheduler) fireOne(r *Reminder) {
+	err := s.fire(*r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.firing, r)
+	if err == nil {
+		_ = s.remove(r)
+	} else if !r.Missed {
+		r.Missed = true
+		_ = s.save()
+	}
+}
+
+func (s *Scheduler) byDevice(deviceId string) []*Reminder {
+	var list []*Reminder
+	for _, r := range s.state.Reminders {
+		if strings.EqualFold(r.DeviceId, deviceId) {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+func (s *Scheduler) remove(target *Reminder) error {
+	for i, r := range s.state.Reminders {
+		if r == target {
+			s.state.Reminders = append(s.state.Reminders[:i], s.state.Reminders[i+1:]...)
+			return s.save()
+		}
+	}
+	return nil
+}
+
+// save writes the reminders to a temporary file renamed over the old one, so
+// a crash never leaves a truncated file.
+func (s *Scheduler) save() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,133 @@
+package reminder
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSchedulerPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reminders.json")
+	s, err := New(path, func(Reminder) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	late, _ := s.Add("AA:BB", "开会", now.Add(time.Hour))
+	early, _ := s.Add("AA:BB", "喝水", now.Add(time.Minute))
+	if _, err := s.Add("CC:DD", "睡觉", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Cancel("cc:dd", early.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("cancelled a reminder of another device: %v", err)
+	}
+
+	s, err = New(path, func(Reminder) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := s.List("aa:bb")
+	if len(list) != 2 || list[0].ID != early.ID || list[1].ID != late.ID {
+		t.Fatalf("reminders not reloaded in due order: %+v", list)
+	}
+	if err := s.Cancel("AA:BB", early.ID); err != nil {
+		t.Fatal(err)
+	}
+	if next, _ := s.Add("AA:BB", "散步", now); next.ID <= late.ID {
+		t.Fatalf("ids reused after reload: %d", next.ID)
+	}
+}
+
+func TestSchedulerDeliversMissed(t *testing.T) {
+	online := make(chan bool, 1)
+	online <- false
+	fired := make(chan Reminder, 1)
+	s, err := New(filepath.Join(t.TempDir(), "reminders.json"), func(r Reminder) error {
+		if !<-online {
+			online <- false
+			return errors.New("offline")
+		}
+		online <- true
+		fired <- r
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	r, _ := s.Add("AA:BB", "喝水", time.Now())
+	eventually(t, "reminder not marked missed", func() bool {
+		list := s.List("AA:BB")
+		return len(list) == 1 && list[0].Missed
+	})
+
+	<-online
+	online <- true
+	s.Deliver("aa:bb")
+	if got := <-fired; got.ID != r.ID {
+		t.Fatalf("delivered %+v", got)
+	}
+	eventually(t, "delivered reminder not removed", func() bool {
+		return len(s.List("AA:BB")) == 0
+	})
+}
+
+func TestSchedulerWaitsForPlayback(t *testing.T) {
+	fired := make(chan Reminder, 4)
+	played := make(chan error)
+	s, err := New(filepath.Join(t.TempDir(), "reminders.json"), func(r Reminder) error {
+		fired <- r
+		return <-played
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add("AA:BB", "喝水", time.Now().Add(-time.Minute))
+	s.fireDue()
+	<-fired
+
+	// 播报中的提醒不会被第二个连接重复触发
+	s.Deliver("AA:BB")
+	s.fireDue()
+	if list := s.List("AA:BB"); len(list) != 1 {
+		t.Fatalf("reminder removed before played: %+v", list)
+	}
+	played <- errors.New("session closed")
+	eventually(t, "reminder not marked missed", func() bool {
+		list := s.List("AA:BB")
+		return len(list) == 1 && list[0].Missed
+	})
+	select {
+	case r := <-fired:
+		t.Fatalf("fired twice: %+v", r)
+	default:
+	}
+
+	s.Deliver("AA:BB")
+	s.Deliver("AA:BB")
+	<-fired
+	played <- nil
+	eventually(t, "played reminder not removed", func() bool {
+		return len(s.List("AA:BB")) == 0
+	})
+	if len(fired) != 0 {
+		t.Fatalf("missed reminder delivered twice")
+	}
+}
+
+func eventually(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.After(time.Second)
+	for !cond() {
+		select {
+		case <-deadline:
+			t.Fatal(msg)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Package replay compares what a replayed session sent to the device with
+// the recording.
+package replay
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+)
+
+const KindAudio = "audio"
+
+// Event is something sent to the device, at an offset from the session start.
+type Event struct {
+	Offset time.Duration
+	Kind   string // 如 tts:start、stt、llm、audio
+	Text   string
+}
+
+// ServerEvent converts an event sent to the device.
+func ServerEvent(offset time.Duration, ev xiaozhi.ServerEvent) Event {
+	e := Event{Offset: offset, Kind: string(ev.GetType())}
+	switch ev := ev.(type) {
+	case *xiaozhi.ServerEventTTS:
+		e.Kind += ":" + string(ev.State)
+		e.Text = ev.Text
+	case *xiaozhi.ServerEventSTT:
+		e.Text = ev.Text
+	case *xiaozhi.ServerEventLLM:
+		e.Text = ev.Emotion
+	}
+	return e
+}
+
+// turn is a reply of the assistant, starting at its tts start.
+type turn struct {
+	User      string
+	Assistant string
+	Latency   time.Duration // tts start 到首个音频帧，无音频时为 -1
+}
+
+func turns(events []Event) []turn {
+	var list []turn
+	cur := -1 // 当前回复在 list 中的下标
+	var start time.Duration
+	lastStt := ""
+	for _, e := range events {
+		switch e.Kind {
+		case "stt":
+			lastStt = e.Text
+			// 用户语音的最终转写通常在回复开始后才到
+			if cur >= 0 {
+				list[cur].User = e.Text
+			}
+		case "tts:start":
+			list = append(list, turn{User: lastStt, Latency: -1})
+			cur, start = len(list)-1, e.Offset
+		case "tts:sentence_end":
+			if cur >= 0 {
+				list[cur].Assistant += e.Text
+			}
+		case KindAudio:
+			if cur >= 0 && list[cur].Latency < 0 {
+				list[cur].Latency = e.Offset - start
+			}
+		case "tts:stop":
+			cur, lastStt = -1, ""
+		}
+	}
+	return list
+}
+
+// order is the sequence of event kinds without audio frames, repeats such as
+// partial transcripts collapsed.
+func order(events []Event) []string {
+	var kinds []string
+	for _, e := range events {
+		if e.Kind == KindAudio {
+			continue
+		}
+		if n := len(kinds); n > 0 && kinds[n-1] == e.Kind {
+			continue
+		}
+		kinds = append(kinds, e.Kind)
+	}
+	return kinds
+}
+
+// diffLines is a line diff of a against b, lines prefixed with " ", "-" or "+".
+func diffLines(a, b []string) []string {
+	// 最长公共子序列
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, " "+a[i])
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+b[j])
+	}
+	return out
+}
+
+// WriteReport compares the replayed session with the original one and
+// reports whether transcripts and event order are the same.
+func WriteReport(w io.Writer, original, replayed []Event) bool {
+	same := true
+	origTurns, replTurns := turns(original), turns(replayed)
+	fmt.Fprintf(w, "turns: original %d, replay %d\n", len(origTurns), len(replTurns))
+	if len(origTurns) != len(replTurns) {
+		same = false
+	}
+	for i := 0; i < max(len(origTurns), len(replTurns)); i++ {
+		var o, r turn
+		o.Latency, r.Latency = -1, -1
+		if i < len(origTurns) {
+			o = origTurns[i]
+		}
+		if i < len(replTurns) {
+			r = replTurns[i]
+		}
+		fmt.Fprintf(w, "\nturn %d\n", i+1)
+		same = compareText(w, "user", o.User, r.User) && same
+		same = compareText(w, "assistant", o.Assistant, r.Assistant) && same
+		fmt.Fprintf(w, "  latency     original %s, replay %s", latency(o.Latency), latency(r.Latency))
+		if o.Latency >= 0 && r.Latency >= 0 {
+			fmt.Fprintf(w, " (%+dms)", (r.Latency - o.Latency).Milliseconds())
+		}
+		fmt.Fprintln(w)
+	}
+
+	diff := diffLines(order(original), order(replayed))
+	changed := false
+	for _, line := range diff {
+		if !strings.HasPrefix(line, " ") {
+			changed = true
+			break
+		}
+	}
+	fmt.Fprintln(w, "\nevent order:", lo.Ternary(changed, "changed", "unchanged"))
+	if changed {
+		same = false
+		for _, line := range diff {
+			fmt.Fprintln(w, "  "+line)
+		}
+	}
+	return same
+}
+
+func compareText(w io.Writer, name, original, replayed string) bool {
+	if original == replayed {
+		fmt.Fprintf(w, "  %-11s = %q\n", name, original)
+		return true
+	}
+	fmt.Fprintf(w, "  %-11s - %q\n  %-11s + %q\n", name, original, "", replayed)
+	return false
+}
+
+func latency(d time.Duration) string {
+	if d < 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
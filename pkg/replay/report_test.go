@@ -0,0 +1,58 @@
+package replay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func session(latency time.Duration, reply string) []Event {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	return []Event{
+		{Offset: ms(0), Kind: "hello"},
+		{Offset: ms(100), Kind: "stt", Text: "今天"},
+		{Offset: ms(900), Kind: "tts:start"},
+		{Offset: ms(950), Kind: "stt", Text: "今天天气如何"},
+		{Offset: ms(900) + latency, Kind: KindAudio},
+		{Offset: ms(1500), Kind: "llm", Text: "happy"},
+		{Offset: ms(1500), Kind: "tts:sentence_start", Text: reply},
+		{Offset: ms(2500), Kind: "tts:sentence_end", Text: reply},
+		{Offset: ms(2600), Kind: "tts:stop"},
+	}
+}
+
+func TestTurns(t *testing.T) {
+	got := turns(session(300*time.Millisecond, "晴。"))
+	if len(got) != 1 || got[0].User != "今天天气如何" || got[0].Assistant != "晴。" ||
+		got[0].Latency != 300*time.Millisecond {
+		t.Fatalf("unexpected turns: %+v", got)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	var buf bytes.Buffer
+	if !WriteReport(&buf, session(300*time.Millisecond, "晴。"), session(200*time.Millisecond, "晴。")) {
+		t.Fatalf("latency alone should not be a difference:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "(-100ms)") {
+		t.Fatalf("latency change not reported:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	replayed := session(300*time.Millisecond, "有雨。")
+	replayed = append(replayed[:5], replayed[6:]...) // 没有表情
+	if WriteReport(&buf, session(300*time.Millisecond, "晴。"), replayed) {
+		t.Fatal("different reply reported as the same")
+	}
+	if !strings.Contains(buf.String(), "-llm") || !strings.Contains(buf.String(), `+ "有雨。"`) {
+		t.Fatalf("diff not reported:\n%s", buf.String())
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	got := strings.Join(diffLines([]string{"a", "b", "c"}, []string{"a", "c", "d"}), ",")
+	if got != " a,-b, c,+d" {
+		t.Fatalf("got %s", got)
+	}
+}
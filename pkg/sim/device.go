@@ -0,0 +1,464 @@
+// Package sim is a simulated xiaozhi device. It connects to the gateway the
+// way an ESP32 does, streams pcm as opus at real-time pace, decodes the reply
+// audio, and keeps a timeline of everything exchanged for latency reports and
+// integration tests.
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xdimtech/go-xiaozhi/pkg/audio"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"gopkg.in/hraban/opus.v2"
+)
+
+// Directions of timeline events, relative to the device.
+const (
+	DirSend = "send"
+	DirRecv = "recv"
+	DirMark = "mark" // 本地标记，不经过网络
+
+	KindAudio = "audio"
+	// KindSpeechEnd marks the end of the user speech, latencies are measured
+	// from it rather than from the trailing silence.
+	KindSpeechEnd = "speech_end"
+)
+
+const (
+	// 最长 120 ms 一帧
+	maxFrameMs = 120
+	// 等待服务端 VAD 时每次发送的静音时长
+	silenceChunk = 300 * time.Millisecond
+)
+
+// Event is an entry of the timeline.
+type Event struct {
+	Offset time.Duration // 距连接建立的时间
+	Dir    string
+	Kind   string // 事件类型，tts 为 tts:<state>，音频帧为 audio
+	Text   string
+	Bytes  int // 音频帧的 opus 字节数
+	// Server is the event received, nil for audio and sent events.
+	Server xiaozhi.ServerEvent
+}
+
+type Option func(*Device)
+
+// WithHeader sets a handshake header, e.g. Authorization.
+func WithHeader(key, value string) Option {
+	return func(d *Device) {
+		d.header.Set(key, value)
+	}
+}
+
+// WithDeviceId sets the Device-Id and Client-Id headers.
+func WithDeviceId(deviceId, clientId string) Option {
+	return func(d *Device) {
+		d.header.Set("Device-Id", deviceId)
+		d.header.Set("Client-Id", clientId)
+	}
+}
+
+// WithProtocolVersion sets the binary protocol version, 1 by default.
+func WithProtocolVersion(version int) Option {
+	return func(d *Device) {
+		d.version = version
+		d.header.Set("Protocol-Version", strconv.Itoa(version))
+	}
+}
+
+// WithAudioParams sets the uplink audio announced in hello.
+func WithAudioParams(params xiaozhi.AudioParams) Option {
+	return func(d *Device) {
+		d.params = params
+	}
+}
+
+// WithFeatures sets the features announced in hello.
+func WithFeatures(features map[string]bool) Option {
+	return func(d *Device) {
+		d.features = features
+	}
+}
+
+// WithDiscardAudio counts the reply audio frames without decoding them, for
+// load tests where the decoded audio would only cost memory and cpu.
+func WithDiscardAudio() Option {
+	return func(d *Device) {
+		d.discard = true
+	}
+}
+
+// Device is a connection to the gateway. Its methods are safe for
+// concurrent use.
+type Device struct {
+	header   http.Header
+	version  int
+	params   xiaozhi.AudioParams
+	features map[string]bool
+	discard  bool
+	ws       *websocket.Conn
+	start    time.Time
+	writeMu  sync.Mutex
+	encoder  *opus.Encoder
+	done     chan struct{}
+
+	mu       sync.Mutex
+	events   []Event
+	cursor   int           // Wait 已返回的事件数
+	changed  chan struct{} // 收到新事件时关闭并替换
+	readErr  error
+	hello    *xiaozhi.ServerEventHello
+	decoder  *opus.Decoder
+	decoded  []int16
+	downlink []byte // 解码后的下行 pcm16
+}
+
+// Dial connects to the gateway, e.g. ws://127.0.0.1:8080/xiaozhi/v1/.
+func Dial(ctx context.Context, url string, opts ...Option) (*Device, error) {
+	d := &Device{
+		header:  http.Header{},
+		version: xiaozhi.BinaryProtocolV1,
+		params: xiaozhi.AudioParams{
+			Format:        "opus",
+			SampleRate:    16000,
+			Channels:      1,
+			FrameDuration: 60,
+		},
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	encoder, err := opus.NewEncoder(d.params.SampleRate, d.params.Channels, opus.AppVoIP)
+	if err != nil {
+		return nil, err
+	}
+	d.encoder = encoder
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, url, d.header)
+	if err != nil {
+		return nil, err
+	}
+	d.ws = ws
+	d.start = time.Now()
+	go d.readLoop()
+	return d, nil
+}
+
+// Close closes the connection.
+func (d *Device) Close() error {
+	err := d.ws.Close()
+	<-d.done
+	return err
+}
+
+// Done is closed when the gateway closes the connection.
+func (d *Device) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *Device) readLoop() {
+	defer close(d.done)
+	for {
+		msgType, data, err := d.ws.ReadMessage()
+		if err != nil {
+			d.mu.Lock()
+			d.readErr = err
+			d.notify()
+			d.mu.Unlock()
+			return
+		}
+		if msgType == websocket.BinaryMessage {
+			d.receiveAudio(data)
+			continue
+		}
+		ev, err := xiaozhi.UnmarshalServerEvent(data)
+		if err != nil {
+			continue
+		}
+		d.receiveEvent(ev)
+	}
+}
+
+func (d *Device) receiveEvent(ev xiaozhi.ServerEvent) {
+	e := Event{Dir: DirRecv, Kind: string(ev.GetType()), Server: ev}
+	switch ev := ev.(type) {
+	case *xiaozhi.ServerEventHello:
+		d.mu.Lock()
+		if d.hello == nil {
+			d.hello = ev
+			if decoder, err := opus.NewDecoder(ev.AudioParams.SampleRate, ev.AudioParams.Channels); err == nil && !d.discard {
+				d.decoder = decoder
+				d.decoded = make([]int16, ev.AudioParams.SampleRate*maxFrameMs/1000*ev.AudioParams.Channels)
+			}
+		}
+		d.mu.Unlock()
+	case *xiaozhi.ServerEventTTS:
+		e.Kind += ":" + string(ev.State)
+		e.Text = ev.Text
+	case *xiaozhi.ServerEventSTT:
+		e.Text = ev.Text
+	case *xiaozhi.ServerEventLLM:
+		e.Text = ev.Emotion
+	case *xiaozhi.ServerEventError:
+		e.Text = ev.Error
+	}
+	d.add(e)
+}
+
+func (d *Device) receiveAudio(data []byte) {
+	frame, err := xiaozhi.UnmarshalBinaryFrame(d.version, data)
+	if err != nil || frame.Type != xiaozhi.BinaryTypeOpus {
+		return
+	}
+	d.mu.Lock()
+	if d.decoder != nil {
+		if n, err := d.decoder.Decode(frame.Payload, d.decoded); err == nil {
+			d.downlink = append(d.downlink, audio.Int16ToBytes(nil, d.decoded[:n*d.hello.AudioParams.Channels])...)
+		}
+	}
+	d.mu.Unlock()
+	d.add(Event{Dir: DirRecv, Kind: KindAudio, Bytes: len(frame.Payload)})
+}
+
+func (d *Device) add(e Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e.Offset = time.Since(d.start)
+	d.events = append(d.events, e)
+	d.notify()
+}
+
+func (d *Device) notify() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+func (d *Device) send(ev xiaozhi.ClientEvent, text string) error {
+	d.writeMu.Lock()
+	err := d.ws.WriteJSON(ev)
+	d.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.add(Event{Dir: DirSend, Kind: string(ev.ClientEventType()), Text: text})
+	return nil
+}
+
+// Mark adds a local event to the timeline, e.g. KindSpeechEnd.
+func (d *Device) Mark(kind, text string) {
+	d.add(Event{Dir: DirMark, Kind: kind, Text: text})
+}
+
+// Hello sends hello and waits for the reply of the gateway.
+func (d *Device) Hello(ctx context.Context) (*xiaozhi.ServerEventHello, error) {
+	params := d.params
+	err := d.send(&xiaozhi.ClientEventHello{
+		ClientEventBase: xiaozhi.ClientEventBase{
+			Type:        xiaozhi.ClientEventTypeHello,
+			Version:     d.version,
+			Transport:   "websocket",
+			AudioParams: &params,
+		},
+		Features: d.features,
+	}, "")
+	if err != nil {
+		return nil, err
+	}
+	ev, err := d.Wait(ctx, Kind(string(xiaozhi.ServerEventTypeHello)))
+	if err != nil {
+		return nil, err
+	}
+	return ev.Server.(*xiaozhi.ServerEventHello), nil
+}
+
+// Listen sends a listen state change, e.g. start in auto mode.
+func (d *Device) Listen(state xiaozhi.ClientState, mode xiaozhi.ClientMode) error {
+	return d.send(&xiaozhi.ClientEventListen{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeListen},
+		State:           state,
+		Mode:            mode,
+	}, string(state))
+}
+
+// Abort interrupts the reply being spoken.
+func (d *Device) Abort(reason string) error {
+	return d.send(&xiaozhi.ClientEventAbort{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeAbort},
+		Reason:          reason,
+	}, reason)
+}
+
+// Text sends typed text.
+func (d *Device) Text(text string) error {
+	return d.send(&xiaozhi.ClientEventText{
+		ClientEventBase: xiaozhi.ClientEventBase{Type: xiaozhi.ClientEventTypeText},
+		Text:            text,
+	}, text)
+}
+
+// SendPCM streams mono pcm16 at sampleRate as opus frames, one frame per
+// frame duration as a microphone would. The last frame is padded with silence.
+func (d *Device) SendPCM(ctx context.Context, pcm []byte, sampleRate int) error {
+	if sampleRate != d.params.SampleRate {
+		resampler, err := audio.NewGoResampler(1, sampleRate, d.params.SampleRate)
+		if err != nil {
+			return err
+		}
+		head, err := resampler.Handle(pcm)
+		if err != nil {
+			return err
+		}
+		pcm = append([]byte(nil), head...)
+		tail, err := resampler.Flush()
+		if err != nil {
+			return err
+		}
+		pcm = append(pcm, tail...)
+	}
+	samples := audio.BytesToInt16(nil, pcm)
+	if d.params.Channels > 1 {
+		samples = upmix(samples, d.params.Channels)
+	}
+	frameSize := d.params.SampleRate * d.params.FrameDuration / 1000 * d.params.Channels
+	frameDuration := time.Duration(d.params.FrameDuration) * time.Millisecond
+	packet := make([]byte, 4000)
+	start := time.Now()
+	for i := 0; i*frameSize < len(samples); i++ {
+		frame := make([]int16, frameSize)
+		copy(frame, samples[i*frameSize:])
+		n, err := d.encoder.Encode(frame, packet)
+		if err != nil {
+			return err
+		}
+		if err := d.sendFrame(packet[:n], uint32(i*d.params.FrameDuration)); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(start.Add(time.Duration(i+1) * frameDuration))):
+		}
+	}
+	return nil
+}
+
+// Speak streams the user speech, marks its end, then streams silence until
+// the gateway starts replying, as a device in auto mode does.
+func (d *Device) Speak(ctx context.Context, pcm []byte, sampleRate int) error {
+	if err := d.SendPCM(ctx, pcm, sampleRate); err != nil {
+		return err
+	}
+	d.Mark(KindSpeechEnd, "")
+
+	replying, stop := context.WithCancel(ctx)
+	defer stop()
+	go func() {
+		defer stop()
+		_, _ = d.Wait(replying, Kind(KindTTSStart))
+	}()
+	for replying.Err() == nil {
+		if err := d.SendSilence(replying, silenceChunk); err != nil && replying.Err() == nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// SendSilence streams d of silence, as a device keeps sending after the user
+// stops talking until the gateway detects the end of speech.
+func (d *Device) SendSilence(ctx context.Context, duration time.Duration) error {
+	samples := int(int64(d.params.SampleRate) * int64(duration) / int64(time.Second))
+	return d.SendPCM(ctx, make([]byte, samples*2), d.params.SampleRate)
+}
+
+func (d *Device) sendFrame(payload []byte, timestamp uint32) error {
+	data, err := xiaozhi.MarshalBinaryFrame(d.version, &xiaozhi.BinaryFrame{
+		Type:      xiaozhi.BinaryTypeOpus,
+		Timestamp: timestamp,
+		Payload:   payload,
+	})
+	if err != nil {
+		return err
+	}
+	d.writeMu.Lock()
+	err = d.ws.WriteMessage(websocket.BinaryMessage, data)
+	d.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	d.add(Event{Dir: DirSend, Kind: KindAudio, Bytes: len(payload)})
+	return nil
+}
+
+func upmix(mono []int16, channels int) []int16 {
+	out := make([]int16, len(mono)*channels)
+	for i, s := range mono {
+		for ch := 0; ch < channels; ch++ {
+			out[i*channels+ch] = s
+		}
+	}
+	return out
+}
+
+// Kind matches received events of a kind, for Wait.
+func Kind(kind string) func(Event) bool {
+	return func(e Event) bool {
+		return e.Dir == DirRecv && e.Kind == kind
+	}
+}
+
+// Wait returns the first matching event after the one returned by the
+// previous Wait, so that a sequence of replies can be awaited in order.
+func (d *Device) Wait(ctx context.Context, match func(Event) bool) (Event, error) {
+	for {
+		d.mu.Lock()
+		for i := d.cursor; i < len(d.events); i++ {
+			if match(d.events[i]) {
+				d.cursor = i + 1
+				e := d.events[i]
+				d.mu.Unlock()
+				return e, nil
+			}
+		}
+		changed, readErr := d.changed, d.readErr
+		d.mu.Unlock()
+		if readErr != nil {
+			return Event{}, fmt.Errorf("connection closed: %w", readErr)
+		}
+		select {
+		case <-ctx.Done():
+			return Event{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Events returns the timeline so far.
+func (d *Device) Events() []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Event(nil), d.events...)
+}
+
+// Downlink returns the reply audio decoded so far.
+func (d *Device) Downlink() (*audio.Wav, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.hello == nil {
+		return nil, errors.New("no hello from the gateway")
+	}
+	return &audio.Wav{
+		SampleRate: d.hello.AudioParams.SampleRate,
+		Channels:   d.hello.AudioParams.Channels,
+		PCM:        append([]byte(nil), d.downlink...),
+	}, nil
+}
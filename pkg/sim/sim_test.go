@@ -0,0 +1,171 @@
+package sim_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/handler"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/openai/mock"
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+	"github.com/xdimtech/go-xiaozhi/pkg/sim"
+)
+
+func TestMain(m *testing.M) {
+	mock.Main(m, filepath.Join("..", "..", "conf", "biz.yaml"))
+}
+
+// gateway starts the gateway backed by a mock realtime server and returns
+// its websocket url.
+func gateway(t *testing.T, opts ...mock.Option) (string, *mock.Server) {
+	t.Helper()
+	return serve(t, handler.NewWebSocketServer(), opts...)
+}
+
+// serve starts the given gateway, see gateway.
+func serve(t *testing.T, ws *handler.WebSocketServer, opts ...mock.Option) (string, *mock.Server) {
+	t.Helper()
+	return mock.Gateway(t, ws.RealTime, opts...)
+}
+
+func dial(t *testing.T, url string) (*sim.Device, context.Context) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	d, err := sim.Dial(ctx, url, sim.WithDeviceId("sim:test", "sim-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = d.Close() })
+	hello, err := d.Hello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.SessionId == "" {
+		t.Fatalf("hello = %+v", hello)
+	}
+	return d, ctx
+}
+
+func TestTextTurn(t *testing.T) {
+	url, _ := gateway(t, mock.WithTurns(mock.Turn{Reply: "你好呀。", Audio: mock.Tone(24000, 300*time.Millisecond)}))
+	d, ctx := dial(t, url)
+
+	if err := d.Text("你好"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Wait(ctx, sim.Kind(sim.KindTTSStop)); err != nil {
+		t.Fatal(err)
+	}
+	turns := sim.Turns(d.Events())
+	if len(turns) != 1 {
+		t.Fatalf("turns = %+v", turns)
+	}
+	turn := turns[0]
+	if strings.Join(turn.Sentences, "") != "你好呀。" || turn.Frames == 0 {
+		t.Errorf("turn = %+v", turn)
+	}
+	if turn.Latency(turn.FirstAudio) <= 0 || turn.TTSStop < turn.FirstAudio {
+		t.Errorf("latencies = %+v", turn)
+	}
+	wav, err := d.Downlink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wav.PCM) == 0 {
+		t.Error("no reply audio decoded")
+	}
+}
+
+func TestVoiceTurn(t *testing.T) {
+	// 上行重采样为 24 kHz pcm16，120 ms 语音后触发 VAD
+	url, _ := gateway(t, mock.WithVAD(5760),
+		mock.WithTurns(mock.Turn{Transcript: "几点了", Reply: "三点了。", Audio: mock.Tone(24000, 200*time.Millisecond)}))
+	d, ctx := dial(t, url)
+
+	if err := d.Listen(xiaozhi.ClientStateListenStart, xiaozhi.ClientModeAuto); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SendPCM(ctx, mock.Tone(16000, 300*time.Millisecond), 16000); err != nil {
+		t.Fatal(err)
+	}
+	d.Mark(sim.KindSpeechEnd, "")
+	if _, err := d.Wait(ctx, sim.Kind(sim.KindTTSStop)); err != nil {
+		t.Fatal(err)
+	}
+	turns := sim.Turns(d.Events())
+	if len(turns) != 1 || turns[0].Transcript != "几点了" || turns[0].STT == 0 {
+		t.Fatalf("turns = %+v", turns)
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	ws := handler.NewWebSocketServer()
+	url, _ := serve(t, ws)
+	d, ctx := dial(t, url)
+	sess, err := ws.Registry().ByDevice("sim:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sess.SendEvent(&xiaozhi.ServerEventAlert{Status: "提醒", Message: "该睡觉了"}); err != nil {
+		t.Fatal(err)
+	}
+	ev, err := d.Wait(ctx, sim.Kind(string(xiaozhi.ServerEventTypeAlert)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alert := ev.Server.(*xiaozhi.ServerEventAlert); alert.Message != "该睡觉了" || alert.SessionId == "" {
+		t.Errorf("alert = %+v", alert)
+	}
+
+	// 管理接口断开会话前先发 goodbye
+	if err := sess.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Wait(ctx, sim.Kind(string(xiaozhi.ServerEventTypeGoodbye))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-d.Done():
+	case <-ctx.Done():
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestTurns(t *testing.T) {
+	ms := time.Millisecond
+	events := []sim.Event{
+		{Offset: 10 * ms, Dir: sim.DirSend, Kind: sim.KindAudio},
+		{Offset: 70 * ms, Dir: sim.DirSend, Kind: sim.KindAudio},
+		{Offset: 100 * ms, Dir: sim.DirMark, Kind: sim.KindSpeechEnd},
+		{Offset: 130 * ms, Dir: sim.DirSend, Kind: sim.KindAudio},
+		{Offset: 300 * ms, Dir: sim.DirRecv, Kind: sim.KindTTSStart},
+		{Offset: 320 * ms, Dir: sim.DirRecv, Kind: string(xiaozhi.ServerEventTypeSTT), Text: "你好"},
+		{Offset: 330 * ms, Dir: sim.DirRecv, Kind: sim.KindSentenceStart, Text: "你"},
+		{Offset: 340 * ms, Dir: sim.DirRecv, Kind: sim.KindSentenceStart, Text: "你好。"},
+		{Offset: 350 * ms, Dir: sim.DirRecv, Kind: sim.KindAudio},
+		{Offset: 410 * ms, Dir: sim.DirRecv, Kind: sim.KindAudio},
+		{Offset: 420 * ms, Dir: sim.DirRecv, Kind: sim.KindSentenceStart, Text: "再见。"},
+		{Offset: 500 * ms, Dir: sim.DirRecv, Kind: sim.KindTTSStop},
+		// 没有输入结束标记的第二轮
+		{Offset: 600 * ms, Dir: sim.DirSend, Kind: sim.KindAudio},
+		{Offset: 700 * ms, Dir: sim.DirRecv, Kind: sim.KindTTSStart},
+	}
+	turns := sim.Turns(events)
+	if len(turns) != 2 {
+		t.Fatalf("turns = %+v", turns)
+	}
+	first := turns[0]
+	if first.Latency(first.TTSStart) != 200*ms || first.Latency(first.FirstAudio) != 250*ms || first.Latency(first.TTSStop) != 400*ms {
+		t.Errorf("latencies = %+v", first)
+	}
+	if first.Transcript != "你好" || strings.Join(first.Sentences, "|") != "你好。|再见。" || first.Frames != 2 {
+		t.Errorf("turn = %+v", first)
+	}
+	if second := turns[1]; second.Latency(second.TTSStart) != 100*ms || second.TTSStop != 0 || second.Latency(second.TTSStop) != 0 {
+		t.Errorf("second turn = %+v", second)
+	}
+}
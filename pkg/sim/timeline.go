@@ -0,0 +1,156 @@
+package sim
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/xdimtech/go-xiaozhi/pkg/protocol/xiaozhi"
+)
+
+// Kinds of the tts events, which carry their state.
+var (
+	KindTTSStart      = string(xiaozhi.ServerEventTypeTTS) + ":" + string(xiaozhi.ServerTTSStateStart)
+	KindTTSStop       = string(xiaozhi.ServerEventTypeTTS) + ":" + string(xiaozhi.ServerTTSStateStop)
+	KindSentenceStart = string(xiaozhi.ServerEventTypeTTS) + ":" + string(xiaozhi.ServerTTSStateSentenceStart)
+)
+
+// Turn is a reply of the gateway. Times are offsets in the timeline, zero
+// when the event did not happen.
+type Turn struct {
+	Input      time.Duration // 用户输入结束
+	STT        time.Duration
+	TTSStart   time.Duration
+	FirstAudio time.Duration
+	TTSStop    time.Duration
+	Transcript string
+	Sentences  []string
+	Frames     int
+}
+
+// Latency is the time from the end of the input to at, or zero if at did
+// not happen.
+func (t Turn) Latency(at time.Duration) time.Duration {
+	if at == 0 {
+		return 0
+	}
+	return at - t.Input
+}
+
+// isInputEnd reports whether e ends the user input: the end of speech mark,
+// typed text, or listen stop.
+func isInputEnd(e Event) bool {
+	switch {
+	case e.Dir == DirMark:
+		return e.Kind == KindSpeechEnd
+	case e.Dir != DirSend:
+		return false
+	case e.Kind == string(xiaozhi.ClientEventTypeText):
+		return true
+	default:
+		return e.Kind == string(xiaozhi.ClientEventTypeListen) && e.Text == string(xiaozhi.ClientStateListenStop)
+	}
+}
+
+// Turns splits the timeline into replies, each starting with tts start.
+func Turns(events []Event) []Turn {
+	var turns []Turn
+	var input, lastAudio time.Duration
+	hasInput, open := false, false
+	pendingSTT, pendingAt := "", time.Duration(0)
+	for _, e := range events {
+		switch {
+		case isInputEnd(e):
+			input, hasInput = e.Offset, true
+		case e.Dir == DirSend && e.Kind == KindAudio:
+			lastAudio = e.Offset
+		case e.Dir != DirRecv:
+		case e.Kind == KindTTSStart:
+			t := Turn{Input: input, TTSStart: e.Offset, Transcript: pendingSTT, STT: pendingAt}
+			if !hasInput {
+				// 没有明确的输入结束时以最后一帧上行音频为准
+				t.Input = lastAudio
+			}
+			turns = append(turns, t)
+			hasInput, open = false, true
+			pendingSTT, pendingAt = "", 0
+		case e.Kind == string(xiaozhi.ServerEventTypeSTT):
+			// 语音输入时 stt 在 tts start 之后到达
+			if open && turns[len(turns)-1].STT == 0 {
+				turns[len(turns)-1].Transcript, turns[len(turns)-1].STT = e.Text, e.Offset
+			} else {
+				pendingSTT, pendingAt = e.Text, e.Offset
+			}
+		case !open:
+		case e.Kind == KindAudio:
+			t := &turns[len(turns)-1]
+			if t.FirstAudio == 0 {
+				t.FirstAudio = e.Offset
+			}
+			t.Frames++
+		case e.Kind == KindSentenceStart:
+			// sentence_start 随转写逐步更新同一句
+			t := &turns[len(turns)-1]
+			if n := len(t.Sentences); n > 0 && strings.HasPrefix(e.Text, t.Sentences[n-1]) {
+				t.Sentences[n-1] = e.Text
+			} else {
+				t.Sentences = append(t.Sentences, e.Text)
+			}
+		case e.Kind == KindTTSStop:
+			turns[len(turns)-1].TTSStop = e.Offset
+			open = false
+		}
+	}
+	return turns
+}
+
+// WriteTimeline prints the events, runs of audio frames folded into a line.
+func WriteTimeline(w io.Writer, events []Event) {
+	for i := 0; i < len(events); i++ {
+		e := events[i]
+		if e.Kind != KindAudio {
+			line := fmt.Sprintf("%9s  %-4s  %s", formatOffset(e.Offset), e.Dir, e.Kind)
+			if e.Text != "" {
+				line += "  " + e.Text
+			}
+			fmt.Fprintln(w, line)
+			continue
+		}
+		frames, size, j := 0, 0, i
+		for ; j < len(events) && events[j].Kind == KindAudio && events[j].Dir == e.Dir; j++ {
+			frames++
+			size += events[j].Bytes
+		}
+		fmt.Fprintf(w, "%9s  %-4s  audio x%d, %d bytes, until %s\n",
+			formatOffset(e.Offset), e.Dir, frames, size, formatOffset(events[j-1].Offset))
+		i = j - 1
+	}
+}
+
+// WriteTurns prints the latencies of each reply, measured from the end of
+// the user input.
+func WriteTurns(w io.Writer, turns []Turn) {
+	for i, t := range turns {
+		fmt.Fprintf(w, "turn %d: stt %s, tts start %s, first audio %s, tts stop %s, %d frames\n",
+			i+1, formatLatency(t.Latency(t.STT)), formatLatency(t.Latency(t.TTSStart)),
+			formatLatency(t.Latency(t.FirstAudio)), formatLatency(t.Latency(t.TTSStop)), t.Frames)
+		if t.Transcript != "" {
+			fmt.Fprintf(w, "  user: %s\n", t.Transcript)
+		}
+		if len(t.Sentences) > 0 {
+			fmt.Fprintf(w, "  reply: %s\n", strings.Join(t.Sentences, ""))
+		}
+	}
+}
+
+func formatOffset(d time.Duration) string {
+	return fmt.Sprintf("+%.3fs", d.Seconds())
+}
+
+func formatLatency(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond).String()
+}
@@ -0,0 +1,105 @@
+// Package tracing sets up OpenTelemetry tracing of the gateway. Spans are
+// started from the global tracer provider, so nothing is recorded until Init
+// installs an exporter.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ServiceName = "go-xiaozhi"
+	tracerName  = "github.com/xdimtech/go-xiaozhi"
+)
+
+// Span names.
+const (
+	SpanSession    = "xiaozhi.session"
+	SpanTurn       = "xiaozhi.turn"
+	SpanDial       = "realtime.dial"
+	SpanTool       = "tool.call"
+	SpanOpusEncode = "opus.encode"
+)
+
+type Options struct {
+	Exporter    string // otlp or file, empty disables tracing
+	Endpoint    string // otlp http host:port
+	Insecure    bool
+	File        string
+	SampleRatio float64 // 0 samples everything
+}
+
+// Init installs the global tracer provider and returns its shutdown, which
+// flushes the spans not exported yet.
+func Init(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	switch opts.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		var options []otlptracehttp.Option
+		if opts.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(opts.Endpoint))
+		}
+		if opts.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		e, err := otlptracehttp.New(ctx, options...)
+		if err != nil {
+			return nil, err
+		}
+		exporter = e
+	case "file":
+		if err := os.MkdirAll(filepath.Dir(opts.File), 0o755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		e, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		exporter, file = e, f
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", opts.Exporter)
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if opts.SampleRatio > 0 && opts.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(opts.SampleRatio)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+		return err
+	}, nil
+}
+
+// Tracer returns the tracer of the gateway.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
@@ -0,0 +1,51 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestFileExporter(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	file := filepath.Join(t.TempDir(), "traces", "spans.jsonl")
+	shutdown, err := Init(context.Background(), Options{Exporter: "file", File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, session := Tracer().Start(context.Background(), SpanSession)
+	_, turn := Tracer().Start(ctx, SpanTurn)
+	turn.End()
+	session.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var span struct{ Name string }
+		if err := dec.Decode(&span); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, span.Name)
+	}
+	if len(names) != 2 || names[0] != SpanTurn || names[1] != SpanSession {
+		t.Errorf("spans = %v", names)
+	}
+}
+
+func TestUnknownExporter(t *testing.T) {
+	if _, err := Init(context.Background(), Options{Exporter: "zipkin"}); err == nil {
+		t.Error("unknown exporter accepted")
+	}
+}
@@ -0,0 +1,458 @@
+// Package webhook delivers conversation events to HTTP endpoints. Events are
+// signed JSON POSTs, queued on disk per endpoint and retried with backoff, so
+// a slow or unreachable receiver never holds up a session.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/xdimtech/go-xiaozhi/pkg/utils"
+)
+
+// Event types.
+const (
+	TypeSessionStart        = "session.start"
+	TypeSessionEnd          = "session.end"
+	TypeUserTranscript      = "transcript.user"
+	TypeAssistantTranscript = "transcript.assistant"
+	TypeToolCall            = "tool.call"
+	TypeUsage               = "usage"
+)
+
+// Headers of a delivery. The signature is the hex HMAC-SHA256 of the
+// timestamp, a dot and the body, keyed with the endpoint secret.
+const (
+	HeaderEvent     = "X-Xiaozhi-Event"
+	HeaderDelivery  = "X-Xiaozhi-Delivery"
+	HeaderTimestamp = "X-Xiaozhi-Timestamp"
+	HeaderSignature = "X-Xiaozhi-Signature"
+)
+
+const (
+	// Send 到落盘之间的缓冲，满时丢弃事件
+	eventBuffer       = 1024
+	deadDir           = "dead"
+	defaultAttempts   = 8
+	defaultTimeout    = 10 * time.Second
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+// Event is the body of a delivery.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"session_id"`
+	DeviceId  string    `json:"device_id"`
+	Data      any       `json:"data,omitempty"`
+}
+
+// Transcript is the data of user and assistant transcript events.
+type Transcript struct {
+	ItemID     string `json:"item_id,omitempty"`
+	ResponseID string `json:"response_id,omitempty"`
+	Source     string `json:"source,omitempty"` // 用户输入：voice 或 text
+	Text       string `json:"text"`
+}
+
+// ToolCall is the data of a tool call event.
+type ToolCall struct {
+	CallID     string `json:"call_id"`
+	Name       string `json:"name"`
+	Arguments  string `json:"arguments"`
+	Output     string `json:"output"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// Usage is the data of a usage event, sent for every response.
+type Usage struct {
+	ResponseID   string `json:"response_id"`
+	Status       string `json:"status"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+}
+
+// Endpoint receives the events of the listed types, all if none.
+type Endpoint struct {
+	Name   string // 队列目录名，需唯一
+	URL    string
+	Secret string
+	Events []string
+}
+
+// Options configures delivery. Zero values use the defaults.
+type Options struct {
+	Endpoints []Endpoint
+	// Dir holds a queue directory per endpoint. Events failing every attempt
+	// are moved to its dead subdirectory.
+	Dir         string
+	MaxAttempts int
+	Timeout     time.Duration // 单次请求超时
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	// MaxQueued bounds the events queued per endpoint, new events are
+	// dropped beyond it. Zero means no limit.
+	MaxQueued int
+}
+
+// Sink queues events for the endpoints. A nil Sink drops them.
+type Sink struct {
+	opts      Options
+	client    *http.Client
+	events    chan Event
+	endpoints []*endpoint
+	dropped   atomic.Int64
+}
+
+type endpoint struct {
+	Endpoint
+	dir  string
+	wake chan struct{}
+
+	mu     sync.Mutex
+	next   int64 // 下一个队列文件的序号
+	queued int
+}
+
+// New opens the queues of the endpoints, events left from a previous run are
+// delivered once Run starts.
+func New(opts Options) (*Sink, error) {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultAttempts
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultMaxBackoff, opts.MinBackoff)
+	}
+	s := &Sink{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		events: make(chan Event, eventBuffer),
+	}
+	names := map[string]bool{}
+	for _, e := range opts.Endpoints {
+		if e.Name == "" || e.URL == "" {
+			return nil, errors.New("webhook endpoint name and url are required")
+		}
+		if !validName(e.Name) || names[e.Name] {
+			return nil, fmt.Errorf("invalid or duplicate webhook endpoint name %q", e.Name)
+		}
+		names[e.Name] = true
+		ep := &endpoint{
+			Endpoint: e,
+			dir:      filepath.Join(opts.Dir, e.Name),
+			wake:     make(chan struct{}, 1),
+		}
+		if err := os.MkdirAll(filepath.Join(ep.dir, deadDir), 0o755); err != nil {
+			return nil, err
+		}
+		pending, err := ep.pending()
+		if err != nil {
+			return nil, err
+		}
+		ep.queued = len(pending)
+		if len(pending) > 0 {
+			ep.next = seqOf(pending[len(pending)-1]) + 1
+		}
+		s.endpoints = append(s.endpoints, ep)
+	}
+	return s, nil
+}
+
+// Send queues an event without blocking. The id and time are filled in if
+// empty. Events are dropped while the queues are not keeping up.
+func (s *Sink) Send(ev Event) {
+	if s == nil {
+		return
+	}
+	if ev.ID == "" {
+		ev.ID = utils.UniqueID()
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	select {
+	case s.events <- ev:
+	default:
+		s.drop(nil, ev, "buffer full")
+	}
+}
+
+// Dropped is the number of events dropped since start.
+func (s *Sink) Dropped() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.dropped.Load()
+}
+
+// Run writes sent events to the queues and delivers them until ctx is done.
+func (s *Sink) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, ep := range s.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliverLoop(ctx, ep)
+		}()
+	}
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-s.events:
+			s.enqueue(ev)
+		}
+	}
+}
+
+func (s *Sink) drop(ep *endpoint, ev Event, reason string) {
+	s.dropped.Add(1)
+	name := ""
+	if ep != nil {
+		name = ep.Name
+	}
+	slog.Warn("webhook event dropped", "endpoint", name, "type", ev.Type,
+		"session_id", ev.SessionID, "reason", reason)
+}
+
+// enqueue writes the event to the queue of every endpoint that wants it.
+func (s *Sink) enqueue(ev Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		s.drop(nil, ev, err.Error())
+		return
+	}
+	for _, ep := range s.endpoints {
+		if len(ep.Events) > 0 && !slices.Contains(ep.Events, ev.Type) {
+			continue
+		}
+		ep.mu.Lock()
+		if s.opts.MaxQueued > 0 && ep.queued >= s.opts.MaxQueued {
+			ep.mu.Unlock()
+			s.drop(ep, ev, "queue full")
+			continue
+		}
+		seq := ep.next
+		ep.next++
+		ep.mu.Unlock()
+		if err := writeFile(filepath.Join(ep.dir, fmt.Sprintf("%020d.json", seq)), body); err != nil {
+			s.drop(ep, ev, err.Error())
+			continue
+		}
+		ep.mu.Lock()
+		ep.queued++
+		ep.mu.Unlock()
+		select {
+		case ep.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliverLoop posts the queued events of an endpoint in order.
+func (s *Sink) deliverLoop(ctx context.Context, ep *endpoint) {
+	for {
+		pending, err := ep.pending()
+		if err != nil {
+			slog.Error("read webhook queue failed", "endpoint", ep.Name, "err", err)
+		}
+		for _, name := range pending {
+			if !s.deliverFile(ctx, ep, name) {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ep.wake:
+		}
+	}
+}
+
+// deliverFile posts a queued event until it is accepted or given up, and
+// removes it from the queue. It returns false if ctx is done first.
+func (s *Sink) deliverFile(ctx context.Context, ep *endpoint, name string) bool {
+	path := filepath.Join(ep.dir, name)
+	body, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("read webhook event failed", "endpoint", ep.Name, "file", name, "err", err)
+		s.finish(ep, path, true)
+		return true
+	}
+	var meta struct{ ID, Type string }
+	_ = json.Unmarshal(body, &meta)
+	for attempt := 1; ; attempt++ {
+		err := s.post(ctx, ep, meta.ID, meta.Type, body)
+		if err == nil {
+			s.finish(ep, path, false)
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		var perm permanentError
+		if errors.As(err, &perm) || attempt >= s.opts.MaxAttempts {
+			slog.Error("webhook delivery failed", "endpoint", ep.Name, "type", meta.Type,
+				"id", meta.ID, "attempts", attempt, "err", err)
+			s.finish(ep, path, true)
+			return true
+		}
+		slog.Warn("webhook delivery failed, retrying", "endpoint", ep.Name, "type", meta.Type,
+			"id", meta.ID, "attempt", attempt, "err", err)
+		if !sleep(ctx, s.backoff(attempt)) {
+			return false
+		}
+	}
+}
+
+// finish removes a delivered event, or moves it to the dead letters.
+func (s *Sink) finish(ep *endpoint, path string, dead bool) {
+	var err error
+	if dead {
+		err = os.Rename(path, filepath.Join(ep.dir, deadDir, filepath.Base(path)))
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		slog.Error("remove webhook event failed", "endpoint", ep.Name, "file", path, "err", err)
+	}
+	ep.mu.Lock()
+	ep.queued--
+	ep.mu.Unlock()
+}
+
+// permanentError is a rejection that retrying will not change.
+type permanentError struct{ error }
+
+func (s *Sink) post(ctx context.Context, ep *endpoint, id, typ string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, typ)
+	req.Header.Set(HeaderDelivery, id)
+	req.Header.Set(HeaderTimestamp, ts)
+	if ep.Secret != "" {
+		req.Header.Set(HeaderSignature, "sha256="+Sign(ep.Secret, ts, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("status %d", resp.StatusCode)
+	// 除超时与限流外的 4xx 重试也不会成功
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusRequestTimeout &&
+		resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+func (s *Sink) backoff(attempt int) time.Duration {
+	d := s.opts.MinBackoff << min(attempt-1, 30)
+	if d <= 0 || d > s.opts.MaxBackoff {
+		return s.opts.MaxBackoff
+	}
+	return d
+}
+
+// Sign returns the hex signature of a delivery.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature header of a delivery received by an endpoint.
+func Verify(secret string, header http.Header, body []byte) bool {
+	sig, ok := strings.CutPrefix(header.Get(HeaderSignature), "sha256=")
+	if !ok {
+		return false
+	}
+	want := Sign(secret, header.Get(HeaderTimestamp), body)
+	return hmac.Equal([]byte(sig), []byte(want))
+}
+
+// pending lists the queued events of the endpoint, oldest first.
+func (ep *endpoint) pending() ([]string, error) {
+	entries, err := os.ReadDir(ep.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := lo.FilterMap(entries, func(e os.DirEntry, _ int) (string, bool) {
+		return e.Name(), !e.IsDir() && strings.HasSuffix(e.Name(), ".json")
+	})
+	// 文件名为定长序号，按名称排序即按入队顺序
+	slices.Sort(names)
+	return names, nil
+}
+
+// validName allows names that are safe as a directory name.
+func validName(name string) bool {
+	return name != deadDir && strings.Trim(name, ".") != "" && strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.')
+	}) < 0
+}
+
+func seqOf(name string) int64 {
+	n, _ := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+	return n
+}
+
+// writeFile writes to a temporary file renamed into place, so the delivery
+// loop never reads a partial event.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
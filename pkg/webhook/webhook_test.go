@@ -0,0 +1,222 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "secret"
+
+// receiver is an endpoint answering with the queued statuses, then 200.
+type receiver struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	statuses []int
+	requests int
+	events   []Event
+	got      chan struct{}
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *httptest.Server) {
+	r := &receiver{t: t, statuses: statuses, got: make(chan struct{}, 100)}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return r, server
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	if !Verify(testSecret, req.Header, body) {
+		r.t.Errorf("bad signature %q", req.Header.Get(HeaderSignature))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	var ev Event
+	if err := json.Unmarshal(body, &ev); err != nil {
+		r.t.Error(err)
+	}
+	if req.Header.Get(HeaderEvent) != ev.Type || req.Header.Get(HeaderDelivery) != ev.ID {
+		r.t.Errorf("headers %v do not match event %+v", req.Header, ev)
+	}
+	r.events = append(r.events, ev)
+	r.got <- struct{}{}
+}
+
+func (r *receiver) wait(n int) []Event {
+	r.t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.got:
+		case <-time.After(5 * time.Second):
+			r.t.Fatalf("received %d of %d events", i, n)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func run(t *testing.T, s *Sink) context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func queued(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range entries {
+		if !e.IsDir() {
+			n++
+		}
+	}
+	return n
+}
+
+// waitQueued waits for the queue in dir to hold n events.
+func waitQueued(t *testing.T, dir string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); queued(t, dir) != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events queued, want %d", queued(t, dir), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	backend, backendServer := newReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	usage, usageServer := newReceiver(t)
+	dir := t.TempDir()
+	s, err := New(Options{
+		Dir:        dir,
+		MinBackoff: 10 * time.Millisecond,
+		Endpoints: []Endpoint{
+			{Name: "backend", URL: backendServer.URL, Secret: testSecret},
+			{Name: "usage", URL: usageServer.URL, Secret: testSecret, Events: []string{TypeUsage}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, s)
+	s.Send(Event{Type: TypeSessionStart, SessionID: "s1"})
+	s.Send(Event{Type: TypeUserTranscript, SessionID: "s1", Data: Transcript{Text: "你好"}})
+	s.Send(Event{Type: TypeUsage, SessionID: "s1", Data: Usage{InputTokens: 3}})
+
+	// 按顺序投递，失败的事件重试成功前不会投递后续事件
+	events := backend.wait(3)
+	for i, typ := range []string{TypeSessionStart, TypeUserTranscript, TypeUsage} {
+		if events[i].Type != typ || events[i].ID == "" || events[i].Time.IsZero() {
+			t.Errorf("event %d = %+v, want %s", i, events[i], typ)
+		}
+	}
+	if events := usage.wait(1); len(events) != 1 || events[0].Type != TypeUsage {
+		t.Errorf("usage endpoint got %+v", events)
+	}
+	backend.mu.Lock()
+	if backend.requests != 5 {
+		t.Errorf("%d requests, want 5", backend.requests)
+	}
+	backend.mu.Unlock()
+	waitQueued(t, filepath.Join(dir, "backend"), 0)
+}
+
+func TestDeadLetter(t *testing.T) {
+	r, server := newReceiver(t, http.StatusBadRequest, http.StatusInternalServerError, http.StatusInternalServerError)
+	dir := t.TempDir()
+	s, err := New(Options{
+		Dir:         dir,
+		MaxAttempts: 2,
+		MinBackoff:  10 * time.Millisecond,
+		Endpoints:   []Endpoint{{Name: "backend", URL: server.URL, Secret: testSecret}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, s)
+	// 400 不重试，500 重试到上限
+	s.Send(Event{Type: TypeSessionStart})
+	s.Send(Event{Type: TypeSessionEnd})
+	s.Send(Event{Type: TypeUsage})
+	if events := r.wait(1); events[0].Type != TypeUsage {
+		t.Errorf("delivered %s", events[0].Type)
+	}
+	if n := queued(t, filepath.Join(dir, "backend", deadDir)); n != 2 {
+		t.Errorf("%d dead letters, want 2", n)
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+	dir := t.TempDir()
+	s, err := New(Options{
+		Dir:        dir,
+		MinBackoff: time.Hour,
+		Endpoints:  []Endpoint{{Name: "backend", URL: down.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := run(t, s)
+	s.Send(Event{Type: TypeSessionStart, SessionID: "s1"})
+	s.Send(Event{Type: TypeSessionEnd, SessionID: "s1"})
+	waitQueued(t, filepath.Join(dir, "backend"), 2)
+	stop()
+
+	r, server := newReceiver(t)
+	s, err = New(Options{
+		Dir:       dir,
+		Endpoints: []Endpoint{{Name: "backend", URL: server.URL, Secret: testSecret}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, s)
+	s.Send(Event{Type: TypeUsage, SessionID: "s2"})
+	events := r.wait(3)
+	if events[0].Type != TypeSessionStart || events[1].Type != TypeSessionEnd || events[2].SessionID != "s2" {
+		t.Errorf("events = %+v", events)
+	}
+}
+
+func TestInvalidEndpoint(t *testing.T) {
+	for _, e := range []Endpoint{{Name: "../x", URL: "http://x"}, {Name: deadDir, URL: "http://x"}, {Name: "a"}} {
+		if _, err := New(Options{Dir: t.TempDir(), Endpoints: []Endpoint{e}}); err == nil {
+			t.Errorf("endpoint %+v accepted", e)
+		}
+	}
+	var s *Sink
+	s.Send(Event{Type: TypeUsage})
+}
@@ -1145,15 +1145,13 @@ function sendTextMessage() {
     if (message === '' || !websocket || websocket.readyState !== WebSocket.OPEN) return;
 
     try {
-        // 发送listen消息
-        const listenMessage = {
-            type: 'listen',
-            mode: 'manual',
-            state: 'detect',
+        // 发送文本消息，服务端转为用户文本输入并语音回复
+        const textMessage = {
+            type: 'text',
             text: message
         };
 
-        websocket.send(JSON.stringify(listenMessage));
+        websocket.send(JSON.stringify(textMessage));
         addMessage(message, true);
         console.log(`发送文本消息: ${message}`);
 
@@ -1176,6 +1174,28 @@ function addMessage(text, isUser = false) {
     conversationDiv.scrollTop = conversationDiv.scrollHeight;
 }
 
+// 同一句字幕会随语音逐步补全，更新同一条消息
+let subtitleDiv = null;
+function updateSubtitle(text) {
+    if (subtitleDiv && text.startsWith(subtitleDiv.textContent)) {
+        subtitleDiv.textContent = text;
+        conversationDiv.scrollTop = conversationDiv.scrollHeight;
+        return;
+    }
+    addMessage(text);
+    subtitleDiv = conversationDiv ? conversationDiv.lastChild : null;
+}
+
+let sttDiv = null;
+function updateStt(text) {
+    if (sttDiv) {
+        sttDiv.textContent = text;
+        return;
+    }
+    addMessage(text, true);
+    sttDiv = conversationDiv ? conversationDiv.lastChild : null;
+}
+
 // 更新状态信息
 function updateStatus(message, type = 'info') {
     console.log(`[${type}] ${message}`);
@@ -1211,11 +1231,13 @@ function handleTextMessage(message) {
             console.log(`服务器发送语音段: ${message.text}`);
             // 添加文本到会话记录
             if (message.text) {
-                addMessage(message.text);
+                updateSubtitle(message.text);
             }
         } else if (message.state === 'sentence_end') {
             console.log(`语音段结束: ${message.text}`);
+            subtitleDiv = null;
         } else if (message.state === 'stop') {
+            sttDiv = null;
             console.log('服务器语音传输结束');
         }
     } else if (message.type === 'audio') {
@@ -1224,8 +1246,8 @@ function handleTextMessage(message) {
     } else if (message.type === 'stt') {
         // 语音识别结果
         console.log(`识别结果: ${message.text}`);
-        // 添加识别结果到会话记录
-        addMessage(`[语音识别] ${message.text}`, true);
+        // 添加识别结果到会话记录，流式转写时更新同一条消息
+        updateStt(`[语音识别] ${message.text}`);
     } else if (message.type === 'llm') {
         // 大模型回复
         console.log(`大模型回复: ${message.text}`);